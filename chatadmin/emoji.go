@@ -0,0 +1,72 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net/url"
+	"os"
+)
+
+// runEmoji lists a room's custom emoji, adds one from an image file, or
+// with -rm removes one.
+func runEmoji(a *admin, args []string) int {
+	fs := flag.NewFlagSet("emoji", flag.ContinueOnError)
+	remove := fs.Bool("rm", false, "remove the named emoji")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	n := fs.NArg()
+	if n == 0 || n > 3 || (*remove && n != 2) || (!*remove && n == 2) {
+		fmt.Fprintln(os.Stderr, "Usage: chatadmin "+commands["emoji"].usage)
+		return 2
+	}
+	room := fs.Arg(0)
+	path := "/rooms/" + url.PathEscape(room) + "/emoji"
+
+	switch {
+	case *remove:
+		if err := a.doJSON("DELETE", path+"/"+url.PathEscape(fs.Arg(1)), nil, nil); err != nil {
+			return fail("emoji", err)
+		}
+		fmt.Printf("Removed :%s: from %s\n", fs.Arg(1), room)
+	case n == 3:
+		data, err := os.ReadFile(fs.Arg(2))
+		if err != nil {
+			return fail("emoji", err)
+		}
+		var e struct {
+			URL string `json:"url"`
+		}
+		reply, err := a.do("PUT", path+"/"+url.PathEscape(fs.Arg(1)), bytes.NewReader(data))
+		if err == nil {
+			err = json.Unmarshal(reply, &e)
+		}
+		if err != nil {
+			return fail("emoji", err)
+		}
+		fmt.Printf("Added :%s: to %s (%s)\n", fs.Arg(1), room, e.URL)
+	default:
+		u, err := a.url("/api" + path)
+		if err != nil {
+			return fail("emoji", err)
+		}
+		resp, err := a.client.Get(u.String())
+		if err != nil {
+			return fail("emoji", err)
+		}
+		defer resp.Body.Close()
+		var list []struct {
+			Name string `json:"name"`
+			URL  string `json:"url"`
+		}
+		if err := json.NewDecoder(resp.Body).Decode(&list); err != nil {
+			return fail("emoji", fmt.Errorf("%s: %w", resp.Status, err))
+		}
+		for _, e := range list {
+			fmt.Printf(":%s:\t%s\n", e.Name, e.URL)
+		}
+	}
+	return 0
+}
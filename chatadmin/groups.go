@@ -0,0 +1,70 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"net/url"
+	"os"
+	"strings"
+)
+
+type group struct {
+	Name    string   `json:"name"`
+	Members []string `json:"members"`
+}
+
+func runGroups(a *admin, args []string) int {
+	var groups []group
+	if err := a.doJSON("GET", "/groups", nil, &groups); err != nil {
+		return fail("groups", err)
+	}
+	for _, g := range groups {
+		fmt.Printf("@%-20s %s\n", g.Name, strings.Join(g.Members, ", "))
+	}
+	return 0
+}
+
+// runGroup sets a group's members, adds or removes one member, or deletes
+// the group.
+func runGroup(a *admin, args []string) int {
+	fs := flag.NewFlagSet("group", flag.ContinueOnError)
+	add := fs.String("add", "", "add this user to the group")
+	remove := fs.String("remove", "", "remove this user from the group")
+	del := fs.Bool("rm", false, "delete the group")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	modes := 0
+	for _, set := range []bool{*add != "", *remove != "", *del} {
+		if set {
+			modes++
+		}
+	}
+	if fs.NArg() == 0 || modes > 1 || (modes == 1 && fs.NArg() != 1) {
+		fmt.Fprintln(os.Stderr, "Usage: chatadmin "+commands["group"].usage)
+		return 2
+	}
+	path := "/groups/" + url.PathEscape(fs.Arg(0))
+
+	var g group
+	var err error
+	switch {
+	case *add != "":
+		err = a.doJSON("POST", path+"/members/"+url.PathEscape(*add), nil, &g)
+	case *remove != "":
+		err = a.doJSON("DELETE", path+"/members/"+url.PathEscape(*remove), nil, &g)
+	case *del:
+		if err := a.doJSON("DELETE", path, nil, nil); err != nil {
+			return fail("group", err)
+		}
+		fmt.Printf("Deleted @%s\n", fs.Arg(0))
+		return 0
+	default:
+		err = a.doJSON("PUT", path, map[string][]string{"members": fs.Args()[1:]}, &g)
+	}
+	if err != nil {
+		return fail("group", err)
+	}
+	fmt.Printf("@%s: %s\n", g.Name, strings.Join(g.Members, ", "))
+	return 0
+}
@@ -0,0 +1,322 @@
+// Command chatadmin operates a chat server through its admin API.
+//
+//	chatadmin [-server URL] [-token TOKEN] <command> [args]
+//
+// The token defaults to $CHAT_ADMIN_TOKEN and must match the server's
+// -admin-token, or be a tenant's key. With -tenant, commands act on that
+// tenant instead of the default one.
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+const defaultServer = "http://localhost:8080"
+
+// command is one chatadmin subcommand. run returns the exit code.
+type command struct {
+	usage string
+	help  string
+	run   func(a *admin, args []string) int
+}
+
+// commands is filled in init, as some commands print their own usage.
+var commands map[string]command
+
+func init() {
+	commands = map[string]command{
+		"announce": {"announce [-room room] <text>", "post an announcement to one room or all of them", runAnnounce},
+		"backup":   {"backup [-o file]", "download a snapshot of the server's history (to stdout without -o)", runBackup},
+		"backups":  {"backups", "list the snapshots in the server's -backup-dir", runBackups},
+		"ban":      {"ban [-for duration] [-reason text] <user>", "disconnect a user and refuse them until the ban ends", runBan},
+		"bans":     {"bans", "list the bans in force", runBans},
+		"config":   {"config [-keys] [-o file]", "export the rooms, their settings and webhooks, and the bans as YAML (to stdout without -o)", runConfig},
+		"conn":     {"conn [-json] <id>", "show one connection's queue, drops, bytes sent and last activity", runConn},
+		"emoji":    {"emoji <room> | emoji <room> <name> <image> | emoji -rm <room> <name>", "list, add or remove a room's custom emoji", runEmoji},
+		"export":   {"export [-o file] <user>", "download everything the server holds about a user", runExport},
+		"group":    {"group <name> [user...] | group -add user <name> | group -remove user <name> | group -rm <name>", "set a mention group's members, add or remove one, or delete it", runGroup},
+		"groups":   {"groups", "list the mention groups and their members", runGroups},
+		"history":  {"history [-o file] <room>", "download a room's stored history", runHistory},
+		"import":   {"import [-dry-run] <file.yaml>", "apply rooms, settings, webhooks and bans exported with config, from this server or another", runImport},
+		"kick":     {"kick [-room room] [-reason text] <user>", "disconnect a user, from one room or all", runKick},
+		"mute":     {"mute [-for duration] [-reason text] [-room room] <user>", "refuse a user's chat until the mute ends; repeated mutes can lead to a ban", runMute},
+		"mutes":    {"mutes", "list the mutes in force", runMutes},
+		"reserve":  {"reserve <user> | reserve -rm <user>", "register a username with a generated password, printed once, or release a registered one", runReserve},
+		"restore":  {"restore <file> | restore -backup <name>", "replace the server's history with a snapshot", runRestore},
+		"rooms":    {"rooms", "list the live rooms", runRooms},
+		"schedule": {"schedule | schedule [-room room] [-name name] [-id id] <cron> <text> | schedule -rm <id>", "list the scheduled posts, schedule one, replace one or delete one", runSchedule},
+		"settings": {"settings [-owner user] [-filter off|mild|strict|default] [-daily-digest=true|false] [-max-pins n] [-pin-ttl duration] [-topic text] [-moderators a,b] [-persistent=true|false] [-no-receipts=true|false] [-no-history=true|false] [-allow-incognito=true|false] [-calendar url] [-calendar-lead minutes] [-transform t]... [-open-hours hours] [-expires time] [-archived=true|false] [-max-idle duration] [-messages-per-day n] [-storage-bytes n] [-max-attachments n] <room>", "show a room's settings, or change them", runSettings},
+		"tail":     {"tail [-json]", "follow the server's lifecycle and moderation events", runTail},
+		"template": {"template | template <name> <file.json> | template -rm <name>", "list the room templates, set one from a JSON file, or delete one", runTemplate},
+		"unban":    {"unban <user>", "lift a user's ban", runUnban},
+		"unmute":   {"unmute <user>", "lift a user's mute", runUnmute},
+		"usage":    {"usage [room]", "show what the tenant and its rooms, or one room, have used of their quotas", runUsage},
+		"users":    {"users [room]", "list connected users, in one room or all", runUsers},
+		"webhook":  {"webhook <room> | webhook <room> <name> | webhook -rm <room> <name>", "list a room's webhooks, create one and print its key, or delete one", runWebhook},
+	}
+}
+
+func main() {
+	server := flag.String("server", defaultServer, "server base URL")
+	token := flag.String("token", os.Getenv("CHAT_ADMIN_TOKEN"), "admin token or tenant key (env CHAT_ADMIN_TOKEN)")
+	tenant := flag.String("tenant", "", "act on this tenant instead of the default one")
+	flag.Usage = usage
+	flag.Parse()
+
+	if flag.NArg() == 0 {
+		usage()
+		os.Exit(2)
+	}
+	cmd, ok := commands[flag.Arg(0)]
+	if !ok {
+		fmt.Fprintf(os.Stderr, "chatadmin: unknown command %q\n", flag.Arg(0))
+		usage()
+		os.Exit(2)
+	}
+	a := &admin{
+		server: strings.TrimSuffix(*server, "/"),
+		token:  *token,
+		tenant: *tenant,
+		client: &http.Client{Timeout: 5 * time.Minute},
+	}
+	os.Exit(cmd.run(a, flag.Args()[1:]))
+}
+
+func usage() {
+	fmt.Fprintln(os.Stderr, "Usage: chatadmin [flags] <command> [args]")
+	fmt.Fprintln(os.Stderr, "\nCommands:")
+	for _, name := range sortedCommands() {
+		c := commands[name]
+		fmt.Fprintf(os.Stderr, "  %-40s %s\n", c.usage, c.help)
+	}
+	fmt.Fprintln(os.Stderr, "\nFlags:")
+	flag.PrintDefaults()
+}
+
+func sortedCommands() []string {
+	names := make([]string, 0, len(commands))
+	for name := range commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// admin is a client for the server's admin API.
+type admin struct {
+	server string
+	token  string
+	tenant string
+	client *http.Client
+}
+
+// url returns the URL of path on the server, scoped to the tenant.
+func (a *admin) url(path string) (*url.URL, error) {
+	u, err := url.Parse(a.server + path)
+	if err != nil {
+		return nil, err
+	}
+	if a.tenant != "" {
+		q := u.Query()
+		q.Set("tenant", a.tenant)
+		u.RawQuery = q.Encode()
+	}
+	return u, nil
+}
+
+// do sends a request to path under /api/admin and returns the response
+// body, or an error carrying the server's message for non-2xx replies.
+func (a *admin) do(method, path string, body io.Reader) ([]byte, error) {
+	u, err := a.url("/api/admin" + path)
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequest(method, u.String(), body)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+a.token)
+	resp, err := a.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode >= 300 {
+		var e struct {
+			Error string `json:"error"`
+		}
+		if json.Unmarshal(data, &e) == nil && e.Error != "" {
+			return nil, fmt.Errorf("%s: %s", resp.Status, e.Error)
+		}
+		return nil, fmt.Errorf("%s", resp.Status)
+	}
+	return data, nil
+}
+
+// doJSON sends body as JSON and decodes the reply into out, if not nil.
+func (a *admin) doJSON(method, path string, body, out any) error {
+	var r io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		r = bytes.NewReader(data)
+	}
+	data, err := a.do(method, path, r)
+	if err != nil || out == nil {
+		return err
+	}
+	return json.Unmarshal(data, out)
+}
+
+// fail reports err for command name and returns exit code 1.
+func fail(name string, err error) int {
+	fmt.Fprintf(os.Stderr, "chatadmin %s: %v\n", name, err)
+	return 1
+}
+
+func runBackup(a *admin, args []string) int {
+	fs := flag.NewFlagSet("backup", flag.ContinueOnError)
+	out := fs.String("o", "", "write the snapshot to this file")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	data, err := a.do("GET", "/snapshot", nil)
+	if err != nil {
+		return fail("backup", err)
+	}
+	return save("backup", data, *out)
+}
+
+// save writes a download to path, or to stdout if path is empty.
+func save(name string, data []byte, path string) int {
+	if path == "" {
+		os.Stdout.Write(data)
+		return 0
+	}
+	if err := os.WriteFile(path, data, 0o600); err != nil {
+		return fail(name, err)
+	}
+	fmt.Fprintf(os.Stderr, "Saved %d bytes to %s\n", len(data), path)
+	return 0
+}
+
+func runBackups(a *admin, args []string) int {
+	data, err := a.do("GET", "/backups", nil)
+	if err != nil {
+		return fail("backups", err)
+	}
+	var backups []struct {
+		Name    string    `json:"name"`
+		Size    int64     `json:"size"`
+		Created time.Time `json:"created"`
+	}
+	if err := json.Unmarshal(data, &backups); err != nil {
+		return fail("backups", err)
+	}
+	for _, b := range backups {
+		fmt.Printf("%-32s %10d  %s\n", b.Name, b.Size, b.Created.Local().Format(time.DateTime))
+	}
+	return 0
+}
+
+func runRestore(a *admin, args []string) int {
+	fs := flag.NewFlagSet("restore", flag.ContinueOnError)
+	name := fs.String("backup", "", "restore this snapshot from the server's -backup-dir instead of a local file")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+
+	var data []byte
+	var err error
+	switch {
+	case *name != "":
+		data, err = a.do("POST", "/restore?backup="+url.QueryEscape(*name), nil)
+	case fs.NArg() == 1:
+		var snap []byte
+		if snap, err = os.ReadFile(fs.Arg(0)); err == nil {
+			data, err = a.do("POST", "/restore", bytes.NewReader(snap))
+		}
+	default:
+		fmt.Fprintln(os.Stderr, "Usage: chatadmin "+commands["restore"].usage)
+		return 2
+	}
+	if err != nil {
+		return fail("restore", err)
+	}
+	var res struct {
+		Messages int `json:"messages"`
+	}
+	json.Unmarshal(data, &res)
+	fmt.Printf("Restored %d messages\n", res.Messages)
+	return 0
+}
+
+func runConfig(a *admin, args []string) int {
+	fs := flag.NewFlagSet("config", flag.ContinueOnError)
+	keys := fs.Bool("keys", false, "include the webhooks' keys, which are secrets")
+	out := fs.String("o", "", "write the configuration to this file")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	path := "/config"
+	if *keys {
+		path += "?keys=true"
+	}
+	data, err := a.do("GET", path, nil)
+	if err != nil {
+		return fail("config", err)
+	}
+	return save("config", data, *out)
+}
+
+func runImport(a *admin, args []string) int {
+	fs := flag.NewFlagSet("import", flag.ContinueOnError)
+	dryRun := fs.Bool("dry-run", false, "check the file and report what it would change, changing nothing")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if fs.NArg() != 1 {
+		fmt.Fprintln(os.Stderr, "Usage: chatadmin "+commands["import"].usage)
+		return 2
+	}
+	doc, err := os.ReadFile(fs.Arg(0))
+	if err != nil {
+		return fail("import", err)
+	}
+	path := "/config"
+	if *dryRun {
+		path += "?dry_run=true"
+	}
+	data, err := a.do("PUT", path, bytes.NewReader(doc))
+	if err != nil {
+		return fail("import", err)
+	}
+	var res struct {
+		Rooms    int `json:"rooms"`
+		Webhooks int `json:"webhooks"`
+		Bans     int `json:"bans"`
+	}
+	json.Unmarshal(data, &res)
+	verb := "Imported"
+	if *dryRun {
+		verb = "Would import"
+	}
+	fmt.Printf("%s %d rooms, %d webhooks and %d bans\n", verb, res.Rooms, res.Webhooks, res.Bans)
+	return 0
+}
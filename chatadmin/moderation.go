@@ -0,0 +1,624 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// room and event mirror the server's /api/admin/rooms and /ws/admin
+// payloads.
+type room struct {
+	Name              string `json:"name"`
+	Members           int    `json:"members"`
+	MessagesPerMinute int64  `json:"messages_per_minute"`
+	LastSeq           int64  `json:"last_seq"`
+	Connections       []struct {
+		ID        string    `json:"id"`
+		Username  string    `json:"username"`
+		Connected time.Time `json:"connected"`
+		Queue     int       `json:"queue"`
+		QueueCap  int       `json:"queue_cap"`
+		BytesSent int64     `json:"bytes_sent"`
+	} `json:"connections"`
+}
+
+type event struct {
+	Time     time.Time `json:"time"`
+	Kind     string    `json:"kind"`
+	Tenant   string    `json:"tenant"`
+	Room     string    `json:"room"`
+	Username string    `json:"username"`
+	Actor    string    `json:"actor"`
+	Detail   string    `json:"detail"`
+}
+
+// parse parses a subcommand's flags and checks it got want arguments, or at
+// least one if want is -1. It returns false after printing usage.
+func parse(fs *flag.FlagSet, args []string, want int) bool {
+	if err := fs.Parse(args); err != nil {
+		return false
+	}
+	if (want < 0 && fs.NArg() == 0) || (want >= 0 && fs.NArg() != want) {
+		fmt.Fprintln(os.Stderr, "Usage: chatadmin "+commands[fs.Name()].usage)
+		return false
+	}
+	return true
+}
+
+func runRooms(a *admin, args []string) int {
+	var rooms []room
+	if err := a.doJSON("GET", "/rooms", nil, &rooms); err != nil {
+		return fail("rooms", err)
+	}
+	fmt.Printf("%-24s %8s %8s %8s\n", "ROOM", "MEMBERS", "MSG/MIN", "SEQ")
+	for _, r := range rooms {
+		fmt.Printf("%-24s %8d %8d %8d\n", r.Name, r.Members, r.MessagesPerMinute, r.LastSeq)
+	}
+	return 0
+}
+
+// runSettings shows a room's settings, changing those given as flags first.
+func runSettings(a *admin, args []string) int {
+	fs := flag.NewFlagSet("settings", flag.ContinueOnError)
+	fs.String("owner", "", "make this user the room's owner")
+	fs.String("filter", "", "language filter: off, mild, strict or default")
+	fs.Bool("daily-digest", false, "post a digest of the room's activity to it every day")
+	fs.Int("max-pins", 0, "most pinned messages the room may hold (0: the server default)")
+	fs.String("pin-ttl", "", "how long pins last when no duration is given, e.g. 72h (empty: for ever)")
+	fs.String("topic", "", "topic shown to members as they join")
+	fs.String("moderators", "", "comma-separated users who may change the room as its owner can")
+	fs.Bool("persistent", false, "keep the room while it is empty")
+	fs.Bool("no-receipts", false, "do not tell senders who received and read their messages")
+	fs.Bool("no-history", false, "relay the room's chat without storing it")
+	fs.Bool("allow-incognito", false, "let members keep their own messages out of history with /incognito")
+	fs.String("calendar", "", "ICS calendar URL whose events are reminded of in the room (empty: none)")
+	fs.Int("calendar-lead", 0, "minutes before an event its reminder is posted (0: the default)")
+	fs.String("open-hours", "", "when the room may be joined, e.g. \"Mon-Fri 09:00-17:00\" in the server's time (empty: always)")
+	fs.String("expires", "", "RFC 3339 time at which the room is archived (empty: never)")
+	fs.Bool("archived", false, "refuse joins to the room, keeping its history; -archived=false brings it back")
+	fs.String("max-idle", "", "archive the room after this long without chat, e.g. 720h, until the next message (0: never; empty: the server default)")
+	fs.Int("messages-per-day", 0, "most chat messages the room takes a day (0: no limit)")
+	fs.Int64("storage-bytes", 0, "most bytes of history, text and attachments, the room may store (0: no limit)")
+	fs.Int("max-attachments", 0, "most attachments the room's history may hold (0: no limit)")
+	var transforms stringList
+	fs.Var(&transforms, "transform", "transform chat sent to members: strip_attachments, strip_forwarded, prefix:<text> or suffix:<text>; repeat for several, or -transform none to remove them")
+	if !parse(fs, args, 1) {
+		return 2
+	}
+	changes := map[string]any{}
+	fs.Visit(func(f *flag.Flag) {
+		v := f.Value.String()
+		switch {
+		case f.Name == "daily-digest" || f.Name == "persistent" || f.Name == "no-receipts" ||
+			f.Name == "no-history" || f.Name == "allow-incognito" || f.Name == "archived":
+			changes[strings.ReplaceAll(f.Name, "-", "_")] = v == "true"
+		case f.Name == "moderators":
+			moderators := []string{}
+			for _, m := range strings.Split(v, ",") {
+				if m = strings.TrimSpace(m); m != "" {
+					moderators = append(moderators, m)
+				}
+			}
+			changes["moderators"] = moderators
+		case f.Name == "transform":
+			kept := []string{}
+			for _, t := range transforms {
+				if t != "none" {
+					kept = append(kept, t)
+				}
+			}
+			changes["transforms"] = kept
+		case f.Name == "max-pins" || f.Name == "calendar-lead" || f.Name == "messages-per-day" || f.Name == "max-attachments":
+			changes[strings.ReplaceAll(f.Name, "-", "_")], _ = strconv.Atoi(v)
+		case f.Name == "storage-bytes":
+			changes["storage_bytes"], _ = strconv.ParseInt(v, 10, 64)
+		case f.Name == "filter" && v == "default":
+			changes["filter"] = ""
+		default:
+			changes[strings.ReplaceAll(f.Name, "-", "_")] = v
+		}
+	})
+	method, body := "GET", any(nil)
+	if len(changes) > 0 {
+		method, body = "PUT", changes
+	}
+	var s struct {
+		Owner          string   `json:"owner"`
+		Filter         string   `json:"filter"`
+		DailyDigest    bool     `json:"daily_digest"`
+		MaxPins        int      `json:"max_pins"`
+		PinTTL         string   `json:"pin_ttl"`
+		Topic          string   `json:"topic"`
+		Moderators     []string `json:"moderators"`
+		Persistent     bool     `json:"persistent"`
+		NoReceipts     bool     `json:"no_receipts"`
+		NoHistory      bool     `json:"no_history"`
+		AllowIncognito bool     `json:"allow_incognito"`
+		Calendar       string   `json:"calendar"`
+		CalendarLead   int      `json:"calendar_lead"`
+		Transforms     []string `json:"transforms"`
+		OpenHours      string   `json:"open_hours"`
+		Expires        string   `json:"expires"`
+		Archived       bool     `json:"archived"`
+		MaxIdle        string   `json:"max_idle"`
+		Dormant        bool     `json:"dormant"`
+		MessagesPerDay int      `json:"messages_per_day"`
+		StorageBytes   int64    `json:"storage_bytes"`
+		MaxAttachments int      `json:"max_attachments"`
+	}
+	if err := a.doJSON(method, "/rooms/"+url.PathEscape(fs.Arg(0))+"/settings", body, &s); err != nil {
+		return fail("settings", err)
+	}
+	if s.Filter == "" {
+		s.Filter = "server default"
+	}
+	maxPins, pinTTL := "server default", "none"
+	if s.MaxPins > 0 {
+		maxPins = strconv.Itoa(s.MaxPins)
+	}
+	if s.PinTTL != "" {
+		pinTTL = s.PinTTL
+	}
+	moderators := strings.Join(s.Moderators, ", ")
+	if moderators == "" {
+		moderators = "none"
+	}
+	history := "stored"
+	switch {
+	case s.NoHistory:
+		history = "off"
+	case s.AllowIncognito:
+		history = "stored, members may go incognito"
+	}
+	transformed := "none"
+	if len(s.Transforms) > 0 {
+		transformed = fmt.Sprintf("%q", s.Transforms)
+	}
+	calendar := "none"
+	if s.Calendar != "" {
+		lead := s.CalendarLead
+		if lead == 0 {
+			lead = 10
+		}
+		calendar = fmt.Sprintf("%s, reminders %d minutes ahead", s.Calendar, lead)
+	}
+	hours, expires := "always", "never"
+	if s.OpenHours != "" {
+		hours = s.OpenHours
+	}
+	if s.Expires != "" {
+		expires = s.Expires
+	}
+	if s.Archived {
+		expires = "archived"
+	}
+	maxIdle := "server default"
+	switch s.MaxIdle {
+	case "":
+	case "0", "0s":
+		maxIdle = "never archived"
+	default:
+		maxIdle = s.MaxIdle
+	}
+	if s.Dormant {
+		maxIdle += ", archived for inactivity until the next message"
+	}
+	fmt.Printf("owner:        %s\nmoderators:   %s\ntopic:        %s\npersistent:   %v\nfilter:       %s\ndaily digest: %v\nmax pins:     %s\npin ttl:      %s\ncalendar:     %s\nreceipts:     %v\nhistory:      %s\ntransforms:   %s\nopen hours:   %s\nexpires:      %s\nmax idle:     %s\nquotas:       %s\n",
+		s.Owner, moderators, s.Topic, s.Persistent, s.Filter, s.DailyDigest, maxPins, pinTTL, calendar, !s.NoReceipts, history, transformed, hours, expires, maxIdle,
+		quotaSummary(s.MessagesPerDay, s.StorageBytes, s.MaxAttachments))
+	return 0
+}
+
+// quotaSummary describes a room's or tenant's quotas in a line.
+func quotaSummary(messages int, storage int64, attachments int) string {
+	var parts []string
+	if messages > 0 {
+		parts = append(parts, fmt.Sprintf("%d messages a day", messages))
+	}
+	if storage > 0 {
+		parts = append(parts, fmt.Sprintf("%d bytes stored", storage))
+	}
+	if attachments > 0 {
+		parts = append(parts, fmt.Sprintf("%d attachments", attachments))
+	}
+	if len(parts) == 0 {
+		return "none"
+	}
+	return strings.Join(parts, ", ")
+}
+
+// usageReport is a tenant's or a room's usage and quotas.
+type usageReport struct {
+	Day          string `json:"day"`
+	Messages     int    `json:"messages"`
+	StorageBytes int64  `json:"storage_bytes"`
+	Attachments  int    `json:"attachments"`
+	Quotas       struct {
+		MessagesPerDay int   `json:"messages_per_day"`
+		StorageBytes   int64 `json:"storage_bytes"`
+		MaxAttachments int   `json:"max_attachments"`
+	} `json:"quotas"`
+}
+
+// of formats used against limit, or used alone if there is no limit.
+func of(used, limit int64) string {
+	if limit <= 0 {
+		return fmt.Sprint(used)
+	}
+	return fmt.Sprintf("%d/%d", used, limit)
+}
+
+func printUsage(name string, u usageReport) {
+	fmt.Printf("%-24s %14s %22s %12s\n", name, of(int64(u.Messages), int64(u.Quotas.MessagesPerDay)), of(u.StorageBytes, u.Quotas.StorageBytes), of(int64(u.Attachments), int64(u.Quotas.MaxAttachments)))
+}
+
+// runUsage shows what the tenant and its rooms, or one room, have used of
+// their quotas.
+func runUsage(a *admin, args []string) int {
+	if len(args) > 1 {
+		fmt.Fprintln(os.Stderr, "Usage: chatadmin "+commands["usage"].usage)
+		return 2
+	}
+	header := func() {
+		fmt.Printf("%-24s %14s %22s %12s\n", "", "MESSAGES TODAY", "STORAGE BYTES", "ATTACHMENTS")
+	}
+	if len(args) == 1 {
+		var u usageReport
+		if err := a.doJSON("GET", "/rooms/"+url.PathEscape(args[0])+"/usage", nil, &u); err != nil {
+			return fail("usage", err)
+		}
+		header()
+		printUsage(args[0], u)
+		return 0
+	}
+	var res struct {
+		Tenant usageReport            `json:"tenant"`
+		Rooms  map[string]usageReport `json:"rooms"`
+	}
+	if err := a.doJSON("GET", "/usage", nil, &res); err != nil {
+		return fail("usage", err)
+	}
+	names := make([]string, 0, len(res.Rooms))
+	for name := range res.Rooms {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	header()
+	printUsage("(tenant)", res.Tenant)
+	for _, name := range names {
+		printUsage(name, res.Rooms[name])
+	}
+	return 0
+}
+
+func runUsers(a *admin, args []string) int {
+	if len(args) > 1 {
+		fmt.Fprintln(os.Stderr, "Usage: chatadmin "+commands["users"].usage)
+		return 2
+	}
+	var rooms []room
+	if err := a.doJSON("GET", "/rooms", nil, &rooms); err != nil {
+		return fail("users", err)
+	}
+	fmt.Printf("%-20s %-24s %-10s %-12s %-20s %s\n", "USER", "ROOM", "QUEUE", "SENT", "CONNECTED", "ID")
+	for _, r := range rooms {
+		if len(args) == 1 && r.Name != args[0] {
+			continue
+		}
+		for _, c := range r.Connections {
+			queue := fmt.Sprintf("%d/%d", c.Queue, c.QueueCap)
+			fmt.Printf("%-20s %-24s %-10s %-12d %-20s %s\n", c.Username, r.Name, queue, c.BytesSent, c.Connected.Local().Format(time.DateTime), c.ID)
+		}
+	}
+	return 0
+}
+
+// runConn prints the server's view of one connection, by the ID users
+// lists.
+func runConn(a *admin, args []string) int {
+	fs := flag.NewFlagSet("conn", flag.ContinueOnError)
+	raw := fs.Bool("json", false, "print the reply as JSON")
+	if !parse(fs, args, 1) {
+		return 2
+	}
+	data, err := a.do("GET", "/connections/"+url.PathEscape(fs.Arg(0)), nil)
+	if err != nil {
+		return fail("conn", err)
+	}
+	if *raw {
+		os.Stdout.Write(data)
+		return 0
+	}
+	var c struct {
+		ID          string     `json:"id"`
+		Username    string     `json:"username"`
+		Tenant      string     `json:"tenant"`
+		Backend     string     `json:"backend"`
+		Protocol    string     `json:"protocol"`
+		Compression bool       `json:"compression"`
+		Connected   time.Time  `json:"connected"`
+		Resumed     bool       `json:"resumed"`
+		Rooms       []string   `json:"rooms"`
+		Queue       int        `json:"queue"`
+		QueueCap    int        `json:"queue_cap"`
+		Control     int        `json:"control_queue"`
+		ControlCap  int        `json:"control_queue_cap"`
+		Closed      bool       `json:"closed"`
+		LastRead    *time.Time `json:"last_read"`
+		LastWrite   *time.Time `json:"last_write"`
+		Drops       int64      `json:"drops"`
+		BytesSent   int64      `json:"bytes_sent"`
+		Bandwidth   int64      `json:"bytes_per_second"`
+		Throttled   int64      `json:"throttled"`
+		Quality     string     `json:"quality"`
+		RTTMillis   int64      `json:"rtt_ms"`
+		Stalls      int64      `json:"stalls"`
+	}
+	if err := json.Unmarshal(data, &c); err != nil {
+		return fail("conn", err)
+	}
+	ago := func(t *time.Time) string {
+		if t == nil {
+			return "never"
+		}
+		return fmt.Sprintf("%s (%s ago)", t.Local().Format(time.DateTime), time.Since(*t).Round(time.Second))
+	}
+	protocol := c.Protocol
+	if protocol == "" {
+		protocol = "-"
+	}
+	fmt.Printf("ID:          %s\n", c.ID)
+	if c.Tenant != "" {
+		fmt.Printf("User:        %s (tenant %s)\n", c.Username, c.Tenant)
+	} else {
+		fmt.Printf("User:        %s\n", c.Username)
+	}
+	fmt.Printf("Rooms:       %s\n", strings.Join(c.Rooms, ", "))
+	fmt.Printf("Connected:   %s, resumed %t\n", c.Connected.Local().Format(time.DateTime), c.Resumed)
+	fmt.Printf("Backend:     %s, protocol %s, compression %t\n", c.Backend, protocol, c.Compression)
+	fmt.Printf("Send queue:  %d/%d chat, %d/%d control, closed %t\n", c.Queue, c.QueueCap, c.Control, c.ControlCap, c.Closed)
+	fmt.Printf("Link:        %s, round trip %d ms, %d stalled writes\n", c.Quality, c.RTTMillis, c.Stalls)
+	fmt.Printf("Drops:       %d\n", c.Drops)
+	fmt.Printf("Sent:        %d bytes, %d bytes/s now, %d low-priority messages throttled\n", c.BytesSent, c.Bandwidth, c.Throttled)
+	fmt.Printf("Last read:   %s\n", ago(c.LastRead))
+	fmt.Printf("Last write:  %s\n", ago(c.LastWrite))
+	return 0
+}
+
+func runKick(a *admin, args []string) int {
+	fs := flag.NewFlagSet("kick", flag.ContinueOnError)
+	roomName := fs.String("room", "", "only disconnect the user from this room")
+	reason := fs.String("reason", "", "reason shown to the user")
+	if !parse(fs, args, 1) {
+		return 2
+	}
+	var res struct {
+		Connections int `json:"connections"`
+	}
+	body := map[string]string{"room": *roomName, "reason": *reason}
+	if err := a.doJSON("POST", "/users/"+url.PathEscape(fs.Arg(0))+"/kick", body, &res); err != nil {
+		return fail("kick", err)
+	}
+	fmt.Printf("Kicked %s (%d connections)\n", fs.Arg(0), res.Connections)
+	return 0
+}
+
+func runBan(a *admin, args []string) int {
+	fs := flag.NewFlagSet("ban", flag.ContinueOnError)
+	duration := fs.Duration("for", 0, "how long the ban lasts (default: until lifted)")
+	reason := fs.String("reason", "", "reason shown to the user")
+	if !parse(fs, args, 1) {
+		return 2
+	}
+	body := map[string]string{"reason": *reason}
+	if *duration > 0 {
+		body["duration"] = duration.String()
+	}
+	var res struct {
+		Connections int `json:"connections"`
+	}
+	if err := a.doJSON("POST", "/users/"+url.PathEscape(fs.Arg(0))+"/ban", body, &res); err != nil {
+		return fail("ban", err)
+	}
+	fmt.Printf("Banned %s (%d connections closed)\n", fs.Arg(0), res.Connections)
+	return 0
+}
+
+func runUnban(a *admin, args []string) int {
+	fs := flag.NewFlagSet("unban", flag.ContinueOnError)
+	if !parse(fs, args, 1) {
+		return 2
+	}
+	if err := a.doJSON("DELETE", "/users/"+url.PathEscape(fs.Arg(0))+"/ban", nil, nil); err != nil {
+		return fail("unban", err)
+	}
+	fmt.Printf("Unbanned %s\n", fs.Arg(0))
+	return 0
+}
+
+func runBans(a *admin, args []string) int {
+	var bans []struct {
+		Username string    `json:"username"`
+		Reason   string    `json:"reason"`
+		Since    time.Time `json:"since"`
+		Until    time.Time `json:"until"`
+	}
+	if err := a.doJSON("GET", "/bans", nil, &bans); err != nil {
+		return fail("bans", err)
+	}
+	fmt.Printf("%-20s %-20s %-20s %s\n", "USER", "SINCE", "UNTIL", "REASON")
+	for _, b := range bans {
+		until := "-"
+		if !b.Until.IsZero() {
+			until = b.Until.Local().Format(time.DateTime)
+		}
+		fmt.Printf("%-20s %-20s %-20s %s\n", b.Username, b.Since.Local().Format(time.DateTime), until, b.Reason)
+	}
+	return 0
+}
+
+func runMute(a *admin, args []string) int {
+	fs := flag.NewFlagSet("mute", flag.ContinueOnError)
+	duration := fs.Duration("for", 0, "how long the mute lasts (default: the server's -mute-for)")
+	reason := fs.String("reason", "", "reason shown to the user")
+	roomName := fs.String("room", "", "room whose owner and moderators are told")
+	if !parse(fs, args, 1) {
+		return 2
+	}
+	body := map[string]string{"reason": *reason, "room": *roomName}
+	if *duration > 0 {
+		body["duration"] = duration.String()
+	}
+	var m struct {
+		Until time.Time `json:"until"`
+	}
+	if err := a.doJSON("POST", "/users/"+url.PathEscape(fs.Arg(0))+"/mute", body, &m); err != nil {
+		return fail("mute", err)
+	}
+	fmt.Printf("Muted %s until %s\n", fs.Arg(0), m.Until.Local().Format(time.DateTime))
+	return 0
+}
+
+func runUnmute(a *admin, args []string) int {
+	fs := flag.NewFlagSet("unmute", flag.ContinueOnError)
+	if !parse(fs, args, 1) {
+		return 2
+	}
+	if err := a.doJSON("DELETE", "/users/"+url.PathEscape(fs.Arg(0))+"/mute", nil, nil); err != nil {
+		return fail("unmute", err)
+	}
+	fmt.Printf("Unmuted %s\n", fs.Arg(0))
+	return 0
+}
+
+func runMutes(a *admin, args []string) int {
+	var mutes []struct {
+		Username string    `json:"username"`
+		Reason   string    `json:"reason"`
+		Since    time.Time `json:"since"`
+		Until    time.Time `json:"until"`
+	}
+	if err := a.doJSON("GET", "/mutes", nil, &mutes); err != nil {
+		return fail("mutes", err)
+	}
+	fmt.Printf("%-20s %-20s %-20s %s\n", "USER", "SINCE", "UNTIL", "REASON")
+	for _, m := range mutes {
+		fmt.Printf("%-20s %-20s %-20s %s\n", m.Username, m.Since.Local().Format(time.DateTime), m.Until.Local().Format(time.DateTime), m.Reason)
+	}
+	return 0
+}
+
+func runAnnounce(a *admin, args []string) int {
+	fs := flag.NewFlagSet("announce", flag.ContinueOnError)
+	roomName := fs.String("room", "", "only post to this room")
+	if !parse(fs, args, -1) {
+		return 2
+	}
+	var res struct {
+		Rooms int `json:"rooms"`
+	}
+	body := map[string]string{"room": *roomName, "text": strings.Join(fs.Args(), " ")}
+	if err := a.doJSON("POST", "/announce", body, &res); err != nil {
+		return fail("announce", err)
+	}
+	fmt.Printf("Announced in %d rooms\n", res.Rooms)
+	return 0
+}
+
+func runExport(a *admin, args []string) int {
+	fs := flag.NewFlagSet("export", flag.ContinueOnError)
+	out := fs.String("o", "", "write the export to this file")
+	if !parse(fs, args, 1) {
+		return 2
+	}
+	data, err := a.do("GET", "/users/"+url.PathEscape(fs.Arg(0))+"/export", nil)
+	if err != nil {
+		return fail("export", err)
+	}
+	return save("export", data, *out)
+}
+
+func runHistory(a *admin, args []string) int {
+	fs := flag.NewFlagSet("history", flag.ContinueOnError)
+	out := fs.String("o", "", "write the history to this file")
+	if !parse(fs, args, 1) {
+		return 2
+	}
+	data, err := a.do("GET", "/rooms/"+url.PathEscape(fs.Arg(0))+"/history", nil)
+	if err != nil {
+		return fail("history", err)
+	}
+	return save("history", data, *out)
+}
+
+// runTail prints events from /ws/admin until interrupted or disconnected.
+func runTail(a *admin, args []string) int {
+	fs := flag.NewFlagSet("tail", flag.ContinueOnError)
+	raw := fs.Bool("json", false, "print each event as JSON")
+	if !parse(fs, args, 0) {
+		return 2
+	}
+	u, err := a.url("/ws/admin")
+	if err != nil {
+		return fail("tail", err)
+	}
+	u.Scheme = strings.Replace(u.Scheme, "http", "ws", 1)
+	conn, resp, err := websocket.DefaultDialer.Dial(u.String(), http.Header{"Authorization": {"Bearer " + a.token}})
+	if err != nil {
+		if resp != nil {
+			err = fmt.Errorf("%w: %s", err, resp.Status)
+		}
+		return fail("tail", err)
+	}
+	defer conn.Close()
+
+	for {
+		_, data, err := conn.ReadMessage()
+		if err != nil {
+			return fail("tail", err)
+		}
+		if *raw {
+			fmt.Println(string(data))
+			continue
+		}
+		var e event
+		if json.Unmarshal(data, &e) != nil {
+			continue
+		}
+		where := e.Room
+		if where != "" {
+			where = "#" + where
+		}
+		if e.Tenant != "" {
+			where = e.Tenant + "/" + where
+		}
+		line := fmt.Sprintf("%s %-14s %-20s %s", e.Time.Local().Format(time.TimeOnly), e.Kind, where, e.Username)
+		if e.Actor != "" {
+			line += " by " + e.Actor
+		}
+		if e.Detail != "" {
+			line += " (" + e.Detail + ")"
+		}
+		fmt.Println(line)
+	}
+}
+
+// stringList is a flag that may be given several times.
+type stringList []string
+
+func (l *stringList) String() string { return strings.Join(*l, ",") }
+
+func (l *stringList) Set(v string) error {
+	*l = append(*l, v)
+	return nil
+}
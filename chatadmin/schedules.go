@@ -0,0 +1,74 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+type scheduledPost struct {
+	ID   string    `json:"id"`
+	Room string    `json:"room,omitempty"`
+	Cron string    `json:"cron"`
+	Text string    `json:"text"`
+	Name string    `json:"name,omitempty"`
+	Next time.Time `json:"next"`
+}
+
+// runSchedule lists the scheduled posts, schedules one, replaces one with
+// -id, or with -rm deletes one.
+func runSchedule(a *admin, args []string) int {
+	fs := flag.NewFlagSet("schedule", flag.ContinueOnError)
+	roomName := fs.String("room", "", "post to this room (default: every live room)")
+	name := fs.String("name", "", "post as this name (default: scheduler)")
+	id := fs.String("id", "", "replace the scheduled post with this ID")
+	remove := fs.String("rm", "", "delete the scheduled post with this ID")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	n := fs.NArg()
+	if (*remove != "" && n != 0) || n == 1 || (n == 0 && *id != "") {
+		fmt.Fprintln(os.Stderr, "Usage: chatadmin "+commands["schedule"].usage)
+		return 2
+	}
+
+	switch {
+	case *remove != "":
+		if err := a.doJSON("DELETE", "/schedules/"+url.PathEscape(*remove), nil, nil); err != nil {
+			return fail("schedule", err)
+		}
+		fmt.Printf("Deleted scheduled post %s\n", *remove)
+	case n >= 2:
+		method, path := "POST", "/schedules"
+		if *id != "" {
+			method, path = "PUT", path+"/"+url.PathEscape(*id)
+		}
+		body := scheduledPost{Room: *roomName, Name: *name, Cron: fs.Arg(0), Text: strings.Join(fs.Args()[1:], " ")}
+		var post scheduledPost
+		if err := a.doJSON(method, path, body, &post); err != nil {
+			return fail("schedule", err)
+		}
+		fmt.Printf("Scheduled post %s, next on %s\n", post.ID, formatNext(post.Next))
+	default:
+		var posts []scheduledPost
+		if err := a.doJSON("GET", "/schedules", nil, &posts); err != nil {
+			return fail("schedule", err)
+		}
+		fmt.Printf("%-4s %-16s %-16s %-17s %s\n", "ID", "CRON", "ROOM", "NEXT", "TEXT")
+		for _, p := range posts {
+			room := p.Room
+			if room == "" {
+				room = "(all)"
+			}
+			fmt.Printf("%-4s %-16s %-16s %-17s %s\n", p.ID, p.Cron, room, formatNext(p.Next), p.Text)
+		}
+	}
+	return 0
+}
+
+func formatNext(t time.Time) string {
+	return t.Local().Format("2006-01-02 15:04")
+}
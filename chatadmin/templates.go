@@ -0,0 +1,80 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net/url"
+	"os"
+	"strings"
+)
+
+type template struct {
+	Name     string   `json:"name"`
+	Topic    string   `json:"topic"`
+	Welcome  string   `json:"welcome"`
+	Webhooks []string `json:"webhooks"`
+	Feeds    []struct {
+		URL string `json:"url"`
+	} `json:"feeds"`
+}
+
+// runTemplate lists the room templates, sets one from a JSON file or
+// deletes one with -rm. The file holds the template without its name:
+// {"topic": ..., "welcome": ..., "webhooks": [...], ...room settings}.
+func runTemplate(a *admin, args []string) int {
+	fs := flag.NewFlagSet("template", flag.ContinueOnError)
+	remove := fs.Bool("rm", false, "delete the named template")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	n := fs.NArg()
+	if n > 2 || (*remove && n != 1) || (!*remove && n == 1) {
+		fmt.Fprintln(os.Stderr, "Usage: chatadmin "+commands["template"].usage)
+		return 2
+	}
+
+	switch {
+	case *remove:
+		if err := a.doJSON("DELETE", "/templates/"+url.PathEscape(fs.Arg(0)), nil, nil); err != nil {
+			return fail("template", err)
+		}
+		fmt.Printf("Deleted template %s\n", fs.Arg(0))
+	case n == 2:
+		data, err := os.ReadFile(fs.Arg(1))
+		if err != nil {
+			return fail("template", err)
+		}
+		var body json.RawMessage
+		if err := json.Unmarshal(data, &body); err != nil {
+			return fail("template", fmt.Errorf("%s: %w", fs.Arg(1), err))
+		}
+		var t template
+		if err := a.doJSON("PUT", "/templates/"+url.PathEscape(fs.Arg(0)), body, &t); err != nil {
+			return fail("template", err)
+		}
+		fmt.Printf("Set template %s\n", t.Name)
+	default:
+		var templates []template
+		if err := a.doJSON("GET", "/templates", nil, &templates); err != nil {
+			return fail("template", err)
+		}
+		for _, t := range templates {
+			var extras []string
+			if t.Topic != "" {
+				extras = append(extras, "topic: "+t.Topic)
+			}
+			if len(t.Webhooks) > 0 {
+				extras = append(extras, "webhooks: "+strings.Join(t.Webhooks, ", "))
+			}
+			if len(t.Feeds) > 0 {
+				extras = append(extras, fmt.Sprintf("%d feeds", len(t.Feeds)))
+			}
+			if t.Welcome != "" {
+				extras = append(extras, "welcome message")
+			}
+			fmt.Printf("%-20s %s\n", t.Name, strings.Join(extras, "; "))
+		}
+	}
+	return 0
+}
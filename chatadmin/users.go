@@ -0,0 +1,37 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"net/url"
+	"os"
+)
+
+// runReserve registers a username on a server running with -registration,
+// for a bot or a name that should not be taken, and prints its password;
+// with -rm it releases a registered name.
+func runReserve(a *admin, args []string) int {
+	fs := flag.NewFlagSet("reserve", flag.ContinueOnError)
+	remove := fs.Bool("rm", false, "release the username")
+	if !parse(fs, args, 1) {
+		return 2
+	}
+	user := fs.Arg(0)
+	path := "/users/" + url.PathEscape(user) + "/registration"
+	if *remove {
+		if err := a.doJSON("DELETE", path, nil, nil); err != nil {
+			return fail("reserve", err)
+		}
+		fmt.Printf("Released %s\n", user)
+		return 0
+	}
+	var reply struct {
+		Password string `json:"password"`
+	}
+	if err := a.doJSON("POST", path, nil, &reply); err != nil {
+		return fail("reserve", err)
+	}
+	fmt.Fprintf(os.Stderr, "Reserved %s; log in with the password\n", user)
+	fmt.Println(reply.Password)
+	return 0
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"net/url"
+	"os"
+)
+
+type webhook struct {
+	Name string `json:"name"`
+	Room string `json:"room"`
+	Key  string `json:"key"`
+}
+
+// runWebhook lists a room's webhooks, creates one and prints its key, or
+// with -rm deletes one. Creating an existing webhook gives it a new key.
+func runWebhook(a *admin, args []string) int {
+	fs := flag.NewFlagSet("webhook", flag.ContinueOnError)
+	remove := fs.Bool("rm", false, "delete the named webhook")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	n := fs.NArg()
+	if n == 0 || n > 2 || (*remove && n != 2) {
+		fmt.Fprintln(os.Stderr, "Usage: chatadmin "+commands["webhook"].usage)
+		return 2
+	}
+	room := fs.Arg(0)
+	path := "/rooms/" + url.PathEscape(room) + "/webhooks"
+
+	switch {
+	case *remove:
+		if err := a.doJSON("DELETE", path+"/"+url.PathEscape(fs.Arg(1)), nil, nil); err != nil {
+			return fail("webhook", err)
+		}
+		fmt.Printf("Deleted webhook %s from %s\n", fs.Arg(1), room)
+	case n == 2:
+		var w webhook
+		if err := a.doJSON("POST", path+"/"+url.PathEscape(fs.Arg(1)), nil, &w); err != nil {
+			return fail("webhook", err)
+		}
+		fmt.Printf("Webhook %s posts to %s with the key\n%s\n", w.Name, w.Room, w.Key)
+	default:
+		var hooks []webhook
+		if err := a.doJSON("GET", path, nil, &hooks); err != nil {
+			return fail("webhook", err)
+		}
+		for _, w := range hooks {
+			fmt.Println(w.Name)
+		}
+	}
+	return 0
+}
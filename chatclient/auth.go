@@ -0,0 +1,74 @@
+package chatclient
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/gorilla/websocket"
+)
+
+// Servers started with -registration let users register their usernames
+// with a password. A registered name can only be used with a login token,
+// passed as Options.Auth:
+//
+//	token, err := chatclient.Login(ctx, opts, password)
+//	opts.Auth = token
+//	c, err := chatclient.Connect(ctx, opts)
+//
+// Tokens last 30 days, or until the password is changed.
+
+// Register registers opts.Username with password and returns a login token.
+func Register(ctx context.Context, opts Options, password string) (string, error) {
+	return authRequest(ctx, opts, "register", password)
+}
+
+// Login returns a login token for opts.Username.
+func Login(ctx context.Context, opts Options, password string) (string, error) {
+	return authRequest(ctx, opts, "login", password)
+}
+
+func authRequest(ctx context.Context, opts Options, action, password string) (string, error) {
+	u, err := url.Parse(opts.Server)
+	if err != nil {
+		return "", fmt.Errorf("chatclient: invalid server URL %q: %w", opts.Server, err)
+	}
+	u.Scheme = strings.Replace(u.Scheme, "ws", "http", 1) // ws to http, wss to https
+	u.Path = "/api/users/" + url.PathEscape(opts.Username) + "/" + action
+	if opts.Tenant != "" {
+		u.RawQuery = url.Values{"tenant": {opts.Tenant}}.Encode()
+	}
+	body, _ := json.Marshal(map[string]string{"password": password})
+	req, err := http.NewRequestWithContext(ctx, "POST", u.String(), bytes.NewReader(body))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	dialer := opts.Dialer
+	if dialer == nil {
+		dialer = websocket.DefaultDialer
+	}
+	hc := &http.Client{Transport: &http.Transport{TLSClientConfig: dialer.TLSClientConfig, Proxy: http.ProxyFromEnvironment}}
+	resp, err := hc.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	var reply struct {
+		Token string `json:"token"`
+		Error string `json:"error"`
+	}
+	json.NewDecoder(resp.Body).Decode(&reply)
+	if resp.StatusCode/100 != 2 {
+		if reply.Error == "" {
+			reply.Error = resp.Status
+		}
+		return "", fmt.Errorf("chatclient: %s failed: %s", action, reply.Error)
+	}
+	return reply.Token, nil
+}
@@ -0,0 +1,563 @@
+// Package chatclient is a Go client for the chat server's WebSocket protocol.
+//
+//	c, err := chatclient.Connect(ctx, chatclient.Options{
+//		Server:   "ws://localhost:8080",
+//		Username: "deploybot",
+//		Rooms:    []string{"ops"},
+//	})
+//	if err != nil {
+//		return err
+//	}
+//	defer c.Close()
+//	c.OnMessage(func(m chatclient.Message) { log.Println(m.Username, m.Text) })
+//	ack, err := c.Send(ctx, "ops", "release v1.2 done")
+//
+// The server binds every WebSocket to a single room, so the client keeps one
+// connection per joined room, unless Options.Multiplex has rooms share a
+// few connections. Connections are pinged to detect silent
+// failures, faster after the machine sleeps or changes networks, redialed
+// with backoff when they drop, and resumed with the server-issued resume
+// token: missed chat messages are replayed and anything already delivered is
+// suppressed. The server delivers each room's chat in
+// sequence order with none missing, so a jump in sequence numbers means
+// messages were lost, for example because a connection was down longer than
+// the server replays; OnGap reports it. When the server asks for a proof of work
+// before a new session may join, the client solves it automatically.
+package chatclient
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+var (
+	// ErrNotJoined is returned when sending to a room that was not joined.
+	ErrNotJoined = errors.New("chatclient: room not joined")
+	// ErrClosed is returned after Close, or when a room is left while a
+	// send is waiting for its ack.
+	ErrClosed = errors.New("chatclient: closed")
+	// ErrNoPong is reported when the server stopped answering pings.
+	ErrNoPong = errors.New("chatclient: no pong from server")
+	// ErrNetworkChanged is reported when a connection was dropped because
+	// the local address it used went away.
+	ErrNetworkChanged = errors.New("chatclient: network changed")
+	// ErrRejected is returned by Send when the server refused the message,
+	// for example because the user is sending too fast.
+	ErrRejected = errors.New("chatclient: rejected by server")
+)
+
+// RejectedError is returned by Send when the server refused the message
+// with a reason, such as a quota exceeded. It wraps ErrRejected.
+type RejectedError struct {
+	Text string // the server's explanation, for people
+	ErrorInfo
+}
+
+func (e *RejectedError) Error() string { return ErrRejected.Error() + ": " + e.Text }
+func (e *RejectedError) Unwrap() error { return ErrRejected }
+
+// Options configure a Client. Server and Username are required.
+type Options struct {
+	Server   string   // base URL, e.g. ws://localhost:8080 or wss://chat.example.com
+	Username string   // name to join rooms as
+	Rooms    []string // rooms joined by Connect
+	Tenant   string   // tenant namespace on multi-tenant servers; empty for the default
+	Auth     string   // login token for a registered username, from Login or Register
+
+	// Dialer is used for every connection; nil means websocket.DefaultDialer.
+	// Unless it sets Subprotocols, it asks for Protocol.
+	Dialer *websocket.Dialer
+
+	// PingInterval is how often each connection is pinged (default 15s).
+	// A connection is declared dead once more than MaxMissedPongs
+	// (default 2) pings in a row go unanswered.
+	PingInterval   time.Duration
+	MaxMissedPongs int
+
+	// MinBackoff and MaxBackoff bound the delay between reconnect attempts
+	// (defaults 1s and 30s).
+	MinBackoff time.Duration
+	MaxBackoff time.Duration
+
+	// TCPKeepAlive is the idle time before TCP keepalive probes are sent
+	// on new connections; 0 leaves the dialer's default and a negative
+	// value disables them. NetworkCheck is how often the machine's
+	// addresses are checked for changes, such as a switch from Wi-Fi to a
+	// tethered link (default 2s; negative disables). See keepalive.go.
+	TCPKeepAlive time.Duration
+	NetworkCheck time.Duration
+
+	// Multiplex, if set, carries every room over a pool of at most this
+	// many shared connections rather than one connection per room. See
+	// mux.go.
+	Multiplex int
+
+	// Observer joins every room read-only, as servers allow dashboards
+	// and moderation tools to: the rooms' traffic is received, but the
+	// user is not listed or announced and Send fails with a RejectedError
+	// of code "read_only".
+	Observer bool
+}
+
+// State is the lifecycle of one room connection, reported to StateHandlers.
+type State int
+
+const (
+	StateConnected    State = iota // joined, or rejoined after a drop
+	StateReconnecting              // connection lost; redialing
+	StateClosed                    // room left or client closed
+)
+
+func (s State) String() string {
+	switch s {
+	case StateConnected:
+		return "connected"
+	case StateReconnecting:
+		return "reconnecting"
+	case StateClosed:
+		return "closed"
+	}
+	return "unknown"
+}
+
+// StateHandler is told about room connection changes. err explains why a
+// connection was lost, if known.
+type StateHandler func(room string, state State, err error)
+
+// GapHandler is told that room's chat messages from sequence number from to
+// to, inclusive, were never delivered. They may be fetched with /history.
+type GapHandler func(room string, from, to int64)
+
+// Client is a connection to the chat server spanning any number of rooms.
+// It is safe for concurrent use.
+type Client struct {
+	opts   Options
+	server *url.URL
+
+	mu       sync.Mutex
+	rooms    map[string]*roomConn
+	pending  map[string]chan Message // ref -> waiting Send
+	handlers []func(Message)
+	byRoom   map[string][]func(Message) // handlers for one room, from OnRoom
+	states   []StateHandler
+	gaps     []GapHandler
+	closed   bool
+
+	done    chan struct{}
+	refSeq  atomic.Uint64
+	refBase string
+
+	muxMu sync.Mutex // held while the pool is changed or dialed
+	muxes []*muxConn
+}
+
+// Connect validates opts and joins opts.Rooms.
+func Connect(ctx context.Context, opts Options) (*Client, error) {
+	if opts.Username == "" {
+		return nil, errors.New("chatclient: username required")
+	}
+	u, err := url.Parse(opts.Server)
+	if err != nil {
+		return nil, fmt.Errorf("chatclient: invalid server URL %q: %w", opts.Server, err)
+	}
+	if u.Scheme != "ws" && u.Scheme != "wss" {
+		return nil, fmt.Errorf("chatclient: invalid server URL %q: scheme must be ws or wss", opts.Server)
+	}
+	if opts.Dialer == nil {
+		opts.Dialer = websocket.DefaultDialer
+	}
+	if opts.PingInterval <= 0 {
+		opts.PingInterval = 15 * time.Second
+	}
+	if opts.MaxMissedPongs <= 0 {
+		opts.MaxMissedPongs = 2
+	}
+	if opts.MinBackoff <= 0 {
+		opts.MinBackoff = time.Second
+	}
+	if opts.MaxBackoff < opts.MinBackoff {
+		opts.MaxBackoff = 30 * time.Second
+	}
+	opts.Dialer = tcpKeepAlive(opts.Dialer, opts.TCPKeepAlive)
+	if len(opts.Dialer.Subprotocols) == 0 {
+		d := *opts.Dialer
+		d.Subprotocols = []string{Protocol}
+		opts.Dialer = &d
+	}
+	if opts.NetworkCheck == 0 {
+		opts.NetworkCheck = defaultNetworkCheck
+	}
+
+	b := make([]byte, 4)
+	rand.Read(b)
+	c := &Client{
+		opts:    opts,
+		server:  u,
+		rooms:   make(map[string]*roomConn),
+		pending: make(map[string]chan Message),
+		done:    make(chan struct{}),
+		refBase: hex.EncodeToString(b),
+	}
+
+	if opts.NetworkCheck > 0 {
+		go c.watchNetwork()
+	}
+	for _, room := range opts.Rooms {
+		if err := c.Join(ctx, room); err != nil {
+			c.Close()
+			return nil, err
+		}
+	}
+	return c, nil
+}
+
+// OnMessage registers h to receive every message from every joined room.
+// Handlers run on the room's read goroutine, so handlers for different rooms
+// may run concurrently; a slow handler delays that room's messages.
+func (c *Client) OnMessage(h func(Message)) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.handlers = append(c.handlers, h)
+}
+
+// OnRoom registers h to receive the messages of room alone, after the
+// OnMessage handlers. Bots serving many rooms can give each its own.
+func (c *Client) OnRoom(room string, h func(Message)) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.byRoom == nil {
+		c.byRoom = make(map[string][]func(Message))
+	}
+	c.byRoom[room] = append(c.byRoom[room], h)
+}
+
+// OnStateChange registers h to be told when room connections drop,
+// reconnect or close.
+func (c *Client) OnStateChange(h StateHandler) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.states = append(c.states, h)
+}
+
+// OnGap registers h to be told when chat messages of a room were missed.
+func (c *Client) OnGap(h GapHandler) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.gaps = append(c.gaps, h)
+}
+
+// Join connects to room. Joining a room twice is a no-op.
+func (c *Client) Join(ctx context.Context, room string) error {
+	room = strings.TrimSpace(room)
+	if room == "" {
+		return errors.New("chatclient: room name required")
+	}
+
+	c.mu.Lock()
+	if c.closed {
+		c.mu.Unlock()
+		return ErrClosed
+	}
+	if _, ok := c.rooms[room]; ok {
+		c.mu.Unlock()
+		return nil
+	}
+	c.mu.Unlock()
+
+	var rc *roomConn
+	if c.opts.Multiplex > 0 {
+		rc = newRoomConn(c, room, nil)
+		if err := rc.joinMux(ctx); err != nil {
+			return err
+		}
+	} else {
+		conn, err := c.dial(ctx, room, nil)
+		if err != nil {
+			return err
+		}
+		rc = newRoomConn(c, room, conn)
+	}
+	c.mu.Lock()
+	if _, ok := c.rooms[room]; ok || c.closed {
+		c.mu.Unlock()
+		rc.hangUp()
+		return nil
+	}
+	c.rooms[room] = rc
+	c.mu.Unlock()
+
+	c.emit(room, StateConnected, nil)
+	go rc.run()
+	return nil
+}
+
+// Leave disconnects from room and waits for its connection to shut down.
+func (c *Client) Leave(room string) error {
+	rc, err := c.room(room)
+	if err != nil {
+		return err
+	}
+	rc.hangUp()
+	<-rc.done
+	return nil
+}
+
+// Rooms returns the names of the joined rooms.
+func (c *Client) Rooms() []string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	names := make([]string, 0, len(c.rooms))
+	for name := range c.rooms {
+		names = append(names, name)
+	}
+	return names
+}
+
+// Send posts a chat message to room and waits for the server's ack, which
+// carries the message's ID and sequence number. If the connection drops
+// before the ack arrives the message may or may not have been delivered.
+// Commands (text starting with "/") are not acknowledged; use Command.
+func (c *Client) Send(ctx context.Context, room, text string) (Message, error) {
+	if strings.HasPrefix(text, "/") {
+		return Message{}, errors.New("chatclient: commands are not acknowledged; use Command")
+	}
+	rc, err := c.room(room)
+	if err != nil {
+		return Message{}, err
+	}
+
+	ref := c.refBase + "-" + strconv.FormatUint(c.refSeq.Add(1), 36)
+	ack := make(chan Message, 1)
+	c.mu.Lock()
+	c.pending[ref] = ack
+	c.mu.Unlock()
+	defer func() {
+		c.mu.Lock()
+		delete(c.pending, ref)
+		c.mu.Unlock()
+	}()
+
+	if err := rc.write(Message{Text: text, Ref: ref}); err != nil {
+		return Message{}, err
+	}
+	select {
+	case m := <-ack:
+		if m.Type == TypeError && m.Error != nil {
+			return Message{}, &RejectedError{Text: m.Text, ErrorInfo: *m.Error}
+		}
+		if m.Type != TypeAck {
+			return Message{}, fmt.Errorf("%w: %s", ErrRejected, m.Text)
+		}
+		return m, nil
+	case <-rc.done:
+		return Message{}, ErrClosed
+	case <-ctx.Done():
+		return Message{}, ctx.Err()
+	}
+}
+
+// Post sends text to room without waiting for an ack.
+func (c *Client) Post(room, text string) error {
+	rc, err := c.room(room)
+	if err != nil {
+		return err
+	}
+	return rc.write(Message{Text: text})
+}
+
+// Command sends a slash command such as "/users" to room. The reply
+// arrives through OnMessage.
+func (c *Client) Command(room, cmd string) error {
+	if !strings.HasPrefix(cmd, "/") {
+		cmd = "/" + cmd
+	}
+	return c.Post(room, cmd)
+}
+
+// MarkDelivered tells the server every chat message in room up to seq has
+// arrived. In small rooms the server relays it to their authors as a
+// TypeReceipt message; elsewhere it is ignored.
+func (c *Client) MarkDelivered(room string, seq int64) error {
+	return c.receipt(room, ReceiptDelivered, seq)
+}
+
+// MarkRead tells the server every chat message in room up to seq has been
+// read, which implies delivered.
+func (c *Client) MarkRead(room string, seq int64) error {
+	return c.receipt(room, ReceiptRead, seq)
+}
+
+func (c *Client) receipt(room, kind string, seq int64) error {
+	rc, err := c.room(room)
+	if err != nil {
+		return err
+	}
+	return rc.write(Message{Type: TypeReceipt, Text: kind, Seq: seq})
+}
+
+// Close leaves every room and stops reconnecting.
+func (c *Client) Close() error {
+	c.mu.Lock()
+	if c.closed {
+		c.mu.Unlock()
+		return nil
+	}
+	c.closed = true
+	close(c.done)
+	rooms := make([]*roomConn, 0, len(c.rooms))
+	for _, rc := range c.rooms {
+		rooms = append(rooms, rc)
+	}
+	c.mu.Unlock()
+
+	for _, rc := range rooms {
+		rc.hangUp()
+	}
+	for _, rc := range rooms {
+		<-rc.done
+	}
+	c.closeMuxes()
+	return nil
+}
+
+func (c *Client) room(name string) (*roomConn, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		return nil, ErrClosed
+	}
+	rc, ok := c.rooms[name]
+	if !ok {
+		return nil, ErrNotJoined
+	}
+	return rc, nil
+}
+
+// dial opens a WebSocket to the server's /ws endpoint for one room. extra
+// carries optional query parameters such as resume and since_seq.
+func (c *Client) dial(ctx context.Context, room string, extra url.Values) (*websocket.Conn, error) {
+	q := url.Values{}
+	for k, v := range extra {
+		q[k] = v
+	}
+	q.Set("room", room)
+	if c.opts.Observer {
+		q.Set("mode", modeObserver)
+	}
+	return c.dialPath(ctx, "/ws", q)
+}
+
+// dialPath opens a WebSocket to path with query parameters q, adding the
+// user's and solving a proof of work if the server asks for one.
+func (c *Client) dialPath(ctx context.Context, path string, q url.Values) (*websocket.Conn, error) {
+	q.Set("username", c.opts.Username)
+	if c.opts.Tenant != "" {
+		q.Set("tenant", c.opts.Tenant)
+	}
+	if c.opts.Auth != "" {
+		q.Set("auth", c.opts.Auth)
+	}
+
+	u := *c.server
+	u.Path = path
+	u.RawQuery = q.Encode()
+
+	conn, resp, err := c.opts.Dialer.DialContext(ctx, u.String(), nil)
+	if resp == nil || err == nil {
+		return conn, err
+	}
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+	ch, ok := readChallenge(resp.StatusCode, body)
+	if !ok {
+		return nil, refusal(err, body)
+	}
+
+	// The server wants a proof of work before a new session joins
+	solution, err := ch.solve(ctx)
+	if err != nil {
+		return nil, err
+	}
+	q.Set("pow", ch.Challenge)
+	q.Set("pow_solution", solution)
+	u.RawQuery = q.Encode()
+	conn, resp, err = c.opts.Dialer.DialContext(ctx, u.String(), nil)
+	if resp != nil && err != nil {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+		return nil, refusal(err, body)
+	}
+	return conn, err
+}
+
+// refusal adds the server's reason, from a JSON {"error": ...} body, to a
+// failed handshake.
+func refusal(err error, body []byte) error {
+	var reply struct {
+		Error string `json:"error"`
+	}
+	if json.Unmarshal(body, &reply) != nil || reply.Error == "" {
+		return err
+	}
+	return fmt.Errorf("%w: %s", err, reply.Error)
+}
+
+// dispatch hands msg, from room, to the waiting Send or to the message
+// handlers.
+func (c *Client) dispatch(room string, msg Message) {
+	c.mu.Lock()
+	if msg.Ref != "" {
+		if ch, ok := c.pending[msg.Ref]; ok {
+			c.mu.Unlock()
+			ch <- msg
+			return
+		}
+	}
+	handlers := c.handlers
+	byRoom := c.byRoom[room]
+	c.mu.Unlock()
+
+	for _, h := range handlers {
+		h(msg)
+	}
+	for _, h := range byRoom {
+		h(msg)
+	}
+}
+
+func (c *Client) emit(room string, state State, err error) {
+	c.mu.Lock()
+	states := c.states
+	c.mu.Unlock()
+	for _, h := range states {
+		h(room, state, err)
+	}
+}
+
+func (c *Client) gap(room string, from, to int64) {
+	c.mu.Lock()
+	gaps := c.gaps
+	c.mu.Unlock()
+	for _, h := range gaps {
+		h(room, from, to)
+	}
+}
+
+func (c *Client) removeRoom(rc *roomConn) {
+	c.mu.Lock()
+	if c.rooms[rc.name] == rc {
+		delete(c.rooms, rc.name)
+	}
+	c.mu.Unlock()
+}
@@ -0,0 +1,181 @@
+package chatclient
+
+import (
+	"net"
+	"slices"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// Connections on laptops and phones die quietly: the machine sleeps and
+// its NAT mappings expire, or it moves from Wi-Fi to a tethered link and
+// the old address disappears. Three things shorten how long the client
+// sits on such a dead connection:
+//
+//   - Pings adapt. Each connection is pinged every PingInterval while the
+//     server answers; once a ping goes unanswered for the probe interval, a
+//     fifth of PingInterval but at least a second, the next ones follow at
+//     that pace, so a dead connection is noticed within PingInterval plus a
+//     few probe intervals rather than several PingIntervals.
+//   - After a wake, noticed when the wall clock has moved well past the
+//     ping timer, and when the machine's addresses change, every
+//     connection is pinged at once and dropped unless the server answers
+//     within the probe interval. A connection whose local address is gone
+//     is dropped straight away. Dropped this way, rooms redial without
+//     waiting out the backoff.
+//   - TCPKeepAlive sets how soon the kernel's keepalive probes start on
+//     new connections, which also keeps NAT mappings alive between pings.
+
+// defaultNetworkCheck is how often local addresses are compared by default.
+const defaultNetworkCheck = 2 * time.Second
+
+// probeInterval is how soon a ping is repeated while one is unanswered.
+func (o Options) probeInterval() time.Duration {
+	return max(o.PingInterval/5, time.Second)
+}
+
+// tcpKeepAlive returns d with TCP keepalive probes sent after keepAlive of
+// idle time, or none if it is negative. A dialer with its own NetDial or
+// NetDialContext is left alone.
+func tcpKeepAlive(d *websocket.Dialer, keepAlive time.Duration) *websocket.Dialer {
+	if keepAlive == 0 || d.NetDial != nil || d.NetDialContext != nil {
+		return d
+	}
+	withKeepAlive := *d
+	withKeepAlive.NetDialContext = (&net.Dialer{Timeout: 30 * time.Second, KeepAlive: keepAlive}).DialContext
+	return &withKeepAlive
+}
+
+// keepAlive pings the server and closes conn once more than MaxMissedPongs
+// pings in a row went unanswered, which makes the pending read fail.
+func (rc *roomConn) keepAlive(conn *websocket.Conn, stop <-chan struct{}, dead chan<- struct{}) {
+	base, probe := rc.c.opts.PingInterval, rc.c.opts.probeInterval()
+	maxMissed := int32(rc.c.opts.MaxMissedPongs)
+	timer := time.NewTimer(base)
+	defer timer.Stop()
+	// Times are kept on the wall clock, which keeps running while asleep.
+	due := time.Now().Round(0).Add(base)
+	var pinged time.Time
+
+	reset := func(d time.Duration) {
+		if !timer.Stop() {
+			select {
+			case <-timer.C:
+			default:
+			}
+		}
+		timer.Reset(d)
+		due = time.Now().Round(0).Add(d)
+	}
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-rc.poke:
+			rc.missed.Store(maxMissed)
+		case <-timer.C:
+			now := time.Now().Round(0)
+			switch {
+			case now.Sub(due) > base:
+				// Slept through the timer: the connection may be gone.
+				rc.missed.Store(maxMissed)
+			case rc.missed.Load() == 0 && now.Sub(pinged) < base:
+				// The last ping was answered; carry on at the usual pace.
+				reset(pinged.Add(base).Sub(now))
+				continue
+			}
+		}
+		if missed := rc.missed.Add(1) - 1; missed > maxMissed {
+			rc.urgent.Store(true)
+			close(dead)
+			conn.Close()
+			return
+		}
+		if err := conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(probe)); err != nil {
+			conn.Close()
+			return
+		}
+		pinged = time.Now().Round(0)
+		reset(probe) // check for the pong
+	}
+}
+
+// probe has the room's connection pinged now, and dropped unless the
+// server answers within the probe interval.
+func (rc *roomConn) probe() {
+	select {
+	case rc.poke <- struct{}{}:
+	default:
+	}
+}
+
+// watchNetwork compares the machine's addresses every NetworkCheck and,
+// when they change, drops connections whose local address is gone and
+// probes the rest.
+func (c *Client) watchNetwork() {
+	ticker := time.NewTicker(c.opts.NetworkCheck)
+	defer ticker.Stop()
+	addrs := localAddrs()
+	for {
+		select {
+		case <-c.done:
+			return
+		case <-ticker.C:
+		}
+		now := localAddrs()
+		if slices.Equal(now, addrs) {
+			continue
+		}
+		addrs = now
+		c.mu.Lock()
+		rooms := make([]*roomConn, 0, len(c.rooms))
+		for _, rc := range c.rooms {
+			rooms = append(rooms, rc)
+		}
+		c.mu.Unlock()
+		c.muxMu.Lock()
+		muxes := slices.Clone(c.muxes)
+		c.muxMu.Unlock()
+		for _, m := range muxes {
+			if tcp, ok := m.conn.LocalAddr().(*net.TCPAddr); ok && !tcp.IP.IsLoopback() {
+				if _, found := slices.BinarySearch(addrs, tcp.IP.String()); !found {
+					m.fail(ErrNetworkChanged)
+					continue
+				}
+			}
+			m.missed.Store(int32(c.opts.MaxMissedPongs))
+		}
+		for _, rc := range rooms {
+			conn := rc.current()
+			if conn == nil {
+				continue // on a shared connection
+			}
+			if tcp, ok := conn.LocalAddr().(*net.TCPAddr); ok && !tcp.IP.IsLoopback() {
+				if _, found := slices.BinarySearch(addrs, tcp.IP.String()); !found {
+					rc.urgent.Store(true)
+					conn.Close()
+					continue
+				}
+			}
+			rc.probe()
+		}
+	}
+}
+
+// localAddrs returns the machine's IP addresses, sorted.
+func localAddrs() []string {
+	ifaddrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return nil
+	}
+	var addrs []string
+	for _, a := range ifaddrs {
+		if ipnet, ok := a.(*net.IPNet); ok {
+			addrs = append(addrs, ipnet.IP.String())
+		}
+	}
+	slices.Sort(addrs)
+	return addrs
+}
@@ -0,0 +1,120 @@
+package chatclient
+
+import (
+	"encoding/json"
+	"time"
+)
+
+// Message types sent by the server.
+const (
+	TypeChat     = "chat"
+	TypeSystem   = "system"
+	TypeUserList = "user_list"
+	TypeStats    = "stats"
+	TypeRoom     = "room"
+	TypeHistory  = "history"
+	TypeAck      = "ack"
+	TypeWelcome  = "welcome"
+	TypeRedacted = "redacted"
+	TypeKicked   = "kicked"
+	TypeMention  = "mention"
+	TypeGroups   = "groups"
+	TypeDirect   = "direct"
+	TypePrefs    = "prefs"
+	TypeDigest   = "digest"
+	TypePinned   = "pinned"
+	TypeUnpinned = "unpinned"
+	TypePins     = "pins"
+	TypeReceipt  = "receipt"
+	TypeQuality  = "quality"
+
+	TypeHistoryMode = "history_mode"
+	TypeError       = "error"      // the server refused something, saying why in Error
+	TypeAnnotation  = "annotation" // a bot annotated message ID; the annotation is in Annotations
+
+	// Room events. The client asks for protocol chat.v2, which sends these
+	// instead of system messages in free text.
+	TypeUserJoined   = "user_joined"
+	TypeUserLeft     = "user_left"
+	TypeTopicChanged = "topic_changed"
+)
+
+// Protocol is the protocol version the client asks the server for.
+const Protocol = "chat.v2"
+
+// modeObserver is the join mode of Options.Observer.
+const modeObserver = "observer"
+
+// Receipt kinds, the Text of a TypeReceipt message.
+const (
+	ReceiptDelivered = "delivered"
+	ReceiptRead      = "read"
+)
+
+// Message is one frame of the chat protocol.
+type Message struct {
+	Type     string `json:"type"`
+	Room     string `json:"room"`
+	Username string `json:"username"`
+	Text     string `json:"text"`
+	Time     string `json:"time"`
+	ID       string `json:"id,omitempty"`
+	Ref      string `json:"ref,omitempty"`
+	Seq      int64  `json:"seq,omitempty"`
+	Redacted bool   `json:"redacted,omitempty"`
+	Group    string `json:"group,omitempty"` // for TypeMention, the @group that mentioned the user
+
+	Attachment *Attachment `json:"attachment,omitempty"`
+	Forwarded  *Forward    `json:"forwarded,omitempty"` // on a forwarded message, where it came from
+
+	Integration bool `json:"integration,omitempty"` // posted by an external system through a room webhook
+	Unverified  bool `json:"unverified,omitempty"`  // sent under a username that is not registered
+	Unsaved     bool `json:"unsaved,omitempty"`     // not stored, so absent from history and resume replays
+
+	Topic       string `json:"topic,omitempty"` // for TypeTopicChanged and TypeWelcome, the room's topic
+	Trace       string `json:"trace,omitempty"` // chat trace ID, sent by servers run with -trace-clients
+	ResumeToken string `json:"resume_token,omitempty"`
+
+	Error *ErrorInfo `json:"error,omitempty"` // for TypeError, why the server refused
+
+	Annotations []Annotation `json:"annotations,omitempty"` // bots' annotations of a stored message
+
+	// Raw is the frame exactly as received from the server.
+	Raw []byte `json:"-"`
+}
+
+// ErrorInfo is the reason the server gave for refusing a message.
+type ErrorInfo struct {
+	Code   string `json:"code"`             // such as "quota_exceeded", "read_only" or "bad_json"
+	Quota  string `json:"quota,omitempty"`  // for quota_exceeded: messages_per_day, storage_bytes or max_attachments
+	Scope  string `json:"scope,omitempty"`  // for quota_exceeded: "room" or "tenant"
+	Limit  int64  `json:"limit,omitempty"`  // the quota; for bad_json, the bad frames that close the connection
+	Used   int64  `json:"used,omitempty"`   // how much of it is used; for bad_json, the bad frames sent
+	Resets string `json:"resets,omitempty"` // RFC 3339 time a daily quota starts over
+}
+
+// Annotation is structured data a bot attached to a stored message.
+type Annotation struct {
+	Bot  string          `json:"bot"`  // the webhook that added it
+	Kind string          `json:"kind"` // such as "sentiment"
+	Data json.RawMessage `json:"data"`
+	Time time.Time       `json:"time"`
+}
+
+// Attachment is a file posted with a chat message, such as a voice clip.
+type Attachment struct {
+	Type        string  `json:"type"` // "audio"
+	URL         string  `json:"url"`  // path on the server
+	ContentType string  `json:"content_type"`
+	Size        int     `json:"size"`
+	Duration    float64 `json:"duration,omitempty"` // seconds, for audio
+}
+
+// Forward identifies the message a forwarded one was copied from.
+type Forward struct {
+	ID     string `json:"id"`
+	Room   string `json:"room"`
+	Seq    int64  `json:"seq"`
+	Author string `json:"author"`
+	Time   string `json:"time"`
+}
@@ -0,0 +1,306 @@
+package chatclient
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// With Options.Multiplex set, rooms share a pool of at most that many
+// connections to the server's /ws/mux endpoint instead of holding one each,
+// so a bot in 500 rooms needs a handful of sockets. Each room joined is
+// placed on the connection with the fewest rooms, opening another while the
+// pool is not full. A room is still its own session on the server, with
+// its own resume token and sequence numbers: when a connection drops, its
+// rooms rejoin over another, or a new one, and resume as they would on
+// their own. Each room keeps its own goroutine for its handlers, so a slow
+// handler delays only its room, until that room's backlog of muxBacklog
+// messages fills and the connection waits for it.
+
+const (
+	muxJoin    = "join"
+	muxLeave   = "leave"
+	muxRefused = "refused"
+	muxClosed  = "closed"
+
+	muxBacklog = 256
+)
+
+// errSessionClosed is how a room learns the server ended its session on a
+// shared connection, which it then rejoins.
+var errSessionClosed = errors.New("chatclient: session closed by server")
+
+type muxFrame struct {
+	Ch       string          `json:"ch"`
+	Op       string          `json:"op,omitempty"`
+	Room     string          `json:"room,omitempty"`
+	Resume   string          `json:"resume,omitempty"`
+	SinceSeq int64           `json:"since_seq,omitempty"`
+	Mode     string          `json:"mode,omitempty"`
+	Status   int             `json:"status,omitempty"`
+	Error    string          `json:"error,omitempty"`
+	Data     json.RawMessage `json:"data,omitempty"`
+}
+
+// muxConn is one shared connection and the rooms on it, by name.
+type muxConn struct {
+	c    *Client
+	conn *websocket.Conn
+	wmu  sync.Mutex
+
+	mu      sync.Mutex
+	rooms   map[string]*roomConn
+	joining map[string]chan error // rooms waiting to hear if they joined
+
+	missed atomic.Int32
+	down   chan struct{} // closed when the connection fails
+	err    error         // why, set before down is closed
+	once   sync.Once
+}
+
+// muxFor returns the connection to put another room on, dialing one if
+// the pool has room.
+func (c *Client) muxFor(ctx context.Context) (*muxConn, error) {
+	c.muxMu.Lock()
+	defer c.muxMu.Unlock()
+	var best *muxConn
+	for _, m := range c.muxes {
+		if best == nil || m.load() < best.load() {
+			best = m
+		}
+	}
+	if best != nil && (len(c.muxes) >= c.opts.Multiplex || best.load() == 0) {
+		return best, nil
+	}
+	conn, err := c.dialPath(ctx, "/ws/mux", url.Values{})
+	if err != nil {
+		if best != nil {
+			return best, nil
+		}
+		return nil, err
+	}
+	m := &muxConn{
+		c:       c,
+		conn:    conn,
+		rooms:   make(map[string]*roomConn),
+		joining: make(map[string]chan error),
+		down:    make(chan struct{}),
+	}
+	c.muxes = append(c.muxes, m)
+	go m.run()
+	go m.keepAlive()
+	return m, nil
+}
+
+func (m *muxConn) load() int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return len(m.rooms)
+}
+
+// fail marks the connection dead for err, closes it and takes it out of
+// the pool. Its rooms notice and rejoin.
+func (m *muxConn) fail(err error) {
+	m.once.Do(func() {
+		m.err = err
+		close(m.down)
+		m.conn.Close()
+		m.c.muxMu.Lock()
+		for i, other := range m.c.muxes {
+			if other == m {
+				m.c.muxes = append(m.c.muxes[:i], m.c.muxes[i+1:]...)
+				break
+			}
+		}
+		m.c.muxMu.Unlock()
+	})
+}
+
+// join starts rc's session on the connection, resuming it if resume is
+// set, and waits for the server to accept or refuse it.
+func (m *muxConn) join(ctx context.Context, rc *roomConn, resume string, sinceSeq int64) error {
+	result := make(chan error, 1)
+	m.mu.Lock()
+	m.rooms[rc.name] = rc
+	m.joining[rc.name] = result
+	m.mu.Unlock()
+
+	f := muxFrame{Ch: rc.name, Op: muxJoin, Room: rc.name, Resume: resume, SinceSeq: sinceSeq}
+	if m.c.opts.Observer {
+		f.Mode = modeObserver
+	}
+	err := m.send(f)
+	if err == nil {
+		select {
+		case err = <-result:
+		case <-m.down:
+			err = m.err
+		case <-ctx.Done():
+			err = ctx.Err()
+		}
+	}
+	if err != nil {
+		m.detach(rc)
+	}
+	return err
+}
+
+// detach takes rc off the connection.
+func (m *muxConn) detach(rc *roomConn) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.rooms[rc.name] == rc {
+		delete(m.rooms, rc.name)
+		delete(m.joining, rc.name)
+	}
+}
+
+// leave ends rc's session.
+func (m *muxConn) leave(rc *roomConn) {
+	m.detach(rc)
+	m.send(muxFrame{Ch: rc.name, Op: muxLeave})
+}
+
+func (m *muxConn) send(f muxFrame) error {
+	data, err := json.Marshal(f)
+	if err != nil {
+		return err
+	}
+	m.wmu.Lock()
+	defer m.wmu.Unlock()
+	return m.conn.WriteMessage(websocket.TextMessage, data)
+}
+
+// run hands each room the frames meant for it until the connection fails.
+func (m *muxConn) run() {
+	m.conn.SetPongHandler(func(string) error {
+		m.missed.Store(0)
+		return nil
+	})
+	for {
+		_, data, err := m.conn.ReadMessage()
+		if err != nil {
+			m.fail(err)
+			return
+		}
+		m.missed.Store(0)
+		var f muxFrame
+		if json.Unmarshal(data, &f) != nil {
+			continue
+		}
+
+		m.mu.Lock()
+		rc := m.rooms[f.Ch]
+		result := m.joining[f.Ch]
+		delete(m.joining, f.Ch)
+		if f.Op == muxRefused || f.Op == muxClosed {
+			delete(m.rooms, f.Ch)
+		}
+		m.mu.Unlock()
+		if rc == nil {
+			continue
+		}
+
+		switch f.Op {
+		case muxRefused:
+			if result != nil {
+				result <- fmt.Errorf("chatclient: joining %s: %s", f.Ch, f.Error)
+			}
+		case muxClosed:
+			select {
+			case rc.inbox <- nil:
+			case <-rc.left:
+			}
+		default:
+			if result != nil {
+				result <- nil
+			}
+			select {
+			case rc.inbox <- f.Data:
+			case <-rc.left:
+			}
+		}
+	}
+}
+
+// keepAlive pings the connection and drops it once more than
+// MaxMissedPongs pings in a row went unanswered.
+func (m *muxConn) keepAlive() {
+	ticker := time.NewTicker(m.c.opts.PingInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-m.down:
+			return
+		case <-ticker.C:
+		}
+		if m.missed.Add(1)-1 > int32(m.c.opts.MaxMissedPongs) {
+			m.fail(ErrNoPong)
+			return
+		}
+		if err := m.conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(m.c.opts.probeInterval())); err != nil {
+			m.fail(err)
+			return
+		}
+	}
+}
+
+// joinMux joins rc over a shared connection, resuming its session if it
+// has one.
+func (rc *roomConn) joinMux(ctx context.Context) error {
+	m, err := rc.c.muxFor(ctx)
+	if err != nil {
+		return err
+	}
+	rc.mu.Lock()
+	resume, since := rc.resumeToken, rc.lastSeq
+	rc.mux = m
+	rc.mu.Unlock()
+	if resume == "" {
+		since = 0
+	}
+	return m.join(ctx, rc, resume, since)
+}
+
+// readMux delivers the room's messages from its shared connection until
+// the connection fails, the server ends the session or the room is left.
+func (rc *roomConn) readMux() error {
+	rc.mu.Lock()
+	m := rc.mux
+	rc.mu.Unlock()
+	for {
+		select {
+		case data := <-rc.inbox:
+			if data == nil {
+				return errSessionClosed
+			}
+			rc.deliver(data)
+		case <-m.down:
+			return m.err
+		case <-rc.left:
+			return nil
+		}
+	}
+}
+
+// closeMuxes closes the shared connections, once every room is left.
+func (c *Client) closeMuxes() {
+	c.muxMu.Lock()
+	muxes := slices.Clone(c.muxes)
+	c.muxMu.Unlock()
+	for _, m := range muxes {
+		m.conn.WriteControl(websocket.CloseMessage,
+			websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""),
+			time.Now().Add(time.Second))
+		m.fail(io.EOF)
+	}
+}
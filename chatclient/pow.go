@@ -0,0 +1,60 @@
+package chatclient
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"math/bits"
+	"net/http"
+	"strconv"
+)
+
+// challenge is the body of the server's 428 reply when it wants a proof of
+// work before letting a new session join.
+type challenge struct {
+	Challenge  string `json:"challenge"`
+	Difficulty int    `json:"difficulty"`
+}
+
+// readChallenge extracts the challenge from a refused handshake's body, if
+// any.
+func readChallenge(status int, body []byte) (challenge, bool) {
+	if status != http.StatusPreconditionRequired {
+		return challenge{}, false
+	}
+	var ch challenge
+	if json.Unmarshal(body, &ch) != nil || ch.Challenge == "" {
+		return challenge{}, false
+	}
+	return ch, true
+}
+
+// solve finds s such that SHA-256("<challenge>:<s>") starts with the
+// required number of zero bits.
+func (ch challenge) solve(ctx context.Context) (string, error) {
+	prefix := []byte(ch.Challenge + ":")
+	buf := make([]byte, 0, len(prefix)+20)
+	for n := uint64(0); ; n++ {
+		if n&0xffff == 0 {
+			if err := ctx.Err(); err != nil {
+				return "", err
+			}
+		}
+		buf = strconv.AppendUint(append(buf[:0], prefix...), n, 36)
+		sum := sha256.Sum256(buf)
+		if zeroBits(sum[:]) >= ch.Difficulty {
+			return strconv.FormatUint(n, 36), nil
+		}
+	}
+}
+
+func zeroBits(b []byte) int {
+	n := 0
+	for _, x := range b {
+		if x != 0 {
+			return n + bits.LeadingZeros8(x)
+		}
+		n += 8
+	}
+	return n
+}
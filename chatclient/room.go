@@ -0,0 +1,300 @@
+package chatclient
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/url"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// roomConn is the connection for one joined room.
+type roomConn struct {
+	c    *Client
+	name string
+
+	wmu sync.Mutex // serializes data frames; control frames need no lock
+
+	mu          sync.Mutex
+	conn        *websocket.Conn
+	closing     bool   // set when we hang up ourselves
+	resumeToken string // from the server's welcome, used on reconnect
+	lastSeq     int64  // highest chat sequence number delivered
+
+	mux   *muxConn      // the shared connection, with Options.Multiplex
+	inbox chan []byte   // frames from mux, nil when the server ends the session
+	left  chan struct{} // closed when a room on a shared connection is left
+
+	missed atomic.Int32  // pings sent since the last pong
+	urgent atomic.Bool   // redial without backoff; see keepalive.go
+	poke   chan struct{} // asks keepAlive to probe now
+	done   chan struct{} // closed when run returns
+}
+
+func newRoomConn(c *Client, name string, conn *websocket.Conn) *roomConn {
+	rc := &roomConn{
+		c:    c,
+		name: name,
+		conn: conn,
+		left: make(chan struct{}),
+		poke: make(chan struct{}, 1),
+		done: make(chan struct{}),
+	}
+	if c.opts.Multiplex > 0 {
+		rc.inbox = make(chan []byte, muxBacklog)
+	}
+	return rc
+}
+
+func (rc *roomConn) current() *websocket.Conn {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	return rc.conn
+}
+
+func (rc *roomConn) isClosing() bool {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	return rc.closing
+}
+
+func (rc *roomConn) write(msg Message) error {
+	data, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	rc.mu.Lock()
+	m := rc.mux
+	rc.mu.Unlock()
+	if m != nil {
+		return m.send(muxFrame{Ch: rc.name, Data: data})
+	}
+	rc.wmu.Lock()
+	defer rc.wmu.Unlock()
+	return rc.current().WriteMessage(websocket.TextMessage, data)
+}
+
+// hangUp closes the connection for good; run then exits.
+func (rc *roomConn) hangUp() {
+	rc.mu.Lock()
+	wasClosing := rc.closing
+	rc.closing = true
+	conn, m := rc.conn, rc.mux
+	rc.mu.Unlock()
+
+	if rc.c.opts.Multiplex > 0 {
+		if !wasClosing {
+			close(rc.left)
+		}
+		if m != nil {
+			m.leave(rc)
+		}
+		return
+	}
+
+	conn.WriteControl(websocket.CloseMessage,
+		websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""),
+		time.Now().Add(time.Second))
+	conn.Close()
+}
+
+// run reads the room until it is left, reconnecting whenever the connection
+// drops or keepAlive declares it dead.
+func (rc *roomConn) run() {
+	defer func() {
+		rc.c.removeRoom(rc)
+		close(rc.done)
+		rc.c.emit(rc.name, StateClosed, nil)
+	}()
+
+	for {
+		err := rc.read()
+		if rc.isClosing() {
+			return
+		}
+		rc.c.emit(rc.name, StateReconnecting, err)
+		if !rc.reconnect() {
+			return
+		}
+		rc.c.emit(rc.name, StateConnected, nil)
+	}
+}
+
+// read delivers messages from the current connection until it fails.
+func (rc *roomConn) read() error {
+	if rc.c.opts.Multiplex > 0 {
+		return rc.readMux()
+	}
+	conn := rc.current()
+
+	stop := make(chan struct{})
+	defer close(stop)
+	dead := make(chan struct{})
+	go rc.keepAlive(conn, stop, dead)
+
+	conn.SetPongHandler(func(string) error {
+		rc.missed.Store(0)
+		rc.urgent.Store(false)
+		return nil
+	})
+
+	for {
+		_, data, err := conn.ReadMessage()
+		if err != nil {
+			select {
+			case <-dead:
+				return ErrNoPong
+			default:
+				if rc.urgent.Load() {
+					return ErrNetworkChanged
+				}
+				return err
+			}
+		}
+		rc.missed.Store(0)
+		rc.deliver(data)
+	}
+}
+
+// deliver hands the messages in a frame to the client's handlers.
+func (rc *roomConn) deliver(data []byte) {
+	for _, frame := range splitBatch(data) {
+		var msg Message
+		if err := json.Unmarshal(frame, &msg); err != nil {
+			continue
+		}
+		deliver, missed := rc.track(msg)
+		if missed > 0 {
+			rc.c.gap(rc.name, msg.Seq-missed, msg.Seq-1)
+		}
+		if !deliver {
+			continue
+		}
+		msg.Raw = frame
+		rc.c.dispatch(rc.name, msg)
+	}
+}
+
+// splitBatch returns the messages in a frame. Under load the server may
+// send a JSON array of messages instead of a single object.
+func splitBatch(data []byte) [][]byte {
+	data = bytes.TrimSpace(data)
+	if len(data) == 0 || data[0] != '[' {
+		return [][]byte{data}
+	}
+	var batch []json.RawMessage
+	if err := json.Unmarshal(data, &batch); err != nil {
+		return nil
+	}
+	frames := make([][]byte, len(batch))
+	for i, m := range batch {
+		frames[i] = m
+	}
+	return frames
+}
+
+// track records resume state from msg and reports whether it should be
+// delivered, and how many chat messages before it were missed. Chat messages
+// at or below the last seen sequence number are duplicates replayed after a
+// reconnect. A welcome is delivered only if it carries the room's topic.
+// After a kicked message the room is not reconnected.
+func (rc *roomConn) track(msg Message) (deliver bool, missed int64) {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+
+	switch {
+	case msg.Type == TypeWelcome:
+		rc.resumeToken = msg.ResumeToken
+		if rc.lastSeq == 0 || msg.Seq < rc.lastSeq {
+			// Fresh join, or the server restarted and its sequence
+			// numbers started over: only messages after this are new.
+			rc.lastSeq = msg.Seq
+		}
+		return msg.Topic != "", 0
+	case msg.Type == TypeKicked:
+		rc.closing = true
+	case msg.Type == TypeChat && msg.Seq > 0:
+		if msg.Seq <= rc.lastSeq {
+			return false, 0
+		}
+		missed = msg.Seq - rc.lastSeq - 1
+		rc.lastSeq = msg.Seq
+	}
+	return true, missed
+}
+
+// reconnect redials the room with exponential backoff, resuming the session
+// if the server issued a token. It reports whether the room has a live
+// connection again.
+func (rc *roomConn) reconnect() bool {
+	backoff := rc.c.opts.MinBackoff
+	wait := backoff
+	if rc.urgent.Swap(false) {
+		wait = 0 // the network changed under us; the server is likely fine
+	}
+	for {
+		select {
+		case <-time.After(wait):
+		case <-rc.c.done:
+			return false
+		}
+		if rc.isClosing() {
+			return false
+		}
+
+		if rc.c.opts.Multiplex > 0 {
+			ctx, cancel := context.WithTimeout(context.Background(), rc.c.opts.MaxBackoff)
+			err := rc.joinMux(ctx)
+			cancel()
+			if err == nil {
+				if rc.isClosing() {
+					rc.mux.leave(rc)
+					return false
+				}
+				return true
+			}
+			rc.c.emit(rc.name, StateReconnecting, err)
+			wait = backoff
+			backoff = min(backoff*2, rc.c.opts.MaxBackoff)
+			continue
+		}
+
+		rc.mu.Lock()
+		resume := url.Values{}
+		if rc.resumeToken != "" {
+			resume.Set("resume", rc.resumeToken)
+			resume.Set("since_seq", strconv.FormatInt(rc.lastSeq, 10))
+		}
+		rc.mu.Unlock()
+
+		ctx, cancel := context.WithTimeout(context.Background(), rc.c.opts.MaxBackoff)
+		conn, err := rc.c.dial(ctx, rc.name, resume)
+		cancel()
+		if err == nil {
+			rc.mu.Lock()
+			closing := rc.closing
+			if !closing {
+				rc.conn = conn
+				rc.missed.Store(0)
+			}
+			rc.mu.Unlock()
+			if closing {
+				conn.Close()
+				return false
+			}
+			return true
+		}
+
+		rc.c.emit(rc.name, StateReconnecting, err)
+		wait = backoff
+		backoff *= 2
+		if backoff > rc.c.opts.MaxBackoff {
+			backoff = rc.c.opts.MaxBackoff
+		}
+	}
+}
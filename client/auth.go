@@ -0,0 +1,51 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/hathucanh13/websocket/chatclient"
+)
+
+// loginOptions are the flags for using a registered username.
+type loginOptions struct {
+	passwordFile string
+	signUp       bool
+}
+
+func (o *loginOptions) register(fs *flag.FlagSet) {
+	fs.StringVar(&o.passwordFile, "password-file", "", "file holding the password of a registered username (default: env CHAT_PASSWORD)")
+	fs.BoolVar(&o.signUp, "register", false, "register the username with the password before connecting")
+}
+
+// apply logs opts.Username in, or registers it, when a password is given,
+// and sets opts.Auth to the login token.
+func (o *loginOptions) apply(opts *chatclient.Options) error {
+	password := os.Getenv("CHAT_PASSWORD")
+	if o.passwordFile != "" {
+		data, err := os.ReadFile(o.passwordFile)
+		if err != nil {
+			return err
+		}
+		password = strings.TrimSpace(string(data))
+	}
+	if password == "" {
+		if o.signUp {
+			return errors.New("-register needs a password in -password-file or CHAT_PASSWORD")
+		}
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	login := chatclient.Login
+	if o.signUp {
+		login = chatclient.Register
+	}
+	token, err := login(ctx, *opts, password)
+	opts.Auth = token
+	return err
+}
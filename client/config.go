@@ -0,0 +1,61 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// clientConfig is the optional JSON config file, e.g.
+//
+//	{"aliases": {"/u": "/users", "/brb": "/status away"}, "plugins": ["./autoreply"]}
+//
+// Plugins are described in plugins.go.
+type clientConfig struct {
+	Aliases map[string]string `json:"aliases"`
+	Plugins []string          `json:"plugins"`
+}
+
+// defaultConfigPath returns <user config dir>/chatclient/config.json.
+func defaultConfigPath() string {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(dir, "chatclient", "config.json")
+}
+
+// loadConfig reads the config at path. A missing file is not an error unless
+// the path was given explicitly.
+func loadConfig(path string, explicit bool) (clientConfig, error) {
+	var cfg clientConfig
+	if path == "" {
+		return cfg, nil
+	}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) && !explicit {
+		return cfg, nil
+	}
+	if err != nil {
+		return cfg, err
+	}
+	err = json.Unmarshal(data, &cfg)
+	return cfg, err
+}
+
+// expandAlias replaces a leading alias with its expansion, keeping any
+// arguments typed after it. Expansion happens once; aliases do not nest.
+func (cfg clientConfig) expandAlias(text string) string {
+	name, rest, _ := strings.Cut(text, " ")
+	expansion, ok := cfg.Aliases[name]
+	if !ok {
+		return text
+	}
+	if rest = strings.TrimSpace(rest); rest != "" {
+		return expansion + " " + rest
+	}
+	return expansion
+}
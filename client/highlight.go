@@ -0,0 +1,72 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+const (
+	colorHighlight = "\033[1;33m"
+	colorReset     = "\033[0m"
+)
+
+// highlighter decides which chat messages deserve attention: those mentioning
+// the local username or one of the configured keywords.
+type highlighter struct {
+	username string
+	keywords []string // lower-cased
+	bell     bool
+	color    bool
+}
+
+// hl is the highlighter used when rendering messages.
+var hl highlighter
+
+func newHighlighter(username, keywords string, bell, color bool) highlighter {
+	h := highlighter{
+		username: username,
+		bell:     bell,
+		color:    color,
+	}
+	if username != "" {
+		h.keywords = append(h.keywords, strings.ToLower(username))
+	}
+	for _, k := range strings.Split(keywords, ",") {
+		k = strings.ToLower(strings.TrimSpace(k))
+		if k != "" {
+			h.keywords = append(h.keywords, k)
+		}
+	}
+	return h
+}
+
+// matches reports whether msg should be highlighted. The user's own
+// messages never are.
+func (h highlighter) matches(msg Message) bool {
+	if msg.Type != "chat" || msg.Username == h.username {
+		return false
+	}
+	text := strings.ToLower(msg.Text)
+	for _, k := range h.keywords {
+		if strings.Contains(text, k) {
+			return true
+		}
+	}
+	return false
+}
+
+// render wraps line in the highlight color and rings the bell if enabled.
+func (h highlighter) render(line string) string {
+	if h.color {
+		line = colorHighlight + line + colorReset
+	}
+	if h.bell {
+		line += "\a"
+	}
+	return line
+}
+
+// notify prints a one-line alert for a highlighted message in a background room.
+func (h highlighter) notify(room string, msg Message) {
+	notice("%s\n", h.render(fmt.Sprintf("* %s mentioned you in #%s (/switch %s)", msg.Username, room, room)))
+}
@@ -2,117 +2,213 @@ package main
 
 import (
 	"bufio"
-	"encoding/json"
+	"context"
+	"flag"
 	"fmt"
 	"log"
-	"net/url"
 	"os"
 	"os/signal"
+	"strconv"
 	"strings"
+	"time"
 
-	"github.com/gorilla/websocket"
+	"github.com/hathucanh13/websocket/chatclient"
 )
 
-type Message struct {
-	Type     string `json:"type"`
-	Room     string `json:"room"`
-	Username string `json:"username"`
-	Text     string `json:"text"`
-	Time     string `json:"time"`
-}
+// outputJSON prints every received message as one JSON object per line.
+var outputJSON bool
+
+// defaultServer is the server URL used when -server is not given.
+const defaultServer = "ws://localhost:8080"
+
+type Message = chatclient.Message
+
+// serverHTTP is the server's http(s) base URL, which attachment paths are
+// relative to.
+var serverHTTP string
 
 func main() {
-	if len(os.Args) < 3 {
+	if len(os.Args) > 1 && os.Args[1] == "send" {
+		os.Exit(runSend(os.Args[2:]))
+	}
+
+	server := flag.String("server", defaultServer, "server URL")
+	tenant := flag.String("tenant", "", "tenant to connect to on a multi-tenant server")
+	highlight := flag.String("highlight", "", "comma-separated keywords to highlight besides your username")
+	bell := flag.Bool("bell", false, "ring the terminal bell on highlighted messages")
+	noColor := flag.Bool("no-color", false, "disable colored highlighting")
+	output := flag.String("output", "text", "output format: text or json")
+	pingInterval := flag.Duration("ping-interval", 15*time.Second, "how often to ping the server")
+	maxMissed := flag.Int("max-missed-pongs", 2, "unanswered pings before the connection is declared dead")
+	tcpKeepAlive := flag.Duration("tcp-keepalive", 0, "idle time before TCP keepalive probes; 0 for the system default, negative to disable")
+	networkCheck := flag.Duration("network-check", 2*time.Second, "how often to check for network changes and reconnect; negative to disable")
+	var tlsOpts tlsOptions
+	tlsOpts.register(flag.CommandLine)
+	var loginOpts loginOptions
+	loginOpts.register(flag.CommandLine)
+	var pluginCmds []string
+	flag.Func("plugin", "command to run as a message plugin (repeatable)", func(cmd string) error {
+		pluginCmds = append(pluginCmds, cmd)
+		return nil
+	})
+	configPath := flag.String("config", "", "path to the client config file (default "+defaultConfigPath()+")")
+	flag.Usage = func() {
+		fmt.Fprintln(os.Stderr, "Usage: client [flags] <username> [room]")
+		fmt.Fprintln(os.Stderr, "       client send --room <room> --user <username> --text <message>")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	if flag.NArg() < 1 {
+		flag.Usage()
+		os.Exit(1)
+	}
+
+	switch *output {
+	case "text":
+	case "json":
+		outputJSON = true
+	default:
+		fmt.Fprintf(os.Stderr, "unknown output format %q (want text or json)\n", *output)
 		os.Exit(1)
 	}
 
-	username := os.Args[1]
-	room := os.Args[2]
+	username := flag.Arg(0)
+	if err := tlsOpts.apply(); err != nil {
+		log.Fatal("TLS setup failed:", err)
+	}
+	hl = newHighlighter(username, *highlight, *bell, !*noColor)
+	serverHTTP = strings.TrimSuffix(*server, "/")
+	if rest, ok := strings.CutPrefix(serverHTTP, "ws"); ok {
+		serverHTTP = "http" + rest // ws:// to http://, wss:// to https://
+	}
+
+	path, explicit := *configPath, *configPath != ""
+	if !explicit {
+		path = defaultConfigPath()
+	}
+	cfg, err := loadConfig(path, explicit)
+	if err != nil {
+		log.Fatal("Failed to load config:", err)
+	}
+	plugins, err := startPlugins(append(cfg.Plugins, pluginCmds...))
+	if err != nil {
+		log.Fatal("Failed to start plugins:", err)
+	}
+	defer plugins.stop()
 
-	room = strings.TrimSpace(room)
+	// Without a room, ask for one from the server's directory.
+	scanner := bufio.NewScanner(os.Stdin)
+	room := strings.TrimSpace(flag.Arg(1))
+	if flag.NArg() < 2 && !outputJSON {
+		if room = pickRoom(*tenant, scanner); room == "" {
+			return
+		}
+	}
 	if room == "" {
 		room = "general"
 	}
 
-	// Build WebSocket URL with query parameters
-	u := url.URL{
-		Scheme:   "ws",
-		Host:     "localhost:8080",
-		Path:     "/ws",
-		RawQuery: fmt.Sprintf("username=%s&room=%s", username, room),
+	opts := chatclient.Options{
+		Server:         *server,
+		Username:       username,
+		Tenant:         *tenant,
+		Dialer:         dialer,
+		PingInterval:   *pingInterval,
+		MaxMissedPongs: *maxMissed,
+		TCPKeepAlive:   *tcpKeepAlive,
+		NetworkCheck:   *networkCheck,
 	}
-
-	// Connect to WebSocket server
-	conn, _, err := websocket.DefaultDialer.Dial(u.String(), nil)
+	if err := loginOpts.apply(&opts); err != nil {
+		log.Fatal("Failed to log in:", err)
+	}
+	client, err := chatclient.Connect(context.Background(), opts)
 	if err != nil {
 		log.Fatal("Failed to connect:", err)
 	}
-	defer conn.Close()
+	defer client.Close()
+
+	s := newSession(client, username, plugins)
+	if err := s.join(room); err != nil {
+		log.Fatal("Failed to connect:", err)
+	}
 
-	fmt.Printf("✓ Connected to room '%s' as '%s'\n", room, username)
-	fmt.Println("Type messages and press Enter (Ctrl+C to exit)")
-	fmt.Println("---")
+	if !outputJSON {
+		fmt.Println("Type messages and press Enter (Ctrl+C to exit)")
+		fmt.Println("Rooms: /join <room>, /switch <room>, /leave [room], /rooms")
+		fmt.Println("History: /history [N] from the server, /page [N] to scroll back locally")
+		fmt.Println("---")
+	}
 
 	// Channel for interrupt signal
 	interrupt := make(chan os.Signal, 1)
 	signal.Notify(interrupt, os.Interrupt)
-
-	// Goroutine to read messages from server
-	done := make(chan struct{})
 	go func() {
-		defer close(done)
-		for {
-
-			_, data, err := conn.ReadMessage()
-			if err != nil {
-				log.Println("Connection closed:", err)
-				return
-			}
-
-			var msg Message
-			if err := json.Unmarshal(data, &msg); err != nil {
-				continue
-			}
-
-			// Display message based on type
-			switch msg.Type {
-			case "chat":
-				fmt.Printf("[%s] %s: %s\n", msg.Time, msg.Username, msg.Text)
-			case "system":
-				fmt.Printf("[%s] * %s\n", msg.Time, msg.Text)
-			case "user_list":
-				fmt.Printf("[%s] * Users in room: %s\n", msg.Time, msg.Text)
-			case "stats":
-				fmt.Printf("[%s] * Global statistics: %s\n", msg.Time, msg.Text)
-			case "room":
-				fmt.Printf("[%s] * Available rooms: %s\n", msg.Time, msg.Text)
-			default:
-				// Unknown message type
-			}
-		}
+		<-interrupt
+		client.Close()
+		os.Exit(0)
 	}()
 
 	// Read input from user
-	scanner := bufio.NewScanner(os.Stdin)
 	for scanner.Scan() {
 		text := strings.TrimSpace(scanner.Text())
 		if text == "" {
 			continue
 		}
-
-		// Send as JSON message
-		msg := Message{
-			Text: text,
+		text = cfg.expandAlias(text)
+		if handleLocalCommand(s, text) {
+			continue
 		}
-		data, _ := json.Marshal(msg)
 
-		err := conn.WriteMessage(websocket.TextMessage, data)
-		if err != nil {
+		if err := s.send(text); err != nil {
 			log.Println("Write error:", err)
-			return
 		}
 	}
+}
 
-	// Wait for goroutine to finish
-	<-done
+// handleLocalCommand runs the room-management commands handled by the client
+// itself. It reports whether text was consumed.
+func handleLocalCommand(s *session, text string) bool {
+	fields := strings.Fields(text)
+	arg := ""
+	if len(fields) > 1 {
+		arg = fields[1]
+	}
+
+	switch fields[0] {
+	case "/join":
+		if arg == "" {
+			notice("* Usage: /join <room>\n")
+			return true
+		}
+		if err := s.join(arg); err != nil {
+			log.Println("Failed to join:", err)
+		}
+	case "/switch":
+		if arg == "" {
+			notice("* Usage: /switch <room>\n")
+			return true
+		}
+		s.switchTo(arg)
+	case "/leave":
+		s.leave(arg)
+	case "/page":
+		page := 1
+		if arg != "" {
+			n, err := strconv.Atoi(arg)
+			if err != nil {
+				notice("* Usage: /page [N]\n")
+				return true
+			}
+			page = n
+		}
+		s.showPage(page)
+	case "/rooms":
+		// Show joined rooms, then let the server list every room.
+		s.listRooms()
+		return false
+	default:
+		return false
+	}
+	return true
 }
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// roomEntry is a room in the server's directory.
+type roomEntry struct {
+	Name    string `json:"name"`
+	Members int    `json:"members"`
+	Topic   string `json:"topic"`
+}
+
+// fetchDirectory lists the server's rooms from GET /api/rooms.
+func fetchDirectory(tenant string) ([]roomEntry, error) {
+	u := serverHTTP + "/api/rooms"
+	if tenant != "" {
+		u += "?tenant=" + url.QueryEscape(tenant)
+	}
+	hc := &http.Client{
+		Transport: &http.Transport{TLSClientConfig: dialer.TLSClientConfig},
+		Timeout:   10 * time.Second,
+	}
+	resp, err := hc.Get(u)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s: %s", u, resp.Status)
+	}
+	var rooms []roomEntry
+	err = json.NewDecoder(resp.Body).Decode(&rooms)
+	return rooms, err
+}
+
+// pickRoom shows the server's rooms and asks which to join, by number or
+// by name; a name not listed creates that room. An empty answer joins
+// general.
+func pickRoom(tenant string, in *bufio.Scanner) string {
+	rooms, err := fetchDirectory(tenant)
+	if err != nil {
+		fmt.Printf("* Could not list rooms: %v\n", err)
+	}
+	if len(rooms) > 0 {
+		fmt.Println("Rooms:")
+		width := 0
+		for _, r := range rooms {
+			width = max(width, len(r.Name))
+		}
+		for i, r := range rooms {
+			members := fmt.Sprintf("%d members", r.Members)
+			if r.Members == 1 {
+				members = "1 member"
+			}
+			line := fmt.Sprintf("%3d) #%-*s  %-11s", i+1, width, r.Name, members)
+			if r.Topic != "" {
+				line += "  " + r.Topic
+			}
+			fmt.Println(strings.TrimRight(line, " "))
+		}
+	}
+	for {
+		fmt.Print("Join room (number or name, Enter for general): ")
+		if !in.Scan() {
+			return ""
+		}
+		answer := strings.TrimSpace(in.Text())
+		if answer == "" {
+			return "general"
+		}
+		n, err := strconv.Atoi(answer)
+		if err != nil {
+			return strings.TrimPrefix(answer, "#")
+		}
+		if n >= 1 && n <= len(rooms) {
+			return rooms[n-1].Name
+		}
+		fmt.Printf("* No room %d\n", n)
+	}
+}
@@ -0,0 +1,222 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Plugins extend the client without forking it. A plugin is any program
+// that reads events on stdin and answers each with one line on stdout, both
+// as JSON. Plugins are started with -plugin, which may be repeated, or
+// listed in the config file:
+//
+//	{"plugins": ["python3 /home/me/.config/chatclient/autoreply.py"]}
+//
+// For every message received, before it is shown, the client sends
+//
+//	{"hook": "incoming", "self": "alice", "room": "general", "message": {...}}
+//
+// and for every line sent to the server
+//
+//	{"hook": "outgoing", "self": "alice", "room": "general", "text": "..."}
+//
+// The plugin answers {} to leave the event alone, {"drop": true} to swallow
+// it, or {"message": {...}} or {"text": "..."} to replace it, and may add
+// {"send": ["..."]} to post messages to the event's room, which are not
+// passed through the outgoing hooks, and {"notice": "..."} to print a line
+// locally. Plugins run in the order given, each seeing the previous one's
+// result. A plugin that exits, or takes longer than pluginTimeout to answer,
+// is stopped and skipped from then on.
+
+const pluginTimeout = 2 * time.Second
+
+type pluginEvent struct {
+	Hook    string   `json:"hook"` // "incoming" or "outgoing"
+	Self    string   `json:"self"`
+	Room    string   `json:"room"`
+	Message *Message `json:"message,omitempty"`
+	Text    *string  `json:"text,omitempty"`
+}
+
+type pluginReply struct {
+	Drop    bool     `json:"drop"`
+	Message *Message `json:"message"`
+	Text    *string  `json:"text"`
+	Send    []string `json:"send"`
+	Notice  string   `json:"notice"`
+}
+
+// plugin is one running plugin process. Events are sent to it one at a
+// time.
+type plugin struct {
+	command string
+
+	mu      sync.Mutex
+	cmd     *exec.Cmd
+	stdin   io.WriteCloser
+	replies chan []byte // lines from stdout; closed when it exits
+	dead    bool
+}
+
+func startPlugin(command string) (*plugin, error) {
+	args := strings.Fields(command)
+	if len(args) == 0 {
+		return nil, errors.New("empty plugin command")
+	}
+	cmd := exec.Command(args[0], args[1:]...)
+	cmd.Stderr = os.Stderr
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+	p := &plugin{command: command, cmd: cmd, stdin: stdin, replies: make(chan []byte)}
+	go func() {
+		defer close(p.replies)
+		scanner := bufio.NewScanner(stdout)
+		scanner.Buffer(nil, 1<<20)
+		for scanner.Scan() {
+			p.replies <- append([]byte(nil), scanner.Bytes()...)
+		}
+	}()
+	return p, nil
+}
+
+// call sends ev to the plugin and returns its answer. It reports false, and
+// stops the plugin, if the plugin fails to answer.
+func (p *plugin) call(ev pluginEvent) (pluginReply, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.dead {
+		return pluginReply{}, false
+	}
+	data, _ := json.Marshal(ev)
+	var reply pluginReply
+	var err error
+	if _, err = p.stdin.Write(append(data, '\n')); err == nil {
+		select {
+		case line, ok := <-p.replies:
+			switch {
+			case !ok:
+				err = errors.New("exited")
+			default:
+				if jerr := json.Unmarshal(line, &reply); jerr != nil {
+					err = fmt.Errorf("invalid reply: %w", jerr)
+				}
+			}
+		case <-time.After(pluginTimeout):
+			err = fmt.Errorf("no reply within %s", pluginTimeout)
+		}
+	}
+	if err != nil {
+		p.stopLocked()
+		notice("* Plugin %q stopped: %v\n", p.command, err)
+		return pluginReply{}, false
+	}
+	return reply, true
+}
+
+func (p *plugin) stop() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.stopLocked()
+}
+
+func (p *plugin) stopLocked() {
+	if p.dead {
+		return
+	}
+	p.dead = true
+	p.stdin.Close()
+	p.cmd.Process.Kill()
+	go p.cmd.Wait()
+}
+
+// pluginChain runs events through the plugins in order.
+type pluginChain []*plugin
+
+// startPlugins starts every command, stopping those already started if one
+// fails.
+func startPlugins(commands []string) (pluginChain, error) {
+	var chain pluginChain
+	for _, command := range commands {
+		p, err := startPlugin(command)
+		if err != nil {
+			chain.stop()
+			return nil, fmt.Errorf("plugin %q: %w", command, err)
+		}
+		chain = append(chain, p)
+	}
+	return chain, nil
+}
+
+func (c pluginChain) stop() {
+	for _, p := range c {
+		p.stop()
+	}
+}
+
+// incoming passes a received message through the plugins. It returns the
+// message to show, false if a plugin dropped it, and the messages plugins
+// asked to send.
+func (c pluginChain) incoming(self string, msg Message) (Message, bool, []string) {
+	var send []string
+	for _, p := range c {
+		m := msg
+		reply, ok := p.call(pluginEvent{Hook: "incoming", Self: self, Room: msg.Room, Message: &m})
+		if !ok {
+			continue
+		}
+		send = append(send, reply.Send...)
+		if reply.Notice != "" {
+			notice("* %s\n", reply.Notice)
+		}
+		if reply.Drop {
+			return msg, false, send
+		}
+		if reply.Message != nil {
+			msg = *reply.Message
+			msg.Raw, _ = json.Marshal(msg)
+		}
+	}
+	return msg, true, send
+}
+
+// outgoing passes text about to be sent to room through the plugins. It
+// returns the text to send, false if a plugin dropped it, and the messages
+// plugins asked to send besides.
+func (c pluginChain) outgoing(self, room, text string) (string, bool, []string) {
+	var send []string
+	for _, p := range c {
+		t := text
+		reply, ok := p.call(pluginEvent{Hook: "outgoing", Self: self, Room: room, Text: &t})
+		if !ok {
+			continue
+		}
+		send = append(send, reply.Send...)
+		if reply.Notice != "" {
+			notice("* %s\n", reply.Notice)
+		}
+		if reply.Drop {
+			return text, false, send
+		}
+		if reply.Text != nil {
+			text = *reply.Text
+		}
+	}
+	return text, true, send
+}
@@ -0,0 +1,607 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/hathucanh13/websocket/chatclient"
+)
+
+// maxBuffered caps how many messages are kept for a background room.
+const maxBuffered = 200
+
+// roomView is the on-screen state of one joined room.
+type roomView struct {
+	name   string
+	unread int
+	buffer []Message
+	scroll scrollback
+
+	connected bool // seen the first StateConnected
+}
+
+// session tracks all joined rooms and which one is rendered on screen. The
+// connections themselves are managed by the chatclient SDK.
+type session struct {
+	client   *chatclient.Client
+	username string
+
+	mu       sync.Mutex
+	rooms    map[string]*roomView
+	order    []string
+	active   string
+	mentions map[string]bool // IDs of messages already announced as mentions
+	plugins  pluginChain
+}
+
+func newSession(client *chatclient.Client, username string, plugins pluginChain) *session {
+	s := &session{
+		client:   client,
+		username: username,
+		plugins:  plugins,
+		rooms:    make(map[string]*roomView),
+		mentions: make(map[string]bool),
+	}
+	client.OnMessage(s.receive)
+	client.OnStateChange(s.stateChanged)
+	return s
+}
+
+// join connects to room and makes it the active room.
+func (s *session) join(room string) error {
+	room = strings.TrimSpace(room)
+	if room == "" {
+		return fmt.Errorf("room name required")
+	}
+
+	s.mu.Lock()
+	if _, ok := s.rooms[room]; ok {
+		s.mu.Unlock()
+		s.switchTo(room)
+		return nil
+	}
+	rv := &roomView{name: room}
+	s.rooms[room] = rv
+	s.order = append(s.order, room)
+	s.active = room
+	s.mu.Unlock()
+
+	if err := s.client.Join(context.Background(), room); err != nil {
+		s.remove(room, false)
+		return err
+	}
+	notice("✓ Connected to room '%s' as '%s'\n", room, s.username)
+	return nil
+}
+
+// leave disconnects from room; an empty name leaves the active room.
+func (s *session) leave(room string) {
+	s.mu.Lock()
+	if room == "" {
+		room = s.active
+	}
+	s.mu.Unlock()
+	if err := s.client.Leave(room); err != nil {
+		notice("* Not in room '%s'\n", room)
+	}
+}
+
+// switchTo makes room active and flushes what was buffered while it was in
+// the background.
+func (s *session) switchTo(room string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	rv, ok := s.rooms[room]
+	if !ok {
+		notice("* Not in room '%s' (use /join %s)\n", room, room)
+		return
+	}
+	s.activate(rv)
+}
+
+// activate renders rv and replays its buffer. Callers must hold s.mu.
+func (s *session) activate(rv *roomView) {
+	s.active = rv.name
+	notice("--- #%s (%d unread) ---\n", rv.name, rv.unread)
+	for _, msg := range rv.buffer {
+		printMessage(msg)
+	}
+	for i := len(rv.buffer) - 1; i >= 0; i-- {
+		if s.receipted(rv.buffer[i]) {
+			s.markRead(rv.buffer[i])
+			break
+		}
+	}
+	rv.buffer = nil
+	rv.unread = 0
+}
+
+// listRooms prints joined rooms with their unread badges.
+func (s *session) listRooms() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if len(s.order) == 0 {
+		notice("* No rooms joined (use /join <room>)\n")
+		return
+	}
+	notice("* Joined rooms:\n")
+	for _, name := range s.order {
+		rv := s.rooms[name]
+		marker := " "
+		if name == s.active {
+			marker = ">"
+		}
+		badge := ""
+		if rv.unread > 0 {
+			badge = fmt.Sprintf(" [%d unread]", rv.unread)
+		}
+		notice("  %s #%s%s\n", marker, name, badge)
+	}
+}
+
+// send writes text to the active room.
+func (s *session) send(text string) error {
+	s.mu.Lock()
+	active := s.active
+	s.mu.Unlock()
+	if active == "" {
+		return fmt.Errorf("no active room (use /join <room>)")
+	}
+	text, keep, extra := s.plugins.outgoing(s.username, active, text)
+	s.post(active, extra)
+	if !keep {
+		return nil
+	}
+	return s.client.Post(active, text)
+}
+
+// post sends the messages plugins asked for to room.
+func (s *session) post(room string, texts []string) {
+	for _, text := range texts {
+		if err := s.client.Post(room, text); err != nil {
+			log.Println("Write error:", err)
+		}
+	}
+}
+
+// showPage prints one page of the active room's scrollback.
+func (s *session) showPage(page int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	rv, ok := s.rooms[s.active]
+	if !ok {
+		notice("* No active room\n")
+		return
+	}
+	msgs, pages := rv.scroll.page(page)
+	if msgs == nil {
+		notice("* No page %d (#%s has %d pages)\n", page, rv.name, pages)
+		return
+	}
+	notice("--- #%s scrollback, page %d of %d ---\n", rv.name, page, pages)
+	for _, msg := range msgs {
+		printMessage(msg)
+	}
+	notice("--- end of page ---\n")
+}
+
+// receive is the SDK message handler.
+func (s *session) receive(msg Message) {
+	msg, keep, extra := s.plugins.incoming(s.username, msg)
+	s.post(msg.Room, extra)
+	if !keep {
+		return
+	}
+	s.acknowledge(msg)
+	if outputJSON {
+		printJSON(msg.Raw)
+		return
+	}
+
+	if msg.Type == chatclient.TypeMention {
+		s.mention(msg)
+		return
+	}
+
+	s.mu.Lock()
+	rv, ok := s.rooms[msg.Room]
+	s.mu.Unlock()
+	if !ok {
+		return
+	}
+	switch msg.Type {
+	case chatclient.TypeRedacted:
+		s.redact(rv, msg)
+	case chatclient.TypeReceipt:
+		s.receipt(rv, msg)
+	default:
+		s.deliver(rv, msg)
+	}
+}
+
+// receipted reports whether msg is chat from another user, whose author
+// may get receipts for it.
+func (s *session) receipted(msg Message) bool {
+	return msg.Type == chatclient.TypeChat && msg.Seq > 0 && msg.Username != s.username && !msg.Integration
+}
+
+// acknowledge tells the server a chat message from someone else arrived.
+func (s *session) acknowledge(msg Message) {
+	if s.receipted(msg) {
+		s.client.MarkDelivered(msg.Room, msg.Seq)
+	}
+}
+
+// receipt shows that someone read the user's messages, if their room is on
+// screen. Delivered receipts are not shown; read ones follow soon enough.
+func (s *session) receipt(rv *roomView, msg Message) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if msg.Text == chatclient.ReceiptRead && rv.name == s.active {
+		printMessage(msg)
+	}
+}
+
+// markRead tells the server the user has seen msg, if it is chat from
+// someone else.
+func (s *session) markRead(msg Message) {
+	if s.receipted(msg) {
+		s.client.MarkRead(msg.Room, msg.Seq)
+	}
+}
+
+// mention announces a message that mentioned the user, unless it is already
+// on screen or highlighted. The server sends a mention on every connection,
+// so one arrives per joined room.
+func (s *session) mention(msg Message) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.mentions[msg.ID] {
+		return
+	}
+	if len(s.mentions) >= maxBuffered {
+		clear(s.mentions)
+	}
+	s.mentions[msg.ID] = true
+
+	_, joined := s.rooms[msg.Room]
+	chat := msg
+	chat.Type = chatclient.TypeChat
+	if msg.Room == s.active || (joined && hl.matches(chat)) {
+		return
+	}
+	who := "you"
+	if msg.Group != "" {
+		who = "@" + msg.Group
+	}
+	hint := "/switch " + msg.Room
+	if !joined {
+		hint = "/join " + msg.Room
+	}
+	notice("%s\n", hl.render(fmt.Sprintf("* %s mentioned %s in #%s: %s (%s)", msg.Username, who, msg.Room, msg.Text, hint)))
+}
+
+// redact blanks a redacted message wherever the client still holds it, so
+// /page and buffered output no longer show the original text.
+func (s *session) redact(rv *roomView, msg Message) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	rv.scroll.redact(msg.ID, msg.Text)
+	for i := range rv.buffer {
+		if rv.buffer[i].ID == msg.ID {
+			rv.buffer[i].Text = msg.Text
+			rv.buffer[i].Redacted = true
+		}
+	}
+	if rv.name == s.active {
+		fmt.Printf("[%s] * A message was redacted by a moderator\n", msg.Time)
+	}
+}
+
+// stateChanged reports connection changes from the SDK.
+func (s *session) stateChanged(room string, state chatclient.State, err error) {
+	switch state {
+	case chatclient.StateReconnecting:
+		switch err {
+		case chatclient.ErrNoPong:
+			notice("* No pong from server for #%s, connection is dead\n", room)
+		case chatclient.ErrNetworkChanged:
+			notice("* Network changed, reconnecting #%s\n", room)
+		}
+		log.Printf("Connection to room '%s' lost: %v (reconnecting)", room, err)
+	case chatclient.StateConnected:
+		s.mu.Lock()
+		rv, ok := s.rooms[room]
+		rejoined := ok && rv.connected
+		if ok {
+			rv.connected = true
+		}
+		s.mu.Unlock()
+		if rejoined {
+			notice("✓ Reconnected to room '%s'\n", room)
+		}
+	case chatclient.StateClosed:
+		s.remove(room, true)
+	}
+}
+
+// deliver renders msg if its room is active, otherwise buffers it and bumps
+// the room's unread badge.
+func (s *session) deliver(rv *roomView, msg Message) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if msg.Type != "history" {
+		rv.scroll.add(msg)
+	}
+	if rv.name == s.active {
+		printMessage(msg)
+		s.markRead(msg)
+		return
+	}
+
+	rv.buffer = append(rv.buffer, msg)
+	if len(rv.buffer) > maxBuffered {
+		rv.buffer = rv.buffer[len(rv.buffer)-maxBuffered:]
+	}
+	rv.unread++
+	if hl.matches(msg) {
+		hl.notify(rv.name, msg)
+	} else if rv.unread == 1 {
+		notice("* New messages in #%s (/switch %s)\n", rv.name, rv.name)
+	}
+}
+
+func (s *session) remove(room string, announce bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.rooms[room]; !ok {
+		return
+	}
+	delete(s.rooms, room)
+	for i, name := range s.order {
+		if name == room {
+			s.order = append(s.order[:i], s.order[i+1:]...)
+			break
+		}
+	}
+	if announce {
+		notice("* Left room '%s'\n", room)
+	}
+
+	if s.active != room {
+		return
+	}
+	s.active = ""
+	if len(s.order) > 0 {
+		s.activate(s.rooms[s.order[len(s.order)-1]])
+	}
+}
+
+// notice prints client status output. In JSON mode it goes to stderr so
+// stdout carries nothing but messages.
+func notice(format string, a ...any) {
+	if outputJSON {
+		fmt.Fprintf(os.Stderr, format, a...)
+		return
+	}
+	fmt.Printf(format, a...)
+}
+
+// printJSON writes one received frame as a single line of JSON.
+func printJSON(data []byte) {
+	var buf bytes.Buffer
+	if err := json.Compact(&buf, data); err != nil {
+		return
+	}
+	buf.WriteByte('\n')
+	os.Stdout.Write(buf.Bytes())
+}
+
+// printMessage displays a message based on its type.
+func printMessage(msg Message) {
+	switch msg.Type {
+	case "chat":
+		author := msg.Username
+		if msg.Integration {
+			author += " [bot]"
+		} else if msg.Unverified {
+			author += " [unverified]"
+		}
+		if msg.Unsaved {
+			author += " [unsaved]"
+		}
+		line := fmt.Sprintf("[%s] %s: %s", msg.Time, author, msg.Text)
+		if a := msg.Attachment; a != nil && a.Type == "audio" {
+			d := time.Duration(a.Duration * float64(time.Second)).Round(time.Second)
+			line = fmt.Sprintf("[%s] %s: [voice clip %d:%02d] %s%s", msg.Time, author, int(d.Minutes()), int(d.Seconds())%60, serverHTTP, a.URL)
+		}
+		if f := msg.Forwarded; f != nil {
+			line += fmt.Sprintf(" (↪ forwarded from %s in #%s, %s)", f.Author, f.Room, f.ID)
+		}
+		if hl.matches(msg) {
+			line = hl.render(line)
+		}
+		fmt.Println(line)
+	case "system":
+		fmt.Printf("[%s] * %s\n", msg.Time, msg.Text)
+	case "error":
+		fmt.Printf("[%s] ! %s\n", msg.Time, msg.Text)
+	case "annotation":
+		for _, a := range msg.Annotations {
+			fmt.Printf("[%s] * %s annotated %s: %s %s\n", msg.Time, msg.Username, msg.ID, a.Kind, a.Data)
+		}
+	case "welcome":
+		if msg.Topic != "" {
+			fmt.Printf("[%s] * Topic: %s\n", msg.Time, msg.Topic)
+		}
+	case "user_joined":
+		fmt.Printf("[%s] * %s joined the room\n", msg.Time, msg.Username)
+	case "user_left":
+		fmt.Printf("[%s] * %s left the room\n", msg.Time, msg.Username)
+	case "topic_changed":
+		if msg.Topic == "" {
+			fmt.Printf("[%s] * The topic was cleared\n", msg.Time)
+		} else {
+			fmt.Printf("[%s] * Topic: %s\n", msg.Time, msg.Topic)
+		}
+	case "direct":
+		fmt.Printf("[%s] %s (to you):\n", msg.Time, msg.Username)
+		for _, line := range strings.Split(msg.Text, "\n") {
+			fmt.Println("    " + line)
+		}
+	case "kicked":
+		fmt.Printf("[%s] * Disconnected by a moderator: %s\n", msg.Time, msg.Text)
+	case "history_mode":
+		switch {
+		case msg.Username != "" && msg.Text == "off":
+			fmt.Printf("[%s] * %s went incognito: their messages are not saved\n", msg.Time, msg.Username)
+		case msg.Username != "":
+			fmt.Printf("[%s] * %s's messages are saved again\n", msg.Time, msg.Username)
+		case msg.Text == "off":
+			fmt.Printf("[%s] * History is off in #%s: messages are not saved\n", msg.Time, msg.Room)
+		default:
+			fmt.Printf("[%s] * History is on in #%s: messages are saved\n", msg.Time, msg.Room)
+		}
+	case "receipt":
+		fmt.Printf("[%s] * Seen by %s (up to %s)\n", msg.Time, msg.Username, msg.ID)
+	case "user_list":
+		fmt.Printf("[%s] * Users in room: %s\n", msg.Time, msg.Text)
+	case "stats":
+		fmt.Printf("[%s] * Global statistics: %s\n", msg.Time, msg.Text)
+	case "room":
+		fmt.Printf("[%s] * Available rooms: %s\n", msg.Time, msg.Text)
+	case "groups":
+		var groups map[string][]string
+		if err := json.Unmarshal([]byte(msg.Text), &groups); err != nil {
+			return
+		}
+		if len(groups) == 0 {
+			fmt.Printf("[%s] * No groups defined\n", msg.Time)
+			return
+		}
+		names := make([]string, 0, len(groups))
+		for name := range groups {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		fmt.Printf("[%s] * Groups:\n", msg.Time)
+		for _, name := range names {
+			fmt.Printf("    @%s: %s\n", name, strings.Join(groups[name], ", "))
+		}
+	case "pinned":
+		var p struct {
+			Author string `json:"author"`
+			Text   string `json:"text"`
+		}
+		json.Unmarshal([]byte(msg.Text), &p)
+		fmt.Printf("[%s] * %s pinned %s's message %s: %s\n", msg.Time, msg.Username, p.Author, msg.ID, p.Text)
+	case "unpinned":
+		if msg.Text == "expired" {
+			fmt.Printf("[%s] * The pin of message %s expired\n", msg.Time, msg.ID)
+		} else {
+			fmt.Printf("[%s] * %s unpinned message %s\n", msg.Time, msg.Username, msg.ID)
+		}
+	case "pins":
+		var pins []struct {
+			ID     string `json:"id"`
+			Author string `json:"author"`
+			Text   string `json:"text"`
+		}
+		if err := json.Unmarshal([]byte(msg.Text), &pins); err != nil {
+			return
+		}
+		if len(pins) == 0 {
+			fmt.Printf("[%s] * No pinned messages in #%s\n", msg.Time, msg.Room)
+			return
+		}
+		fmt.Printf("[%s] * Pinned in #%s:\n", msg.Time, msg.Room)
+		for _, p := range pins {
+			fmt.Printf("    %s %s: %s\n", p.ID, p.Author, p.Text)
+		}
+	case "quality":
+		var reports []struct {
+			Username  string `json:"username"`
+			Quality   string `json:"quality"`
+			RTTMillis int64  `json:"rtt_ms"`
+			Stalls    int64  `json:"stalls"`
+			Drops     int64  `json:"drops"`
+		}
+		if err := json.Unmarshal([]byte(msg.Text), &reports); err != nil {
+			return
+		}
+		fmt.Printf("[%s] * Connection quality in #%s:\n", msg.Time, msg.Room)
+		for _, r := range reports {
+			line := fmt.Sprintf("    %-16s %-7s", r.Username, r.Quality)
+			if r.RTTMillis > 0 {
+				line += fmt.Sprintf(" %5d ms", r.RTTMillis)
+			}
+			if r.Stalls > 0 {
+				line += fmt.Sprintf(", %d stalls", r.Stalls)
+			}
+			if r.Drops > 0 {
+				line += fmt.Sprintf(", %d dropped", r.Drops)
+			}
+			fmt.Println(strings.TrimRight(line, " "))
+		}
+	case "digest":
+		var d struct {
+			Messages int `json:"messages"`
+			TopUsers []struct {
+				Name  string `json:"name"`
+				Count int    `json:"count"`
+			} `json:"top_users"`
+			TopLinks []struct {
+				Name  string `json:"name"`
+				Count int    `json:"count"`
+			} `json:"top_links"`
+		}
+		if err := json.Unmarshal([]byte(msg.Text), &d); err != nil {
+			return
+		}
+		fmt.Printf("[%s] * Digest of #%s: %d messages\n", msg.Time, msg.Room, d.Messages)
+		for _, u := range d.TopUsers {
+			fmt.Printf("    %-20s %d messages\n", u.Name, u.Count)
+		}
+		for _, l := range d.TopLinks {
+			fmt.Printf("    %s (%d)\n", l.Name, l.Count)
+		}
+	case "prefs":
+		var p struct {
+			MentionsOnly bool     `json:"mentions_only"`
+			MutedRooms   []string `json:"muted_rooms"`
+		}
+		if err := json.Unmarshal([]byte(msg.Text), &p); err != nil {
+			return
+		}
+		fmt.Printf("[%s] * Notification preferences:\n", msg.Time)
+		fmt.Printf("    mentions only: %v\n    muted rooms:   %s\n",
+			p.MentionsOnly, strings.Join(p.MutedRooms, ", "))
+	case "history":
+		var entries []Message
+		if err := json.Unmarshal([]byte(msg.Text), &entries); err != nil {
+			return
+		}
+		fmt.Printf("--- last %d messages in #%s ---\n", len(entries), msg.Room)
+		for _, entry := range entries {
+			printMessage(entry)
+		}
+		fmt.Println("--- end of history ---")
+	default:
+		// Unknown message type
+	}
+}
@@ -0,0 +1,54 @@
+package main
+
+const (
+	// scrollbackSize is how many messages each room keeps for /page.
+	scrollbackSize = 1000
+	// pageSize is how many messages one /page shows.
+	pageSize = 20
+)
+
+// scrollback is a fixed-size ring buffer of displayed messages.
+type scrollback struct {
+	lines []Message
+	start int // index of the oldest entry once the ring is full
+}
+
+func (sb *scrollback) add(msg Message) {
+	if len(sb.lines) < scrollbackSize {
+		sb.lines = append(sb.lines, msg)
+		return
+	}
+	sb.lines[sb.start] = msg
+	sb.start = (sb.start + 1) % scrollbackSize
+}
+
+// redact replaces the text of the message with the given ID.
+func (sb *scrollback) redact(id, text string) {
+	for i := range sb.lines {
+		if sb.lines[i].ID == id {
+			sb.lines[i].Text = text
+			sb.lines[i].Redacted = true
+		}
+	}
+}
+
+// page returns the page-th block of pageSize messages counting back from the
+// newest (page 1 is the most recent), oldest first, and the number of pages.
+func (sb *scrollback) page(page int) ([]Message, int) {
+	total := len(sb.lines)
+	pages := (total + pageSize - 1) / pageSize
+	if page < 1 || page > pages {
+		return nil, pages
+	}
+
+	end := total - (page-1)*pageSize
+	begin := end - pageSize
+	if begin < 0 {
+		begin = 0
+	}
+	out := make([]Message, 0, end-begin)
+	for i := begin; i < end; i++ {
+		out = append(out, sb.lines[(sb.start+i)%len(sb.lines)])
+	}
+	return out, pages
+}
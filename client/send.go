@@ -0,0 +1,67 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/hathucanh13/websocket/chatclient"
+)
+
+// runSend implements `client send`: connect, post one message, wait for the
+// server's ack and exit. It returns the process exit code: 0 when the message
+// was acknowledged, 1 on connection or delivery failure, 2 on bad usage.
+func runSend(args []string) int {
+	fs := flag.NewFlagSet("send", flag.ContinueOnError)
+	server := fs.String("server", defaultServer, "server URL")
+	tenant := fs.String("tenant", "", "tenant to connect to on a multi-tenant server")
+	room := fs.String("room", "", "room to post into")
+	user := fs.String("user", "", "username to post as")
+	text := fs.String("text", "", "message text")
+	timeout := fs.Duration("timeout", 10*time.Second, "how long to wait for the ack")
+	var tlsOpts tlsOptions
+	tlsOpts.register(fs)
+	var loginOpts loginOptions
+	loginOpts.register(fs)
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if err := tlsOpts.apply(); err != nil {
+		fmt.Fprintln(os.Stderr, "send:", err)
+		return 2
+	}
+	if *room == "" || *user == "" || *text == "" {
+		fmt.Fprintln(os.Stderr, "send: --room, --user and --text are required")
+		fs.Usage()
+		return 2
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), *timeout)
+	defer cancel()
+
+	opts := chatclient.Options{
+		Server:   *server,
+		Username: *user,
+		Rooms:    []string{*room},
+		Tenant:   *tenant,
+		Dialer:   dialer,
+	}
+	if err := loginOpts.apply(&opts); err != nil {
+		fmt.Fprintln(os.Stderr, "send: failed to log in:", err)
+		return 1
+	}
+	client, err := chatclient.Connect(ctx, opts)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "send: failed to connect:", err)
+		return 1
+	}
+	defer client.Close()
+
+	if _, err := client.Send(ctx, *room, *text); err != nil {
+		fmt.Fprintln(os.Stderr, "send: not delivered:", err)
+		return 1
+	}
+	return 0
+}
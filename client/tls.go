@@ -0,0 +1,99 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/gorilla/websocket"
+)
+
+// dialer is used for every connection; TLS options replace it at startup.
+var dialer = websocket.DefaultDialer
+
+// tlsOptions are the flags controlling how wss:// servers are verified.
+type tlsOptions struct {
+	caCert string
+	pins   string
+}
+
+func (o *tlsOptions) register(fs *flag.FlagSet) {
+	fs.StringVar(&o.caCert, "ca-cert", "", "PEM file with CA certificates to trust instead of the system roots")
+	fs.StringVar(&o.pins, "pin-sha256", "", "comma-separated SHA-256 pins (base64 or hex) of the server's public key; the chain must contain one")
+}
+
+// apply installs a dialer configured with the options.
+func (o *tlsOptions) apply() error {
+	if o.caCert == "" && o.pins == "" {
+		return nil
+	}
+
+	tlsConfig := &tls.Config{MinVersion: tls.VersionTLS12}
+	if o.caCert != "" {
+		pem, err := os.ReadFile(o.caCert)
+		if err != nil {
+			return fmt.Errorf("reading CA cert: %w", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return fmt.Errorf("no certificates found in %s", o.caCert)
+		}
+		tlsConfig.RootCAs = pool
+	}
+	if o.pins != "" {
+		pins, err := parsePins(o.pins)
+		if err != nil {
+			return err
+		}
+		tlsConfig.VerifyConnection = func(cs tls.ConnectionState) error {
+			return checkPins(cs.PeerCertificates, pins)
+		}
+	}
+
+	d := *websocket.DefaultDialer
+	d.TLSClientConfig = tlsConfig
+	dialer = &d
+	return nil
+}
+
+// parsePins decodes the SHA-256 digests given on the command line.
+func parsePins(s string) ([][]byte, error) {
+	var pins [][]byte
+	for _, p := range strings.Split(s, ",") {
+		p = strings.TrimPrefix(strings.TrimSpace(p), "sha256//")
+		if p == "" {
+			continue
+		}
+		pin, err := hex.DecodeString(p)
+		if err != nil {
+			pin, err = base64.StdEncoding.DecodeString(p)
+		}
+		if err != nil || len(pin) != sha256.Size {
+			return nil, fmt.Errorf("invalid pin %q: want a SHA-256 digest in base64 or hex", p)
+		}
+		pins = append(pins, pin)
+	}
+	return pins, nil
+}
+
+// checkPins accepts the connection if any certificate in the chain has a
+// public key whose SHA-256 matches a pin. Normal chain verification has
+// already run by the time this is called.
+func checkPins(certs []*x509.Certificate, pins [][]byte) error {
+	for _, cert := range certs {
+		sum := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+		for _, pin := range pins {
+			if string(sum[:]) == string(pin) {
+				return nil
+			}
+		}
+	}
+	return errors.New("server public key does not match any pinned key")
+}
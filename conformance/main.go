@@ -0,0 +1,723 @@
+// Command conformance checks that a running chat server speaks the
+// protocol: it connects as a handful of clients and exercises the
+// handshake and its errors, joining, presence, chat broadcast, acks,
+// sequence numbers, the slash commands, resuming, pings and close codes,
+// and reports pass, fail or skip for each capability. It is meant for
+// validating other server implementations, and this one across backends.
+//
+//	conformance [-server URL] [-token TOKEN] [-tenant NAME] [-timeout 5s] [-run REGEXP] [-json]
+//
+// The run exits 1 if any check fails. The token is the server's
+// -admin-token; with it the kick check also runs. Every check uses its own
+// users and a room named conformance-<random>, so other traffic does not
+// disturb it, and solves a proof of work if the server asks for one. If
+// the server sets -rate-limit, it must allow at least a few messages per
+// second.
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"math/bits"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+type config struct {
+	server  string
+	token   string
+	tenant  string
+	timeout time.Duration
+}
+
+// message is one frame of the protocol.
+type message struct {
+	Type        string `json:"type"`
+	Room        string `json:"room"`
+	Username    string `json:"username"`
+	Text        string `json:"text"`
+	Time        string `json:"time"`
+	ID          string `json:"id,omitempty"`
+	Ref         string `json:"ref,omitempty"`
+	Seq         int64  `json:"seq,omitempty"`
+	ResumeToken string `json:"resume_token,omitempty"`
+}
+
+// check is one capability under test. run returns nil if the server
+// conforms, or a skip to say the check could not run.
+type check struct {
+	name string
+	run  func(s *suite) error
+}
+
+type skip string
+
+func (s skip) Error() string { return string(s) }
+
+// result is one check's outcome as reported.
+type result struct {
+	Check    string        `json:"check"`
+	Status   string        `json:"status"` // pass, fail or skip
+	Detail   string        `json:"detail,omitempty"`
+	Duration time.Duration `json:"duration_ns"`
+}
+
+var checks = []check{
+	{"handshake-errors", checkHandshakeErrors},
+	{"join", checkJoin},
+	{"presence", checkPresence},
+	{"chat", checkChat},
+	{"ack", checkAck},
+	{"sequence", checkSequence},
+	{"command-users", checkUsers},
+	{"command-stats", checkStats},
+	{"command-rooms", checkRooms},
+	{"command-history", checkHistory},
+	{"unknown-command", checkUnknownCommand},
+	{"resume", checkResume},
+	{"ping", checkPing},
+	{"client-close", checkClientClose},
+	{"kick", checkKick},
+	{"schema", checkSchema},
+}
+
+func main() {
+	var c config
+	var pattern string
+	var asJSON bool
+	flag.StringVar(&c.server, "server", "http://localhost:8080", "server base URL")
+	flag.StringVar(&c.token, "token", os.Getenv("CHAT_ADMIN_TOKEN"), "server admin token, enabling the kick check (env CHAT_ADMIN_TOKEN)")
+	flag.StringVar(&c.tenant, "tenant", "", "tenant to connect to (default: the default tenant)")
+	flag.DurationVar(&c.timeout, "timeout", 5*time.Second, "how long to wait for each expected frame")
+	flag.StringVar(&pattern, "run", "", "only run checks whose name matches this regular expression")
+	flag.BoolVar(&asJSON, "json", false, "print the results as JSON")
+	flag.Parse()
+	c.server = strings.TrimSuffix(c.server, "/")
+	only, err := regexp.Compile(pattern)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "conformance: -run: %v\n", err)
+		os.Exit(2)
+	}
+
+	s := &suite{cfg: c, http: &http.Client{Timeout: 10 * time.Second}, id: strconv.FormatInt(rand.Int63(), 36)}
+	var results []result
+	failed := false
+	for _, ch := range checks {
+		if !only.MatchString(ch.name) {
+			continue
+		}
+		start := time.Now()
+		err := ch.run(s)
+		r := result{Check: ch.name, Status: "pass", Duration: time.Since(start)}
+		var sk skip
+		switch {
+		case errors.As(err, &sk):
+			r.Status, r.Detail = "skip", sk.Error()
+		case err != nil:
+			r.Status, r.Detail = "fail", err.Error()
+			failed = true
+		}
+		results = append(results, r)
+		if !asJSON {
+			line := fmt.Sprintf("%-4s %-18s %6s", strings.ToUpper(r.Status), r.Check, r.Duration.Round(time.Millisecond))
+			if r.Detail != "" {
+				line += "  " + r.Detail
+			}
+			fmt.Println(line)
+		}
+	}
+	if asJSON {
+		out, _ := json.MarshalIndent(results, "", "  ")
+		fmt.Println(string(out))
+	}
+	if failed {
+		os.Exit(1)
+	}
+}
+
+// suite holds what the checks share.
+type suite struct {
+	cfg  config
+	http *http.Client
+	id   string // makes this run's usernames and rooms unique
+	n    int
+}
+
+// name returns a fresh username or room name with prefix.
+func (s *suite) name(prefix string) string {
+	s.n++
+	return fmt.Sprintf("%s-%s-%d", prefix, s.id, s.n)
+}
+
+// conn is one client connection. Frames carrying a JSON array of messages
+// are split, and read messages wait in pending until a check looks for
+// them.
+type conn struct {
+	ws      *websocket.Conn
+	timeout time.Duration
+	pending []message
+}
+
+// dial joins room as username with any extra query parameters, solving a
+// proof of work if the server asks for one. On a refused handshake it
+// returns the response.
+func (s *suite) dial(username, room string, extra url.Values) (*conn, *http.Response, error) {
+	q := url.Values{"username": {username}, "room": {room}}
+	if s.cfg.tenant != "" {
+		q.Set("tenant", s.cfg.tenant)
+	}
+	for k, v := range extra {
+		q[k] = v
+	}
+	ws, resp, err := s.dialURL(q)
+	if resp != nil && resp.StatusCode == http.StatusPreconditionRequired {
+		var ch struct {
+			Challenge  string `json:"challenge"`
+			Difficulty int    `json:"difficulty"`
+		}
+		body, _ := io.ReadAll(resp.Body)
+		if json.Unmarshal(body, &ch) != nil || ch.Challenge == "" {
+			return nil, resp, fmt.Errorf("428 without a challenge: %s", body)
+		}
+		q.Set("pow", ch.Challenge)
+		q.Set("pow_solution", solve(ch.Challenge, ch.Difficulty))
+		ws, resp, err = s.dialURL(q)
+	}
+	if err != nil {
+		return nil, resp, err
+	}
+	return &conn{ws: ws, timeout: s.cfg.timeout}, resp, nil
+}
+
+func (s *suite) dialURL(q url.Values) (*websocket.Conn, *http.Response, error) {
+	u := strings.Replace(s.cfg.server, "http", "ws", 1) + "/ws?" + q.Encode()
+	ctx, cancel := context.WithTimeout(context.Background(), s.cfg.timeout)
+	defer cancel()
+	return websocket.DefaultDialer.DialContext(ctx, u, nil)
+}
+
+// join dials and waits for the welcome.
+func (s *suite) join(username, room string) (*conn, message, error) {
+	c, _, err := s.dial(username, room, nil)
+	if err != nil {
+		return nil, message{}, fmt.Errorf("joining %s as %s: %w", room, username, err)
+	}
+	welcome, err := c.await("welcome", func(m message) bool { return m.Type == "welcome" })
+	if err != nil {
+		c.close()
+	}
+	return c, welcome, err
+}
+
+// solve finds a proof of work: s such that SHA-256("<challenge>:<s>")
+// starts with difficulty zero bits.
+func solve(challenge string, difficulty int) string {
+	for n := uint64(0); ; n++ {
+		s := strconv.FormatUint(n, 36)
+		sum := sha256.Sum256([]byte(challenge + ":" + s))
+		zeros := 0
+		for _, b := range sum {
+			zeros += bits.LeadingZeros8(b)
+			if b != 0 {
+				break
+			}
+		}
+		if zeros >= difficulty {
+			return s
+		}
+	}
+}
+
+func (c *conn) close() { c.ws.Close() }
+
+// send sends a chat message or command, with ref if not empty.
+func (c *conn) send(text, ref string) error {
+	c.ws.SetWriteDeadline(time.Now().Add(c.timeout))
+	return c.ws.WriteJSON(message{Text: text, Ref: ref})
+}
+
+// await returns the first message, pending or yet to come, that match
+// accepts, leaving the others pending. what describes it for errors.
+func (c *conn) await(what string, match func(message) bool) (message, error) {
+	deadline := time.Now().Add(c.timeout)
+	for {
+		for i, m := range c.pending {
+			if match(m) {
+				c.pending = append(c.pending[:i:i], c.pending[i+1:]...)
+				return m, nil
+			}
+		}
+		c.ws.SetReadDeadline(deadline)
+		_, data, err := c.ws.ReadMessage()
+		if err != nil {
+			var ne interface{ Timeout() bool }
+			if errors.As(err, &ne) && ne.Timeout() {
+				return message{}, fmt.Errorf("no %s within %s", what, c.timeout)
+			}
+			return message{}, fmt.Errorf("waiting for %s: %w", what, err)
+		}
+		msgs, err := decode(data)
+		if err != nil {
+			return message{}, err
+		}
+		c.pending = append(c.pending, msgs...)
+	}
+}
+
+// decode parses a frame holding one message or a JSON array of them.
+func decode(data []byte) ([]message, error) {
+	data = bytes.TrimSpace(data)
+	if len(data) > 0 && data[0] == '[' {
+		var msgs []message
+		if err := json.Unmarshal(data, &msgs); err != nil {
+			return nil, fmt.Errorf("malformed batch frame: %w", err)
+		}
+		return msgs, nil
+	}
+	var m message
+	if err := json.Unmarshal(data, &m); err != nil {
+		return nil, fmt.Errorf("malformed frame %q: %w", data, err)
+	}
+	return []message{m}, nil
+}
+
+// reply waits for a reply of type typ.
+func (c *conn) reply(typ string) (message, error) {
+	return c.await(typ+" reply", func(m message) bool { return m.Type == typ })
+}
+
+// chat waits for the chat message with text.
+func (c *conn) chat(text string) (message, error) {
+	return c.await(fmt.Sprintf("chat %q", text), func(m message) bool { return m.Type == "chat" && m.Text == text })
+}
+
+// system waits for a system message containing text.
+func (c *conn) system(text string) (message, error) {
+	return c.await(fmt.Sprintf("system message %q", text), func(m message) bool {
+		return m.Type == "system" && strings.Contains(m.Text, text)
+	})
+}
+
+// closeCode waits for the server's close frame and returns its status.
+func (c *conn) closeCode() (int, error) {
+	c.ws.SetReadDeadline(time.Now().Add(c.timeout))
+	for {
+		if _, _, err := c.ws.ReadMessage(); err != nil {
+			var ce *websocket.CloseError
+			if errors.As(err, &ce) {
+				return ce.Code, nil
+			}
+			return 0, fmt.Errorf("connection ended without a close frame: %w", err)
+		}
+	}
+}
+
+func checkHandshakeErrors(s *suite) error {
+	_, resp, err := s.dialURL(url.Values{"room": {s.name("conformance")}})
+	if err == nil || resp == nil || resp.StatusCode != http.StatusBadRequest {
+		return fmt.Errorf("joining without a username: want HTTP 400, got %s", status(resp, err))
+	}
+	_, resp, err = s.dialURL(url.Values{"username": {s.name("user")}, "room": {s.name("conformance")}, "tenant": {"conformance-no-such-tenant-" + s.id}})
+	if err == nil || resp == nil || resp.StatusCode != http.StatusNotFound {
+		return fmt.Errorf("joining an unknown tenant: want HTTP 404, got %s", status(resp, err))
+	}
+	return nil
+}
+
+func status(resp *http.Response, err error) string {
+	if resp != nil {
+		return resp.Status
+	}
+	if err == nil {
+		return "an open connection"
+	}
+	return err.Error()
+}
+
+func checkJoin(s *suite) error {
+	user, room := s.name("user"), s.name("conformance")
+	c, welcome, err := s.join(user, room)
+	if err != nil {
+		return err
+	}
+	defer c.close()
+	if welcome.Username != user || welcome.Room != room {
+		return fmt.Errorf("welcome is for %s in %s, want %s in %s", welcome.Username, welcome.Room, user, room)
+	}
+	if welcome.ResumeToken == "" {
+		return errors.New("welcome carries no resume_token")
+	}
+	_, err = c.system(user + " joined the room")
+	return err
+}
+
+func checkPresence(s *suite) error {
+	room := s.name("conformance")
+	a, _, err := s.join(s.name("user"), room)
+	if err != nil {
+		return err
+	}
+	defer a.close()
+	other := s.name("user")
+	b, _, err := s.join(other, room)
+	if err != nil {
+		return err
+	}
+	if _, err := a.system(other + " joined the room"); err != nil {
+		b.close()
+		return err
+	}
+	b.close()
+	_, err = a.system(other + " left the room")
+	return err
+}
+
+func checkChat(s *suite) error {
+	room, sender := s.name("conformance"), s.name("user")
+	a, _, err := s.join(sender, room)
+	if err != nil {
+		return err
+	}
+	defer a.close()
+	b, _, err := s.join(s.name("user"), room)
+	if err != nil {
+		return err
+	}
+	defer b.close()
+	text := "hello from " + sender
+	if err := a.send(text, ""); err != nil {
+		return err
+	}
+	for _, c := range []*conn{a, b} {
+		m, err := c.chat(text)
+		if err != nil {
+			return err
+		}
+		if m.Username != sender || m.Room != room || m.ID == "" || m.Seq <= 0 {
+			return fmt.Errorf("chat message lacks its author, room, id or seq: %+v", m)
+		}
+	}
+	return nil
+}
+
+func checkAck(s *suite) error {
+	c, _, err := s.join(s.name("user"), s.name("conformance"))
+	if err != nil {
+		return err
+	}
+	defer c.close()
+	ref := "ref-" + s.id
+	if err := c.send("acknowledge this", ref); err != nil {
+		return err
+	}
+	ack, err := c.await("ack for "+ref, func(m message) bool { return m.Type == "ack" && m.Ref == ref })
+	if err != nil {
+		return err
+	}
+	m, err := c.chat("acknowledge this")
+	if err != nil {
+		return err
+	}
+	if ack.ID != m.ID {
+		return fmt.Errorf("ack names message %q, but it was sent as %q", ack.ID, m.ID)
+	}
+	if m.Ref != "" {
+		return errors.New("the broadcast chat message carries the sender's ref")
+	}
+	return nil
+}
+
+func checkSequence(s *suite) error {
+	c, welcome, err := s.join(s.name("user"), s.name("conformance"))
+	if err != nil {
+		return err
+	}
+	defer c.close()
+	last := welcome.Seq
+	for i := range 3 {
+		text := fmt.Sprintf("message %d", i)
+		if err := c.send(text, ""); err != nil {
+			return err
+		}
+		m, err := c.chat(text)
+		if err != nil {
+			return err
+		}
+		if m.Seq != last+1 {
+			return fmt.Errorf("seq went from %d to %d", last, m.Seq)
+		}
+		last = m.Seq
+	}
+	return nil
+}
+
+// command joins a fresh room with a second member, sends cmd and returns
+// the reply of type typ.
+func (s *suite) command(cmd, typ string) (message, []string, error) {
+	room := s.name("conformance")
+	users := []string{s.name("user"), s.name("user")}
+	a, _, err := s.join(users[0], room)
+	if err != nil {
+		return message{}, nil, err
+	}
+	defer a.close()
+	b, _, err := s.join(users[1], room)
+	if err != nil {
+		return message{}, nil, err
+	}
+	defer b.close()
+	if _, err := a.system(users[1] + " joined the room"); err != nil {
+		return message{}, nil, err
+	}
+	if err := a.send(cmd, ""); err != nil {
+		return message{}, nil, err
+	}
+	m, err := a.reply(typ)
+	return m, append(users, room), err
+}
+
+func checkUsers(s *suite) error {
+	m, names, err := s.command("/users", "user_list")
+	if err != nil {
+		return err
+	}
+	for _, user := range names[:2] {
+		if !strings.Contains(m.Text, user) {
+			return fmt.Errorf("user_list %q does not name %s", m.Text, user)
+		}
+	}
+	return nil
+}
+
+func checkStats(s *suite) error {
+	m, _, err := s.command("/stats", "stats")
+	if err != nil {
+		return err
+	}
+	var stats struct {
+		TotalUsers *int `json:"total_users"`
+		TotalRooms *int `json:"total_rooms"`
+	}
+	if err := json.Unmarshal([]byte(m.Text), &stats); err != nil || stats.TotalUsers == nil || stats.TotalRooms == nil {
+		return fmt.Errorf("stats text %q is not {\"total_users\": n, \"total_rooms\": n}", m.Text)
+	}
+	if *stats.TotalUsers < 2 || *stats.TotalRooms < 1 {
+		return fmt.Errorf("stats count %d users in %d rooms while this check has 2 in 1", *stats.TotalUsers, *stats.TotalRooms)
+	}
+	return nil
+}
+
+func checkRooms(s *suite) error {
+	m, names, err := s.command("/rooms", "room")
+	if err != nil {
+		return err
+	}
+	var rooms map[string]int
+	if err := json.Unmarshal([]byte(m.Text), &rooms); err != nil {
+		return fmt.Errorf("room text %q is not a map of room names to user counts", m.Text)
+	}
+	if n := rooms[names[2]]; n != 2 {
+		return fmt.Errorf("rooms gives %s %d users, want 2", names[2], n)
+	}
+	return nil
+}
+
+func checkHistory(s *suite) error {
+	c, _, err := s.join(s.name("user"), s.name("conformance"))
+	if err != nil {
+		return err
+	}
+	defer c.close()
+	for _, text := range []string{"first", "second", "third"} {
+		if err := c.send(text, ""); err != nil {
+			return err
+		}
+		if _, err := c.chat(text); err != nil {
+			return err
+		}
+	}
+	if err := c.send("/history 2", ""); err != nil {
+		return err
+	}
+	m, err := c.reply("history")
+	if err != nil {
+		return err
+	}
+	var history []message
+	if err := json.Unmarshal([]byte(m.Text), &history); err != nil {
+		return fmt.Errorf("history text %q is not a JSON array of messages", m.Text)
+	}
+	if len(history) != 2 || history[0].Text != "second" || history[1].Text != "third" {
+		return fmt.Errorf("/history 2 returned %d messages, want second and third oldest first", len(history))
+	}
+	return nil
+}
+
+func checkUnknownCommand(s *suite) error {
+	c, _, err := s.join(s.name("user"), s.name("conformance"))
+	if err != nil {
+		return err
+	}
+	defer c.close()
+	if err := c.send("/conformance-no-such-command", ""); err != nil {
+		return err
+	}
+	_, err = c.system("Unknown command")
+	return err
+}
+
+func checkResume(s *suite) error {
+	room, user := s.name("conformance"), s.name("user")
+	a, welcome, err := s.join(user, room)
+	if err != nil {
+		return err
+	}
+	b, _, err := s.join(s.name("user"), room)
+	if err != nil {
+		a.close()
+		return err
+	}
+	defer b.close()
+	a.close()
+	if err := b.send("while you were away", ""); err != nil {
+		return err
+	}
+	if _, err := b.chat("while you were away"); err != nil {
+		return err
+	}
+	extra := url.Values{"resume": {welcome.ResumeToken}, "since_seq": {strconv.FormatInt(welcome.Seq, 10)}}
+	c, _, err := s.dial(user, room, extra)
+	if err != nil {
+		return fmt.Errorf("resuming: %w", err)
+	}
+	defer c.close()
+	if _, err := c.reply("welcome"); err != nil {
+		return err
+	}
+	_, err = c.chat("while you were away")
+	return err
+}
+
+func checkPing(s *suite) error {
+	c, _, err := s.join(s.name("user"), s.name("conformance"))
+	if err != nil {
+		return err
+	}
+	defer c.close()
+	pong := make(chan string, 1)
+	c.ws.SetPongHandler(func(data string) error {
+		pong <- data
+		return nil
+	})
+	if err := c.ws.WriteControl(websocket.PingMessage, []byte(s.id), time.Now().Add(c.timeout)); err != nil {
+		return err
+	}
+	// Pongs are handled while reading, so read until one comes.
+	go func() {
+		c.await("pong", func(message) bool { return false })
+	}()
+	select {
+	case data := <-pong:
+		if data != s.id {
+			return fmt.Errorf("pong carries %q, want the ping's %q", data, s.id)
+		}
+		return nil
+	case <-time.After(c.timeout):
+		return fmt.Errorf("no pong within %s", c.timeout)
+	}
+}
+
+func checkClientClose(s *suite) error {
+	c, _, err := s.join(s.name("user"), s.name("conformance"))
+	if err != nil {
+		return err
+	}
+	defer c.close()
+	msg := websocket.FormatCloseMessage(websocket.CloseNormalClosure, "")
+	if err := c.ws.WriteControl(websocket.CloseMessage, msg, time.Now().Add(c.timeout)); err != nil {
+		return err
+	}
+	code, err := c.closeCode()
+	if err != nil {
+		return err
+	}
+	if code != websocket.CloseNormalClosure {
+		return fmt.Errorf("server answered close with %d, want %d", code, websocket.CloseNormalClosure)
+	}
+	return nil
+}
+
+func checkKick(s *suite) error {
+	if s.cfg.token == "" {
+		return skip("needs the server's admin token (-token)")
+	}
+	room, user := s.name("conformance"), s.name("user")
+	c, _, err := s.join(user, room)
+	if err != nil {
+		return err
+	}
+	defer c.close()
+	body, _ := json.Marshal(map[string]string{"room": room, "reason": "conformance check"})
+	u := s.cfg.server + "/api/admin/users/" + url.PathEscape(user) + "/kick"
+	if s.cfg.tenant != "" {
+		u += "?tenant=" + url.QueryEscape(s.cfg.tenant)
+	}
+	req, _ := http.NewRequest("POST", u, bytes.NewReader(body))
+	req.Header.Set("Authorization", "Bearer "+s.cfg.token)
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := s.http.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("kick: %s", resp.Status)
+	}
+	m, err := c.reply("kicked")
+	if err != nil {
+		return err
+	}
+	if m.Text != "conformance check" {
+		return fmt.Errorf("kicked message gives reason %q, want the admin's", m.Text)
+	}
+	code, err := c.closeCode()
+	if err != nil {
+		return err
+	}
+	if code != websocket.CloseNormalClosure {
+		return fmt.Errorf("kicked connection closed with %d, want %d", code, websocket.CloseNormalClosure)
+	}
+	return nil
+}
+
+func checkSchema(s *suite) error {
+	resp, err := s.http.Get(s.cfg.server + "/api/schema")
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return skip("the server publishes no /api/schema")
+	}
+	var doc struct {
+		AsyncAPI string `json:"asyncapi"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&doc); err != nil || doc.AsyncAPI == "" {
+		return errors.New("/api/schema is not an AsyncAPI document")
+	}
+	return nil
+}
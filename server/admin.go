@@ -0,0 +1,266 @@
+package main
+
+import (
+	"bufio"
+	"crypto/subtle"
+	"encoding/json"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// The admin API lives under /api/admin. Requests send "Authorization:
+// Bearer <token>" with either the server's -admin-token, which acts on the
+// tenant named by ?tenant= (default: the default tenant) and may use the
+// server-wide endpoints, or a tenant's key, which acts on that tenant only.
+// Every action is written to the audit log.
+
+func registerAdminRoutes(router *gin.Engine) {
+	enabled := cfg.AdminToken != ""
+	for _, t := range tenants {
+		enabled = enabled || t.Config.Key != ""
+	}
+	if !enabled {
+		return
+	}
+	router.GET("/admin", handleAdminPage)
+	admin := router.Group("/api/admin", requireAdmin)
+	admin.GET("/users/:username/export", handleExportUser)
+	admin.DELETE("/users/:username", handleEraseUser)
+	admin.GET("/users/:username/prefs", handleAdminGetPrefs)
+	admin.PUT("/users/:username/prefs", handleAdminUpdatePrefs)
+	admin.POST("/users/:username/registration", handleReserveUser)
+	admin.DELETE("/users/:username/registration", handleReleaseUser)
+	admin.POST("/messages/:id/redact", handleRedact)
+	admin.GET("/rooms", handleListRooms)
+	admin.POST("/rooms/:room/close", handleCloseRoom)
+	admin.POST("/users/:username/kick", handleKick)
+	admin.GET("/bans", handleListBans)
+	admin.POST("/users/:username/ban", handleBan)
+	admin.DELETE("/users/:username/ban", handleUnban)
+	admin.GET("/mutes", handleListMutes)
+	admin.POST("/users/:username/mute", handleMute)
+	admin.DELETE("/users/:username/mute", handleUnmute)
+	admin.GET("/rooms/:room/history", handleRoomHistory)
+	admin.GET("/rooms/:room/settings", handleRoomSettings)
+	admin.PUT("/rooms/:room/settings", handleUpdateRoomSettings)
+	admin.GET("/rooms/:room/webhooks", handleListWebhooks)
+	admin.POST("/rooms/:room/webhooks/:name", handleCreateWebhook)
+	admin.DELETE("/rooms/:room/webhooks/:name", handleDeleteWebhook)
+	admin.GET("/connections/:id", handleConnection)
+	admin.PUT("/rooms/:room/emoji/:name", handleAddEmoji)
+	admin.DELETE("/rooms/:room/emoji/:name", handleRemoveEmoji)
+	admin.GET("/groups", handleListGroups)
+	admin.PUT("/groups/:group", handleSetGroup)
+	admin.DELETE("/groups/:group", handleDeleteGroup)
+	admin.POST("/groups/:group/members/:username", handleAddGroupMember)
+	admin.DELETE("/groups/:group/members/:username", handleRemoveGroupMember)
+	admin.POST("/announce", handleAnnounce)
+	admin.GET("/schedules", handleListSchedules)
+	admin.POST("/schedules", handleSetSchedule)
+	admin.PUT("/schedules/:id", handleSetSchedule)
+	admin.DELETE("/schedules/:id", handleDeleteSchedule)
+	admin.GET("/templates", handleListTemplates)
+	admin.PUT("/templates/:name", handleSetTemplate)
+	admin.DELETE("/templates/:name", handleDeleteTemplate)
+	admin.GET("/usage", handleUsage)
+	admin.GET("/rooms/:room/usage", handleRoomUsage)
+	admin.GET("/config", handleExportConfig)
+	admin.PUT("/config", handleImportConfig)
+	router.GET("/ws/admin", requireAdmin, handleAdminEvents)
+
+	server := admin.Group("", requireServerAdmin)
+	server.GET("/runtime", handleRuntime)
+	server.GET("/snapshot", handleSnapshot)
+	server.GET("/backups", handleListBackups)
+	server.POST("/backups", handleCreateBackup)
+	server.POST("/restore", handleRestore)
+}
+
+func requireAdmin(c *gin.Context) {
+	token, _ := strings.CutPrefix(c.GetHeader("Authorization"), "Bearer ")
+	if token == "" && c.Request.URL.Path == "/ws/admin" {
+		// Browsers cannot set headers on a WebSocket handshake
+		token = c.Query("token")
+	}
+	if cfg.AdminToken != "" && constantTimeEqual(token, cfg.AdminToken) {
+		t, ok := lookupTenant(c.Query("tenant"))
+		if !ok {
+			c.AbortWithStatusJSON(404, gin.H{"error": "unknown tenant"})
+			return
+		}
+		c.Set("tenant", t)
+		c.Set("server_admin", true)
+		c.Next()
+		return
+	}
+	t, ok := tenantByKey(token)
+	if !ok {
+		c.AbortWithStatusJSON(401, gin.H{"error": "admin token required"})
+		return
+	}
+	if name := c.Query("tenant"); name != "" && name != t.Name {
+		c.AbortWithStatusJSON(403, gin.H{"error": "tenant key is not valid for " + name})
+		return
+	}
+	c.Set("tenant", t)
+	c.Next()
+}
+
+// requireServerAdmin limits server-wide endpoints to the -admin-token.
+func requireServerAdmin(c *gin.Context) {
+	if !c.GetBool("server_admin") {
+		c.AbortWithStatusJSON(403, gin.H{"error": "server admin token required"})
+		return
+	}
+	c.Next()
+}
+
+// adminTenant returns the tenant an admin request acts on.
+func adminTenant(c *gin.Context) *Tenant {
+	return c.MustGet("tenant").(*Tenant)
+}
+
+func constantTimeEqual(a, b string) bool {
+	return subtle.ConstantTimeCompare([]byte(a), []byte(b)) == 1
+}
+
+// userExport is everything the server holds about one user: the chat
+// messages in the history store, the rooms they are connected to, when they
+// registered their name, if they did, their preferences and audit entries
+// about them.
+type userExport struct {
+	Username   string       `json:"username"`
+	ExportedAt time.Time    `json:"exported_at"`
+	Registered *time.Time   `json:"registered,omitempty"` // when the password was last set
+	Messages   []Message    `json:"messages"`
+	Rooms      []string     `json:"connected_rooms"`
+	Prefs      Prefs        `json:"prefs"`
+	Audit      []AuditEntry `json:"audit"`
+}
+
+func handleExportUser(c *gin.Context) {
+	username := c.Param("username")
+	t := adminTenant(c)
+	msgs, err := t.hub.store.ByUser(username)
+	if err != nil {
+		c.JSON(500, gin.H{"error": err.Error()})
+		return
+	}
+	recordAudit(AuditEntry{Actor: c.ClientIP(), Tenant: t.Name, Action: "user.export", Subject: username})
+	var registered *time.Time
+	if r, ok := registration(t.Name, username); ok {
+		registered = &r.Changed
+	}
+	c.JSON(200, userExport{
+		Username:   username,
+		ExportedAt: time.Now(),
+		Registered: registered,
+		Messages:   msgs,
+		Rooms:      t.hub.userRooms(username),
+		Prefs:      userPrefs(t.Name, username),
+		Audit:      auditFor(t.Name, username),
+	})
+}
+
+// handleEraseUser anonymizes a user's history entries: the author becomes
+// tombstoneAuthor and, unless ?keep_text=true, the text is removed too. A
+// registered name is released and preferences are forgotten.
+func handleEraseUser(c *gin.Context) {
+	username := c.Param("username")
+	t := adminTenant(c)
+	keepText, _ := strconv.ParseBool(c.Query("keep_text"))
+	text := tombstoneText
+	if keepText {
+		text = ""
+	}
+	n, err := t.hub.store.Anonymize(username, tombstoneAuthor, text)
+	if err != nil {
+		c.JSON(500, gin.H{"error": err.Error()})
+		return
+	}
+	unregister(t.Name, username)
+	deletePrefs(t.Name, username)
+	t.hub.recountStorage()
+	recordAudit(AuditEntry{
+		Actor:   c.ClientIP(),
+		Tenant:  t.Name,
+		Action:  "user.erase",
+		Subject: username,
+		Detail:  strconv.Itoa(n) + " messages anonymized, keep_text=" + strconv.FormatBool(keepText),
+	})
+	c.JSON(200, gin.H{"username": username, "messages": n})
+}
+
+// handleRedact replaces a stored message's text with the redaction marker,
+// which history replays and exports then show, and tells the room. An
+// optional JSON body {"reason": "..."} is kept in the audit log.
+func handleRedact(c *gin.Context) {
+	var body struct {
+		Reason string `json:"reason"`
+	}
+	c.ShouldBindJSON(&body)
+
+	t := adminTenant(c)
+	msg, err := t.hub.store.Redact(c.Param("id"), redactedText)
+	if err == errNotFound {
+		c.JSON(404, gin.H{"error": "message not found in history"})
+		return
+	} else if err != nil {
+		c.JSON(500, gin.H{"error": err.Error()})
+		return
+	}
+	t.hub.recountStorage()
+	recordAudit(AuditEntry{
+		Actor:   c.ClientIP(),
+		Tenant:  t.Name,
+		Action:  "message.redact",
+		Subject: msg.Username,
+		Detail:  msg.ID + " in " + msg.Room + ": " + body.Reason,
+	})
+	t.hub.broadcastToRoom(msg.Room, Message{
+		Type: MsgRedacted,
+		Room: msg.Room,
+		Text: redactedText,
+		Time: t.hub.clockTime(),
+		ID:   msg.ID,
+		Seq:  msg.Seq,
+	})
+	c.JSON(200, msg)
+}
+
+// handleRoomHistory exports everything the store holds for a room, oldest
+// first. The array is written as the store reads it, so a large room is
+// never held in memory; a store error midway cuts it short, leaving invalid
+// JSON rather than a truncated export that looks complete.
+func handleRoomHistory(c *gin.Context) {
+	t := adminTenant(c)
+	room := c.Param("room")
+	c.Header("Content-Type", "application/json; charset=utf-8")
+	c.Status(200)
+	w := bufio.NewWriter(c.Writer)
+	enc := json.NewEncoder(w)
+	n := 0
+	w.WriteByte('[')
+	err := t.hub.store.Each(func(msg Message) error {
+		if msg.Room != room {
+			return nil
+		}
+		if n > 0 {
+			w.WriteByte(',')
+		}
+		n++
+		return enc.Encode(msg)
+	})
+	if err != nil {
+		w.Flush()
+		log.Printf("Exporting %s: %v", room, err)
+		return
+	}
+	w.WriteString("]\n")
+	w.Flush()
+	recordAudit(AuditEntry{Actor: c.ClientIP(), Tenant: t.Name, Action: "room.export", Subject: room, Detail: strconv.Itoa(n) + " messages"})
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Prometheus Alertmanager can send its notifications to a room, making the
+// room an ops channel:
+//
+//	receivers:
+//	- name: chat
+//	  webhook_configs:
+//	  - url: https://chat.example.com/api/rooms/ops/alertmanager
+//	    http_config:
+//	      authorization:
+//	        credentials: <webhook key>
+//
+// Each notification becomes one message from the webhook, listing its
+// alerts firing first, most severe first, each marked by its severity label:
+//
+//	🔥 2 firing, 1 resolved (ops-pager)
+//	  🔴 [critical] HighLatency: p99 above 2s on api-1 http://prometheus/graph?...
+//	  🟠 [warning] DiskFilling: /var at 91% on db-2
+//	  ✅ [warning] CertExpiring: resolved
+
+// severityIcons marks firing alerts by their severity label; others get
+// the info icon.
+var severityIcons = map[string]string{"critical": "🔴", "error": "🔴", "warning": "🟠", "info": "🔵"}
+
+// severityRank orders alerts in a notification, most severe first.
+var severityRank = map[string]int{"critical": 0, "error": 0, "warning": 1, "info": 2}
+
+type amAlert struct {
+	Status       string            `json:"status"` // "firing" or "resolved"
+	Labels       map[string]string `json:"labels"`
+	Annotations  map[string]string `json:"annotations"`
+	GeneratorURL string            `json:"generatorURL"`
+}
+
+func (a amAlert) rank() int {
+	r, ok := severityRank[a.Labels["severity"]]
+	if !ok {
+		r = len(severityRank)
+	}
+	if a.Status == "resolved" {
+		r += 10
+	}
+	return r
+}
+
+func (a amAlert) String() string {
+	icon, ok := severityIcons[a.Labels["severity"]]
+	if !ok {
+		icon = severityIcons["info"]
+	}
+	line := "  " + icon + " "
+	if a.Status == "resolved" {
+		line = "  ✅ "
+	}
+	if s := a.Labels["severity"]; s != "" {
+		line += "[" + s + "] "
+	}
+	line += a.Labels["alertname"]
+	if a.Status == "resolved" {
+		return line + ": resolved"
+	}
+	summary := a.Annotations["summary"]
+	if summary == "" {
+		summary = a.Annotations["description"]
+	}
+	if summary != "" {
+		line += ": " + summary
+	}
+	if a.GeneratorURL != "" {
+		line += " " + a.GeneratorURL
+	}
+	return line
+}
+
+// handleAlertmanagerHook posts the Alertmanager notification in the request
+// body to the room.
+func handleAlertmanagerHook(c *gin.Context) {
+	t, room, payload, ok := readHook(c)
+	if !ok {
+		return
+	}
+	key, _ := strings.CutPrefix(c.GetHeader("Authorization"), "Bearer ")
+	name, ok := t.hub.webhooks.lookup(room, key)
+	if !ok {
+		c.JSON(401, gin.H{"error": "invalid webhook key for this room"})
+		return
+	}
+	text, err := formatAlertmanager(payload)
+	postHookEvent(c, t, room, name, text, err)
+}
+
+// formatAlertmanager returns the chat message for an Alertmanager webhook
+// notification, or "" if it has no alerts.
+func formatAlertmanager(payload []byte) (string, error) {
+	var n struct {
+		Receiver string    `json:"receiver"`
+		Alerts   []amAlert `json:"alerts"`
+	}
+	if err := json.Unmarshal(payload, &n); err != nil {
+		return "", fmt.Errorf("invalid Alertmanager payload: %w", err)
+	}
+	if len(n.Alerts) == 0 {
+		return "", nil
+	}
+	sort.SliceStable(n.Alerts, func(i, j int) bool { return n.Alerts[i].rank() < n.Alerts[j].rank() })
+	firing := 0
+	for _, a := range n.Alerts {
+		if a.Status != "resolved" {
+			firing++
+		}
+	}
+	resolved := len(n.Alerts) - firing
+
+	var b strings.Builder
+	switch {
+	case firing > 0 && resolved > 0:
+		fmt.Fprintf(&b, "🔥 %d firing, %d resolved", firing, resolved)
+	case firing > 0:
+		fmt.Fprintf(&b, "🔥 %d firing", firing)
+	default:
+		fmt.Fprintf(&b, "✅ %d resolved", resolved)
+	}
+	if n.Receiver != "" {
+		fmt.Fprintf(&b, " (%s)", n.Receiver)
+	}
+	for _, a := range n.Alerts {
+		b.WriteString("\n" + a.String())
+	}
+	return b.String(), nil
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Alerts tell operators about likely abuse as it happens. Each one is logged
+// as an "ALERT {json}" line and, with -alert-webhook, POSTed as JSON. A
+// detector fires once per subject per window, when its count first reaches
+// the threshold, so a sustained attack yields one alert a minute rather
+// than one per event.
+
+const (
+	alertMassJoin = "mass_join"   // many joins from one IP
+	alertFlood    = "flood"       // one username keeps hitting the rate limit
+	alertPowFail  = "pow_failure" // repeated bad proofs of work from one IP
+	alertKicked   = "kicked"      // one username keeps being kicked or banned
+)
+
+const alertWindow = time.Minute
+
+type Alert struct {
+	Kind    string    `json:"kind"`
+	Subject string    `json:"subject"` // the IP or username it is about
+	Count   int       `json:"count"`   // events seen in the window
+	Window  string    `json:"window"`
+	Time    time.Time `json:"time"`
+}
+
+// alertCounter counts events per subject in fixed windows.
+type alertCounter struct {
+	kind      string
+	threshold func() int
+	mu        sync.Mutex
+	counts    map[string]*windowCount
+}
+
+type windowCount struct {
+	start time.Time
+	n     int
+}
+
+func newAlertCounter(kind string, threshold func() int) *alertCounter {
+	return &alertCounter{kind: kind, threshold: threshold, counts: make(map[string]*windowCount)}
+}
+
+// hit records one event for subject and raises an alert if it crosses the
+// threshold.
+func (a *alertCounter) hit(subject string, now time.Time) {
+	limit := a.threshold()
+	if limit <= 0 {
+		return
+	}
+
+	a.mu.Lock()
+	w, ok := a.counts[subject]
+	if !ok || now.Sub(w.start) >= alertWindow {
+		if len(a.counts) > 10000 {
+			a.sweep(now)
+		}
+		w = &windowCount{start: now}
+		a.counts[subject] = w
+	}
+	w.n++
+	n := w.n
+	a.mu.Unlock()
+
+	if n == limit {
+		raiseAlert(Alert{Kind: a.kind, Subject: subject, Count: n, Window: alertWindow.String(), Time: now})
+	}
+}
+
+func (a *alertCounter) sweep(now time.Time) {
+	for s, w := range a.counts {
+		if now.Sub(w.start) >= alertWindow {
+			delete(a.counts, s)
+		}
+	}
+}
+
+var (
+	joinAlerts  = newAlertCounter(alertMassJoin, func() int { return cfg.AlertJoins })
+	floodAlerts = newAlertCounter(alertFlood, func() int { return cfg.AlertFloods })
+	powAlerts   = newAlertCounter(alertPowFail, func() int { return cfg.AlertPowFailures })
+	kickAlerts  = newAlertCounter(alertKicked, func() int { return cfg.AlertKicks })
+)
+
+// alertQueue feeds the webhook sender; alerts are dropped rather than
+// blocking the caller when the webhook falls behind.
+var alertQueue = make(chan Alert, 64)
+
+func raiseAlert(a Alert) {
+	data, _ := json.Marshal(a)
+	log.Printf("ALERT %s", data)
+	publishEvent(AdminEvent{Time: a.Time, Kind: EventAlert, Detail: string(data)})
+	if cfg.AlertWebhook == "" {
+		return
+	}
+	select {
+	case alertQueue <- a:
+	default:
+		log.Printf("Alert webhook backlog full, dropped %s alert", a.Kind)
+	}
+}
+
+func startAlerts() {
+	if cfg.AlertWebhook == "" {
+		return
+	}
+	go func() {
+		client := &http.Client{Timeout: 10 * time.Second}
+		for a := range alertQueue {
+			data, _ := json.Marshal(a)
+			resp, err := client.Post(cfg.AlertWebhook, "application/json", bytes.NewReader(data))
+			if err != nil {
+				log.Printf("Alert webhook failed: %v", err)
+				continue
+			}
+			resp.Body.Close()
+			if resp.StatusCode >= 300 {
+				log.Printf("Alert webhook returned %s", resp.Status)
+			}
+		}
+	}()
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"regexp"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Bots with a room's webhook key can annotate the room's stored messages
+// with structured data, such as a sentiment score, the language a message
+// is in or a moderation verdict, without changing the messages themselves:
+//
+//	POST /api/rooms/:room/messages/:id/annotations?tenant=
+//	Authorization: Bearer <webhook key>
+//	{"kind": "sentiment", "data": {"score": 0.8}}
+//
+// An annotation is kept with its message in history, so /history, resume
+// replays and exports carry it, and the room is sent an annotation event
+// with the message's id and seq and the annotation. A bot has one
+// annotation of each kind per message; annotating again replaces it.
+// Redacting or erasing a message drops its annotations with its text.
+
+const (
+	maxAnnotationSize = 4096 // bytes of data
+	maxAnnotations    = 16   // per message
+)
+
+var annotationKind = regexp.MustCompile(`^[a-z0-9_.-]{1,32}$`)
+
+var errTooManyAnnotations = errors.New("a message holds at most 16 annotations")
+
+// Annotation is structured data a bot attached to a message.
+type Annotation struct {
+	Bot  string          `json:"bot"`  // the webhook that added it
+	Kind string          `json:"kind"` // such as sentiment, language or moderation
+	Data json.RawMessage `json:"data"`
+	Time time.Time       `json:"time"`
+}
+
+// annotate sets a on msg, replacing the bot's earlier annotation of the
+// same kind, and reports false if msg already has maxAnnotations others.
+func annotate(msg *Message, a Annotation) bool {
+	i := slices.IndexFunc(msg.Annotations, func(b Annotation) bool { return b.Bot == a.Bot && b.Kind == a.Kind })
+	if i >= 0 {
+		msg.Annotations = slices.Clone(msg.Annotations)
+		msg.Annotations[i] = a
+		return true
+	}
+	if len(msg.Annotations) >= maxAnnotations {
+		return false
+	}
+	msg.Annotations = append(slices.Clip(msg.Annotations), a)
+	return true
+}
+
+// handleAnnotate stores the annotation in the request body with the
+// message and tells the room.
+func handleAnnotate(c *gin.Context) {
+	tenant, roomName, id := c.Query("tenant"), c.Param("room"), c.Param("id")
+	t, ok := lookupTenant(tenant)
+	if !ok {
+		c.JSON(404, gin.H{"error": "unknown tenant"})
+		return
+	}
+	key, _ := strings.CutPrefix(c.GetHeader("Authorization"), "Bearer ")
+	name, ok := t.hub.webhooks.lookup(roomName, key)
+	if !ok {
+		c.JSON(401, gin.H{"error": "invalid webhook key for this room"})
+		return
+	}
+	var body struct {
+		Kind string          `json:"kind"`
+		Data json.RawMessage `json:"data"`
+	}
+	if err := c.ShouldBindJSON(&body); err != nil || !annotationKind.MatchString(body.Kind) || len(body.Data) == 0 {
+		c.JSON(400, gin.H{"error": "body must be {\"kind\": kind, \"data\": JSON}, with kind 1 to 32 of a-z, 0-9, _, . and -"})
+		return
+	}
+	if len(body.Data) > maxAnnotationSize {
+		c.JSON(413, gin.H{"error": "annotation data is limited to 4096 bytes"})
+		return
+	}
+	now := time.Now()
+	if t.hub.rateLimited("#"+roomName+"/"+name, now) {
+		c.JSON(429, gin.H{"error": "You are sending messages too fast; slow down."})
+		return
+	}
+	if msg, err := t.hub.store.Get(id); err != nil || msg.Room != roomName {
+		c.JSON(404, gin.H{"error": "message not found in this room's history"})
+		return
+	}
+
+	a := Annotation{Bot: name, Kind: body.Kind, Data: body.Data, Time: now.UTC()}
+	msg, err := t.hub.store.Annotate(id, a)
+	switch {
+	case err == errTooManyAnnotations:
+		c.JSON(409, gin.H{"error": err.Error()})
+		return
+	case err != nil:
+		c.JSON(500, gin.H{"error": err.Error()})
+		return
+	}
+	t.hub.broadcastToRoom(roomName, Message{
+		Type:        MsgAnnotation,
+		Room:        roomName,
+		Username:    name,
+		Time:        t.hub.clockTime(),
+		ID:          msg.ID,
+		Seq:         msg.Seq,
+		Annotations: []Annotation{a},
+	})
+	c.JSON(200, a)
+}
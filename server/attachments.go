@@ -0,0 +1,135 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Attachments are files kept alongside the chat, such as custom emoji
+// images and voice clips. They live in -attachment-dir under a name derived from their
+// content, so storing the same file twice keeps one copy, and are served
+// read-only from /attachments/<name>. Without -attachment-dir nothing can be
+// uploaded.
+
+// attachmentTypes maps the content types accepted for upload to the file
+// extension they are stored with, which is what they are served as.
+var attachmentTypes = map[string]string{
+	"image/png":  ".png",
+	"image/gif":  ".gif",
+	"image/jpeg": ".jpg",
+	"image/webp": ".webp",
+	"audio/ogg":  ".ogg",
+	"audio/webm": ".weba",
+	"audio/mp4":  ".m4a",
+	"audio/mpeg": ".mp3",
+	"audio/wav":  ".wav",
+}
+
+// Attachment describes a file a chat message carries.
+type Attachment struct {
+	Type        string  `json:"type"` // "audio"
+	URL         string  `json:"url"`
+	ContentType string  `json:"content_type"`
+	Size        int     `json:"size"`
+	Duration    float64 `json:"duration,omitempty"` // seconds, for audio
+}
+
+var errNoAttachments = errors.New("no -attachment-dir configured")
+
+type attachmentStore struct {
+	dir string
+}
+
+// attachments is nil when -attachment-dir is not set.
+var attachments *attachmentStore
+
+func setupAttachments() error {
+	if cfg.AttachmentDir == "" {
+		return nil
+	}
+	if err := os.MkdirAll(cfg.AttachmentDir, 0o755); err != nil {
+		return err
+	}
+	attachments = &attachmentStore{dir: cfg.AttachmentDir}
+	return loadEmoji()
+}
+
+// put stores data, which must be of one of the attachmentTypes, and returns
+// its name.
+func (s *attachmentStore) put(data []byte, contentType string) (string, error) {
+	ext, ok := attachmentTypes[contentType]
+	if !ok {
+		return "", errors.New("unsupported content type " + contentType)
+	}
+	sum := sha256.Sum256(data)
+	name := hex.EncodeToString(sum[:16]) + ext
+	path := filepath.Join(s.dir, name)
+	if _, err := os.Stat(path); err == nil {
+		return name, nil
+	}
+	if err := writeFileAtomic(s.dir, path, data); err != nil {
+		return "", err
+	}
+	return name, nil
+}
+
+// remove deletes the attachment called name.
+func (s *attachmentStore) remove(name string) error {
+	err := os.Remove(filepath.Join(s.dir, name))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	return err
+}
+
+// writeFileAtomic writes data to path through a temporary file in dir, so
+// readers never see it half written.
+func writeFileAtomic(dir, path string, data []byte) error {
+	tmp, err := os.CreateTemp(dir, ".upload-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// attachmentURL returns the path an attachment is served from.
+func attachmentURL(name string) string {
+	return "/attachments/" + name
+}
+
+// handleAttachment serves a stored attachment. Names change with content,
+// so responses can be cached for good.
+func handleAttachment(c *gin.Context) {
+	name := c.Param("name")
+	if attachments == nil || name != filepath.Base(name) || strings.HasPrefix(name, ".") {
+		c.JSON(404, gin.H{"error": "not found"})
+		return
+	}
+	path := filepath.Join(attachments.dir, name)
+	if _, err := os.Stat(path); err != nil {
+		c.JSON(404, gin.H{"error": "not found"})
+		return
+	}
+	c.Header("Cache-Control", "public, max-age=31536000, immutable")
+	c.Header("X-Content-Type-Options", "nosniff")
+	for contentType, ext := range attachmentTypes {
+		if strings.HasSuffix(name, ext) {
+			c.Header("Content-Type", contentType)
+		}
+	}
+	c.File(path)
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Users can post short audio clips, such as voice messages, to a room:
+//
+//	POST /api/rooms/:room/attachments?tenant=&username=&duration=<seconds>
+//	Authorization: Bearer <resume token>
+//
+// with the recording as the body. The resume token from the welcome message
+// proves the sender is in the room. The clip is stored as an attachment and
+// posted as a chat message whose attachment gives its URL, type and length.
+// Clips are limited by -max-audio-size and -max-audio-duration. WAV and Ogg
+// lengths are read from the file; for other containers the client's
+// duration is taken as given.
+
+// audioTypes maps the content types http.DetectContentType reports for
+// audio containers to the type the clip is stored and served as.
+var audioTypes = map[string]string{
+	"application/ogg": "audio/ogg",
+	"video/webm":      "audio/webm",
+	"video/mp4":       "audio/mp4",
+	"audio/mpeg":      "audio/mpeg",
+	"audio/wave":      "audio/wav",
+}
+
+// audioDuration returns the length of a WAV or Ogg (Opus or Vorbis) clip,
+// and false for other formats or files it cannot make sense of.
+func audioDuration(data []byte, contentType string) (time.Duration, bool) {
+	switch contentType {
+	case "audio/wav":
+		return wavDuration(data)
+	case "audio/ogg":
+		return oggDuration(data)
+	}
+	return 0, false
+}
+
+// wavDuration divides the size of the data chunk by the byte rate in the
+// fmt chunk.
+func wavDuration(data []byte) (time.Duration, bool) {
+	if len(data) < 12 || string(data[0:4]) != "RIFF" || string(data[8:12]) != "WAVE" {
+		return 0, false
+	}
+	var byteRate uint32
+	for p := data[12:]; len(p) >= 8; {
+		id, size := string(p[0:4]), binary.LittleEndian.Uint32(p[4:8])
+		p = p[8:]
+		switch id {
+		case "fmt ":
+			if size < 16 || len(p) < 16 {
+				return 0, false
+			}
+			byteRate = binary.LittleEndian.Uint32(p[8:12])
+		case "data":
+			if byteRate == 0 {
+				return 0, false
+			}
+			size = min(size, uint32(len(p))) // streamed WAVs leave the size unset
+			return time.Duration(float64(size) / float64(byteRate) * float64(time.Second)), true
+		}
+		next := uint64(size) + uint64(size%2) // chunks are padded to even sizes
+		if next > uint64(len(p)) {
+			return 0, false
+		}
+		p = p[next:]
+	}
+	return 0, false
+}
+
+// oggDuration reads the granule position of the last page, which counts
+// samples at 48 kHz for Opus and at the stream's rate for Vorbis.
+func oggDuration(data []byte) (time.Duration, bool) {
+	var rate, skip float64
+	if i := bytes.Index(data[:min(len(data), 512)], []byte("OpusHead")); i >= 0 && len(data) >= i+12 {
+		rate = 48000
+		skip = float64(binary.LittleEndian.Uint16(data[i+10 : i+12]))
+	} else if i := bytes.Index(data[:min(len(data), 512)], []byte("\x01vorbis")); i >= 0 && len(data) >= i+16 {
+		rate = float64(binary.LittleEndian.Uint32(data[i+12 : i+16]))
+	}
+	last := bytes.LastIndex(data, []byte("OggS"))
+	if rate == 0 || last < 0 || len(data) < last+14 {
+		return 0, false
+	}
+	granule := float64(binary.LittleEndian.Uint64(data[last+6 : last+14]))
+	if granule < skip {
+		return 0, false
+	}
+	return time.Duration((granule - skip) / rate * float64(time.Second)), true
+}
+
+// handleUploadAudio stores the audio clip in the request body and posts it
+// to the room.
+func handleUploadAudio(c *gin.Context) {
+	tenant, username, roomName := c.Query("tenant"), c.Query("username"), c.Param("room")
+	t, ok := lookupTenant(tenant)
+	if !ok {
+		c.JSON(404, gin.H{"error": "unknown tenant"})
+		return
+	}
+	if attachments == nil {
+		c.JSON(404, gin.H{"error": errNoAttachments.Error()})
+		return
+	}
+	now := time.Now()
+	token, _ := strings.CutPrefix(c.GetHeader("Authorization"), "Bearer ")
+	if err := verifyResumeToken(token, tenant, username, roomName, now); err != nil {
+		c.JSON(401, gin.H{"error": err.Error()})
+		return
+	}
+	if _, banned := t.hub.bans.banned(username, now); banned {
+		c.JSON(403, gin.H{"error": "banned"})
+		return
+	}
+	if t.hub.rateLimited(username, now) {
+		floodAlerts.hit(tenantQualified(tenant, username), now)
+		c.JSON(429, gin.H{"error": "You are sending messages too fast; slow down."})
+		return
+	}
+
+	data, err := io.ReadAll(http.MaxBytesReader(c.Writer, c.Request.Body, int64(cfg.MaxAudioSize)))
+	if err != nil {
+		c.JSON(413, gin.H{"error": fmt.Sprintf("audio clips are limited to %d bytes", cfg.MaxAudioSize)})
+		return
+	}
+	contentType, ok := audioTypes[http.DetectContentType(data)]
+	if !ok {
+		c.JSON(415, gin.H{"error": "audio must be Ogg, WebM, MP4, MP3 or WAV"})
+		return
+	}
+	duration, measured := audioDuration(data, contentType)
+	if !measured {
+		secs, err := strconv.ParseFloat(c.Query("duration"), 64)
+		if err != nil || secs <= 0 {
+			c.JSON(400, gin.H{"error": "duration must be the clip's length in seconds"})
+			return
+		}
+		duration = time.Duration(secs * float64(time.Second))
+	}
+	if duration > cfg.MaxAudioDuration {
+		c.JSON(413, gin.H{"error": "audio clips are limited to " + cfg.MaxAudioDuration.String()})
+		return
+	}
+	attachment := &Attachment{
+		Type:        "audio",
+		ContentType: contentType,
+		Size:        len(data),
+		Duration:    duration.Round(time.Millisecond).Seconds(),
+	}
+	if e := t.hub.overQuota(roomName, Message{Attachment: attachment}, t.hub.now()); e != nil {
+		c.JSON(403, gin.H{"error": quotaText(roomName, e), "quota_exceeded": e})
+		return
+	}
+	file, err := attachments.put(data, contentType)
+	if err != nil {
+		c.JSON(500, gin.H{"error": err.Error()})
+		return
+	}
+	attachment.URL = attachmentURL(file)
+
+	msg := Message{
+		Type:       MsgChat,
+		Room:       roomName,
+		Username:   username,
+		Time:       t.hub.clockTime(),
+		ID:         t.hub.newMessageID(),
+		Unverified: unverified(tenant, username),
+		Trace:      requestTrace(c),
+		Attachment: attachment,
+	}
+	c.JSON(201, t.hub.publish(roomName, msg))
+}
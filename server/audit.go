@@ -0,0 +1,60 @@
+package main
+
+import (
+	"strings"
+	"sync"
+	"time"
+)
+
+// The audit log records administrative actions so operators can later show
+// who did what to whom. It is kept in memory, newest last, and bounded, and
+// each entry is also streamed to /ws/admin.
+
+const auditSize = 1000
+
+type AuditEntry struct {
+	Time    time.Time `json:"time"`
+	Actor   string    `json:"actor"`             // who acted: the admin's address
+	Tenant  string    `json:"tenant,omitempty"`  // the tenant acted in
+	Action  string    `json:"action"`            // e.g. "user.export"
+	Subject string    `json:"subject,omitempty"` // the user or room acted on
+	Detail  string    `json:"detail,omitempty"`
+}
+
+var audit struct {
+	mu      sync.Mutex
+	entries []AuditEntry
+}
+
+func recordAudit(e AuditEntry) {
+	if e.Time.IsZero() {
+		e.Time = time.Now()
+	}
+	ev := AdminEvent{Time: e.Time, Kind: e.Action, Tenant: e.Tenant, Actor: e.Actor, Detail: e.Detail}
+	if strings.HasPrefix(e.Action, "room.") {
+		ev.Room = e.Subject
+	} else {
+		ev.Username = e.Subject
+	}
+	publishEvent(ev)
+
+	audit.mu.Lock()
+	defer audit.mu.Unlock()
+	audit.entries = append(audit.entries, e)
+	if len(audit.entries) > auditSize {
+		audit.entries = audit.entries[len(audit.entries)-auditSize:]
+	}
+}
+
+// auditFor returns the entries about subject in tenant, oldest first.
+func auditFor(tenant, subject string) []AuditEntry {
+	audit.mu.Lock()
+	defer audit.mu.Unlock()
+	var out []AuditEntry
+	for _, e := range audit.entries {
+		if e.Tenant == tenant && e.Subject == subject {
+			out = append(out, e)
+		}
+	}
+	return out
+}
@@ -0,0 +1,282 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Backups are JSON snapshots of every tenant's history, room settings,
+// webhooks and bans. With -backup-dir set one is written every
+// -backup-interval and the newest -backup-keep are kept. When a history key
+// is configured the whole snapshot is sealed with it, so backups, which hold
+// webhook keys, are as protected at rest as the store. A restore replaces
+// the store's contents with a snapshot's and imports its rooms and bans as
+// PUT /api/admin/config would (see config_yaml.go).
+
+// snapshotVersion 1 held only the default tenant, in Messages; 2 held no
+// Config.
+const snapshotVersion = 3
+
+type snapshot struct {
+	Version  int                       `json:"version"`
+	Created  time.Time                 `json:"created"`
+	Tenants  map[string][]Message      `json:"tenants"`
+	Config   map[string]ConfigDocument `json:"config,omitempty"` // by tenant
+	Messages []Message                 `json:"messages,omitempty"`
+}
+
+type backupInfo struct {
+	Name    string    `json:"name"`
+	Size    int64     `json:"size"`
+	Created time.Time `json:"created"`
+}
+
+const backupPrefix = "chat-"
+
+func takeSnapshot(now time.Time) ([]byte, error) {
+	snap := snapshot{Version: snapshotVersion, Created: now.UTC(), Tenants: map[string][]Message{}, Config: map[string]ConfigDocument{}}
+	for _, name := range tenantNames() {
+		snap.Config[name] = tenants[name].hub.exportConfig(true, now)
+		msgs := []Message{}
+		err := tenants[name].hub.store.Each(func(msg Message) error {
+			msgs = append(msgs, msg)
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+		snap.Tenants[name] = msgs
+	}
+	data, err := json.Marshal(snap)
+	if err != nil {
+		return nil, err
+	}
+	if historySealer != nil {
+		data = []byte(historySealer.seal(string(data)))
+	}
+	return data, nil
+}
+
+// restoreSnapshot replaces the history of every tenant in a snapshot taken
+// by takeSnapshot, imports its rooms and bans, and returns how many messages
+// it holds. Tenants missing from the snapshot are left alone.
+func restoreSnapshot(data []byte) (int, error) {
+	if strings.HasPrefix(string(data), sealedPrefix) {
+		if historySealer == nil {
+			return 0, errors.New("backup is encrypted but no history key is configured")
+		}
+		text, err := historySealer.open(string(data))
+		if err != nil {
+			return 0, err
+		}
+		data = []byte(text)
+	}
+	var snap snapshot
+	if err := json.Unmarshal(data, &snap); err != nil {
+		return 0, fmt.Errorf("not a backup: %w", err)
+	}
+	switch snap.Version {
+	case 1:
+		snap.Tenants = map[string][]Message{defaultTenant: snap.Messages}
+	case 2, snapshotVersion:
+	default:
+		return 0, fmt.Errorf("unsupported backup version %d", snap.Version)
+	}
+	for name := range snap.Tenants {
+		if _, ok := lookupTenant(name); !ok {
+			return 0, fmt.Errorf("backup holds unknown tenant %q", name)
+		}
+	}
+	for name, doc := range snap.Config {
+		if _, ok := lookupTenant(name); !ok {
+			return 0, fmt.Errorf("backup holds unknown tenant %q", name)
+		}
+		if err := doc.validate(); err != nil {
+			return 0, fmt.Errorf("tenant %q: %w", name, err)
+		}
+	}
+
+	n := 0
+	for name, msgs := range snap.Tenants {
+		if err := tenants[name].hub.restore(msgs); err != nil {
+			return n, fmt.Errorf("tenant %q: %w", name, err)
+		}
+		n += len(msgs)
+	}
+	now := time.Now()
+	for name, doc := range snap.Config {
+		res := tenants[name].hub.importConfig(doc, false, now)
+		log.Printf("Restored %d rooms, %d webhooks and %d bans of tenant %q", res.Rooms, res.Webhooks, res.Bans, name)
+	}
+	return n, nil
+}
+
+// restore replaces the hub's history. It holds the hub while swapping so
+// sequence numbers are reloaded from the restored history before anyone
+// posts again.
+func (h *Hub) restore(msgs []Message) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if err := h.store.Replace(msgs); err != nil {
+		return err
+	}
+	clear(h.seqs)
+	go h.recountStorage()
+	return nil
+}
+
+// writeBackup saves a snapshot into the backup directory and prunes old
+// ones.
+func writeBackup(now time.Time) (string, error) {
+	if cfg.BackupDir == "" {
+		return "", errors.New("no -backup-dir configured")
+	}
+	data, err := takeSnapshot(now)
+	if err != nil {
+		return "", err
+	}
+	name := backupPrefix + now.UTC().Format("20060102T150405Z") + ".json"
+	tmp, err := os.CreateTemp(cfg.BackupDir, ".backup-*")
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return "", err
+	}
+	if err := tmp.Close(); err != nil {
+		return "", err
+	}
+	if err := os.Rename(tmp.Name(), filepath.Join(cfg.BackupDir, name)); err != nil {
+		return "", err
+	}
+
+	backups, err := listBackups()
+	if err != nil {
+		return name, err
+	}
+	for i := 0; i < len(backups)-cfg.BackupKeep; i++ {
+		os.Remove(filepath.Join(cfg.BackupDir, backups[i].Name))
+	}
+	return name, nil
+}
+
+// listBackups returns the backups in the backup directory, oldest first.
+func listBackups() ([]backupInfo, error) {
+	entries, err := os.ReadDir(cfg.BackupDir)
+	if err != nil {
+		return nil, err
+	}
+	backups := []backupInfo{}
+	for _, e := range entries {
+		if !strings.HasPrefix(e.Name(), backupPrefix) || e.IsDir() {
+			continue
+		}
+		info, err := e.Info()
+		if err != nil {
+			continue
+		}
+		backups = append(backups, backupInfo{Name: e.Name(), Size: info.Size(), Created: info.ModTime()})
+	}
+	sort.Slice(backups, func(i, j int) bool { return backups[i].Name < backups[j].Name })
+	return backups, nil
+}
+
+func startBackups() error {
+	if cfg.BackupDir == "" {
+		return nil
+	}
+	if err := os.MkdirAll(cfg.BackupDir, 0o700); err != nil {
+		return err
+	}
+	go func() {
+		for range time.Tick(cfg.BackupInterval) {
+			name, err := writeBackup(time.Now())
+			if err != nil {
+				log.Printf("Backup failed: %v", err)
+				continue
+			}
+			log.Printf("Wrote backup %s", name)
+		}
+	}()
+	return nil
+}
+
+// handleSnapshot streams a fresh snapshot, for `chatadmin backup`.
+func handleSnapshot(c *gin.Context) {
+	data, err := takeSnapshot(time.Now())
+	if err != nil {
+		c.JSON(500, gin.H{"error": err.Error()})
+		return
+	}
+	recordAudit(AuditEntry{Actor: c.ClientIP(), Action: "backup.download"})
+	c.Data(200, "application/octet-stream", data)
+}
+
+func handleListBackups(c *gin.Context) {
+	if cfg.BackupDir == "" {
+		c.JSON(404, gin.H{"error": "no -backup-dir configured"})
+		return
+	}
+	backups, err := listBackups()
+	if err != nil {
+		c.JSON(500, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(200, backups)
+}
+
+func handleCreateBackup(c *gin.Context) {
+	name, err := writeBackup(time.Now())
+	if err != nil {
+		c.JSON(500, gin.H{"error": err.Error()})
+		return
+	}
+	recordAudit(AuditEntry{Actor: c.ClientIP(), Action: "backup.create", Detail: name})
+	c.JSON(200, gin.H{"name": name})
+}
+
+// handleRestore restores the snapshot in the request body, or with
+// ?backup=<name> one from the backup directory.
+func handleRestore(c *gin.Context) {
+	var data []byte
+	var err error
+	source := "upload"
+	if name := c.Query("backup"); name != "" {
+		if cfg.BackupDir == "" || filepath.Base(name) != name {
+			c.JSON(400, gin.H{"error": "no such backup"})
+			return
+		}
+		source = name
+		data, err = os.ReadFile(filepath.Join(cfg.BackupDir, name))
+	} else {
+		data, err = io.ReadAll(c.Request.Body)
+	}
+	if errors.Is(err, os.ErrNotExist) {
+		c.JSON(404, gin.H{"error": "no such backup"})
+		return
+	} else if err != nil {
+		c.JSON(400, gin.H{"error": err.Error()})
+		return
+	}
+
+	n, err := restoreSnapshot(data)
+	if err != nil {
+		c.JSON(400, gin.H{"error": err.Error()})
+		return
+	}
+	recordAudit(AuditEntry{Actor: c.ClientIP(), Action: "backup.restore", Detail: fmt.Sprintf("%s, %d messages", source, n)})
+	log.Printf("Restored %d messages from %s", n, source)
+	c.JSON(200, gin.H{"messages": n})
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"sync/atomic"
+)
+
+// A frame that is not valid JSON, or not a message, is handled by the
+// -bad-json policy:
+//
+//	ignore      drop it, as the server always used to
+//	warn        drop it and send the client an "error" message with code
+//	            bad_json saying what did not parse (the default)
+//	disconnect  warn, and close the connection at the -bad-json-limit'th
+//	            such frame
+//
+// Under every policy the frames are counted, per connection in
+// /api/admin/connections/:id and for the server under "bad_frames" in
+// /api/admin/runtime, so broken clients show up rather than going quiet.
+// On /ws/mux a frame that is not a valid mux frame counts against the
+// shared connection, is answered with an error frame and closes it when
+// the policy says; a session's own bad messages count against the session.
+
+const (
+	badJSONIgnore     = "ignore"
+	badJSONWarn       = "warn"
+	badJSONDisconnect = "disconnect"
+
+	errBadJSON = "bad_json"
+)
+
+// badFrames counts frames from all connections that did not parse.
+var badFrames atomic.Int64
+
+func validBadJSON(policy string) bool {
+	return policy == badJSONIgnore || policy == badJSONWarn || policy == badJSONDisconnect
+}
+
+// badFrame counts a frame n that did not parse and reports whether the
+// connection that sent it should be closed for it.
+func badFrame(n int64) bool {
+	badFrames.Add(1)
+	return cfg.BadJSON == badJSONDisconnect && n >= int64(cfg.BadJSONLimit)
+}
+
+// badJSONText explains err, the frame's parse error, to the client that
+// sent it.
+func badJSONText(err error, closing bool) string {
+	text := fmt.Sprintf("Your message was not valid JSON: %v.", err)
+	if closing {
+		text += " Closing the connection after too many."
+	}
+	return text
+}
+
+// refuseBadJSON applies the -bad-json policy to a frame from client that
+// did not parse for err.
+func (h *Hub) refuseBadJSON(client *Client, err error) {
+	n := client.stats.badFrames.Add(1)
+	closing := badFrame(n)
+	if cfg.BadJSON == badJSONIgnore {
+		return
+	}
+	e := &ErrorInfo{Code: errBadJSON}
+	if cfg.BadJSON == badJSONDisconnect {
+		e.Limit, e.Used = int64(cfg.BadJSONLimit), n
+	}
+	h.sendToClient(client, Message{
+		Type:  MsgError,
+		Room:  client.Room,
+		Text:  badJSONText(err, closing),
+		Time:  h.clockTime(),
+		Error: e,
+	})
+	if closing && client.closeSend() {
+		log.Printf("Disconnecting %s (connection %s): %d frames that were not valid JSON", tenantQualified(h.tenant, client.Username), client.ID, n)
+		publishEvent(AdminEvent{Kind: EventDrop, Tenant: h.tenant, Room: client.Room, Username: client.Username, Detail: "invalid JSON"})
+	}
+}
@@ -0,0 +1,39 @@
+package main
+
+import "time"
+
+// Bytes written to each connection are counted in its connStats, in total
+// and over the last minute, and each room adds up what its connections were
+// sent, including those that have left; the dashboard and the connection
+// endpoint show both. With -client-bandwidth set, a connection sent more
+// than that many bytes per second over the last bandwidthWindow is over its
+// cap, and low-priority messages, which are join and leave notices and daily
+// digests, are skipped for it rather than queued. That leaves its queues to
+// chat and replies, so a busy reader falls behind on what matters least
+// before its queue overflows and it is dropped.
+
+// bandwidthWindow is how many seconds a connection's bandwidth is averaged
+// over.
+const bandwidthWindow = 5
+
+// bandwidth returns the bytes per second c was sent over the last
+// bandwidthWindow.
+func (c *Client) bandwidth(now time.Time) int64 {
+	return c.stats.bandwidth.within(now, bandwidthWindow) / bandwidthWindow
+}
+
+// throttle reports whether a low-priority message to c should be skipped
+// because c is over -client-bandwidth, counting it if so.
+func (c *Client) throttle(now time.Time) bool {
+	if cfg.ClientBandwidth <= 0 || c.bandwidth(now) <= cfg.ClientBandwidth {
+		return false
+	}
+	c.stats.throttled.Add(1)
+	return true
+}
+
+// broadcastNotice sends a low-priority msg to everyone in the room who is
+// not over -client-bandwidth.
+func (h *Hub) broadcastNotice(roomName string, msg Message) {
+	h.broadcast(roomName, msg, true)
+}
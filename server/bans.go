@@ -0,0 +1,124 @@
+package main
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Bans keep a username out of a tenant: banned users are disconnected and
+// refused at the handshake, resume token or not, until the ban expires or
+// is lifted. They are kept in memory, like the audit log.
+
+type Ban struct {
+	Username string    `json:"username"`
+	Reason   string    `json:"reason,omitempty"`
+	Since    time.Time `json:"since"`
+	Until    time.Time `json:"until,omitempty"` // zero for a permanent ban
+}
+
+type banList struct {
+	mu   sync.Mutex
+	bans map[string]Ban
+}
+
+// banned returns username's ban if one is in force at now.
+func (l *banList) banned(username string, now time.Time) (Ban, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	b, ok := l.bans[username]
+	if ok && !b.Until.IsZero() && !now.Before(b.Until) {
+		delete(l.bans, username)
+		return Ban{}, false
+	}
+	return b, ok
+}
+
+func (l *banList) add(b Ban) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.bans == nil {
+		l.bans = make(map[string]Ban)
+	}
+	l.bans[b.Username] = b
+}
+
+// remove lifts username's ban and reports whether there was one.
+func (l *banList) remove(username string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	_, ok := l.bans[username]
+	delete(l.bans, username)
+	return ok
+}
+
+// list returns the bans in force at now, by username.
+func (l *banList) list(now time.Time) []Ban {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	out := []Ban{}
+	for name, b := range l.bans {
+		if !b.Until.IsZero() && !now.Before(b.Until) {
+			delete(l.bans, name)
+			continue
+		}
+		out = append(out, b)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Username < out[j].Username })
+	return out
+}
+
+func handleListBans(c *gin.Context) {
+	c.JSON(200, adminTenant(c).hub.bans.list(time.Now()))
+}
+
+// handleBan bans a user, for {"duration": "1h"} or for good, and
+// disconnects them.
+func handleBan(c *gin.Context) {
+	var body struct {
+		Duration string `json:"duration"`
+		Reason   string `json:"reason"`
+	}
+	c.ShouldBindJSON(&body)
+	now := time.Now()
+	b := Ban{Username: c.Param("username"), Reason: body.Reason, Since: now}
+	if body.Duration != "" {
+		d, err := time.ParseDuration(body.Duration)
+		if err != nil || d <= 0 {
+			c.JSON(400, gin.H{"error": "duration must be a positive Go duration such as 30m"})
+			return
+		}
+		b.Until = now.Add(d)
+	}
+
+	t := adminTenant(c)
+	t.hub.bans.add(b)
+	reason := "You are banned from this server."
+	if b.Reason != "" {
+		reason = "You are banned: " + b.Reason
+	}
+	n := t.hub.kick(b.Username, "", reason)
+	t.hub.kicked(b.Username, n)
+	detail := "permanent"
+	if !b.Until.IsZero() {
+		detail = "for " + body.Duration
+	}
+	if b.Reason != "" {
+		detail += ": " + b.Reason
+	}
+	recordAudit(AuditEntry{Actor: c.ClientIP(), Tenant: t.Name, Action: "user.ban", Subject: b.Username, Detail: detail})
+	c.JSON(200, gin.H{"ban": b, "connections": n})
+}
+
+func handleUnban(c *gin.Context) {
+	t := adminTenant(c)
+	username := c.Param("username")
+	if !t.hub.bans.remove(username) {
+		c.JSON(404, gin.H{"error": "user is not banned"})
+		return
+	}
+	recordAudit(AuditEntry{Actor: c.ClientIP(), Tenant: t.Name, Action: "user.unban", Subject: username})
+	c.JSON(200, gin.H{"username": username})
+}
@@ -0,0 +1,64 @@
+package main
+
+import "time"
+
+// collectBatch gathers first with whatever else is queued for the client.
+// Batching only kicks in under load: if nothing else is waiting, the batch is
+// just first. Otherwise messages are gathered until BatchWindow elapses or
+// BatchMax is reached; a batch of several is sent as one JSON array frame.
+// ok is false if the send channel was closed while collecting; the batch
+// collected so far is still returned.
+func (c *Client) collectBatch(first []byte) (batch [][]byte, ok bool) {
+	batch = [][]byte{first}
+	if cfg.BatchWindow <= 0 || len(c.Send) == 0 {
+		return batch, true
+	}
+
+	timer := time.NewTimer(cfg.BatchWindow)
+	defer timer.Stop()
+
+	ok = true
+collect:
+	for len(batch) < cfg.BatchMax {
+		select {
+		case msg, open := <-c.Send:
+			if !open {
+				ok = false
+				break collect
+			}
+			batch = append(batch, msg)
+		case <-timer.C:
+			break collect
+		}
+	}
+	return batch, ok
+}
+
+// frameSize returns the size of batch as one frame.
+func frameSize(batch [][]byte) int {
+	if len(batch) == 1 {
+		return len(batch[0])
+	}
+	size := len(batch) + 1 // brackets and commas
+	for _, m := range batch {
+		size += len(m)
+	}
+	return size
+}
+
+// joinBatch returns batch as one frame: a single message as is, several
+// joined into a JSON array.
+func joinBatch(batch [][]byte) []byte {
+	if len(batch) == 1 {
+		return batch[0]
+	}
+	out := make([]byte, 0, frameSize(batch))
+	out = append(out, '[')
+	for i, m := range batch {
+		if i > 0 {
+			out = append(out, ',')
+		}
+		out = append(out, m...)
+	}
+	return append(out, ']')
+}
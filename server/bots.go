@@ -0,0 +1,53 @@
+package main
+
+import "log"
+
+// Bots are built-in users that run inside the server and react to what
+// happens in a hub. They are registered at startup from the configuration
+// and talk to users through direct messages: a "direct" message is sent to
+// one connection only, carries the bot's name as its username and is never
+// stored. A bot must not block, since hooks run on the hub's goroutine.
+
+type Bot interface {
+	// Name is the username the bot's messages carry.
+	Name() string
+	// Connected is called after client has joined its room and been sent
+	// its welcome and any replayed history.
+	Connected(h *Hub, client *Client)
+}
+
+// bots are the bots running on every tenant.
+var bots []Bot
+
+// setupBots registers the bots enabled in the configuration.
+func setupBots() error {
+	if cfg.WelcomeBot {
+		b, err := newWelcomeBot()
+		if err != nil {
+			return err
+		}
+		bots = append(bots, b)
+	}
+	for _, b := range bots {
+		log.Printf("Bot %s enabled", b.Name())
+	}
+	return nil
+}
+
+// botsConnected runs the bots' Connected hooks for client.
+func (h *Hub) botsConnected(client *Client) {
+	for _, b := range bots {
+		b.Connected(h, client)
+	}
+}
+
+// direct sends text from bot to client alone.
+func (h *Hub) direct(bot Bot, client *Client, text string) {
+	h.sendToClient(client, Message{
+		Type:     MsgDirect,
+		Room:     client.Room,
+		Username: bot.Name(),
+		Text:     text,
+		Time:     h.clockTime(),
+	})
+}
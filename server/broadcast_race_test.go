@@ -0,0 +1,120 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"sync"
+	"testing"
+	"time"
+)
+
+// These tests are meant for the race detector: go test -race.
+
+func raceConfig(t *testing.T) {
+	t.Helper()
+	saved, out := cfg, log.Writer()
+	cfg = Config{SendQueue: 4, ControlQueue: 4, ResumeSecret: "test", ResumeTTL: time.Hour}
+	log.SetOutput(io.Discard)
+	t.Cleanup(func() {
+		cfg = saved
+		log.SetOutput(out)
+	})
+}
+
+// raceClient registers a client in room with a reader draining its queues,
+// as writePump would, until the hub closes its send queue. done is closed
+// once the reader has stopped.
+func raceClient(hub *Hub, id, room string) (c *Client, done chan struct{}) {
+	c = &Client{
+		ID:       id,
+		Username: id,
+		Room:     room,
+		Send:     make(chan []byte, cfg.SendQueue),
+		Control:  make(chan []byte, cfg.ControlQueue),
+		hub:      hub,
+	}
+	done = make(chan struct{})
+	go func() {
+		defer close(done)
+		for {
+			select {
+			case <-c.Control:
+			case _, ok := <-c.Send:
+				if !ok {
+					return
+				}
+			}
+		}
+	}()
+	hub.registerClient(c)
+	return c, done
+}
+
+// TestBroadcastDuringDisconnect broadcasts to a room while its clients
+// disconnect: some close their own send queues and unregister, some are
+// dropped for falling behind, and some are kicked, all at once.
+func TestBroadcastDuringDisconnect(t *testing.T) {
+	raceConfig(t)
+	hub := newHub(defaultTenant, newMemoryStore())
+	go hub.run()
+
+	const clients, rounds = 50, 20
+	for round := 0; round < rounds; round++ {
+		var wg sync.WaitGroup
+		conns := make([]*Client, clients)
+		readers := make([]chan struct{}, clients)
+		for i := range conns {
+			conns[i], readers[i] = raceClient(hub, fmt.Sprintf("user%d", i), "lobby")
+		}
+
+		for b := 0; b < 4; b++ {
+			wg.Add(1)
+			go func(b int) {
+				defer wg.Done()
+				for i := 0; i < 50; i++ {
+					hub.broadcastToRoom("lobby", Message{Type: MsgChat, Room: "lobby", Username: "bot", Text: fmt.Sprintf("%d-%d", b, i)})
+				}
+			}(b)
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			hub.kick("user0", "", "kicked")
+			hub.kick("user1", "lobby", "kicked")
+		}()
+		for i, c := range conns {
+			wg.Add(1)
+			go func(i int, c *Client) {
+				defer wg.Done()
+				if i%2 == 0 {
+					c.closeSend() // the connection failed
+				}
+				hub.unregisterClient(c)
+			}(i, c)
+		}
+		wg.Wait()
+		for _, c := range conns {
+			c.closeSend()
+		}
+		for _, done := range readers {
+			<-done
+		}
+	}
+
+	settle(hub, 5*time.Second)
+	if n := hub.clientCount(); n != 0 {
+		t.Errorf("%d connections left after every client left", n)
+	}
+	if n := hub.roomCount(); n != 0 {
+		t.Errorf("%d rooms left after every client left", n)
+	}
+}
+
+// TestConcurrentSimulation runs simulate -concurrent briefly.
+func TestConcurrentSimulation(t *testing.T) {
+	raceConfig(t)
+	if code := runConcurrent(16, 3, 300*time.Millisecond); code != 0 {
+		t.Fatalf("runConcurrent returned %d", code)
+	}
+}
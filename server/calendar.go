@@ -0,0 +1,395 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// A room can subscribe to an ICS calendar, such as a team's shared Google or
+// Outlook calendar published as an .ics URL. The server posts a reminder to
+// the room calendar_lead minutes before each event starts, as an
+// integration message from "calendar". The room's owner and moderators set
+// it up with
+//
+//	/calendar <ics url> [minutes]
+//	/calendar off
+//
+// and anyone can see it, and the next event, with /calendar. Calendars are
+// fetched again every calendarRefresh. Recurring events with a daily or
+// weekly RRULE are expanded, skipping their EXDATEs; other recurrences are
+// reminded of at their first occurrence only, and all-day events are not
+// reminded of.
+
+const (
+	defaultCalendarLead = 10 // minutes
+	maxCalendarLead     = 24 * 60
+	calendarRefresh     = 15 * time.Minute
+	calendarTick        = 30 * time.Second
+	calendarBot         = "calendar"
+	maxCalendarSize     = 5 << 20
+)
+
+// calEvent is one VEVENT of a calendar.
+type calEvent struct {
+	Summary  string
+	Location string
+	URL      string
+	Start    time.Time
+	AllDay   bool
+	Rule     map[string]string // RRULE parts, such as FREQ=WEEKLY
+	Except   []time.Time       // EXDATEs
+}
+
+// occurrences returns the event's start times in (from, to].
+func (e calEvent) occurrences(from, to time.Time) []time.Time {
+	var out []time.Time
+	add := func(t time.Time) {
+		if t.After(from) && !t.After(to) && !slices.ContainsFunc(e.Except, t.Equal) {
+			out = append(out, t)
+		}
+	}
+	freq := e.Rule["FREQ"]
+	if freq != "DAILY" && freq != "WEEKLY" {
+		add(e.Start)
+		return out
+	}
+	interval, _ := strconv.Atoi(e.Rule["INTERVAL"])
+	interval = max(interval, 1)
+	count, _ := strconv.Atoi(e.Rule["COUNT"])
+	until := to
+	if u, _, err := parseICSTime(e.Rule["UNTIL"], "", e.Start.Location()); err == nil && u.Before(until) {
+		until = u
+	}
+	// Weekly events may fall on several days of each week.
+	days := []time.Weekday{e.Start.Weekday()}
+	if by := e.Rule["BYDAY"]; freq == "WEEKLY" && by != "" {
+		days = nil
+		for _, d := range strings.Split(by, ",") {
+			if wd, ok := icsWeekdays[d]; ok {
+				days = append(days, wd)
+			}
+		}
+		slices.Sort(days)
+	}
+	if len(days) == 0 {
+		days = []time.Weekday{e.Start.Weekday()}
+	}
+	n := 0
+	for period := 0; ; period += interval {
+		var starts []time.Time
+		if freq == "DAILY" {
+			starts = []time.Time{e.Start.AddDate(0, 0, period)}
+		} else {
+			week := e.Start.AddDate(0, 0, 7*period-int(e.Start.Weekday()))
+			for _, d := range days {
+				starts = append(starts, week.AddDate(0, 0, int(d)))
+			}
+		}
+		for _, t := range starts {
+			if t.Before(e.Start) {
+				continue
+			}
+			if t.After(until) || (count > 0 && n == count) {
+				return out
+			}
+			n++
+			add(t)
+		}
+	}
+}
+
+var icsWeekdays = map[string]time.Weekday{
+	"SU": time.Sunday, "MO": time.Monday, "TU": time.Tuesday, "WE": time.Wednesday,
+	"TH": time.Thursday, "FR": time.Friday, "SA": time.Saturday,
+}
+
+// parseICS returns the events of an iCalendar document.
+func parseICS(data string) ([]calEvent, error) {
+	data = strings.ReplaceAll(data, "\r\n", "\n")
+	data = strings.NewReplacer("\n ", "", "\n\t", "").Replace(data)
+	if !strings.HasPrefix(strings.TrimSpace(data), "BEGIN:VCALENDAR") {
+		return nil, errors.New("not an iCalendar file")
+	}
+	var events []calEvent
+	var e *calEvent
+	for _, line := range strings.Split(data, "\n") {
+		nameParams, value, ok := strings.Cut(line, ":")
+		if !ok {
+			continue
+		}
+		name, params, _ := strings.Cut(nameParams, ";")
+		switch {
+		case name == "BEGIN" && value == "VEVENT":
+			e = &calEvent{}
+		case name == "END" && value == "VEVENT" && e != nil:
+			if !e.Start.IsZero() {
+				events = append(events, *e)
+			}
+			e = nil
+		case e == nil:
+		case name == "SUMMARY":
+			e.Summary = icsText(value)
+		case name == "LOCATION":
+			e.Location = icsText(value)
+		case name == "URL":
+			e.URL = value
+		case name == "DTSTART":
+			e.Start, e.AllDay, _ = parseICSTime(value, params, time.Local)
+		case name == "RRULE":
+			e.Rule = map[string]string{}
+			for _, part := range strings.Split(value, ";") {
+				k, v, _ := strings.Cut(part, "=")
+				e.Rule[k] = v
+			}
+		case name == "EXDATE":
+			for _, v := range strings.Split(value, ",") {
+				if t, _, err := parseICSTime(v, params, time.Local); err == nil {
+					e.Except = append(e.Except, t)
+				}
+			}
+		}
+	}
+	return events, nil
+}
+
+// parseICSTime parses a DATE or DATE-TIME value with its parameters, such as
+// TZID=Europe/Paris, and reports whether it is a date alone. Times without
+// a zone are in loc.
+func parseICSTime(value, params string, loc *time.Location) (time.Time, bool, error) {
+	for _, p := range strings.Split(params, ";") {
+		if tzid, ok := strings.CutPrefix(p, "TZID="); ok {
+			if l, err := time.LoadLocation(strings.Trim(tzid, `"`)); err == nil {
+				loc = l
+			}
+		}
+	}
+	if t, err := time.Parse("20060102T150405Z", value); err == nil {
+		return t, false, nil
+	}
+	if t, err := time.ParseInLocation("20060102T150405", value, loc); err == nil {
+		return t, false, nil
+	}
+	t, err := time.ParseInLocation("20060102", value, loc)
+	return t, true, err
+}
+
+func icsText(s string) string {
+	return strings.NewReplacer(`\n`, "\n", `\N`, "\n", `\,`, ",", `\;`, ";", `\\`, `\`).Replace(s)
+}
+
+// calendars caches fetched calendars by URL.
+var calendars = struct {
+	mu    sync.Mutex
+	feeds map[string]*calendarFeed
+}{feeds: map[string]*calendarFeed{}}
+
+type calendarFeed struct {
+	events  []calEvent
+	fetched time.Time
+}
+
+// calendarEvents returns the events of the calendar at u, fetching it if it
+// is not cached or is older than calendarRefresh. A calendar that cannot be
+// fetched keeps its last events.
+func calendarEvents(u string, now time.Time) []calEvent {
+	calendars.mu.Lock()
+	f, ok := calendars.feeds[u]
+	calendars.mu.Unlock()
+	if ok && now.Sub(f.fetched) < calendarRefresh {
+		return f.events
+	}
+	events, err := fetchCalendar(u)
+	if err != nil {
+		log.Printf("Calendar %s: %v", u, err)
+		if ok {
+			events = f.events
+		}
+	}
+	calendars.mu.Lock()
+	calendars.feeds[u] = &calendarFeed{events: events, fetched: now}
+	calendars.mu.Unlock()
+	return events
+}
+
+// cachedCalendar returns the events of the calendar at u if it has been
+// fetched, without fetching it.
+func cachedCalendar(u string) ([]calEvent, bool) {
+	calendars.mu.Lock()
+	defer calendars.mu.Unlock()
+	f, ok := calendars.feeds[u]
+	if !ok {
+		return nil, false
+	}
+	return f.events, true
+}
+
+func fetchCalendar(u string) ([]calEvent, error) {
+	resp, err := feedClient.Get(u)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, errors.New(resp.Status)
+	}
+	data, err := io.ReadAll(io.LimitReader(resp.Body, maxCalendarSize))
+	if err != nil {
+		return nil, err
+	}
+	return parseICS(string(data))
+}
+
+// startCalendars posts the rooms' calendar reminders as they fall due.
+func startCalendars() {
+	go func() {
+		last := time.Now()
+		for range time.Tick(calendarTick) {
+			now := time.Now()
+			for _, h := range allHubs() {
+				h.postReminders(last, now)
+			}
+			last = now
+		}
+	}()
+}
+
+// postReminders posts the reminders due in (from, to] to the hub's rooms.
+func (h *Hub) postReminders(from, to time.Time) {
+	h.mu.RLock()
+	subscribed := map[string]RoomSettings{}
+	for room, s := range h.settings {
+		if s.Calendar != "" {
+			subscribed[room] = s
+		}
+	}
+	h.mu.RUnlock()
+
+	for room, s := range subscribed {
+		lead := time.Duration(s.calendarLead()) * time.Minute
+		for _, e := range calendarEvents(s.Calendar, to) {
+			if e.AllDay {
+				continue
+			}
+			for _, start := range e.occurrences(from.Add(lead), to.Add(lead)) {
+				h.postIntegration(room, calendarBot, reminderText(e, start, s.calendarLead()), "")
+			}
+		}
+	}
+}
+
+func reminderText(e calEvent, start time.Time, lead int) string {
+	minutes := "minutes"
+	if lead == 1 {
+		minutes = "minute"
+	}
+	text := fmt.Sprintf("📅 %s starts in %d %s, at %s", e.Summary, lead, minutes, start.In(time.Local).Format("15:04"))
+	if e.Location != "" {
+		text += " · " + e.Location
+	}
+	if e.URL != "" {
+		text += " " + e.URL
+	}
+	return text
+}
+
+// nextEvent returns the first event starting after now and when it starts.
+func nextEvent(events []calEvent, now time.Time) (calEvent, time.Time, bool) {
+	var next calEvent
+	var at time.Time
+	for _, e := range events {
+		if e.AllDay {
+			continue
+		}
+		// Look a year ahead; recurrences further out are not worth it.
+		starts := e.occurrences(now, now.AddDate(1, 0, 0))
+		if len(starts) > 0 && (at.IsZero() || starts[0].Before(at)) {
+			next, at = e, starts[0]
+		}
+	}
+	return next, at, !at.IsZero()
+}
+
+// calendarURL checks u is an http, https or webcal URL and returns it as
+// one that can be fetched.
+func calendarURL(u string) (string, error) {
+	parsed, err := url.Parse(u)
+	if err != nil {
+		return "", errors.New("invalid calendar url")
+	}
+	switch parsed.Scheme {
+	case "webcal":
+		parsed.Scheme = "https"
+	case "http", "https":
+	default:
+		return "", errors.New("calendar url must be http, https or webcal")
+	}
+	if parsed.Host == "" {
+		return "", errors.New("invalid calendar url")
+	}
+	return parsed.String(), nil
+}
+
+// calendarCommand handles /calendar and, from the room's owner or a
+// moderator, /calendar <url> [minutes] and /calendar off.
+func (h *Hub) calendarCommand(client *Client, args []string) {
+	reply := func(text string) {
+		h.sendToClient(client, Message{Type: MsgSystem, Room: client.Room, Text: text, Time: h.clockTime()})
+	}
+	s := h.roomSettings(client.Room)
+	if len(args) == 0 {
+		if s.Calendar == "" {
+			reply("This room has no calendar.")
+			return
+		}
+		text := fmt.Sprintf("Reminders are posted %d minutes before events in %s.", s.calendarLead(), s.Calendar)
+		if events, ok := cachedCalendar(s.Calendar); ok {
+			if e, at, ok := nextEvent(events, h.now()); ok {
+				text += fmt.Sprintf(" Next: %s on %s.", e.Summary, at.In(time.Local).Format("Mon Jan 2 at 15:04"))
+			}
+		}
+		reply(text)
+		return
+	}
+	if len(args) > 2 {
+		reply("Usage: /calendar [<ics url> [minutes] | off]")
+		return
+	}
+	if !s.manages(client.Username) {
+		reply("Only the room's owner and moderators can change its calendar.")
+		return
+	}
+	if args[0] == "off" {
+		h.updateSettings(client.Room, func(s *RoomSettings) { s.Calendar, s.CalendarLead = "", 0 })
+		recordAudit(AuditEntry{Actor: client.Username, Tenant: h.tenant, Action: "room.calendar", Subject: client.Room, Detail: "off"})
+		reply("Calendar reminders for " + client.Room + " are off.")
+		return
+	}
+	changed := s
+	u, err := calendarURL(args[0])
+	changed.Calendar = u
+	if err == nil && len(args) == 2 {
+		changed.CalendarLead, err = strconv.Atoi(args[1])
+		if err != nil {
+			err = errors.New("minutes must be a number")
+		}
+	}
+	if err == nil {
+		err = changed.validate()
+	}
+	if err != nil {
+		reply("Cannot use that calendar: " + err.Error() + ".")
+		return
+	}
+	h.updateSettings(client.Room, func(s *RoomSettings) { s.Calendar, s.CalendarLead = changed.Calendar, changed.CalendarLead })
+	recordAudit(AuditEntry{Actor: client.Username, Tenant: h.tenant, Action: "room.calendar", Subject: client.Room, Detail: changed.Calendar})
+	reply(fmt.Sprintf("Reminders will be posted %d minutes before events in %s.", changed.calendarLead(), changed.Calendar))
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/hathucanh13/websocket/chatclient"
+)
+
+// With -canary-interval, the server checks itself end to end: a canary
+// client connects to the server's own listener through the Go SDK, like any
+// other client, joins the hidden room _canary and every interval sends a
+// probe message and waits for it to come back through the hub. Health
+// checks answer from an HTTP handler and miss a hub loop that is stuck or a
+// broadcast path that has stalled; the canary does not. Probes, failures,
+// the last error and a histogram of round trips are reported under
+// "canary" by /api/admin/runtime, and failures are logged.
+//
+// The canary room is kept out of the room directory and /rooms, and out of
+// history.
+
+const (
+	canaryRoom = "_canary"
+	canaryUser = "_canary"
+)
+
+type canaryStats struct {
+	Probes      int64             `json:"probes"`
+	Failures    int64             `json:"failures"`
+	LastSuccess time.Time         `json:"last_success"`
+	LastError   string            `json:"last_error,omitempty"`
+	Latency     HistogramSnapshot `json:"latency"`
+}
+
+var canary struct {
+	on       atomic.Bool
+	probes   atomic.Int64
+	failures atomic.Int64
+	latency  histogram
+
+	mu          sync.Mutex
+	lastSuccess time.Time
+	lastError   string
+}
+
+// currentCanaryStats returns the canary's results, or nil if it is off.
+func currentCanaryStats() *canaryStats {
+	if !canary.on.Load() {
+		return nil
+	}
+	canary.mu.Lock()
+	defer canary.mu.Unlock()
+	return &canaryStats{
+		Probes:      canary.probes.Load(),
+		Failures:    canary.failures.Load(),
+		LastSuccess: canary.lastSuccess,
+		LastError:   canary.lastError,
+		Latency:     canary.latency.snapshot(),
+	}
+}
+
+// startCanary probes the server listening on addr every -canary-interval.
+func startCanary(addr net.Addr) {
+	if cfg.CanaryInterval <= 0 {
+		return
+	}
+	tcp, ok := addr.(*net.TCPAddr)
+	if !ok {
+		log.Printf("Canary disabled: it needs a TCP listener, not %s", addr.Network())
+		return
+	}
+	host := "127.0.0.1"
+	if !tcp.IP.IsUnspecified() {
+		host = tcp.IP.String()
+	}
+	hub.preload(canaryRoom, RoomSettings{Owner: canaryUser, NoHistory: true})
+	canary.on.Store(true)
+	go runCanary("ws://" + net.JoinHostPort(host, strconv.Itoa(tcp.Port)))
+}
+
+func runCanary(server string) {
+	echoes := make(chan string, 16)
+	var client *chatclient.Client
+	for range time.Tick(cfg.CanaryInterval) {
+		if client == nil {
+			ctx, cancel := context.WithTimeout(context.Background(), cfg.CanaryTimeout)
+			c, err := chatclient.Connect(ctx, chatclient.Options{
+				Server:       server,
+				Username:     canaryUser,
+				Rooms:        []string{canaryRoom},
+				NetworkCheck: -1,
+			})
+			cancel()
+			if err != nil {
+				canaryFailed(fmt.Errorf("connecting: %w", err))
+				continue
+			}
+			c.OnRoom(canaryRoom, func(m chatclient.Message) {
+				if m.Type == chatclient.TypeChat && m.Username == canaryUser {
+					select {
+					case echoes <- m.Text:
+					default:
+					}
+				}
+			})
+			client = c
+		}
+		if err := probe(client, echoes); err != nil {
+			canaryFailed(err)
+			// Start over with a fresh connection next time.
+			client.Close()
+			client = nil
+		}
+	}
+}
+
+// probe sends one probe through the hub and waits for it to come back.
+func probe(client *chatclient.Client, echoes chan string) error {
+	n := canary.probes.Add(1)
+	text := "probe " + strconv.FormatInt(n, 10)
+	ctx, cancel := context.WithTimeout(context.Background(), cfg.CanaryTimeout)
+	defer cancel()
+	start := time.Now()
+	if err := client.Post(canaryRoom, text); err != nil {
+		return fmt.Errorf("sending: %w", err)
+	}
+	for {
+		select {
+		case echo := <-echoes:
+			if echo != text {
+				continue // a late echo of an earlier probe
+			}
+			canary.latency.observe(time.Since(start))
+			canary.mu.Lock()
+			canary.lastSuccess = time.Now()
+			canary.mu.Unlock()
+			return nil
+		case <-ctx.Done():
+			return fmt.Errorf("%s not back within %v", text, cfg.CanaryTimeout)
+		}
+	}
+}
+
+func canaryFailed(err error) {
+	canary.failures.Add(1)
+	canary.mu.Lock()
+	canary.lastError = err.Error()
+	canary.mu.Unlock()
+	log.Printf("Canary failed: %v", err)
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// clockCache holds the HH:MM:SS rendering of one wall-clock second, so the
+// hot path formats a timestamp once per second rather than once per message.
+type clockCache struct {
+	unix int64
+	text string
+}
+
+var clock atomic.Pointer[clockCache]
+
+// clockTime returns the current time formatted as "15:04:05".
+func clockTime() string {
+	now := time.Now()
+	sec := now.Unix()
+	if c := clock.Load(); c != nil && c.unix == sec {
+		return c.text
+	}
+	c := &clockCache{unix: sec, text: now.Format("15:04:05")}
+	clock.Store(c)
+	return c.text
+}
+
+// Each hub reads the time of its messages from a Clock and numbers them
+// with an IDGenerator. Servers use the system clock and the generator
+// chosen with -message-ids; the simulator gives each hub a fakeClock and
+// sequentialIDs so a seed reproduces every timestamp and ID too.
+
+// Clock tells the time.
+type Clock interface {
+	Now() time.Time
+}
+
+type systemClock struct{}
+
+func (systemClock) Now() time.Time { return time.Now() }
+
+// fakeClock is a Clock that moves only when it is advanced.
+type fakeClock struct {
+	mu  sync.Mutex
+	now time.Time
+}
+
+func newFakeClock(start time.Time) *fakeClock {
+	return &fakeClock{now: start}
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = c.now.Add(d)
+}
+
+// now returns the hub's current time.
+func (h *Hub) now() time.Time {
+	return h.clock.Now()
+}
+
+// clockTime returns the hub's current time formatted as "15:04:05".
+func (h *Hub) clockTime() string {
+	if _, ok := h.clock.(systemClock); ok {
+		return clockTime()
+	}
+	return h.clock.Now().Format("15:04:05")
+}
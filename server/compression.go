@@ -0,0 +1,30 @@
+package main
+
+import "bytes"
+
+// skipPrefixes holds the encoded start of messages whose type is excluded
+// from compression. Message always marshals its type first, so a prefix
+// check avoids decoding every outbound frame.
+var skipPrefixes [][]byte
+
+func setupCompression() {
+	upgrader.EnableCompression = cfg.Compression
+	for _, t := range cfg.CompressionSkipTypes {
+		skipPrefixes = append(skipPrefixes, []byte(`{"type":"`+t+`"`))
+	}
+}
+
+// shouldCompress reports whether an outbound frame of size bytes starting
+// with data is worth compressing: compression is on, the payload reaches the
+// size threshold, and its type is not excluded.
+func shouldCompress(data []byte, size int) bool {
+	if !cfg.Compression || size < cfg.CompressionMinSize {
+		return false
+	}
+	for _, p := range skipPrefixes {
+		if bytes.HasPrefix(data, p) {
+			return false
+		}
+	}
+	return true
+}
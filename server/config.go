@@ -0,0 +1,254 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"flag"
+	"log"
+	"os"
+	"runtime"
+	"strings"
+	"time"
+)
+
+// Config holds the server settings, taken from flags with environment
+// variable fallbacks for secrets.
+type Config struct {
+	Addr         string
+	Verbose      bool          // log every message sent and received
+	Echo         bool          // echo chat messages to their sender only, without storing or broadcasting them
+	Backend      string        // connection backend: gorilla or epoll
+	SendQueue    int           // outbound chat messages buffered per client
+	ControlQueue int           // outbound control messages buffered per client
+	EpollWorkers int           // goroutines serving reads and writes for the epoll backend
+	ResumeSecret string        // HMAC key for resume tokens
+	ResumeTTL    time.Duration // how long a resume token stays valid
+
+	Compression          bool     // negotiate permessage-deflate
+	CompressionLevel     int      // flate level, 1 (fastest) to 9 (best)
+	CompressionMinSize   int      // frames smaller than this are sent uncompressed
+	CompressionSkipTypes []string // message types never compressed
+
+	BatchWindow time.Duration // how long to gather queued messages into one frame; 0 disables
+	BatchMax    int           // most messages per batch frame
+
+	FragmentSize int // outbound messages larger than this are streamed in fragments of this size; 0 disables
+
+	MaxConnections  int           // refuse new connections beyond this many; 0 is unlimited
+	ClientBandwidth int64         // bytes per second a client is sent before low-priority messages to it are throttled; 0 is unlimited
+	DrainDelay      time.Duration // time between reporting not-ready and closing the listener
+
+	RateLimit float64 // messages per second allowed per username across all its connections; 0 disables
+	RateBurst int     // messages a username may send at once before the rate applies
+
+	PowDifficulty int // leading zero bits of proof of work required to join without a resume token; 0 disables
+
+	AlertWebhook     string // URL alerts are POSTed to; they are always logged
+	AlertJoins       int    // joins from one IP per minute that raise an alert; 0 disables
+	AlertFloods      int    // rate-limited messages from one username per minute that raise an alert; 0 disables
+	AlertPowFailures int    // failed proofs of work from one IP per minute that raise an alert; 0 disables
+	AlertKicks       int    // kicks of one username per minute that raise an alert; 0 disables
+
+	MuteAfter        int           // rate-limit violations within EscalationWindow that mute a user; 0 disables
+	MuteFor          time.Duration // how long such a mute lasts
+	BanAfter         int           // mutes within EscalationWindow that ban a user; 0 disables
+	BanFor           time.Duration // how long such a ban lasts
+	EscalationWindow time.Duration // window violations and mutes are counted in
+
+	MaxObservers int // observers each room may have; 0 refuses them
+
+	RoomMaxIdle time.Duration // how long a room may go without chat before it is archived, unless it says otherwise; 0 for ever
+
+	BadJSON      string // what to do with frames that are not valid JSON: ignore, warn or disconnect
+	BadJSONLimit int    // frames that are not valid JSON a connection may send before -bad-json disconnect closes it
+
+	CanaryInterval time.Duration // how often the canary probes the server end to end; 0 disables
+	CanaryTimeout  time.Duration // how long a probe may take to come back
+
+	AdminToken    string // bearer token for /api/admin; empty disables the admin API
+	TenantsFile   string // JSON file defining tenants beyond the default one
+	RoomsFile     string // JSON file declaring rooms that exist from startup
+	TemplatesFile string // JSON file of templates rooms can be created from with /create
+	PublicURL     string // base URL of the web UI in /invite links; empty uses the client's Host
+
+	LanguageFilter string // default profanity filter level: off, mild or strict
+
+	WelcomeBot      bool   // greet first-time users with a direct message
+	WelcomeTemplate string // text/template file for the greeting; empty uses the built-in one
+	WelcomeSeen     string // file remembering greeted users; empty keeps them in memory
+
+	PrefsFile    string // file keeping users' notification preferences; empty keeps them in memory
+	Registration bool   // let users register their names; chat from unregistered names is marked unverified
+	UsersFile    string // file keeping registered usernames; empty keeps them in memory
+	DigestTime   string // local time of day, HH:MM, daily digests are posted
+	MaxPins      int    // pinned messages a room may hold unless its settings say otherwise
+
+	ReceiptRoomSize int // rooms of at most this many members relay delivered and read receipts; 0 disables them
+
+	AttachmentDir    string        // where uploaded files such as custom emoji are kept; empty disables uploads
+	MaxAudioSize     int           // largest audio clip accepted for upload, in bytes
+	MaxAudioDuration time.Duration // longest audio clip accepted for upload
+
+	MessageIDs   string // how message IDs are made: counter, ulid or uuid
+	TraceLog     bool   // log each step of every chat message's path with its trace ID
+	TraceClients bool   // send chat messages' trace IDs to clients
+
+	Store          string // where history is kept: memory, sqlite:<path> or postgres:<dsn>
+	AutoMigrate    bool   // apply pending schema migrations at startup
+	RoomCache      int    // recent messages per room kept in memory in front of a database store; 0 disables
+	HistoryKey     string // AES-256 key, hex or base64, encrypting stored message text
+	HistoryKeyFile string // file holding HistoryKey, e.g. written by a KMS agent
+
+	BackupDir      string        // where periodic snapshots are written; empty disables them
+	BackupInterval time.Duration // time between snapshots
+	BackupKeep     int           // snapshots kept before the oldest is deleted
+}
+
+var cfg Config
+
+const (
+	backendGorilla = "gorilla"
+	backendEpoll   = "epoll"
+)
+
+func loadConfig() Config {
+	var c Config
+	flag.StringVar(&c.Addr, "addr", ":8080", "listen address")
+	flag.BoolVar(&c.Verbose, "verbose", false, "log every message sent and received (slow)")
+	flag.BoolVar(&c.Echo, "echo", false,
+		"dry-run mode for client development and conformance tests: chat messages are accepted, validated and echoed to their sender only, never stored or broadcast")
+	flag.StringVar(&c.Backend, "backend", backendGorilla,
+		"connection backend: gorilla (two goroutines per connection) or epoll (shared workers, low memory; Linux only)")
+	flag.IntVar(&c.SendQueue, "send-queue", 256, "outbound chat messages buffered per client")
+	flag.IntVar(&c.ControlQueue, "control-queue", 64,
+		"outbound system messages, acks and kicks buffered per client, delivered ahead of chat")
+	flag.IntVar(&c.EpollWorkers, "epoll-workers", runtime.GOMAXPROCS(0)*4, "worker goroutines for the epoll backend")
+	flag.IntVar(&c.MaxConnections, "max-connections", 0, "report not ready and refuse new connections at this many (0 = unlimited)")
+	flag.Int64Var(&c.ClientBandwidth, "client-bandwidth", 0,
+		"bytes per second sent to one client before join and leave notices and digests to it are skipped (0 = unlimited)")
+	flag.DurationVar(&c.DrainDelay, "drain-delay", 0, "on shutdown, report not ready for this long before closing the listener")
+	flag.Float64Var(&c.RateLimit, "rate-limit", 0, "messages per second per username, shared by all its connections on this process (0 = off, the default)")
+	flag.IntVar(&c.RateBurst, "rate-burst", 10, "messages a username may send in a burst once -rate-limit is set")
+	flag.IntVar(&c.PowDifficulty, "pow-difficulty", 0, "require a proof of work of this many zero bits to join without a resume token (0 = off, ~20 costs a client about a second)")
+	flag.StringVar(&c.AlertWebhook, "alert-webhook", "", "URL to POST abuse alerts to as JSON (alerts are always logged)")
+	flag.IntVar(&c.AlertJoins, "alert-joins", 30, "alert when one IP joins this many times in a minute (0 = off)")
+	flag.IntVar(&c.AlertFloods, "alert-floods", 20, "alert when one username is rate-limited this many times in a minute; needs -rate-limit (0 = off)")
+	flag.IntVar(&c.AlertPowFailures, "alert-pow-failures", 10, "alert when one IP fails this many proofs of work in a minute (0 = off)")
+	flag.IntVar(&c.AlertKicks, "alert-kicks", 3, "alert when one username is kicked or banned, by an admin or by escalation, this many times in a minute (0 = off)")
+	flag.IntVar(&c.MuteAfter, "mute-after", 0, "mute a user who hits the rate limit this many times within -escalation-window (0 = off)")
+	flag.DurationVar(&c.MuteFor, "mute-for", 10*time.Minute, "how long a user muted by -mute-after stays muted")
+	flag.IntVar(&c.BanAfter, "ban-after", 0, "ban a user muted this many times within -escalation-window (0 = off)")
+	flag.DurationVar(&c.BanFor, "ban-for", 24*time.Hour, "how long a user banned by -ban-after stays banned")
+	flag.DurationVar(&c.RoomMaxIdle, "room-max-idle", 0,
+		"archive rooms that have had no chat for this long, even with members connected, until the next message, unless their max_idle setting says otherwise (0 = never)")
+	flag.IntVar(&c.MaxObservers, "max-observers", 100, "read-only ?mode=observer connections each room may have, apart from the tenant's connection quota (0 = none)")
+	flag.StringVar(&c.BadJSON, "bad-json", badJSONWarn,
+		"frames that are not valid JSON: ignore (drop them), warn (drop them and send the client a bad_json error) or disconnect (warn, and close the connection at -bad-json-limit)")
+	flag.IntVar(&c.BadJSONLimit, "bad-json-limit", 5, "with -bad-json disconnect, close a connection at this many frames that are not valid JSON")
+	flag.DurationVar(&c.CanaryInterval, "canary-interval", 0, "probe the server end to end through its own WebSocket endpoint this often, reporting to /api/admin/runtime (0 = off)")
+	flag.DurationVar(&c.CanaryTimeout, "canary-timeout", 5*time.Second, "how long a canary probe may take to come back before it counts as failed")
+	flag.DurationVar(&c.EscalationWindow, "escalation-window", time.Hour, "window in which -mute-after counts violations and -ban-after counts mutes")
+	flag.StringVar(&c.AdminToken, "admin-token", os.Getenv("CHAT_ADMIN_TOKEN"),
+		"bearer token enabling the /api/admin endpoints (env CHAT_ADMIN_TOKEN; empty disables them)")
+	flag.StringVar(&c.MessageIDs, "message-ids", idsCounter,
+		"message IDs: counter (shortest), ulid or uuid (version 7), both of which sort in the order messages were sent")
+	flag.BoolVar(&c.TraceLog, "trace-log", false, "log each step of every chat message's path through the server with its trace ID")
+	flag.BoolVar(&c.TraceClients, "trace-clients", false, "send clients the trace ID of each chat message, and of the ack of their own")
+	flag.StringVar(&c.Store, "store", "memory", "history store: memory (last 100 per room), sqlite:<path> or postgres:<dsn>")
+	flag.BoolVar(&c.AutoMigrate, "auto-migrate", true, "apply pending database migrations at startup (otherwise run `server migrate`)")
+	flag.IntVar(&c.RoomCache, "room-cache", historySize,
+		"recent messages per room kept in memory in front of a sqlite or postgres store, serving replays and /history (0 = off)")
+	flag.StringVar(&c.HistoryKey, "history-key", os.Getenv("CHAT_HISTORY_KEY"),
+		"32-byte key, hex or base64, to encrypt stored message text with AES-GCM (env CHAT_HISTORY_KEY)")
+	flag.StringVar(&c.HistoryKeyFile, "history-key-file", "", "read the history key from this file instead, e.g. one provisioned by a KMS")
+	flag.StringVar(&c.BackupDir, "backup-dir", "", "write periodic snapshots of the history store to this directory")
+	flag.DurationVar(&c.BackupInterval, "backup-interval", time.Hour, "time between snapshots in -backup-dir")
+	flag.IntVar(&c.BackupKeep, "backup-keep", 24, "number of snapshots to keep in -backup-dir")
+	flag.StringVar(&c.PublicURL, "public-url", "", "base URL for /invite links, e.g. https://chat.example.com (default: the host clients connect to)")
+	flag.StringVar(&c.AttachmentDir, "attachment-dir", "", "keep uploaded files such as custom emoji in this directory (default: uploads disabled)")
+	flag.StringVar(&c.LanguageFilter, "language-filter", filterOff, "default profanity filter for rooms that do not choose their own: off, mild or strict")
+	flag.BoolVar(&c.WelcomeBot, "welcome-bot", false, "send users a direct message with instructions the first time they connect")
+	flag.StringVar(&c.WelcomeTemplate, "welcome-template", "", "text/template file for the welcome bot's message (default: built in)")
+	flag.StringVar(&c.WelcomeSeen, "welcome-seen", "", "file remembering which users the welcome bot has greeted (default: in memory)")
+	flag.StringVar(&c.PrefsFile, "prefs-file", "", "file keeping users' notification preferences (default: in memory)")
+	flag.BoolVar(&c.Registration, "registration", false,
+		"let users register their usernames with a password; registered names need a login to use, and chat from other names is marked unverified")
+	flag.StringVar(&c.UsersFile, "users-file", "", "file keeping registered usernames (default: in memory)")
+	flag.StringVar(&c.DigestTime, "digest-time", "09:00", "local time of day, HH:MM, to post daily digests to rooms that want them")
+	flag.IntVar(&c.MaxPins, "max-pins", 10, "pinned messages a room may hold, unless its settings give its own limit")
+	flag.IntVar(&c.ReceiptRoomSize, "receipt-room-size", 10, "tell senders who received and read their messages in rooms of at most this many members (0 = never)")
+	flag.IntVar(&c.MaxAudioSize, "max-audio-size", 1<<20, "largest audio clip users may upload, in bytes")
+	flag.DurationVar(&c.MaxAudioDuration, "max-audio-duration", time.Minute, "longest audio clip users may upload")
+	flag.StringVar(&c.RoomsFile, "rooms", "", "JSON file of rooms to create at startup with their topic, settings and moderators")
+	flag.StringVar(&c.TemplatesFile, "room-templates", "", "JSON file of room templates users can create rooms from with /create <room> --template <name>")
+	flag.StringVar(&c.TenantsFile, "tenants", "", "JSON file of tenants with their keys and quotas; clients pick one with ?tenant=")
+	flag.StringVar(&c.ResumeSecret, "resume-secret", os.Getenv("CHAT_RESUME_SECRET"),
+		"key used to sign resume tokens (default: random per process, env CHAT_RESUME_SECRET)")
+	flag.DurationVar(&c.ResumeTTL, "resume-ttl", 24*time.Hour, "lifetime of resume tokens")
+	flag.BoolVar(&c.Compression, "compression", false, "enable permessage-deflate compression")
+	flag.IntVar(&c.CompressionLevel, "compression-level", 1, "compression level, 1 (fastest) to 9 (best)")
+	flag.IntVar(&c.CompressionMinSize, "compression-min-size", 512, "minimum payload size in bytes worth compressing")
+	skipTypes := flag.String("compression-skip-types", "",
+		"comma-separated message types sent uncompressed, e.g. already-compressed attachments")
+	flag.DurationVar(&c.BatchWindow, "batch-window", 0,
+		"coalesce messages queued for a client into one JSON array frame for up to this long (0 disables)")
+	flag.IntVar(&c.BatchMax, "batch-max", 64, "maximum messages per batch frame")
+	flag.IntVar(&c.FragmentSize, "fragment-size", 64<<10,
+		"stream outbound messages larger than this many bytes as fragments of this size (0 disables; minimum 16384)")
+	flag.Parse()
+
+	for _, t := range strings.Split(*skipTypes, ",") {
+		if t = strings.TrimSpace(t); t != "" {
+			c.CompressionSkipTypes = append(c.CompressionSkipTypes, t)
+		}
+	}
+
+	if c.Backend != backendGorilla && c.Backend != backendEpoll {
+		log.Fatalf("unknown backend %q (want %s or %s)", c.Backend, backendGorilla, backendEpoll)
+	}
+	if c.FragmentSize != 0 && c.FragmentSize < minFragmentSize {
+		log.Fatalf("-fragment-size must be 0 or at least %d", minFragmentSize)
+	}
+	if c.RoomCache < 0 {
+		log.Fatal("-room-cache must not be negative")
+	}
+	if c.ClientBandwidth < 0 {
+		log.Fatal("-client-bandwidth must not be negative")
+	}
+	ids, err := newIDGenerator(c.MessageIDs, systemClock{})
+	if err != nil {
+		log.Fatalf("-message-ids: %v", err)
+	}
+	messageIDs = ids
+	if !validBadJSON(c.BadJSON) {
+		log.Fatalf("unknown -bad-json %q (want ignore, warn or disconnect)", c.BadJSON)
+	}
+	if c.RoomMaxIdle < 0 {
+		log.Fatal("-room-max-idle must not be negative")
+	}
+	if c.BadJSONLimit <= 0 {
+		log.Fatal("-bad-json-limit must be positive")
+	}
+	if !validFilter(c.LanguageFilter) {
+		log.Fatalf("unknown -language-filter %q (want off, mild or strict)", c.LanguageFilter)
+	}
+	if _, err := time.Parse("15:04", c.DigestTime); err != nil {
+		log.Fatal("-digest-time must be HH:MM, e.g. 09:00")
+	}
+	if c.MaxPins <= 0 {
+		log.Fatal("-max-pins must be positive")
+	}
+	if c.MaxAudioSize <= 0 || c.MaxAudioDuration <= 0 {
+		log.Fatal("-max-audio-size and -max-audio-duration must be positive")
+	}
+	if c.BackupDir != "" && c.BackupInterval <= 0 {
+		log.Fatal("-backup-interval must be positive")
+	}
+	c.BackupKeep = max(c.BackupKeep, 1)
+	if c.ResumeSecret == "" {
+		b := make([]byte, 32)
+		rand.Read(b)
+		c.ResumeSecret = hex.EncodeToString(b)
+	}
+	return c
+}
@@ -0,0 +1,289 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"gopkg.in/yaml.v3"
+)
+
+// A tenant's rooms, with their settings and webhooks, and its bans can be
+// exported as YAML and imported into another server, to promote a setup
+// from staging to production or to rehearse recovering from a disaster:
+//
+//	GET /api/admin/config[?keys=true]     exports the tenant's configuration
+//	PUT /api/admin/config[?dry_run=true]  imports a document
+//
+// A document looks like this, with the RoomSettings fields by their JSON
+// names, as in the -rooms file; tenant names the tenant it was exported
+// from, and is left out for the default tenant:
+//
+//	version: 1
+//	tenant: acme
+//	exported: "2026-06-01T09:00:00Z"
+//	rooms:
+//	  - name: general
+//	    webhooks:
+//	      ci: whk_...
+//	    owner: alice
+//	    topic: Say hello
+//	    persistent: true
+//	bans:
+//	  - username: mallory
+//	    reason: spam
+//	    since: "2026-05-30T12:00:00Z"
+//	    until: "0001-01-01T00:00:00Z"
+//
+// Webhook keys are secrets, so an export gives them only with ?keys=true,
+// and webhooks otherwise have empty keys, which an import skips. An import
+// merges: each room in the document gets exactly the settings it gives, its
+// webhooks with keys are set and its bans are added, while rooms, webhooks
+// and bans the document does not mention are left alone. Banned users who
+// are connected are sent away. The whole document is checked before any of
+// it is applied, and with ?dry_run=true none of it is. Whether a room is
+// dormant (see idle.go) is the server's own business and is neither
+// exported nor imported; nor are feeds and membership hooks, which stay in
+// the -rooms file.
+
+const configVersion = 1
+
+// ConfigDocument is a tenant's configuration as exported and imported.
+type ConfigDocument struct {
+	Version  int          `json:"version"`
+	Tenant   string       `json:"tenant,omitempty"`
+	Exported time.Time    `json:"exported"`
+	Rooms    []RoomExport `json:"rooms"`
+	Bans     []Ban        `json:"bans"`
+}
+
+// RoomExport is one room in a ConfigDocument.
+type RoomExport struct {
+	Name     string            `json:"name"`
+	Webhooks map[string]string `json:"webhooks,omitempty"` // name -> key, empty if keys were not exported
+	RoomSettings
+}
+
+// keys returns room's webhooks by name with their keys.
+func (l *webhookList) keys(room string) map[string]string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	keys := make(map[string]string, len(l.rooms[room]))
+	for name, key := range l.rooms[room] {
+		keys[name] = key
+	}
+	return keys
+}
+
+// exportConfig returns the hub's rooms and bans at now, with the webhooks'
+// keys if withKeys is set.
+func (h *Hub) exportConfig(withKeys bool, now time.Time) ConfigDocument {
+	h.mu.RLock()
+	names := make([]string, 0, len(h.settings))
+	for name := range h.settings {
+		if name != canaryRoom {
+			names = append(names, name)
+		}
+	}
+	h.mu.RUnlock()
+	sort.Strings(names)
+
+	doc := ConfigDocument{Version: configVersion, Tenant: h.tenant, Exported: now.UTC(), Rooms: []RoomExport{}}
+	for _, name := range names {
+		r := RoomExport{Name: name, RoomSettings: h.roomSettings(name)}
+		r.Dormant = false
+		if hooks := h.webhooks.keys(name); len(hooks) > 0 {
+			if !withKeys {
+				for hook := range hooks {
+					hooks[hook] = ""
+				}
+			}
+			r.Webhooks = hooks
+		}
+		doc.Rooms = append(doc.Rooms, r)
+	}
+	doc.Bans = h.bans.list(now)
+	return doc
+}
+
+// toYAML renders v as block-style YAML with the field names and order of
+// its JSON encoding.
+func toYAML(v any) ([]byte, error) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	var node yaml.Node
+	if err := yaml.Unmarshal(data, &node); err != nil {
+		return nil, err
+	}
+	var plain func(n *yaml.Node)
+	plain = func(n *yaml.Node) {
+		n.Style = 0 // the encoder quotes what needs it
+		for _, c := range n.Content {
+			plain(c)
+		}
+	}
+	plain(&node)
+	var buf bytes.Buffer
+	enc := yaml.NewEncoder(&buf)
+	enc.SetIndent(2)
+	if err := enc.Encode(&node); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), enc.Close()
+}
+
+// parseConfig reads a YAML, or JSON, document, refusing fields it does
+// not know.
+func parseConfig(data []byte) (ConfigDocument, error) {
+	var doc ConfigDocument
+	var v any
+	if err := yaml.Unmarshal(data, &v); err != nil {
+		return doc, err
+	}
+	j, err := json.Marshal(v)
+	if err != nil {
+		return doc, err
+	}
+	dec := json.NewDecoder(bytes.NewReader(j))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&doc); err != nil {
+		return doc, err
+	}
+	return doc, nil
+}
+
+// validate checks doc before any of it is applied.
+func (doc ConfigDocument) validate() error {
+	if doc.Version != configVersion {
+		return fmt.Errorf("unsupported version %d (want %d)", doc.Version, configVersion)
+	}
+	seen := map[string]bool{}
+	for _, r := range doc.Rooms {
+		if r.Name == "" || r.Name != strings.TrimSpace(r.Name) || r.Name == canaryRoom {
+			return fmt.Errorf("invalid room name %q", r.Name)
+		}
+		if seen[r.Name] {
+			return fmt.Errorf("room %s is given twice", r.Name)
+		}
+		seen[r.Name] = true
+		if err := r.validate(); err != nil {
+			return fmt.Errorf("room %s: %w", r.Name, err)
+		}
+		for name := range r.Webhooks {
+			if !groupName.MatchString(name) {
+				return fmt.Errorf("room %s: invalid webhook %q", r.Name, name)
+			}
+		}
+	}
+	for _, b := range doc.Bans {
+		if b.Username == "" {
+			return errors.New("a ban has no username")
+		}
+	}
+	return nil
+}
+
+// importResult counts what an import changed, or would change.
+type importResult struct {
+	Rooms    int  `json:"rooms"`
+	Webhooks int  `json:"webhooks"`
+	Bans     int  `json:"bans"`
+	DryRun   bool `json:"dry_run,omitempty"`
+}
+
+// importConfig applies doc, checked already, to the hub at now, or with
+// dryRun only counts what it would change.
+func (h *Hub) importConfig(doc ConfigDocument, dryRun bool, now time.Time) importResult {
+	res := importResult{DryRun: dryRun}
+	for _, r := range doc.Rooms {
+		res.Rooms++
+		for name, key := range r.Webhooks {
+			if key == "" {
+				continue
+			}
+			res.Webhooks++
+			if !dryRun {
+				h.webhooks.set(r.Name, name, key)
+			}
+		}
+		if dryRun {
+			continue
+		}
+		before := h.roomSettings(r.Name)
+		s := r.RoomSettings
+		s.Dormant = before.Dormant
+		h.preload(r.Name, s)
+		h.historyChanged(r.Name, before, s)
+		h.topicChanged(r.Name, before, s)
+	}
+	for _, b := range doc.Bans {
+		if !b.Until.IsZero() && !now.Before(b.Until) {
+			continue // over already
+		}
+		res.Bans++
+		if dryRun {
+			continue
+		}
+		if b.Since.IsZero() {
+			b.Since = now
+		}
+		h.bans.add(b)
+		reason := "You are banned from this server."
+		if b.Reason != "" {
+			reason = "You are banned: " + b.Reason
+		}
+		h.kick(b.Username, "", reason)
+	}
+	return res
+}
+
+// handleExportConfig exports the tenant's rooms and bans as YAML.
+func handleExportConfig(c *gin.Context) {
+	t := adminTenant(c)
+	withKeys, _ := strconv.ParseBool(c.Query("keys"))
+	doc := t.hub.exportConfig(withKeys, time.Now())
+	data, err := toYAML(doc)
+	if err != nil {
+		c.JSON(500, gin.H{"error": err.Error()})
+		return
+	}
+	recordAudit(AuditEntry{Actor: c.ClientIP(), Tenant: t.Name, Action: "config.export",
+		Detail: fmt.Sprintf("%d rooms, %d bans, keys=%v", len(doc.Rooms), len(doc.Bans), withKeys)})
+	c.Data(200, "application/yaml; charset=utf-8", data)
+}
+
+// handleImportConfig imports the YAML document in the body into the
+// tenant.
+func handleImportConfig(c *gin.Context) {
+	t := adminTenant(c)
+	dryRun, _ := strconv.ParseBool(c.Query("dry_run"))
+	data, err := io.ReadAll(c.Request.Body)
+	if err != nil {
+		c.JSON(400, gin.H{"error": err.Error()})
+		return
+	}
+	doc, err := parseConfig(data)
+	if err != nil {
+		c.JSON(400, gin.H{"error": "invalid document: " + err.Error()})
+		return
+	}
+	if err := doc.validate(); err != nil {
+		c.JSON(400, gin.H{"error": err.Error()})
+		return
+	}
+	res := t.hub.importConfig(doc, dryRun, time.Now())
+	if !dryRun {
+		recordAudit(AuditEntry{Actor: c.ClientIP(), Tenant: t.Name, Action: "config.import",
+			Detail: fmt.Sprintf("from tenant %q: %d rooms, %d webhooks, %d bans", doc.Tenant, res.Rooms, res.Webhooks, res.Bans)})
+	}
+	c.JSON(200, res)
+}
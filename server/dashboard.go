@@ -0,0 +1,294 @@
+package main
+
+import (
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// The dashboard at /admin is a static page that polls /api/admin/rooms and
+// drives the moderation endpoints below with the token the operator enters,
+// so it can do exactly what the admin API allows and nothing more.
+
+// roomInfo is one live room as shown on the dashboard.
+type roomInfo struct {
+	Name              string     `json:"name"`
+	Members           int        `json:"members"`
+	Observers         int        `json:"observers,omitempty"` // see observers.go
+	MessagesPerMinute int64      `json:"messages_per_minute"`
+	LastSeq           int64      `json:"last_seq"`
+	BytesSent         int64      `json:"bytes_sent"` // to its connections, live and gone
+	Connections       []connInfo `json:"connections"`
+}
+
+// connInfo is one connection in a room. Queue is how many messages wait in
+// its send queue; a queue near QueueCap belongs to a slow reader about to
+// be dropped.
+type connInfo struct {
+	ID        string    `json:"id"`
+	Username  string    `json:"username"`
+	Connected time.Time `json:"connected"`
+	Resumed   bool      `json:"resumed"`
+	Observer  bool      `json:"observer,omitempty"`
+	Queue     int       `json:"queue"`
+	QueueCap  int       `json:"queue_cap"`
+	BytesSent int64     `json:"bytes_sent"`
+	Bandwidth int64     `json:"bytes_per_second"`
+	Throttled int64     `json:"throttled"`
+	Quality   string    `json:"quality"` // graded as in quality.go
+	RTTMillis int64     `json:"rtt_ms"`
+}
+
+// rateMeter counts events, or bytes, over the last minute in one-second
+// buckets.
+type rateMeter struct {
+	mu      sync.Mutex
+	counts  [60]int64
+	seconds [60]int64 // the unix second each bucket is counting
+}
+
+func (m *rateMeter) add(now time.Time) { m.addN(now, 1) }
+
+func (m *rateMeter) addN(now time.Time, n int64) {
+	sec := now.Unix()
+	i := sec % 60
+	m.mu.Lock()
+	if m.seconds[i] != sec {
+		m.seconds[i], m.counts[i] = sec, 0
+	}
+	m.counts[i] += n
+	m.mu.Unlock()
+}
+
+// perMinute returns the number of events in the minute before now.
+func (m *rateMeter) perMinute(now time.Time) int64 {
+	return m.within(now, 60)
+}
+
+// within returns the number of events in the secs seconds before now, at
+// most 60.
+func (m *rateMeter) within(now time.Time, secs int64) int64 {
+	sec := now.Unix()
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var n int64
+	for i := range m.counts {
+		if sec-m.seconds[i] < secs {
+			n += m.counts[i]
+		}
+	}
+	return n
+}
+
+// roomInfos describes the hub's live rooms, by name.
+func (h *Hub) roomInfos(now time.Time) []roomInfo {
+	rooms := h.roomList()
+	sort.Slice(rooms, func(i, j int) bool { return rooms[i].Name < rooms[j].Name })
+
+	infos := make([]roomInfo, 0, len(rooms))
+	for _, room := range rooms {
+		h.mu.Lock()
+		seq := h.lastSeq(room.Name)
+		h.mu.Unlock()
+		info := roomInfo{
+			Name:              room.Name,
+			MessagesPerMinute: room.rate.perMinute(now),
+			LastSeq:           seq,
+			BytesSent:         room.sent.Load(),
+			Connections:       []connInfo{},
+		}
+		room.mu.RLock()
+		for c := range room.Clients {
+			sent := c.stats.sent.Load()
+			info.BytesSent += sent
+			info.Connections = append(info.Connections, connInfo{
+				ID:        c.ID,
+				Username:  c.Username,
+				Connected: c.connected,
+				Resumed:   c.Resumed,
+				Observer:  c.observer,
+				Queue:     len(c.Send),
+				QueueCap:  cap(c.Send),
+				BytesSent: sent,
+				Bandwidth: c.bandwidth(now),
+				Throttled: c.stats.throttled.Load(),
+				Quality:   c.stats.quality(now),
+				RTTMillis: c.stats.rttMillis(),
+			})
+		}
+		info.Members = room.members()
+		info.Observers = len(info.Connections) - info.Members
+		room.mu.RUnlock()
+		sort.Slice(info.Connections, func(i, j int) bool {
+			return info.Connections[i].Username < info.Connections[j].Username
+		})
+		infos = append(infos, info)
+	}
+	return infos
+}
+
+// kick disconnects username's connections, only those in room if it is not
+// empty, telling them reason. It returns how many it closed. Kicked clients
+// get a kicked message, which tells the SDK not to reconnect, and leave
+// their rooms when they unregister.
+func (h *Hub) kick(username, room, reason string) int {
+	n := 0
+	for _, r := range h.roomList() {
+		if room != "" && r.Name != room {
+			continue
+		}
+		notice := mustMarshal(Message{Type: MsgKicked, Room: r.Name, Text: reason, Time: h.clockTime()})
+		r.mu.RLock()
+		for c := range r.Clients {
+			if c.Username == username {
+				c.enqueue(notice)
+				if c.closeSend() {
+					n++
+				}
+			}
+		}
+		r.mu.RUnlock()
+	}
+	return n
+}
+
+// kicked counts a kick or ban of username that closed n connections
+// towards -alert-kicks. Kicks that only tidy up, like sending off an
+// unregistered user of a name just registered, are not counted.
+func (h *Hub) kicked(username string, n int) {
+	if n > 0 {
+		kickAlerts.hit(tenantQualified(h.tenant, username), time.Now())
+	}
+}
+
+// closeRoom disconnects everyone in room, telling them reason, and removes
+// it. It returns how many connections it closed.
+func (h *Hub) closeRoom(name, reason string) int {
+	notice := mustMarshal(Message{Type: MsgKicked, Room: name, Text: reason, Time: h.clockTime()})
+	h.mu.Lock()
+	room, ok := h.rooms[name]
+	delete(h.rooms, name)
+	h.mu.Unlock()
+	if !ok {
+		return 0
+	}
+	room.mu.Lock()
+	defer room.mu.Unlock()
+	n := len(room.Clients)
+	for c := range room.Clients {
+		c.enqueue(notice)
+		c.closeSend()
+		delete(room.Clients, c)
+	}
+	return n
+}
+
+// announce posts text as a system message to room, or to every room if it
+// is empty, and returns how many rooms it reached.
+func (h *Hub) announce(room, text string) int {
+	n := 0
+	for _, r := range h.roomList() {
+		if room != "" && r.Name != room {
+			continue
+		}
+		h.broadcastToRoom(r.Name, Message{
+			Type: MsgSystem,
+			Room: r.Name,
+			Text: "Announcement: " + text,
+			Time: h.clockTime(),
+		})
+		n++
+	}
+	return n
+}
+
+// handleAdminPage serves the dashboard. The page itself holds no data; it
+// asks for a token and uses the admin API.
+func handleAdminPage(c *gin.Context) {
+	c.File("static/admin.html")
+}
+
+func handleListRooms(c *gin.Context) {
+	c.JSON(200, adminTenant(c).hub.roomInfos(time.Now()))
+}
+
+// moderation is the JSON body of the kick, close and announce endpoints.
+type moderation struct {
+	Room   string `json:"room"`
+	Reason string `json:"reason"`
+	Text   string `json:"text"`
+}
+
+// handleKick disconnects a user, from one room with {"room": ...}.
+func handleKick(c *gin.Context) {
+	var body moderation
+	c.ShouldBindJSON(&body)
+	if body.Reason == "" {
+		body.Reason = "You were removed by an admin."
+	}
+	t := adminTenant(c)
+	username := c.Param("username")
+	n := t.hub.kick(username, body.Room, body.Reason)
+	t.hub.kicked(username, n)
+	if n == 0 {
+		c.JSON(404, gin.H{"error": "user is not connected"})
+		return
+	}
+	recordAudit(AuditEntry{
+		Actor:   c.ClientIP(),
+		Tenant:  t.Name,
+		Action:  "user.kick",
+		Subject: username,
+		Detail:  strconv.Itoa(n) + " connections: " + body.Reason,
+	})
+	c.JSON(200, gin.H{"connections": n})
+}
+
+func handleCloseRoom(c *gin.Context) {
+	var body moderation
+	c.ShouldBindJSON(&body)
+	if body.Reason == "" {
+		body.Reason = "This room was closed by an admin."
+	}
+	t := adminTenant(c)
+	room := c.Param("room")
+	if !t.hub.hasRoom(room) {
+		c.JSON(404, gin.H{"error": "no such room"})
+		return
+	}
+	n := t.hub.closeRoom(room, body.Reason)
+	recordAudit(AuditEntry{
+		Actor:   c.ClientIP(),
+		Tenant:  t.Name,
+		Action:  "room.close",
+		Subject: room,
+		Detail:  strconv.Itoa(n) + " connections: " + body.Reason,
+	})
+	c.JSON(200, gin.H{"connections": n})
+}
+
+// handleAnnounce posts {"text": ...} to {"room": ...}, or to every room.
+func handleAnnounce(c *gin.Context) {
+	var body moderation
+	if err := c.ShouldBindJSON(&body); err != nil || body.Text == "" {
+		c.JSON(400, gin.H{"error": "text required"})
+		return
+	}
+	t := adminTenant(c)
+	n := t.hub.announce(body.Room, body.Text)
+	if body.Room != "" && n == 0 {
+		c.JSON(404, gin.H{"error": "no such room"})
+		return
+	}
+	recordAudit(AuditEntry{
+		Actor:   c.ClientIP(),
+		Tenant:  t.Name,
+		Action:  "room.announce",
+		Subject: body.Room,
+		Detail:  body.Text,
+	})
+	c.JSON(200, gin.H{"rooms": n})
+}
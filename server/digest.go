@@ -0,0 +1,173 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+// A digest summarizes a room's activity from its stored history: how many
+// messages were sent, by whom most, and the links shared most. /digest
+// covers the messages since the room's last daily digest, or its latest
+// maxDigestMessages if it has had none. A room whose owner turns on daily
+// digests with /digest daily on gets one posted to it every day at
+// -digest-time, skipped for members who muted the room in their prefs and
+// for connections over -client-bandwidth.
+
+const (
+	maxDigestMessages = 1000
+	digestTop         = 5 // users and links listed
+)
+
+var link = regexp.MustCompile(`https?://[^\s<>"]+`)
+
+type Digest struct {
+	Room     string        `json:"room"`
+	FromSeq  int64         `json:"from_seq"`
+	ToSeq    int64         `json:"to_seq"`
+	Messages int           `json:"messages"`
+	TopUsers []DigestCount `json:"top_users"`
+	TopLinks []DigestCount `json:"top_links"`
+}
+
+type DigestCount struct {
+	Name  string `json:"name"`
+	Count int    `json:"count"`
+}
+
+// digest summarizes room's messages after seq.
+func (h *Hub) digest(room string, seq int64) (Digest, error) {
+	msgs, err := h.store.Since(room, seq, maxDigestMessages)
+	if err != nil {
+		return Digest{}, err
+	}
+	d := Digest{Room: room, Messages: len(msgs), TopUsers: []DigestCount{}, TopLinks: []DigestCount{}}
+	if len(msgs) == 0 {
+		return d, nil
+	}
+	d.FromSeq, d.ToSeq = msgs[0].Seq, msgs[len(msgs)-1].Seq
+	users, links := map[string]int{}, map[string]int{}
+	for _, m := range msgs {
+		users[m.Username]++
+		if m.Redacted {
+			continue
+		}
+		for _, l := range link.FindAllString(m.Text, -1) {
+			links[strings.TrimRight(l, ".,;:!?)'")]++
+		}
+	}
+	d.TopUsers, d.TopLinks = topCounts(users), topCounts(links)
+	return d, nil
+}
+
+// topCounts returns the digestTop largest counts, ties by name.
+func topCounts(counts map[string]int) []DigestCount {
+	out := make([]DigestCount, 0, len(counts))
+	for name, n := range counts {
+		out = append(out, DigestCount{Name: name, Count: n})
+	}
+	sort.Slice(out, func(i, j int) bool {
+		if out[i].Count != out[j].Count {
+			return out[i].Count > out[j].Count
+		}
+		return out[i].Name < out[j].Name
+	})
+	return out[:min(len(out), digestTop)]
+}
+
+// digestCommand handles /digest and, from the room's owner or a moderator,
+// /digest daily on|off.
+func (h *Hub) digestCommand(client *Client, args []string) {
+	reply := func(text string) {
+		h.sendToClient(client, Message{Type: MsgSystem, Room: client.Room, Text: text, Time: h.clockTime()})
+	}
+	switch {
+	case len(args) == 0:
+		h.mu.RLock()
+		seq := h.digestSeqs[client.Room]
+		h.mu.RUnlock()
+		d, err := h.digest(client.Room, seq)
+		if err != nil {
+			log.Printf("Digest of %s: %v", client.Room, err)
+			reply("The digest is not available right now.")
+			return
+		}
+		h.sendToClient(client, h.digestMessage(d))
+	case len(args) == 2 && args[0] == "daily" && (args[1] == "on" || args[1] == "off"):
+		if !h.roomSettings(client.Room).manages(client.Username) {
+			reply("Only the room's owner and moderators can change its daily digest.")
+			return
+		}
+		h.updateSettings(client.Room, func(s *RoomSettings) { s.DailyDigest = args[1] == "on" })
+		recordAudit(AuditEntry{Actor: client.Username, Tenant: h.tenant, Action: "room.digest", Subject: client.Room, Detail: "daily " + args[1]})
+		reply("Daily digests for " + client.Room + " are " + args[1] + ".")
+	default:
+		reply("Usage: /digest [daily on|off]")
+	}
+}
+
+func (h *Hub) digestMessage(d Digest) Message {
+	data, _ := json.Marshal(d)
+	return Message{Type: MsgDigest, Room: d.Room, Text: string(data), Time: h.clockTime()}
+}
+
+// postDailyDigests posts a digest to every live room that wants one and has
+// had messages since its last.
+func (h *Hub) postDailyDigests() {
+	h.mu.RLock()
+	var rooms []*Room
+	for name, s := range h.settings {
+		if room, ok := h.rooms[name]; ok && s.DailyDigest {
+			rooms = append(rooms, room)
+		}
+	}
+	h.mu.RUnlock()
+
+	for _, room := range rooms {
+		h.mu.RLock()
+		seq := h.digestSeqs[room.Name]
+		h.mu.RUnlock()
+		d, err := h.digest(room.Name, seq)
+		if err != nil {
+			log.Printf("Daily digest of %s: %v", room.Name, err)
+			continue
+		}
+		if d.Messages == 0 {
+			continue
+		}
+		h.mu.Lock()
+		h.digestSeqs[room.Name] = d.ToSeq
+		h.mu.Unlock()
+
+		msg := h.digestMessage(d)
+		now := h.now()
+		room.mu.RLock()
+		for c := range room.Clients {
+			if !userPrefs(h.tenant, c.Username).mutes(room.Name) && !c.throttle(now) {
+				h.sendToClient(c, msg)
+			}
+		}
+		room.mu.RUnlock()
+	}
+}
+
+// startDigests posts the daily digests at -digest-time every day.
+func startDigests() {
+	at, _ := time.Parse("15:04", cfg.DigestTime)
+	go func() {
+		for {
+			now := time.Now()
+			next := time.Date(now.Year(), now.Month(), now.Day(), at.Hour(), at.Minute(), 0, 0, now.Location())
+			if !next.After(now) {
+				next = next.AddDate(0, 0, 1)
+			}
+			time.Sleep(time.Until(next))
+			for _, h := range allHubs() {
+				h.postDailyDigests()
+			}
+		}
+	}()
+}
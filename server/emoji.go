@@ -0,0 +1,248 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Moderators can give a room custom emoji: an image under a short name,
+// uploaded through the admin API and stored as an attachment. Chat messages
+// that use :name: for one of their room's emoji carry the image URLs in
+// Message.emoji, and clients draw the image in place of the shortcode. The
+// URLs are looked up as messages are delivered, history replays included,
+// so they always reflect the room's current emoji.
+//
+// GET /api/rooms/:room/emoji lists a room's emoji. Which name maps to which
+// image is kept in emoji.json in -attachment-dir.
+
+const maxEmojiSize = 256 << 10
+
+var (
+	emojiName = regexp.MustCompile(`^[a-z0-9_+-]{1,32}$`)
+	shortcode = regexp.MustCompile(`:([a-z0-9_+-]{1,32}):`)
+)
+
+type Emoji struct {
+	Name    string    `json:"name"`
+	File    string    `json:"file"` // attachment name
+	AddedBy string    `json:"added_by,omitempty"`
+	Added   time.Time `json:"added"`
+}
+
+// emojiInfo is an emoji as GET /api/rooms/:room/emoji lists it.
+type emojiInfo struct {
+	Name string `json:"name"`
+	URL  string `json:"url"`
+}
+
+// emoji maps tenant, room and name to a custom emoji.
+var emoji = struct {
+	mu    sync.RWMutex
+	table map[string]map[string]map[string]Emoji
+}{table: map[string]map[string]map[string]Emoji{}}
+
+func emojiPath() string {
+	return filepath.Join(cfg.AttachmentDir, "emoji.json")
+}
+
+func loadEmoji() error {
+	data, err := os.ReadFile(emojiPath())
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	emoji.mu.Lock()
+	defer emoji.mu.Unlock()
+	return json.Unmarshal(data, &emoji.table)
+}
+
+// saveEmoji writes the emoji table out. emoji.mu must be held.
+func saveEmoji() error {
+	data, err := json.MarshalIndent(emoji.table, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(cfg.AttachmentDir, emojiPath(), data)
+}
+
+// roomEmoji returns room's emoji by name.
+func roomEmoji(tenant, room string) []emojiInfo {
+	emoji.mu.RLock()
+	defer emoji.mu.RUnlock()
+	out := []emojiInfo{}
+	for _, e := range emoji.table[tenant][room] {
+		out = append(out, emojiInfo{Name: e.Name, URL: attachmentURL(e.File)})
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Name < out[j].Name })
+	return out
+}
+
+// expandEmoji returns the image URLs of room's emoji used in text, by name,
+// or nil if it uses none.
+func expandEmoji(tenant, room, text string) map[string]string {
+	emoji.mu.RLock()
+	defer emoji.mu.RUnlock()
+	set := emoji.table[tenant][room]
+	if len(set) == 0 {
+		return nil
+	}
+	var out map[string]string
+	for _, m := range shortcode.FindAllStringSubmatch(text, -1) {
+		if e, ok := set[m[1]]; ok {
+			if out == nil {
+				out = map[string]string{}
+			}
+			out[e.Name] = attachmentURL(e.File)
+		}
+	}
+	return out
+}
+
+// withEmoji fills in the emoji of messages loaded from history.
+func withEmoji(tenant string, msgs []Message) {
+	for i := range msgs {
+		if !msgs[i].Redacted {
+			msgs[i].Emoji = expandEmoji(tenant, msgs[i].Room, msgs[i].Text)
+		}
+	}
+}
+
+// setEmoji adds e to room, or replaces the emoji of that name, and returns
+// the attachment no emoji uses any more, if any.
+func setEmoji(tenant, room string, e Emoji) (unused string, err error) {
+	emoji.mu.Lock()
+	defer emoji.mu.Unlock()
+	if emoji.table[tenant] == nil {
+		emoji.table[tenant] = map[string]map[string]Emoji{}
+	}
+	if emoji.table[tenant][room] == nil {
+		emoji.table[tenant][room] = map[string]Emoji{}
+	}
+	old, replaced := emoji.table[tenant][room][e.Name]
+	emoji.table[tenant][room][e.Name] = e
+	if replaced && !emojiUses(old.File) {
+		unused = old.File
+	}
+	return unused, saveEmoji()
+}
+
+// deleteEmoji removes room's emoji called name. It reports whether there
+// was one, and returns its attachment if no other emoji uses it.
+func deleteEmoji(tenant, room, name string) (unused string, ok bool, err error) {
+	emoji.mu.Lock()
+	defer emoji.mu.Unlock()
+	e, ok := emoji.table[tenant][room][name]
+	if !ok {
+		return "", false, nil
+	}
+	delete(emoji.table[tenant][room], name)
+	if len(emoji.table[tenant][room]) == 0 {
+		delete(emoji.table[tenant], room)
+	}
+	if !emojiUses(e.File) {
+		unused = e.File
+	}
+	return unused, true, saveEmoji()
+}
+
+// emojiUses reports whether any emoji's image is file. emoji.mu must be
+// held.
+func emojiUses(file string) bool {
+	for _, rooms := range emoji.table {
+		for _, set := range rooms {
+			for _, e := range set {
+				if e.File == file {
+					return true
+				}
+			}
+		}
+	}
+	return false
+}
+
+func handleRoomEmoji(c *gin.Context) {
+	tenant := c.Query("tenant")
+	if _, ok := lookupTenant(tenant); !ok {
+		c.JSON(404, gin.H{"error": "unknown tenant"})
+		return
+	}
+	c.JSON(200, roomEmoji(tenant, c.Param("room")))
+}
+
+// handleAddEmoji stores the image in the request body as room's emoji
+// called name, replacing any emoji of that name.
+func handleAddEmoji(c *gin.Context) {
+	if attachments == nil {
+		c.JSON(404, gin.H{"error": errNoAttachments.Error()})
+		return
+	}
+	room, name := c.Param("room"), c.Param("name")
+	if !emojiName.MatchString(name) {
+		c.JSON(400, gin.H{"error": "emoji names are 1 to 32 of a-z, 0-9, _, + and -"})
+		return
+	}
+	data, err := io.ReadAll(http.MaxBytesReader(c.Writer, c.Request.Body, maxEmojiSize))
+	if err != nil {
+		c.JSON(413, gin.H{"error": "emoji images are limited to 256 KiB"})
+		return
+	}
+	contentType := http.DetectContentType(data)
+	if _, ok := attachmentTypes[contentType]; !ok || !strings.HasPrefix(contentType, "image/") {
+		c.JSON(415, gin.H{"error": "emoji must be PNG, GIF, JPEG or WebP images"})
+		return
+	}
+	file, err := attachments.put(data, contentType)
+	if err != nil {
+		c.JSON(500, gin.H{"error": err.Error()})
+		return
+	}
+
+	t := adminTenant(c)
+	e := Emoji{Name: name, File: file, AddedBy: c.ClientIP(), Added: time.Now()}
+	unused, err := setEmoji(t.Name, room, e)
+	if err != nil {
+		c.JSON(500, gin.H{"error": err.Error()})
+		return
+	}
+	if unused != "" {
+		attachments.remove(unused)
+	}
+	recordAudit(AuditEntry{Actor: c.ClientIP(), Tenant: t.Name, Action: "room.emoji.add", Subject: room, Detail: ":" + name + ":"})
+	c.JSON(200, emojiInfo{Name: name, URL: attachmentURL(file)})
+}
+
+func handleRemoveEmoji(c *gin.Context) {
+	if attachments == nil {
+		c.JSON(404, gin.H{"error": errNoAttachments.Error()})
+		return
+	}
+	t := adminTenant(c)
+	room, name := c.Param("room"), c.Param("name")
+	unused, ok, err := deleteEmoji(t.Name, room, name)
+	if err != nil {
+		c.JSON(500, gin.H{"error": err.Error()})
+		return
+	}
+	if !ok {
+		c.JSON(404, gin.H{"error": "no such emoji"})
+		return
+	}
+	if unused != "" {
+		attachments.remove(unused)
+	}
+	recordAudit(AuditEntry{Actor: c.ClientIP(), Tenant: t.Name, Action: "room.emoji.remove", Subject: room, Detail: ":" + name + ":"})
+	c.JSON(200, gin.H{"name": name})
+}
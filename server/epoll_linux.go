@@ -0,0 +1,353 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gobwas/ws"
+)
+
+// The epoll backend serves connections without a readPump and writePump per
+// client. One goroutine waits on epoll for readable sockets and a fixed pool
+// of workers reads the waiting frame, or drains a client's send queue when
+// the hub wakes it. Idle connections cost a socket, the Client and its send
+// queue, and no goroutines or read/write buffers.
+//
+// Nothing that hands the workers a task waits for one to be free: wakes
+// come from broadcasters holding room locks, and workers themselves may
+// wait on those locks, so when the queue is full the task runs on a
+// goroutine of its own instead.
+
+const (
+	// maxEpollMessage bounds inbound message size for the epoll backend.
+	maxEpollMessage = 64 << 10
+	// epollIdleTimeout closes connections that sent nothing, not even a
+	// pong, for this long.
+	epollIdleTimeout = 60 * time.Second
+	// epollPingInterval is how often idle connections are pinged.
+	epollPingInterval = 54 * time.Second
+	// epollFrameTimeout bounds reading the rest of a frame once epoll
+	// reported the socket readable.
+	epollFrameTimeout = 5 * time.Second
+)
+
+// pollConn is a connection served by the epoll backend.
+type pollConn struct {
+	client *Client
+	conn   net.Conn
+	fd     int
+
+	wmu      sync.Mutex   // serializes frames written by workers and pong replies
+	writing  atomic.Bool  // a worker owns the send queue
+	lastRead atomic.Int64 // unix nanos of the last inbound frame
+	partial  []byte       // fragments of an unfinished message
+	closed   sync.Once
+}
+
+type epollPoller struct {
+	epfd  int
+	tasks chan func()
+
+	mu    sync.Mutex
+	conns map[int]*pollConn
+}
+
+var poller *epollPoller
+
+// epollUpgrader negotiates the protocol version, taking the first the
+// client asks for that is known.
+var epollUpgrader = ws.HTTPUpgrader{Protocol: knownProtocol}
+
+func startPoller() error {
+	epfd, err := syscall.EpollCreate1(syscall.EPOLL_CLOEXEC)
+	if err != nil {
+		return err
+	}
+	poller = &epollPoller{
+		epfd:  epfd,
+		tasks: make(chan func(), cfg.EpollWorkers*16),
+		conns: make(map[int]*pollConn),
+	}
+	for i := 0; i < cfg.EpollWorkers; i++ {
+		go poller.worker()
+	}
+	go poller.wait()
+	go poller.keepAlive()
+	log.Printf("epoll backend started with %d workers", cfg.EpollWorkers)
+	return nil
+}
+
+// upgradeEpoll completes the WebSocket handshake and prepares client to be
+// served by the poller.
+func upgradeEpoll(c *gin.Context, client *Client) (*pollConn, error) {
+	conn, _, hs, err := epollUpgrader.Upgrade(c.Request, c.Writer)
+	if err != nil {
+		return nil, err
+	}
+	tcp, ok := conn.(*net.TCPConn)
+	if !ok {
+		conn.Close()
+		return nil, errors.New("epoll backend needs a TCP connection")
+	}
+	raw, err := tcp.SyscallConn()
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	fd := -1
+	raw.Control(func(s uintptr) { fd = int(s) })
+
+	client.protocol = hs.Protocol
+	pc := &pollConn{client: client, conn: conn, fd: fd}
+	pc.lastRead.Store(time.Now().UnixNano())
+	client.wake = pc.wake
+	return pc, nil
+}
+
+// watch starts delivering pc's inbound frames to the hub.
+func (p *epollPoller) watch(pc *pollConn) {
+	p.mu.Lock()
+	p.conns[pc.fd] = pc
+	p.mu.Unlock()
+
+	ev := syscall.EpollEvent{Events: syscall.EPOLLIN | syscall.EPOLLRDHUP | syscall.EPOLLONESHOT, Fd: int32(pc.fd)}
+	if err := syscall.EpollCtl(p.epfd, syscall.EPOLL_CTL_ADD, pc.fd, &ev); err != nil {
+		log.Printf("epoll add failed for %s: %v", pc.client.Username, err)
+		pc.hangUp()
+		return
+	}
+	// Ping straight away so the link is graded within a round trip.
+	pc.ping()
+}
+
+// ping sends a keepalive ping, timing its round trip for quality.go.
+func (pc *pollConn) ping() {
+	pc.client.stats.pinged()
+	pc.writeFrame(ws.NewPingFrame(nil))
+}
+
+// rearm re-enables pc's one-shot read notification.
+func (p *epollPoller) rearm(pc *pollConn) {
+	ev := syscall.EpollEvent{Events: syscall.EPOLLIN | syscall.EPOLLRDHUP | syscall.EPOLLONESHOT, Fd: int32(pc.fd)}
+	if err := syscall.EpollCtl(p.epfd, syscall.EPOLL_CTL_MOD, pc.fd, &ev); err != nil {
+		pc.hangUp()
+	}
+}
+
+func (p *epollPoller) wait() {
+	events := make([]syscall.EpollEvent, 256)
+	for {
+		n, err := syscall.EpollWait(p.epfd, events, -1)
+		if err != nil {
+			if errors.Is(err, syscall.EINTR) {
+				continue
+			}
+			log.Fatalf("epoll wait: %v", err)
+		}
+		for i := 0; i < n; i++ {
+			p.mu.Lock()
+			pc := p.conns[int(events[i].Fd)]
+			p.mu.Unlock()
+			if pc != nil {
+				p.schedule(pc.read)
+			}
+		}
+	}
+}
+
+// schedule hands task to a worker, or to a goroutine of its own if they
+// are all behind.
+func (p *epollPoller) schedule(task func()) {
+	select {
+	case p.tasks <- task:
+	default:
+		go task()
+	}
+}
+
+func (p *epollPoller) worker() {
+	for task := range p.tasks {
+		task()
+	}
+}
+
+// keepAlive pings every connection and closes those that went quiet.
+func (p *epollPoller) keepAlive() {
+	ticker := time.NewTicker(epollPingInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		p.mu.Lock()
+		conns := make([]*pollConn, 0, len(p.conns))
+		for _, pc := range p.conns {
+			conns = append(conns, pc)
+		}
+		p.mu.Unlock()
+
+		cutoff := time.Now().Add(-epollIdleTimeout).UnixNano()
+		for _, pc := range conns {
+			if pc.lastRead.Load() < cutoff {
+				pc.hangUp()
+				continue
+			}
+			pc.ping()
+		}
+	}
+}
+
+// read handles one readable event: it reads a frame, hands complete
+// messages to the hub and re-arms the socket.
+func (pc *pollConn) read() {
+	pc.conn.SetReadDeadline(time.Now().Add(epollFrameTimeout))
+	if err := pc.readFrame(); err != nil {
+		if !errors.Is(err, io.EOF) {
+			log.Printf("epoll read from %s: %v", pc.client.Username, err)
+		}
+		pc.hangUp()
+		return
+	}
+	pc.lastRead.Store(time.Now().UnixNano())
+	pc.client.stats.read()
+	poller.rearm(pc)
+}
+
+func (pc *pollConn) readFrame() error {
+	frame, err := ws.ReadFrame(pc.conn)
+	if err != nil {
+		return err
+	}
+	if frame.Header.Masked {
+		ws.Cipher(frame.Payload, frame.Header.Mask, 0)
+	}
+
+	switch op := frame.Header.OpCode; {
+	case op == ws.OpClose:
+		// Answer with the peer's status code, as RFC 6455 asks, then hang up.
+		pc.writeFrame(ws.NewCloseFrame(frame.Payload[:min(len(frame.Payload), 2)]))
+		return io.EOF
+	case op == ws.OpPing:
+		return pc.writeFrame(ws.NewPongFrame(frame.Payload))
+	case op == ws.OpPong:
+		pc.client.stats.ponged()
+		return nil
+	case op.IsData() || op == ws.OpContinuation:
+		if len(pc.partial)+len(frame.Payload) > maxEpollMessage {
+			return fmt.Errorf("message exceeds %d bytes", maxEpollMessage)
+		}
+		pc.partial = append(pc.partial, frame.Payload...)
+		if !frame.Header.Fin {
+			return nil
+		}
+		data := pc.partial
+		pc.partial = nil
+		pc.client.handleMessage(pc.client.hub, data)
+	}
+	return nil
+}
+
+// wake schedules a worker to drain the send queue unless one already is.
+func (pc *pollConn) wake() {
+	if pc.writing.CompareAndSwap(false, true) {
+		poller.schedule(pc.flush)
+	}
+}
+
+// flush writes everything queued for the client. If the hub closed the
+// queue the connection is hung up.
+func (pc *pollConn) flush() {
+	for {
+		for {
+			// Control messages go out ahead of any queued chat
+			if data, ok := pc.client.nextControl(); ok {
+				if !pc.writeText(data) {
+					return
+				}
+				continue
+			}
+			select {
+			case data, ok := <-pc.client.Send:
+				if !ok {
+					for {
+						data, ok := pc.client.nextControl()
+						if !ok || !pc.writeText(data) {
+							break
+						}
+					}
+					pc.writeFrame(ws.NewCloseFrame(ws.NewCloseFrameBody(ws.StatusNormalClosure, "")))
+					pc.hangUp()
+					return
+				}
+				if !pc.writeText(data) {
+					return
+				}
+				continue
+			default:
+			}
+			break
+		}
+		pc.writing.Store(false)
+		// A message queued after the drain but before the flag was
+		// cleared would otherwise wait for the next wake.
+		if pc.client.queued() == 0 || !pc.writing.CompareAndSwap(false, true) {
+			return
+		}
+	}
+}
+
+// writeText writes one message, in fragments if it is large, hanging up if
+// that fails.
+func (pc *pollConn) writeText(data []byte) bool {
+	size := len(data)
+	op := ws.OpText
+	began := time.Now()
+	for {
+		n := len(data)
+		if fragmented(n) {
+			n = cfg.FragmentSize
+		}
+		fin := n == len(data)
+		if err := pc.writeFrame(ws.NewFrame(op, fin, data[:n])); err != nil {
+			pc.hangUp()
+			return false
+		}
+		if fin {
+			break
+		}
+		data, op = data[n:], ws.OpContinuation
+	}
+	pc.client.stats.wroteIn(time.Since(began))
+	pc.client.stats.wrote(size)
+	return true
+}
+
+func (pc *pollConn) writeFrame(f ws.Frame) error {
+	pc.wmu.Lock()
+	defer pc.wmu.Unlock()
+	pc.conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
+	return ws.WriteFrame(pc.conn, f)
+}
+
+// hangUp drops the connection and unregisters its client, once, whether the
+// connection broke, went idle or the hub closed its send queue. The
+// unregister is handed off, as a worker must not wait on the hub.
+func (pc *pollConn) hangUp() {
+	pc.closed.Do(func() {
+		pc.release()
+		go pc.client.hub.unregisterClient(pc.client)
+	})
+}
+
+func (pc *pollConn) release() {
+	poller.mu.Lock()
+	delete(poller.conns, pc.fd)
+	poller.mu.Unlock()
+	syscall.EpollCtl(poller.epfd, syscall.EPOLL_CTL_DEL, pc.fd, nil)
+	pc.conn.Close()
+}
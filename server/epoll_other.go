@@ -0,0 +1,27 @@
+//go:build !linux
+
+package main
+
+import (
+	"errors"
+
+	"github.com/gin-gonic/gin"
+)
+
+// The epoll backend is Linux only; elsewhere selecting it fails at startup.
+
+type pollConn struct{}
+
+type epollPoller struct{}
+
+var poller *epollPoller
+
+func startPoller() error {
+	return errors.New("the epoll backend is only available on Linux")
+}
+
+func upgradeEpoll(*gin.Context, *Client) (*pollConn, error) {
+	return nil, errors.New("the epoll backend is only available on Linux")
+}
+
+func (*epollPoller) watch(*pollConn) {}
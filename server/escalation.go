@@ -0,0 +1,231 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Escalation polices busy rooms without a moderator watching: a user who
+// hits the rate limit -mute-after times within -escalation-window is muted
+// for -mute-for, and one muted -ban-after times within the window, by
+// escalation or by an admin, is banned for -ban-for. Muted users stay
+// connected and may run commands, but their chat is refused until the mute
+// ends or an admin lifts it. Every step is recorded in the audit log, and so
+// streamed to /ws/admin, and the owner and moderators of the room it
+// happened in are told as it happens. Like bans, mutes are kept in memory.
+
+const escalationActor = "escalation"
+
+type Mute struct {
+	Username string    `json:"username"`
+	Reason   string    `json:"reason,omitempty"`
+	Since    time.Time `json:"since"`
+	Until    time.Time `json:"until"`
+}
+
+type escalationBook struct {
+	mu         sync.Mutex
+	violations map[string]*windowCount
+	mutings    map[string]*windowCount
+	muted      map[string]Mute
+}
+
+// count adds one to username's count in m within the window and returns it.
+func (b *escalationBook) count(m *map[string]*windowCount, username string, now time.Time) int {
+	if *m == nil {
+		*m = make(map[string]*windowCount)
+	}
+	w, ok := (*m)[username]
+	if !ok || now.Sub(w.start) >= cfg.EscalationWindow {
+		w = &windowCount{start: now}
+		(*m)[username] = w
+	}
+	w.n++
+	return w.n
+}
+
+// violation records a rate-limit violation by username and reports whether
+// it earns a mute. Violations while muted don't count.
+func (b *escalationBook) violation(username string, now time.Time) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if m, ok := b.muted[username]; ok && now.Before(m.Until) {
+		return false
+	}
+	if b.count(&b.violations, username, now) < cfg.MuteAfter {
+		return false
+	}
+	delete(b.violations, username)
+	return true
+}
+
+// mute mutes m.Username and returns how many times they have been muted
+// within the window.
+func (b *escalationBook) mute(m Mute) int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.muted == nil {
+		b.muted = make(map[string]Mute)
+	}
+	b.muted[m.Username] = m
+	return b.count(&b.mutings, m.Username, m.Since)
+}
+
+// forgive clears username's mute count, once it has led to a ban.
+func (b *escalationBook) forgive(username string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	delete(b.mutings, username)
+}
+
+// mutedAt returns username's mute if one is in force at now.
+func (b *escalationBook) mutedAt(username string, now time.Time) (Mute, bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	m, ok := b.muted[username]
+	if ok && !now.Before(m.Until) {
+		delete(b.muted, username)
+		return Mute{}, false
+	}
+	return m, ok
+}
+
+// unmute lifts username's mute and reports whether there was one.
+func (b *escalationBook) unmute(username string) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	_, ok := b.muted[username]
+	delete(b.muted, username)
+	return ok
+}
+
+// list returns the mutes in force at now, by username.
+func (b *escalationBook) list(now time.Time) []Mute {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	out := []Mute{}
+	for name, m := range b.muted {
+		if !now.Before(m.Until) {
+			delete(b.muted, name)
+			continue
+		}
+		out = append(out, m)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Username < out[j].Username })
+	return out
+}
+
+// rateViolation records that client hit the rate limit and escalates if it
+// is one too many. It reports whether client was muted for it.
+func (h *Hub) rateViolation(client *Client, now time.Time) bool {
+	if cfg.MuteAfter <= 0 || !h.escalation.violation(client.Username, now) {
+		return false
+	}
+	reason := fmt.Sprintf("rate limit hit %d times within %v", cfg.MuteAfter, cfg.EscalationWindow)
+	h.mute(client.Username, client.Room, reason, cfg.MuteFor, escalationActor, now)
+	return true
+}
+
+// mute mutes username for d, as actor did in room, tells them and the
+// room's managers, and bans them if they have been muted too often.
+func (h *Hub) mute(username, room, reason string, d time.Duration, actor string, now time.Time) Mute {
+	m := Mute{Username: username, Reason: reason, Since: now, Until: now.Add(d)}
+	n := h.escalation.mute(m)
+	where := ""
+	if room != "" {
+		where = " in " + room
+	}
+	recordAudit(AuditEntry{Actor: actor, Tenant: h.tenant, Action: "user.mute", Subject: username, Detail: fmt.Sprintf("for %v%s: %s", d, where, reason)})
+	h.tellUser(username, fmt.Sprintf("You are muted until %s: %s.", m.Until.Local().Format("15:04"), reason))
+	h.tellManagers(room, fmt.Sprintf("%s was muted for %v: %s.", username, d, reason))
+
+	if cfg.BanAfter <= 0 || n < cfg.BanAfter {
+		return m
+	}
+	h.escalation.forgive(username)
+	h.escalation.unmute(username)
+	b := Ban{Username: username, Reason: fmt.Sprintf("muted %d times within %v", n, cfg.EscalationWindow), Since: now, Until: now.Add(cfg.BanFor)}
+	h.bans.add(b)
+	closed := h.kick(username, "", "You are banned until "+b.Until.Local().Format("Jan 2 15:04")+": "+b.Reason+".")
+	h.kicked(username, closed)
+	recordAudit(AuditEntry{Actor: escalationActor, Tenant: h.tenant, Action: "user.ban", Subject: username, Detail: fmt.Sprintf("for %v%s: %s; %d connections", cfg.BanFor, where, b.Reason, closed)})
+	h.tellManagers(room, fmt.Sprintf("%s was banned for %v: %s.", username, cfg.BanFor, b.Reason))
+	return m
+}
+
+// tellUser sends text to every connection of username.
+func (h *Hub) tellUser(username, text string) {
+	for _, r := range h.roomList() {
+		r.mu.RLock()
+		for c := range r.Clients {
+			if c.Username == username {
+				h.sendToClient(c, Message{Type: MsgSystem, Room: r.Name, Text: text, Time: h.clockTime()})
+			}
+		}
+		r.mu.RUnlock()
+	}
+}
+
+// tellManagers sends text to the owner and moderators of room who are in
+// it.
+func (h *Hub) tellManagers(room, text string) {
+	h.mu.RLock()
+	r, ok := h.rooms[room]
+	h.mu.RUnlock()
+	if !ok {
+		return
+	}
+	s := h.roomSettings(room)
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	for c := range r.Clients {
+		if s.manages(c.Username) {
+			h.sendToClient(c, Message{Type: MsgSystem, Room: room, Text: text, Time: h.clockTime()})
+		}
+	}
+}
+
+func handleListMutes(c *gin.Context) {
+	c.JSON(200, adminTenant(c).hub.escalation.list(time.Now()))
+}
+
+// handleMute mutes a user for {"duration": "30m"}, or -mute-for. It counts
+// towards -ban-after like a mute by escalation.
+func handleMute(c *gin.Context) {
+	var body struct {
+		Duration string `json:"duration"`
+		Reason   string `json:"reason"`
+		Room     string `json:"room"`
+	}
+	c.ShouldBindJSON(&body)
+	d := cfg.MuteFor
+	if body.Duration != "" {
+		var err error
+		if d, err = time.ParseDuration(body.Duration); err != nil || d <= 0 {
+			c.JSON(400, gin.H{"error": "duration must be a positive Go duration such as 30m"})
+			return
+		}
+	}
+	if body.Reason == "" {
+		body.Reason = "muted by an admin"
+	}
+	t := adminTenant(c)
+	m := t.hub.mute(c.Param("username"), body.Room, body.Reason, d, c.ClientIP(), time.Now())
+	c.JSON(200, m)
+}
+
+func handleUnmute(c *gin.Context) {
+	t := adminTenant(c)
+	username := c.Param("username")
+	if !t.hub.escalation.unmute(username) {
+		c.JSON(404, gin.H{"error": "user is not muted"})
+		return
+	}
+	recordAudit(AuditEntry{Actor: c.ClientIP(), Tenant: t.Name, Action: "user.unmute", Subject: username})
+	t.hub.tellUser(username, "You are no longer muted.")
+	c.JSON(200, gin.H{"username": username})
+}
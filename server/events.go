@@ -0,0 +1,146 @@
+package main
+
+import (
+	"log"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gorilla/websocket"
+)
+
+// /ws/admin streams lifecycle and moderation events as they happen, one
+// JSON AdminEvent per frame, for monitoring tools and the dashboard. It
+// takes the same credentials as the admin API; browsers, which cannot set
+// headers on a WebSocket, may pass the token as ?token= instead. A tenant
+// key sees its own tenant's events, the server token sees the tenant named
+// by ?tenant= or, without it, every tenant's.
+//
+// The stream is best effort: a subscriber that cannot keep up loses events
+// rather than slowing the server down, and is told how many with a "lost"
+// event.
+
+// Event kinds besides the audit actions, which are streamed as they are
+// recorded (user.kick, user.report, room.close, message.redact, ...).
+const (
+	EventJoin  = "join"  // a client joined a room
+	EventLeave = "leave" // a client left a room
+	EventDrop  = "drop"  // a client was disconnected, for not reading its messages or as Detail says
+	EventAlert = "alert" // an abuse alert was raised
+	EventLost  = "lost"  // this subscriber missed Detail events
+
+	EventMemberJoin  = "member.join"  // a user became a member of a room; see members.go
+	EventMemberLeave = "member.leave" // a user stopped being one
+)
+
+type AdminEvent struct {
+	Time     time.Time `json:"time"`
+	Kind     string    `json:"kind"`
+	Tenant   string    `json:"tenant,omitempty"`
+	Room     string    `json:"room,omitempty"`
+	Username string    `json:"username,omitempty"` // the user the event is about
+	Actor    string    `json:"actor,omitempty"`    // who caused it, if not the user
+	Detail   string    `json:"detail,omitempty"`
+}
+
+const eventBuffer = 256
+
+type eventSub struct {
+	tenant string // only this tenant's events, unless all
+	all    bool
+	ch     chan AdminEvent
+	lost   int
+}
+
+var eventSubs struct {
+	mu   sync.Mutex
+	subs map[*eventSub]bool
+}
+
+// publishEvent sends e to every interested subscriber without blocking.
+func publishEvent(e AdminEvent) {
+	if e.Time.IsZero() {
+		e.Time = time.Now()
+	}
+	eventSubs.mu.Lock()
+	defer eventSubs.mu.Unlock()
+	for sub := range eventSubs.subs {
+		if !sub.all && sub.tenant != e.Tenant {
+			continue
+		}
+		if sub.lost > 0 {
+			select {
+			case sub.ch <- AdminEvent{Time: e.Time, Kind: EventLost, Detail: strconv.Itoa(sub.lost)}:
+				sub.lost = 0
+			default:
+			}
+		}
+		select {
+		case sub.ch <- e:
+		default:
+			sub.lost++
+		}
+	}
+}
+
+func subscribeEvents(tenant string, all bool) *eventSub {
+	sub := &eventSub{tenant: tenant, all: all, ch: make(chan AdminEvent, eventBuffer)}
+	eventSubs.mu.Lock()
+	defer eventSubs.mu.Unlock()
+	if eventSubs.subs == nil {
+		eventSubs.subs = make(map[*eventSub]bool)
+	}
+	eventSubs.subs[sub] = true
+	return sub
+}
+
+func (sub *eventSub) close() {
+	eventSubs.mu.Lock()
+	defer eventSubs.mu.Unlock()
+	delete(eventSubs.subs, sub)
+}
+
+// handleAdminEvents serves /ws/admin.
+func handleAdminEvents(c *gin.Context) {
+	t := adminTenant(c)
+	all := c.GetBool("server_admin") && c.Query("tenant") == ""
+	conn, err := upgrader.Upgrade(c.Writer, c.Request, nil)
+	if err != nil {
+		log.Printf("Admin event stream upgrade failed: %v", err)
+		return
+	}
+	defer conn.Close()
+	sub := subscribeEvents(t.Name, all)
+	defer sub.close()
+
+	// The stream is one way; reading only notices the subscriber leaving.
+	gone := make(chan struct{})
+	go func() {
+		defer close(gone)
+		for {
+			if _, _, err := conn.ReadMessage(); err != nil {
+				return
+			}
+		}
+	}()
+
+	ticker := time.NewTicker(54 * time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case e := <-sub.ch:
+			conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
+			if err := conn.WriteJSON(e); err != nil {
+				return
+			}
+		case <-ticker.C:
+			conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
+			if err := conn.WriteMessage(websocket.PingMessage, nil); err != nil {
+				return
+			}
+		case <-gone:
+			return
+		}
+	}
+}
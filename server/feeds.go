@@ -0,0 +1,217 @@
+package main
+
+import (
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"time"
+)
+
+// Rooms in the -rooms file can follow RSS and Atom feeds:
+//
+//	{"name": "news", "feeds": [{"url": "https://go.dev/blog/feed.atom", "interval": "30m", "name": "goblog"}]}
+//
+// Each feed is fetched every interval, and entries that were not in the
+// previous fetch are posted to the room, oldest first, as integration
+// messages from the feed's name. The first fetch only notes what is there,
+// so a restart does not repost a feed's backlog; at most maxFeedPosts
+// entries are posted per fetch.
+
+const (
+	minFeedInterval = time.Minute
+	maxFeedPosts    = 5
+	maxFeedSize     = 5 << 20
+)
+
+var feedClient = &http.Client{Timeout: 30 * time.Second}
+
+// FeedConfig is a feed followed by a room.
+type FeedConfig struct {
+	URL      string `json:"url"`
+	Interval string `json:"interval,omitempty"` // Go duration, 15m by default
+	Name     string `json:"name,omitempty"`     // username the entries are posted under, "feed" by default
+}
+
+func (f *FeedConfig) validate() error {
+	if u, err := url.Parse(f.URL); err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+		return fmt.Errorf("feed url %q must be http or https", f.URL)
+	}
+	if f.Interval == "" {
+		f.Interval = "15m"
+	}
+	if d, err := time.ParseDuration(f.Interval); err != nil || d < minFeedInterval {
+		return fmt.Errorf("feed interval must be a Go duration of at least %s", minFeedInterval)
+	}
+	if f.Name == "" {
+		f.Name = "feed"
+	}
+	if !groupName.MatchString(f.Name) {
+		return errors.New("feed names are 1 to 32 of a-z, 0-9, _ and -")
+	}
+	return nil
+}
+
+// feedPoller follows one feed for one room.
+type feedPoller struct {
+	hub      *Hub
+	room     string
+	feed     FeedConfig
+	etag     string
+	seen     []string // entry IDs in the last fetch; nil before the first
+	interval time.Duration
+}
+
+// feedPollers are the feeds of every room, started by startFeeds.
+var feedPollers []*feedPoller
+
+// followFeed has room follow feed once startFeeds runs.
+func (h *Hub) followFeed(room string, feed FeedConfig) {
+	d, _ := time.ParseDuration(feed.Interval)
+	feedPollers = append(feedPollers, &feedPoller{hub: h, room: room, feed: feed, interval: d})
+}
+
+// startFeed has room follow feed from now on, for rooms set up after
+// startFeeds.
+func (h *Hub) startFeed(room string, feed FeedConfig) {
+	d, _ := time.ParseDuration(feed.Interval)
+	go (&feedPoller{hub: h, room: room, feed: feed, interval: d}).run()
+}
+
+// startFeeds starts fetching the rooms' feeds.
+func startFeeds() {
+	for _, p := range feedPollers {
+		go p.run()
+	}
+}
+
+func (p *feedPoller) run() {
+	for {
+		if err := p.poll(); err != nil {
+			log.Printf("Feed %s for %s: %v", p.feed.URL, p.room, err)
+		}
+		time.Sleep(p.interval)
+	}
+}
+
+// poll fetches the feed and posts its new entries.
+func (p *feedPoller) poll() error {
+	req, err := http.NewRequest("GET", p.feed.URL, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "application/rss+xml, application/atom+xml, application/xml;q=0.9, */*;q=0.8")
+	if p.etag != "" {
+		req.Header.Set("If-None-Match", p.etag)
+	}
+	resp, err := feedClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotModified {
+		return nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		return errors.New(resp.Status)
+	}
+	data, err := io.ReadAll(io.LimitReader(resp.Body, maxFeedSize))
+	if err != nil {
+		return err
+	}
+	title, entries, err := parseFeed(data)
+	if err != nil {
+		return err
+	}
+	p.etag = resp.Header.Get("ETag")
+
+	var fresh []feedEntry
+	ids := make([]string, len(entries))
+	for i, e := range entries {
+		ids[i] = e.ID
+		if p.seen != nil && !slices.Contains(p.seen, e.ID) {
+			fresh = append(fresh, e)
+		}
+	}
+	p.seen = ids
+	// Feeds list the newest entry first.
+	fresh = fresh[:min(len(fresh), maxFeedPosts)]
+	for i := len(fresh) - 1; i >= 0; i-- {
+		p.hub.postIntegration(p.room, p.feed.Name, fresh[i].text(title), "")
+	}
+	return nil
+}
+
+type feedEntry struct {
+	ID, Title, Link string
+}
+
+func (e feedEntry) text(feedTitle string) string {
+	text := e.Title
+	if feedTitle != "" {
+		text = feedTitle + ": " + text
+	}
+	return strings.TrimSpace("📰 " + text + " " + e.Link)
+}
+
+// parseFeed returns the title and entries of an RSS 2.0 or Atom feed.
+func parseFeed(data []byte) (string, []feedEntry, error) {
+	var doc struct {
+		XMLName xml.Name
+		// RSS
+		Channel struct {
+			Title string `xml:"title"`
+			Items []struct {
+				Title string `xml:"title"`
+				Link  string `xml:"link"`
+				GUID  string `xml:"guid"`
+			} `xml:"item"`
+		} `xml:"channel"`
+		// Atom
+		Title   string `xml:"title"`
+		Entries []struct {
+			Title string `xml:"title"`
+			ID    string `xml:"id"`
+			Links []struct {
+				Href string `xml:"href,attr"`
+				Rel  string `xml:"rel,attr"`
+			} `xml:"link"`
+		} `xml:"entry"`
+	}
+	if err := xml.Unmarshal(data, &doc); err != nil {
+		return "", nil, fmt.Errorf("not a feed: %w", err)
+	}
+	var entries []feedEntry
+	switch doc.XMLName.Local {
+	case "rss":
+		for _, it := range doc.Channel.Items {
+			e := feedEntry{ID: it.GUID, Title: strings.TrimSpace(it.Title), Link: strings.TrimSpace(it.Link)}
+			if e.ID == "" {
+				e.ID = e.Link + "\x00" + e.Title
+			}
+			entries = append(entries, e)
+		}
+		return strings.TrimSpace(doc.Channel.Title), entries, nil
+	case "feed":
+		for _, it := range doc.Entries {
+			e := feedEntry{ID: it.ID, Title: strings.TrimSpace(it.Title)}
+			for _, l := range it.Links {
+				if l.Rel == "" || l.Rel == "alternate" {
+					e.Link = l.Href
+					break
+				}
+			}
+			if e.ID == "" {
+				e.ID = e.Link + "\x00" + e.Title
+			}
+			entries = append(entries, e)
+		}
+		return strings.TrimSpace(doc.Title), entries, nil
+	}
+	return "", nil, fmt.Errorf("not an RSS or Atom feed: <%s>", doc.XMLName.Local)
+}
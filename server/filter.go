@@ -0,0 +1,334 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"regexp"
+	"slices"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/gin-gonic/gin"
+)
+
+// The language filter masks profanity in chat messages before they are
+// stored or broadcast, keeping each word's first letter: "f***". It has
+// three levels: off; mild, which catches the strongest words; and strict,
+// which adds milder ones and also catches the strongest inside other words,
+// at the cost of the odd false positive. -language-filter sets the server
+// default and each room may choose its own in its RoomSettings.
+//
+// A room's owner is the first user to join it, unless the -rooms file names
+// one. The owner and the room's moderators change its filter with /filter,
+// and the server's moderators change any setting through the admin API.
+// Like bans, room settings are kept in memory.
+
+const (
+	filterOff    = "off"
+	filterMild   = "mild"
+	filterStrict = "strict"
+)
+
+// suffixes are the endings a filtered word may carry and still be caught.
+const suffixes = `(?:s|es|ed|er|ers|ing|in|y|ty|head|heads)?`
+
+var (
+	mildWords   = `fuck|shit|cunt|motherfuck|bitch|asshole|bastard|whore|slut`
+	strictWords = mildWords + `|damn|hell|crap|piss|dick|cock|bollocks|bugger|wanker|twat|arse|ass|bloody`
+
+	profanity = map[string]*regexp.Regexp{
+		filterMild:   regexp.MustCompile(`(?i)\b(?:` + mildWords + `)` + suffixes + `\b`),
+		filterStrict: regexp.MustCompile(`(?i)\b(?:` + strictWords + `)` + suffixes + `\b|\w*(?:fuck|shit|cunt)\w*`),
+	}
+)
+
+func validFilter(level string) bool {
+	return level == filterOff || level == filterMild || level == filterStrict
+}
+
+// RoomSettings are a room's own choices, kept while the room is empty.
+type RoomSettings struct {
+	Owner       string `json:"owner,omitempty"`
+	Filter      string `json:"filter,omitempty"` // off, mild or strict; empty follows -language-filter
+	DailyDigest bool   `json:"daily_digest,omitempty"`
+	MaxPins     int    `json:"max_pins,omitempty"` // 0 follows -max-pins
+	PinTTL      string `json:"pin_ttl,omitempty"`  // how long pins last by default, as a Go duration; empty for ever
+
+	Topic      string   `json:"topic,omitempty"`       // shown to members as they join
+	Moderators []string `json:"moderators,omitempty"`  // users who may change the room as its owner can
+	Persistent bool     `json:"persistent,omitempty"`  // the room is kept while empty
+	NoReceipts bool     `json:"no_receipts,omitempty"` // senders are not told who received and read their messages
+
+	NoHistory      bool `json:"no_history,omitempty"`      // chat is relayed but not stored
+	AllowIncognito bool `json:"allow_incognito,omitempty"` // members may keep their own messages out of history
+
+	Calendar     string `json:"calendar,omitempty"`      // ICS URL whose events are reminded of in the room
+	CalendarLead int    `json:"calendar_lead,omitempty"` // minutes before an event its reminder is posted; 0 for 10
+
+	Transforms []string `json:"transforms,omitempty"` // applied to chat sent to members; see transforms.go
+
+	OpenHours string `json:"open_hours,omitempty"` // when the room may be joined, such as "Mon-Fri 09:00-17:00"; see lifecycle.go
+	Expires   string `json:"expires,omitempty"`    // RFC 3339 time at which the room is archived
+	Archived  bool   `json:"archived,omitempty"`   // the room refuses joins; its history is kept
+	MaxIdle   string `json:"max_idle,omitempty"`   // how long the room may go without chat before it is archived, as a Go duration; empty follows -room-max-idle; see idle.go
+	Dormant   bool   `json:"dormant,omitempty"`    // archived for inactivity until the next message
+
+	Quotas // see quotas.go
+}
+
+// calendarLead returns how many minutes before events their reminders are
+// posted.
+func (s RoomSettings) calendarLead() int {
+	if s.CalendarLead == 0 {
+		return defaultCalendarLead
+	}
+	return s.CalendarLead
+}
+
+// manages reports whether username owns or moderates the room.
+func (s RoomSettings) manages(username string) bool {
+	return username == s.Owner || slices.Contains(s.Moderators, username)
+}
+
+// roomSettings returns room's settings.
+func (h *Hub) roomSettings(room string) RoomSettings {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	return h.settings[room]
+}
+
+// updateSettings changes room's settings with fn and returns the result.
+func (h *Hub) updateSettings(room string, fn func(*RoomSettings)) RoomSettings {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	s := h.settings[room]
+	fn(&s)
+	if len(s.Moderators) == 0 {
+		s.Moderators = nil
+	}
+	if len(s.Transforms) == 0 {
+		s.Transforms = nil
+	}
+	if reflect.ValueOf(s).IsZero() {
+		delete(h.settings, room)
+	} else {
+		h.settings[room] = s
+	}
+	return s
+}
+
+// validate checks the settings that have a fixed form.
+func (s RoomSettings) validate() error {
+	if s.Filter != "" && !validFilter(s.Filter) {
+		return errors.New("filter must be off, mild, strict or empty for the server default")
+	}
+	if s.MaxPins < 0 {
+		return errors.New("max_pins must be positive, or 0 for the server default")
+	}
+	if s.PinTTL != "" {
+		if d, err := time.ParseDuration(s.PinTTL); err != nil || d <= 0 {
+			return errors.New("pin_ttl must be a positive Go duration such as 72h, or empty for pins that last")
+		}
+	}
+	if s.Calendar != "" {
+		if _, err := calendarURL(s.Calendar); err != nil {
+			return err
+		}
+	}
+	if s.CalendarLead < 0 || s.CalendarLead > maxCalendarLead {
+		return fmt.Errorf("calendar_lead must be between 1 and %d minutes, or 0 for the default", maxCalendarLead)
+	}
+	if err := validTransforms(s.Transforms); err != nil {
+		return err
+	}
+	if err := s.validQuotas(); err != nil {
+		return err
+	}
+	if err := s.validMaxIdle(); err != nil {
+		return err
+	}
+	return s.validLifecycle()
+}
+
+// filterLevel returns the language filter level in force in room.
+func (h *Hub) filterLevel(room string) string {
+	if level := h.roomSettings(room).Filter; level != "" {
+		return level
+	}
+	return cfg.LanguageFilter
+}
+
+// censor masks the profanity in text at level.
+func censor(text, level string) string {
+	re, ok := profanity[level]
+	if !ok {
+		return text
+	}
+	return re.ReplaceAllStringFunc(text, func(word string) string {
+		_, n := utf8.DecodeRuneInString(word)
+		return word[:n] + strings.Repeat("*", utf8.RuneCountInString(word[n:]))
+	})
+}
+
+// filterCommand handles /filter [off|mild|strict|default] from client.
+// Anyone may see the room's filter; only its owner and moderators may change
+// it.
+func (h *Hub) filterCommand(client *Client, args []string) {
+	reply := func(text string) {
+		h.sendToClient(client, Message{Type: MsgSystem, Room: client.Room, Text: text, Time: h.clockTime()})
+	}
+	s := h.roomSettings(client.Room)
+	if len(args) == 0 {
+		level := h.filterLevel(client.Room)
+		if s.Filter == "" {
+			level += " (server default)"
+		}
+		owner := s.Owner
+		if owner == "" {
+			owner = "nobody"
+		}
+		reply("The language filter in " + client.Room + " is " + level + "; the room is owned by " + owner + ".")
+		return
+	}
+	level := args[0]
+	if len(args) > 1 || (level != "default" && !validFilter(level)) {
+		reply("Usage: /filter [off|mild|strict|default]")
+		return
+	}
+	if !s.manages(client.Username) {
+		reply("Only the room's owner and moderators can change its language filter.")
+		return
+	}
+	if level == "default" {
+		level = ""
+	}
+	h.updateSettings(client.Room, func(s *RoomSettings) { s.Filter = level })
+	recordAudit(AuditEntry{Actor: client.Username, Tenant: h.tenant, Action: "room.filter", Subject: client.Room, Detail: args[0]})
+	h.broadcastToRoom(client.Room, Message{
+		Type: MsgSystem,
+		Room: client.Room,
+		Text: client.Username + " set the language filter to " + args[0],
+		Time: h.clockTime(),
+	})
+}
+
+func handleRoomSettings(c *gin.Context) {
+	c.JSON(200, adminTenant(c).hub.roomSettings(c.Param("room")))
+}
+
+// handleUpdateRoomSettings changes the settings given in the body, such as
+// {"filter": "strict"}, {"owner": "alice"} or {"max_pins": 20}, and leaves
+// the rest alone. An empty filter or a zero max_pins returns the room to the
+// server default.
+func handleUpdateRoomSettings(c *gin.Context) {
+	var body struct {
+		Owner          *string   `json:"owner"`
+		Filter         *string   `json:"filter"`
+		DailyDigest    *bool     `json:"daily_digest"`
+		MaxPins        *int      `json:"max_pins"`
+		PinTTL         *string   `json:"pin_ttl"`
+		Topic          *string   `json:"topic"`
+		Moderators     *[]string `json:"moderators"`
+		Persistent     *bool     `json:"persistent"`
+		NoReceipts     *bool     `json:"no_receipts"`
+		NoHistory      *bool     `json:"no_history"`
+		AllowIncognito *bool     `json:"allow_incognito"`
+		Calendar       *string   `json:"calendar"`
+		CalendarLead   *int      `json:"calendar_lead"`
+		Transforms     *[]string `json:"transforms"`
+		OpenHours      *string   `json:"open_hours"`
+		Expires        *string   `json:"expires"`
+		Archived       *bool     `json:"archived"`
+		MaxIdle        *string   `json:"max_idle"`
+		MessagesPerDay *int      `json:"messages_per_day"`
+		StorageBytes   *int64    `json:"storage_bytes"`
+		MaxAttachments *int      `json:"max_attachments"`
+	}
+	if err := c.ShouldBindJSON(&body); err != nil {
+		c.JSON(400, gin.H{"error": "body must be {\"owner\": username, \"filter\": level, \"daily_digest\": bool, \"max_pins\": n, \"pin_ttl\": duration, " +
+			"\"topic\": text, \"moderators\": [username], \"persistent\": bool, \"no_receipts\": bool, \"no_history\": bool, \"allow_incognito\": bool, \"calendar\": ics url, \"calendar_lead\": minutes, \"transforms\": [transform], \"open_hours\": hours, \"expires\": time, \"archived\": bool, \"max_idle\": duration, \"messages_per_day\": n, \"storage_bytes\": n, \"max_attachments\": n}"})
+		return
+	}
+	apply := func(s *RoomSettings) {
+		if body.Owner != nil {
+			s.Owner = *body.Owner
+		}
+		if body.Filter != nil {
+			s.Filter = *body.Filter
+		}
+		if body.DailyDigest != nil {
+			s.DailyDigest = *body.DailyDigest
+		}
+		if body.MaxPins != nil {
+			s.MaxPins = *body.MaxPins
+		}
+		if body.PinTTL != nil {
+			s.PinTTL = *body.PinTTL
+		}
+		if body.Topic != nil {
+			s.Topic = *body.Topic
+		}
+		if body.Moderators != nil {
+			s.Moderators = *body.Moderators
+		}
+		if body.Persistent != nil {
+			s.Persistent = *body.Persistent
+		}
+		if body.NoReceipts != nil {
+			s.NoReceipts = *body.NoReceipts
+		}
+		if body.NoHistory != nil {
+			s.NoHistory = *body.NoHistory
+		}
+		if body.AllowIncognito != nil {
+			s.AllowIncognito = *body.AllowIncognito
+		}
+		if body.Calendar != nil {
+			s.Calendar = *body.Calendar
+		}
+		if body.CalendarLead != nil {
+			s.CalendarLead = *body.CalendarLead
+		}
+		if body.Transforms != nil {
+			s.Transforms = *body.Transforms
+		}
+		if body.OpenHours != nil {
+			s.OpenHours = *body.OpenHours
+		}
+		if body.Expires != nil {
+			s.Expires = *body.Expires
+		}
+		if body.Archived != nil {
+			s.Archived = *body.Archived
+		}
+		if body.MaxIdle != nil {
+			s.MaxIdle = *body.MaxIdle
+		}
+		if body.MessagesPerDay != nil {
+			s.MessagesPerDay = *body.MessagesPerDay
+		}
+		if body.StorageBytes != nil {
+			s.StorageBytes = *body.StorageBytes
+		}
+		if body.MaxAttachments != nil {
+			s.MaxAttachments = *body.MaxAttachments
+		}
+	}
+	t, room := adminTenant(c), c.Param("room")
+	changed := t.hub.roomSettings(room)
+	apply(&changed)
+	if err := changed.validate(); err != nil {
+		c.JSON(400, gin.H{"error": err.Error()})
+		return
+	}
+	before := t.hub.roomSettings(room)
+	s := t.hub.updateSettings(room, apply)
+	t.hub.historyChanged(room, before, s)
+	t.hub.topicChanged(room, before, s)
+	detail := fmt.Sprintf("owner=%s filter=%s daily_digest=%v max_pins=%d pin_ttl=%s topic=%q moderators=%s persistent=%v no_receipts=%v no_history=%v allow_incognito=%v calendar=%s calendar_lead=%d transforms=%q open_hours=%q expires=%s archived=%v max_idle=%s messages_per_day=%d storage_bytes=%d max_attachments=%d",
+		s.Owner, s.Filter, s.DailyDigest, s.MaxPins, s.PinTTL, s.Topic, strings.Join(s.Moderators, ","), s.Persistent, s.NoReceipts, s.NoHistory, s.AllowIncognito, s.Calendar, s.CalendarLead, s.Transforms, s.OpenHours, s.Expires, s.Archived, s.MaxIdle, s.MessagesPerDay, s.StorageBytes, s.MaxAttachments)
+	recordAudit(AuditEntry{Actor: c.ClientIP(), Tenant: t.Name, Action: "room.settings", Subject: room, Detail: detail})
+	c.JSON(200, s)
+}
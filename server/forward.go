@@ -0,0 +1,78 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"slices"
+)
+
+// /forward <id> <room> reposts a chat message into another room the user
+// is connected to. The copy is a new chat message from the forwarder, with
+// the original's text and attachment, and its Forwarded field names the
+// source message and its author so clients can credit them and link back.
+// Forwarding a forwarded message keeps the first source.
+
+type Forward struct {
+	ID     string `json:"id"` // the source message
+	Room   string `json:"room"`
+	Seq    int64  `json:"seq"`
+	Author string `json:"author"`
+	Time   string `json:"time"`
+}
+
+// forwardCommand handles /forward <id> <room> from client.
+func (h *Hub) forwardCommand(client *Client, args []string) {
+	reply := func(text string) {
+		h.sendToClient(client, Message{Type: MsgSystem, Room: client.Room, Text: text, Time: h.clockTime()})
+	}
+	if len(args) != 2 {
+		reply("Usage: /forward <message id> <room>")
+		return
+	}
+	rooms := append(h.userRooms(client.Username), client.Room)
+	target := args[1]
+	if !slices.Contains(rooms, target) {
+		reply("You can only forward to rooms you are in, and you are not in " + target + ".")
+		return
+	}
+	src, err := h.store.Get(args[0])
+	if errors.Is(err, errNotFound) || (err == nil && !slices.Contains(rooms, src.Room)) {
+		reply("There is no message " + args[0] + " in your rooms.")
+		return
+	}
+	if err != nil {
+		log.Printf("Loading message %s: %v", args[0], err)
+		reply("Forwarding is not available right now.")
+		return
+	}
+	if src.Redacted {
+		reply("Redacted messages cannot be forwarded.")
+		return
+	}
+	if src.Room == target {
+		reply("That message is already in " + target + ".")
+		return
+	}
+
+	fwd := src.Forwarded
+	if fwd == nil {
+		fwd = &Forward{ID: src.ID, Room: src.Room, Seq: src.Seq, Author: src.Username, Time: src.Time}
+	}
+	msg := Message{
+		Type:       MsgChat,
+		Room:       target,
+		Username:   client.Username,
+		Text:       censor(src.Text, h.filterLevel(target)),
+		Time:       h.clockTime(),
+		ID:         h.newMessageID(),
+		Attachment: src.Attachment,
+		Forwarded:  fwd,
+		Unverified: cfg.Registration && !client.verified,
+		Trace:      newTraceID(),
+	}
+	traceLog(msg, "forwarded by %s from %s in %s", client.Username, src.ID, src.Room)
+	h.publish(target, msg)
+	if client.Room != target {
+		reply("Forwarded " + src.ID + " to " + target + ".")
+	}
+}
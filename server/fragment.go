@@ -0,0 +1,67 @@
+package main
+
+import (
+	"bufio"
+	"io"
+
+	"github.com/gorilla/websocket"
+)
+
+// Messages larger than -fragment-size, such as long history replies and
+// batches of them, are streamed as a fragmented WebSocket message instead of
+// one frame: the writer goes through NextWriter a fragment at a time, and a
+// batch is written element by element rather than joined first.
+
+// minFragmentSize keeps fragments above twice gorilla's write buffer. Writes
+// that large go out as frames of their own; smaller ones would be buffered
+// and split at the buffer size instead.
+const minFragmentSize = 16 << 10
+
+// fragmented reports whether a frame of size bytes is streamed in fragments.
+func fragmented(size int) bool {
+	return cfg.FragmentSize > 0 && size > cfg.FragmentSize
+}
+
+// writeFragmented streams batch as one message in fragments of
+// cfg.FragmentSize.
+func (c *Client) writeFragmented(batch [][]byte) error {
+	w, err := c.Conn.NextWriter(websocket.TextMessage)
+	if err != nil {
+		return err
+	}
+	fw := bufio.NewWriterSize(w, cfg.FragmentSize)
+	err = writeBatch(fw, batch)
+	if err == nil {
+		err = fw.Flush()
+	}
+	if cerr := w.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// writeBatch writes batch to w as joinBatch would lay it out, in pieces of
+// at most cfg.FragmentSize.
+func writeBatch(w io.Writer, batch [][]byte) error {
+	var err error
+	put := func(p []byte) {
+		for len(p) > 0 && err == nil {
+			n := min(len(p), cfg.FragmentSize)
+			_, err = w.Write(p[:n])
+			p = p[n:]
+		}
+	}
+	if len(batch) == 1 {
+		put(batch[0])
+		return err
+	}
+	put([]byte{'['})
+	for i, m := range batch {
+		if i > 0 {
+			put([]byte{','})
+		}
+		put(m)
+	}
+	put([]byte{']'})
+	return err
+}
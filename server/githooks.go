@@ -0,0 +1,264 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// GitHub and GitLab can post their webhooks straight to a room, which turns
+// push, pull request and issue events into chat messages:
+//
+//	POST /api/rooms/:room/github?tenant=
+//	POST /api/rooms/:room/gitlab?tenant=
+//
+// The secret configured in GitHub or GitLab is one of the room's webhook
+// keys: GitHub signs its payloads with it (X-Hub-Signature-256) and GitLab
+// sends it as X-Gitlab-Token. Events are posted under the webhook's name
+// like any other integration message; other events are accepted and
+// ignored, so a repository can send everything.
+
+const (
+	maxHookPayload = 5 << 20
+	maxGitCommits  = 5 // commits listed in a push message
+)
+
+// gitPush is the part of a push event that is shown, from either forge.
+type gitPush struct {
+	Pusher  string
+	Repo    string
+	Ref     string
+	URL     string
+	Total   int
+	Commits []gitCommit
+}
+
+type gitCommit struct {
+	ID      string
+	Message string
+}
+
+func (p gitPush) String() string {
+	branch, ok := strings.CutPrefix(p.Ref, "refs/heads/")
+	if !ok {
+		branch, _ = strings.CutPrefix(p.Ref, "refs/tags/")
+	}
+	noun := "commits"
+	if p.Total == 1 {
+		noun = "commit"
+	}
+	var b strings.Builder
+	fmt.Fprintf(&b, "%s pushed %d %s to %s in %s", p.Pusher, p.Total, noun, branch, p.Repo)
+	if p.URL != "" {
+		b.WriteString(": " + p.URL)
+	}
+	for i, c := range p.Commits {
+		if i == maxGitCommits {
+			fmt.Fprintf(&b, "\n  … and %d more", p.Total-i)
+			break
+		}
+		subject, _, _ := strings.Cut(c.Message, "\n")
+		fmt.Fprintf(&b, "\n  %.7s %s", c.ID, subject)
+	}
+	return b.String()
+}
+
+// gitChange formats a pull request, merge request or issue event.
+func gitChange(user, action, kind string, number int, repo, title, url string) string {
+	return fmt.Sprintf("%s %s %s #%d in %s: %s %s", user, action, kind, number, repo, title, url)
+}
+
+// handleGitHubHook posts the GitHub event in the request body to the room.
+func handleGitHubHook(c *gin.Context) {
+	t, room, payload, ok := readHook(c)
+	if !ok {
+		return
+	}
+	name, ok := t.hub.webhooks.match(room, func(key string) bool {
+		mac := hmac.New(sha256.New, []byte(key))
+		mac.Write(payload)
+		return constantTimeEqual(c.GetHeader("X-Hub-Signature-256"), "sha256="+hex.EncodeToString(mac.Sum(nil)))
+	})
+	if !ok {
+		c.JSON(401, gin.H{"error": "invalid signature for this room's webhooks"})
+		return
+	}
+	text, err := formatGitHubEvent(c.GetHeader("X-GitHub-Event"), payload)
+	postHookEvent(c, t, room, name, text, err)
+}
+
+// handleGitLabHook posts the GitLab event in the request body to the room.
+func handleGitLabHook(c *gin.Context) {
+	t, room, payload, ok := readHook(c)
+	if !ok {
+		return
+	}
+	name, ok := t.hub.webhooks.lookup(room, c.GetHeader("X-Gitlab-Token"))
+	if !ok {
+		c.JSON(401, gin.H{"error": "invalid webhook key for this room"})
+		return
+	}
+	text, err := formatGitLabEvent(c.GetHeader("X-Gitlab-Event"), payload)
+	postHookEvent(c, t, room, name, text, err)
+}
+
+// readHook reads the tenant, room and payload of a request to one of the
+// receivers that turn other systems' webhooks into chat messages.
+func readHook(c *gin.Context) (*Tenant, string, []byte, bool) {
+	t, ok := lookupTenant(c.Query("tenant"))
+	if !ok {
+		c.JSON(404, gin.H{"error": "unknown tenant"})
+		return nil, "", nil, false
+	}
+	payload, err := io.ReadAll(http.MaxBytesReader(c.Writer, c.Request.Body, maxHookPayload))
+	if err != nil {
+		c.JSON(413, gin.H{"error": fmt.Sprintf("payloads are limited to %d bytes", maxHookPayload)})
+		return nil, "", nil, false
+	}
+	return t, c.Param("room"), payload, true
+}
+
+// postHookEvent posts text, the formatted event, from the webhook called
+// name, or answers that the event was ignored if there is no text.
+func postHookEvent(c *gin.Context, t *Tenant, room, name, text string, err error) {
+	if err != nil {
+		c.JSON(400, gin.H{"error": err.Error()})
+		return
+	}
+	if text == "" {
+		c.JSON(202, gin.H{"ignored": true})
+		return
+	}
+	if t.hub.rateLimited("#"+room+"/"+name, time.Now()) {
+		c.JSON(429, gin.H{"error": "You are sending messages too fast; slow down."})
+		return
+	}
+	c.JSON(201, t.hub.postIntegration(room, name, text, requestTrace(c)))
+}
+
+// formatGitHubEvent returns the chat message for a GitHub event, or "" for
+// events and actions that are not posted.
+func formatGitHubEvent(event string, payload []byte) (string, error) {
+	var p struct {
+		Ref     string `json:"ref"`
+		Compare string `json:"compare"`
+		Action  string `json:"action"`
+		Sender  struct {
+			Login string `json:"login"`
+		} `json:"sender"`
+		Repository struct {
+			FullName string `json:"full_name"`
+		} `json:"repository"`
+		Commits []struct {
+			ID      string `json:"id"`
+			Message string `json:"message"`
+		} `json:"commits"`
+		PullRequest struct {
+			Number  int    `json:"number"`
+			Title   string `json:"title"`
+			HTMLURL string `json:"html_url"`
+			Merged  bool   `json:"merged"`
+		} `json:"pull_request"`
+		Issue struct {
+			Number  int    `json:"number"`
+			Title   string `json:"title"`
+			HTMLURL string `json:"html_url"`
+		} `json:"issue"`
+	}
+	if err := json.Unmarshal(payload, &p); err != nil {
+		return "", fmt.Errorf("invalid %s payload: %w", event, err)
+	}
+	repo := p.Repository.FullName
+	switch event {
+	case "push":
+		if len(p.Commits) == 0 {
+			return "", nil // branch deletions and tag pushes
+		}
+		push := gitPush{Pusher: p.Sender.Login, Repo: repo, Ref: p.Ref, URL: p.Compare, Total: len(p.Commits)}
+		for _, c := range p.Commits {
+			push.Commits = append(push.Commits, gitCommit{c.ID, c.Message})
+		}
+		return push.String(), nil
+	case "pull_request":
+		action := p.Action
+		switch {
+		case action == "closed" && p.PullRequest.Merged:
+			action = "merged"
+		case action != "opened" && action != "closed" && action != "reopened":
+			return "", nil
+		}
+		pr := p.PullRequest
+		return gitChange(p.Sender.Login, action, "pull request", pr.Number, repo, pr.Title, pr.HTMLURL), nil
+	case "issues":
+		if p.Action != "opened" && p.Action != "closed" && p.Action != "reopened" {
+			return "", nil
+		}
+		return gitChange(p.Sender.Login, p.Action, "issue", p.Issue.Number, repo, p.Issue.Title, p.Issue.HTMLURL), nil
+	}
+	return "", nil
+}
+
+// gitLabActions maps GitLab's merge request and issue actions to the words
+// used in chat; other actions, such as updates, are not posted.
+var gitLabActions = map[string]string{"open": "opened", "close": "closed", "reopen": "reopened", "merge": "merged"}
+
+// formatGitLabEvent returns the chat message for a GitLab event, or "" for
+// events and actions that are not posted.
+func formatGitLabEvent(event string, payload []byte) (string, error) {
+	var p struct {
+		Ref         string `json:"ref"`
+		UserName    string `json:"user_name"` // push events
+		TotalCommit int    `json:"total_commits_count"`
+		User        struct {
+			Username string `json:"username"`
+		} `json:"user"`
+		Project struct {
+			PathWithNamespace string `json:"path_with_namespace"`
+		} `json:"project"`
+		Commits []struct {
+			ID      string `json:"id"`
+			Message string `json:"message"`
+		} `json:"commits"`
+		ObjectAttributes struct {
+			IID    int    `json:"iid"`
+			Title  string `json:"title"`
+			URL    string `json:"url"`
+			Action string `json:"action"`
+		} `json:"object_attributes"`
+	}
+	if err := json.Unmarshal(payload, &p); err != nil {
+		return "", fmt.Errorf("invalid %s payload: %w", event, err)
+	}
+	repo := p.Project.PathWithNamespace
+	switch event {
+	case "Push Hook":
+		if p.TotalCommit == 0 {
+			return "", nil
+		}
+		push := gitPush{Pusher: p.UserName, Repo: repo, Ref: p.Ref, Total: p.TotalCommit}
+		for _, c := range p.Commits {
+			push.Commits = append(push.Commits, gitCommit{c.ID, c.Message})
+		}
+		return push.String(), nil
+	case "Merge Request Hook", "Issue Hook":
+		action, ok := gitLabActions[p.ObjectAttributes.Action]
+		if !ok {
+			return "", nil
+		}
+		kind := "issue"
+		if event == "Merge Request Hook" {
+			kind = "merge request"
+		}
+		o := p.ObjectAttributes
+		return gitChange(p.User.Username, action, kind, o.IID, repo, o.Title, o.URL), nil
+	}
+	return "", nil
+}
@@ -0,0 +1,230 @@
+package main
+
+import (
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Groups are named sets of usernames, such as oncall or devs, managed
+// through the admin API. A chat message that mentions @name, for a group or
+// a user, sends every mentioned user a mention message on each of their
+// connections in the tenant, whatever room they are in; for a group the
+// mention names it. /groups lists the groups and their members. Like bans,
+// groups are kept in memory.
+
+var (
+	groupName = regexp.MustCompile(`^[a-z0-9_-]{1,32}$`)
+	mention   = regexp.MustCompile(`@([\w.-]+)`)
+)
+
+type Group struct {
+	Name    string   `json:"name"`
+	Members []string `json:"members"`
+}
+
+type groupList struct {
+	mu     sync.Mutex
+	groups map[string]map[string]bool
+}
+
+// set replaces the members of group, creating it if needed.
+func (l *groupList) set(group string, members []string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.groups == nil {
+		l.groups = make(map[string]map[string]bool)
+	}
+	l.groups[group] = make(map[string]bool)
+	for _, m := range members {
+		l.groups[group][m] = true
+	}
+}
+
+// remove deletes group and reports whether it existed.
+func (l *groupList) remove(group string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	_, ok := l.groups[group]
+	delete(l.groups, group)
+	return ok
+}
+
+// join adds username to group, creating it if needed.
+func (l *groupList) join(group, username string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.groups == nil {
+		l.groups = make(map[string]map[string]bool)
+	}
+	if l.groups[group] == nil {
+		l.groups[group] = make(map[string]bool)
+	}
+	l.groups[group][username] = true
+}
+
+// leave removes username from group and reports whether they were in it.
+func (l *groupList) leave(group, username string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	ok := l.groups[group][username]
+	delete(l.groups[group], username)
+	return ok
+}
+
+// members returns group's members, and false if there is no such group.
+func (l *groupList) members(group string) ([]string, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	set, ok := l.groups[group]
+	if !ok {
+		return nil, false
+	}
+	return sortedKeys(set), true
+}
+
+// list returns every group by name.
+func (l *groupList) list() []Group {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	out := []Group{}
+	for name, set := range l.groups {
+		out = append(out, Group{Name: name, Members: sortedKeys(set)})
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Name < out[j].Name })
+	return out
+}
+
+func sortedKeys(set map[string]bool) []string {
+	out := make([]string, 0, len(set))
+	for k := range set {
+		out = append(out, k)
+	}
+	sort.Strings(out)
+	return out
+}
+
+// mentioned returns the users text mentions, each with the group it
+// mentioned them through, or "" if it named them directly.
+func (h *Hub) mentioned(text string) map[string]string {
+	var out map[string]string
+	for _, m := range mention.FindAllStringSubmatch(text, -1) {
+		if out == nil {
+			out = map[string]string{}
+		}
+		name := strings.TrimRight(m[1], ".-") // sentence punctuation
+		if members, ok := h.groups.members(name); ok {
+			for _, u := range members {
+				if _, seen := out[u]; !seen {
+					out[u] = name
+				}
+			}
+			continue
+		}
+		out[name] = ""
+	}
+	return out
+}
+
+// notifyMentions sends a mention message for msg to every connection of the
+// users it mentions, except its author and those whose preferences turn it
+// down.
+func (h *Hub) notifyMentions(msg Message) {
+	users := h.mentioned(msg.Text)
+	delete(users, msg.Username)
+	for u, group := range users {
+		if p := userPrefs(h.tenant, u); p.mutes(msg.Room) || (p.MentionsOnly && group != "") {
+			delete(users, u)
+		}
+	}
+	if len(users) == 0 {
+		return
+	}
+	for _, room := range h.roomList() {
+		room.mu.RLock()
+		for c := range room.Clients {
+			group, ok := users[c.Username]
+			if !ok {
+				continue
+			}
+			h.sendToClient(c, Message{
+				Type:     MsgMention,
+				Room:     msg.Room,
+				Username: msg.Username,
+				Text:     msg.Text,
+				Time:     msg.Time,
+				ID:       msg.ID,
+				Seq:      msg.Seq,
+				Group:    group,
+				Trace:    msg.Trace,
+			})
+		}
+		room.mu.RUnlock()
+	}
+	traceLog(msg, "mentioned %d users", len(users))
+}
+
+func handleListGroups(c *gin.Context) {
+	c.JSON(200, adminTenant(c).hub.groups.list())
+}
+
+// handleSetGroup replaces a group's members with {"members": [...]}.
+func handleSetGroup(c *gin.Context) {
+	var body struct {
+		Members []string `json:"members"`
+	}
+	if err := c.ShouldBindJSON(&body); err != nil {
+		c.JSON(400, gin.H{"error": "body must be {\"members\": [usernames]}"})
+		return
+	}
+	name := c.Param("group")
+	if !groupName.MatchString(name) {
+		c.JSON(400, gin.H{"error": "group names are 1 to 32 of a-z, 0-9, _ and -"})
+		return
+	}
+	t := adminTenant(c)
+	t.hub.groups.set(name, body.Members)
+	members, _ := t.hub.groups.members(name)
+	recordAudit(AuditEntry{Actor: c.ClientIP(), Tenant: t.Name, Action: "group.set", Subject: "@" + name, Detail: strconv.Itoa(len(members)) + " members"})
+	c.JSON(200, Group{Name: name, Members: members})
+}
+
+func handleDeleteGroup(c *gin.Context) {
+	t := adminTenant(c)
+	name := c.Param("group")
+	if !t.hub.groups.remove(name) {
+		c.JSON(404, gin.H{"error": "no such group"})
+		return
+	}
+	recordAudit(AuditEntry{Actor: c.ClientIP(), Tenant: t.Name, Action: "group.delete", Subject: "@" + name})
+	c.JSON(200, gin.H{"name": name})
+}
+
+func handleAddGroupMember(c *gin.Context) {
+	name, username := c.Param("group"), c.Param("username")
+	if !groupName.MatchString(name) {
+		c.JSON(400, gin.H{"error": "group names are 1 to 32 of a-z, 0-9, _ and -"})
+		return
+	}
+	t := adminTenant(c)
+	t.hub.groups.join(name, username)
+	members, _ := t.hub.groups.members(name)
+	recordAudit(AuditEntry{Actor: c.ClientIP(), Tenant: t.Name, Action: "group.join", Subject: username, Detail: "@" + name})
+	c.JSON(200, Group{Name: name, Members: members})
+}
+
+func handleRemoveGroupMember(c *gin.Context) {
+	name, username := c.Param("group"), c.Param("username")
+	t := adminTenant(c)
+	if !t.hub.groups.leave(name, username) {
+		c.JSON(404, gin.H{"error": "not a member of that group"})
+		return
+	}
+	members, _ := t.hub.groups.members(name)
+	recordAudit(AuditEntry{Actor: c.ClientIP(), Tenant: t.Name, Action: "group.leave", Subject: username, Detail: "@" + name})
+	c.JSON(200, Group{Name: name, Members: members})
+}
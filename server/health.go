@@ -0,0 +1,77 @@
+package main
+
+import (
+	"runtime"
+	"sync/atomic"
+
+	"github.com/gin-gonic/gin"
+)
+
+// /healthz answers whether the process is alive; /readyz whether it wants
+// new connections. While draining for shutdown, or when at its connection
+// limit, the server stays healthy but reports not ready and refuses new
+// WebSockets with 503 so load balancers send traffic elsewhere.
+
+var draining atomic.Bool
+
+// readiness returns why the server is not accepting connections, or "" if
+// it is.
+func readiness() string {
+	if draining.Load() {
+		return "draining"
+	}
+	if cfg.MaxConnections > 0 && totalClients() >= int64(cfg.MaxConnections) {
+		return "overloaded"
+	}
+	return ""
+}
+
+func handleHealthz(c *gin.Context) {
+	c.JSON(200, gin.H{"status": "ok"})
+}
+
+func handleReadyz(c *gin.Context) {
+	if reason := readiness(); reason != "" {
+		c.JSON(503, gin.H{"status": reason})
+		return
+	}
+	c.JSON(200, gin.H{"status": "ready"})
+}
+
+// runtimeStats is what /api/admin/runtime reports, for watching a server
+// under load: the soak tool fails a run whose goroutines or heap keep
+// growing. Hub times the hub loops; see hubmetrics.go. Canary is the
+// built-in canary's results, with -canary-interval; see canary.go.
+type runtimeStats struct {
+	Goroutines  int      `json:"goroutines"`
+	HeapAlloc   uint64   `json:"heap_alloc"`
+	HeapInuse   uint64   `json:"heap_inuse"`
+	Sys         uint64   `json:"sys"`
+	NumGC       uint32   `json:"num_gc"`
+	Connections int64    `json:"connections"`
+	Rooms       int      `json:"rooms"`
+	Hub         hubStats `json:"hub"`
+	BadFrames   int64    `json:"bad_frames"` // inbound frames that were not valid JSON, since startup
+
+	Canary *canaryStats `json:"canary,omitempty"`
+}
+
+func handleRuntime(c *gin.Context) {
+	var m runtime.MemStats
+	runtime.ReadMemStats(&m)
+	stats := runtimeStats{
+		Goroutines:  runtime.NumGoroutine(),
+		HeapAlloc:   m.HeapAlloc,
+		HeapInuse:   m.HeapInuse,
+		Sys:         m.Sys,
+		NumGC:       m.NumGC,
+		Connections: totalClients(),
+		Hub:         currentHubStats(),
+		BadFrames:   badFrames.Load(),
+		Canary:      currentCanaryStats(),
+	}
+	for _, h := range allHubs() {
+		stats.Rooms += h.roomCount()
+	}
+	c.JSON(200, stats)
+}
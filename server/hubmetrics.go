@@ -0,0 +1,134 @@
+package main
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// Each tenant's hub admits and removes connections in a single loop, run,
+// fed by the unbuffered register and unregister channels: a connection
+// waits to be handed over until the loop is free, and while the loop works
+// on one event every other joiner and leaver waits. Three histograms, over
+// all hubs, show how close that loop is to saturated before joins start to
+// lag:
+//
+//	register_wait    how long connections waited to hand themselves to run
+//	unregister_wait  the same for leaving connections
+//	run              how long run spent on each event
+//
+// They are reported under "hub" by /api/admin/runtime, with cumulative
+// bucket counts in the manner of Prometheus and estimated percentiles.
+// Waits that grow while run stays fast mean the loop is busy more than it
+// is slow; a slow run is the place to look first.
+
+// histogramBounds are the upper bounds of the histogram buckets, above
+// which a last bucket counts the rest.
+var histogramBounds = []time.Duration{
+	10 * time.Microsecond, 25 * time.Microsecond, 50 * time.Microsecond,
+	100 * time.Microsecond, 250 * time.Microsecond, 500 * time.Microsecond,
+	time.Millisecond, 2500 * time.Microsecond, 5 * time.Millisecond,
+	10 * time.Millisecond, 25 * time.Millisecond, 50 * time.Millisecond,
+	100 * time.Millisecond, 250 * time.Millisecond, 500 * time.Millisecond,
+	time.Second, 2500 * time.Millisecond, 5 * time.Second,
+}
+
+// histogram counts durations into histogramBounds. It is safe for
+// concurrent use and its zero value is ready to use.
+type histogram struct {
+	counts [19]atomic.Int64 // one per bound, then the overflow
+	sum    atomic.Int64     // nanoseconds
+}
+
+func (h *histogram) observe(d time.Duration) {
+	i := 0
+	for i < len(histogramBounds) && d > histogramBounds[i] {
+		i++
+	}
+	h.counts[i].Add(1)
+	h.sum.Add(int64(d))
+}
+
+// histogramBucket is a cumulative count: how many durations were at most
+// LeMillis, or all of them for the last bucket, whose LeMillis is 0.
+type histogramBucket struct {
+	LeMillis float64 `json:"le_ms,omitempty"`
+	Count    int64   `json:"count"`
+}
+
+// HistogramSnapshot is a histogram as reported.
+type HistogramSnapshot struct {
+	Count     int64             `json:"count"`
+	SumMillis float64           `json:"sum_ms"`
+	P50Millis float64           `json:"p50_ms"` // upper bound of the bucket holding the median
+	P99Millis float64           `json:"p99_ms"`
+	Buckets   []histogramBucket `json:"buckets"`
+}
+
+func millis(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
+
+func (h *histogram) snapshot() HistogramSnapshot {
+	var s HistogramSnapshot
+	for i := range h.counts {
+		s.Count += h.counts[i].Load()
+		b := histogramBucket{Count: s.Count}
+		if i < len(histogramBounds) {
+			b.LeMillis = millis(histogramBounds[i])
+		}
+		s.Buckets = append(s.Buckets, b)
+	}
+	s.SumMillis = millis(time.Duration(h.sum.Load()))
+	s.P50Millis = s.quantile(0.5)
+	s.P99Millis = s.quantile(0.99)
+	return s
+}
+
+// quantile returns the upper bound of the bucket holding quantile q, or
+// the largest bound if it is in the overflow.
+func (s HistogramSnapshot) quantile(q float64) float64 {
+	if s.Count == 0 {
+		return 0
+	}
+	rank := int64(q*float64(s.Count) + 0.5)
+	for _, b := range s.Buckets {
+		if b.Count >= rank && b.LeMillis > 0 {
+			return b.LeMillis
+		}
+	}
+	return millis(histogramBounds[len(histogramBounds)-1])
+}
+
+var hubMetrics struct {
+	registerWait, unregisterWait, run histogram
+}
+
+// hubStats is the "hub" section of /api/admin/runtime.
+type hubStats struct {
+	RegisterWait   HistogramSnapshot `json:"register_wait"`
+	UnregisterWait HistogramSnapshot `json:"unregister_wait"`
+	Run            HistogramSnapshot `json:"run"`
+}
+
+func currentHubStats() hubStats {
+	return hubStats{
+		RegisterWait:   hubMetrics.registerWait.snapshot(),
+		UnregisterWait: hubMetrics.unregisterWait.snapshot(),
+		Run:            hubMetrics.run.snapshot(),
+	}
+}
+
+// registerClient hands c to the hub's loop, timing the wait.
+func (h *Hub) registerClient(c *Client) {
+	start := time.Now()
+	h.register <- c
+	hubMetrics.registerWait.observe(time.Since(start))
+}
+
+// unregisterClient hands c back to the hub's loop to be removed, timing
+// the wait.
+func (h *Hub) unregisterClient(c *Client) {
+	start := time.Now()
+	h.unregister <- c
+	hubMetrics.unregisterWait.observe(time.Since(start))
+}
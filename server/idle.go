@@ -0,0 +1,151 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+)
+
+// A room that has had no chat for its max_idle setting, or -room-max-idle
+// if it has none, is archived for inactivity even while members are still
+// connected: a notice is posted to its history, its members are sent away
+// with it, and the hub lets go of the room and of its cached history. The
+// room is marked dormant rather than archived, so it can still be joined,
+// and the next chat message posted to it, by a member or a webhook, brings
+// it back: dormant is cleared, a persistent room is listed again and its
+// members are told. Its history, pins and settings are kept throughout.
+//
+// A room's idle time runs from its last chat message, or from when the
+// server first saw it, so a restart gives every room the full period.
+
+const dormantText = "This room was archived for inactivity; post a message to bring it back."
+
+// activityBook keeps when each room last had chat.
+type activityBook struct {
+	mu    sync.Mutex
+	rooms map[string]time.Time
+}
+
+// touch records chat in room at now.
+func (b *activityBook) touch(room string, now time.Time) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.rooms == nil {
+		b.rooms = make(map[string]time.Time)
+	}
+	b.rooms[room] = now
+}
+
+// last returns when room last had chat, counting from now if it has had
+// none the book knows of.
+func (b *activityBook) last(room string, now time.Time) time.Time {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.rooms == nil {
+		b.rooms = make(map[string]time.Time)
+	}
+	t, ok := b.rooms[room]
+	if !ok {
+		t = now
+		b.rooms[room] = t
+	}
+	return t
+}
+
+// forget drops room's activity, once it is gone.
+func (b *activityBook) forget(room string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	delete(b.rooms, room)
+}
+
+// validMaxIdle checks the max_idle setting.
+func (s RoomSettings) validMaxIdle() error {
+	if s.MaxIdle == "" {
+		return nil
+	}
+	if d, err := time.ParseDuration(s.MaxIdle); err != nil || d < 0 {
+		return errors.New("max_idle must be a Go duration such as 720h, 0 to never archive for inactivity, or empty for the server default")
+	}
+	return nil
+}
+
+// maxIdle returns how long the room may go without chat; 0 for ever.
+func (s RoomSettings) maxIdle() time.Duration {
+	if s.MaxIdle == "" {
+		return cfg.RoomMaxIdle
+	}
+	d, _ := time.ParseDuration(s.MaxIdle)
+	return d
+}
+
+// enforceMaxIdle archives the hub's rooms that have been idle too long.
+func (h *Hub) enforceMaxIdle(now time.Time) {
+	for _, r := range h.roomList() {
+		if r.Name == canaryRoom {
+			continue
+		}
+		s := h.roomSettings(r.Name)
+		idle := s.maxIdle()
+		if idle <= 0 || s.Dormant || s.Archived {
+			continue
+		}
+		if now.Sub(h.activity.last(r.Name, now)) >= idle {
+			h.hibernate(r.Name, idle, now)
+		}
+	}
+}
+
+// hibernate archives room for having had no chat for idle: it tells the
+// room, marks it dormant, sends its members away and frees what the hub
+// holds for it.
+func (h *Hub) hibernate(room string, idle time.Duration, now time.Time) {
+	notice := fmt.Sprintf("No one has written here for %s; this room has been archived. Post a message to bring it back.", idle)
+	w := h.writer(room)
+	w.Lock()
+	if now.Sub(h.activity.last(room, now)) < idle {
+		w.Unlock()
+		return // chat came in meanwhile
+	}
+	h.updateSettings(room, func(s *RoomSettings) { s.Dormant = true })
+	msg := h.recordHistory(room, Message{
+		Type:        MsgChat,
+		Room:        room,
+		Username:    lifecycleBot,
+		Text:        notice,
+		Time:        h.clockTime(),
+		ID:          h.newMessageID(),
+		Integration: true,
+	})
+	h.broadcastToRoom(room, msg)
+	// Still as the writer, so chat can't wake the room before it is closed.
+	n := h.closeRoom(room, notice)
+	h.activity.forget(room)
+	h.receipts.forget(room)
+	h.incognito.forget(room)
+	if c, ok := h.store.(*cachedStore); ok {
+		c.forget(room)
+	}
+	w.Unlock()
+
+	recordAudit(AuditEntry{Actor: lifecycleBot, Tenant: h.tenant, Action: "room.dormant", Subject: room, Detail: fmt.Sprintf("%d connections: idle for %s", n, idle)})
+	log.Printf("Archived %s for inactivity: %d connections", tenantQualified(h.tenant, room), n)
+}
+
+// wake brings back room, dormant until chat was posted to it. It must be
+// called as the room's writer.
+func (h *Hub) wake(room string) {
+	s := h.updateSettings(room, func(s *RoomSettings) { s.Dormant = false })
+	if s.Persistent && !s.Archived {
+		h.mu.Lock()
+		if _, ok := h.rooms[room]; !ok {
+			h.rooms[room] = &Room{Name: room, Clients: make(map[*Client]bool)}
+		}
+		h.mu.Unlock()
+	}
+	h.broadcastToRoom(room, Message{Type: MsgSystem, Room: room, Text: "This room is active again.", Time: h.clockTime()})
+	recordAudit(AuditEntry{Actor: lifecycleBot, Tenant: h.tenant, Action: "room.wake", Subject: room})
+	log.Printf("Reactivated %s", tenantQualified(h.tenant, room))
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Message IDs come from one of these, chosen with -message-ids:
+//
+//	counter  a per-process prefix plus a counter, the shortest; unique, but
+//	         only ordered within one process
+//	ulid     ULIDs, 26 characters that sort in the order they were issued
+//	uuid     version 7 UUIDs, which sort the same way and suit stores and
+//	         tools that expect UUIDs
+//
+// The ulid and uuid generators are monotonic: IDs issued in the same
+// millisecond, or after the clock stepped back, still sort after earlier
+// ones.
+
+const (
+	idsCounter = "counter"
+	idsULID    = "ulid"
+	idsUUID    = "uuid"
+)
+
+// IDGenerator issues unique message IDs.
+type IDGenerator interface {
+	NewID() string
+}
+
+// messageIDs numbers the messages of every hub.
+var messageIDs IDGenerator = newCounterIDs()
+
+func newIDGenerator(kind string, clock Clock) (IDGenerator, error) {
+	switch kind {
+	case idsCounter:
+		return newCounterIDs(), nil
+	case idsULID:
+		return &ulidIDs{clock: clock}, nil
+	case idsUUID:
+		return &uuidIDs{clock: clock}, nil
+	}
+	return nil, fmt.Errorf("unknown message ID kind %q (want %s, %s or %s)", kind, idsCounter, idsULID, idsUUID)
+}
+
+// counterIDs are a random per-process prefix plus a counter: unique without
+// reading crypto/rand for every message.
+type counterIDs struct {
+	prefix string
+	n      atomic.Uint64
+}
+
+func newCounterIDs() *counterIDs {
+	return &counterIDs{prefix: strconv.FormatInt(time.Now().UnixNano(), 36)}
+}
+
+func (g *counterIDs) NewID() string {
+	return g.prefix + "-" + strconv.FormatUint(g.n.Add(1), 36)
+}
+
+// sequentialIDs are m-1, m-2 and so on, for runs that must reproduce.
+type sequentialIDs struct {
+	n atomic.Uint64
+}
+
+func (g *sequentialIDs) NewID() string {
+	return "m-" + strconv.FormatUint(g.n.Add(1), 10)
+}
+
+// monotonicMillis returns the millisecond to stamp an ID issued at now
+// with, never earlier than last, and whether it is last again.
+func monotonicMillis(now time.Time, last int64) (int64, bool) {
+	ms := now.UnixMilli()
+	if ms <= last {
+		return last, true
+	}
+	return ms, false
+}
+
+// ulidIDs issues ULIDs: a 48-bit millisecond timestamp and 80 random bits,
+// in Crockford's base 32. Within a millisecond the random part counts up.
+type ulidIDs struct {
+	clock Clock
+	mu    sync.Mutex
+	last  int64
+	rand  [10]byte
+}
+
+const crockford = "0123456789ABCDEFGHJKMNPQRSTVWXYZ"
+
+func (g *ulidIDs) NewID() string {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	ms, same := monotonicMillis(g.clock.Now(), g.last)
+	if same {
+		for i := len(g.rand) - 1; i >= 0; i-- {
+			g.rand[i]++
+			if g.rand[i] != 0 {
+				break
+			}
+		}
+	} else {
+		rand.Read(g.rand[:])
+	}
+	g.last = ms
+
+	var id [16]byte
+	for i := 0; i < 6; i++ {
+		id[i] = byte(ms >> (40 - 8*i))
+	}
+	copy(id[6:], g.rand[:])
+
+	// 26 characters of 5 bits hold the 128 bits with 2 to spare at the top.
+	var out [26]byte
+	for i := range out {
+		var v byte
+		for b := i*5 - 2; b < i*5+3; b++ {
+			v <<= 1
+			if b >= 0 && id[b/8]&(0x80>>(b%8)) != 0 {
+				v |= 1
+			}
+		}
+		out[i] = crockford[v]
+	}
+	return string(out[:])
+}
+
+// uuidIDs issues version 7 UUIDs: a 48-bit millisecond timestamp, a 12-bit
+// counter within the millisecond and 62 random bits. A millisecond that
+// runs out of counter borrows the next.
+type uuidIDs struct {
+	clock Clock
+	mu    sync.Mutex
+	last  int64
+	seq   int
+}
+
+func (g *uuidIDs) NewID() string {
+	g.mu.Lock()
+	ms, same := monotonicMillis(g.clock.Now(), g.last)
+	if same {
+		g.seq++
+		if g.seq > 0xfff {
+			ms, g.seq = ms+1, 0
+		}
+	} else {
+		g.seq = 0
+	}
+	g.last = ms
+	seq := g.seq
+	g.mu.Unlock()
+
+	var id [16]byte
+	rand.Read(id[8:])
+	for i := 0; i < 6; i++ {
+		id[i] = byte(ms >> (40 - 8*i))
+	}
+	id[6] = 0x70 | byte(seq>>8)
+	id[7] = byte(seq)
+	id[8] = 0x80 | id[8]&0x3f
+
+	h := hex.EncodeToString(id[:])
+	return h[:8] + "-" + h[8:12] + "-" + h[12:16] + "-" + h[16:20] + "-" + h[20:]
+}
+
+// newMessageID returns a unique identifier for a chat message.
+func (h *Hub) newMessageID() string {
+	return h.ids.NewID()
+}
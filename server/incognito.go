@@ -0,0 +1,123 @@
+package main
+
+import (
+	"sync"
+)
+
+// Chat can be kept out of the stored history, for conversations nobody
+// wants on record. A room whose no_history setting is on relays its chat
+// but stores none of it; a room whose allow_incognito setting is on lets
+// each member turn storing their own messages off and on with
+//
+//	/incognito [on|off]
+//
+// Either way the messages are marked unsaved, and the room says so in a
+// history_mode message: sent to joiners after the welcome when the room's
+// history is off, and to the room whenever the setting changes or a member
+// goes incognito or comes back (username then names them). Unsaved
+// messages are numbered like the others, but /history, digests and resume
+// replays come from the store and so skip them; a client resuming across
+// one sees a gap. Incognito members are remembered until the room empties.
+
+const (
+	historyOn  = "on"
+	historyOff = "off"
+)
+
+// incognitoList is the members of each room keeping their messages out of
+// its history.
+type incognitoList struct {
+	mu    sync.Mutex
+	rooms map[string]map[string]bool // room -> username
+}
+
+// set turns username's incognito in room on or off and reports whether it
+// changed.
+func (l *incognitoList) set(room, username string, on bool) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.rooms[room][username] == on {
+		return false
+	}
+	if !on {
+		delete(l.rooms[room], username)
+		return true
+	}
+	if l.rooms == nil {
+		l.rooms = make(map[string]map[string]bool)
+	}
+	if l.rooms[room] == nil {
+		l.rooms[room] = make(map[string]bool)
+	}
+	l.rooms[room][username] = true
+	return true
+}
+
+func (l *incognitoList) has(room, username string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.rooms[room][username]
+}
+
+// forget drops room's incognito members, once it is gone.
+func (l *incognitoList) forget(room string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	delete(l.rooms, room)
+}
+
+// unsaved reports whether chat from client is kept out of its room's
+// history.
+func (h *Hub) unsaved(client *Client) bool {
+	s := h.roomSettings(client.Room)
+	return s.NoHistory || (s.AllowIncognito && h.incognito.has(client.Room, client.Username))
+}
+
+// historyMode returns the history_mode message saying whether room stores
+// history, or whether username's messages are stored if username is set.
+func (h *Hub) historyMode(room, username string, off bool) Message {
+	mode := historyOn
+	if off {
+		mode = historyOff
+	}
+	return Message{Type: MsgHistoryMode, Room: room, Username: username, Text: mode, Time: h.clockTime()}
+}
+
+// incognitoCommand handles /incognito [on|off].
+func (h *Hub) incognitoCommand(client *Client, args []string) {
+	reply := func(text string) {
+		h.sendToClient(client, Message{Type: MsgSystem, Room: client.Room, Text: text, Time: h.clockTime()})
+	}
+	s := h.roomSettings(client.Room)
+	on := h.incognito.has(client.Room, client.Username)
+	switch {
+	case len(args) > 1 || (len(args) == 1 && args[0] != "on" && args[0] != "off"):
+		reply("Usage: /incognito [on|off]")
+		return
+	case s.NoHistory:
+		reply("History is off in " + client.Room + "; no messages are saved.")
+		return
+	case !s.AllowIncognito:
+		reply("This room does not allow incognito; ask its owner.")
+		return
+	case len(args) == 0:
+		if on {
+			reply("You are incognito in " + client.Room + "; your messages are not saved.")
+		} else {
+			reply("Your messages in " + client.Room + " are saved. /incognito on to stop.")
+		}
+		return
+	}
+	if !h.incognito.set(client.Room, client.Username, args[0] == "on") {
+		reply("Incognito is already " + args[0] + ".")
+		return
+	}
+	h.broadcastToRoom(client.Room, h.historyMode(client.Room, client.Username, args[0] == "on"))
+}
+
+// historyChanged tells room its history was turned off or back on.
+func (h *Hub) historyChanged(room string, before, after RoomSettings) {
+	if before.NoHistory != after.NoHistory {
+		h.broadcastToRoom(room, h.historyMode(room, "", after.NoHistory))
+	}
+}
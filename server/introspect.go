@@ -0,0 +1,156 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// GET /api/admin/connections/:id reports what the server knows about one
+// live connection, for "this user stopped receiving messages" reports: a
+// send queue near its cap or a last write long ago points at a slow reader,
+// drops at messages it never got, and a closed queue at a connection the
+// hub already hung up that has yet to unregister.
+
+// connCounter makes connection IDs unique when a user connects twice in the
+// same second.
+var connCounter atomic.Uint64
+
+func newConnID(username string) string {
+	return fmt.Sprintf("%s-%d-%d", username, time.Now().Unix(), connCounter.Add(1))
+}
+
+// connStats is updated by the backends as a connection reads and writes.
+type connStats struct {
+	lastRead  atomic.Int64 // unix nanos of the last inbound message
+	lastWrite atomic.Int64 // unix nanos of the last frame written
+	drops     atomic.Int64 // messages dropped because the send queue was full or closed
+	sent      atomic.Int64 // bytes written
+	bandwidth rateMeter    // bytes written over the last minute
+	throttled atomic.Int64 // low-priority messages skipped because the client was over -client-bandwidth
+
+	// For the link's quality; see quality.go.
+	pingSent atomic.Int64 // unix nanos of the unanswered ping, 0 if none
+	rtt      atomic.Int64 // smoothed ping round trip in nanos, 0 until one is answered
+	writes   atomic.Int64 // frames written
+	stalls   atomic.Int64 // writes that took stallThreshold or more
+
+	badFrames atomic.Int64 // inbound frames that were not valid JSON; see badjson.go
+}
+
+func (s *connStats) read() { s.lastRead.Store(time.Now().UnixNano()) }
+
+// wrote records a frame of n bytes written.
+func (s *connStats) wrote(n int) {
+	now := time.Now()
+	s.lastWrite.Store(now.UnixNano())
+	s.sent.Add(int64(n))
+	s.bandwidth.addN(now, int64(n))
+}
+
+// connDebug is the introspection endpoint's reply.
+type connDebug struct {
+	ID          string     `json:"id"`
+	Username    string     `json:"username"`
+	Tenant      string     `json:"tenant"`
+	Backend     string     `json:"backend"`
+	Protocol    string     `json:"protocol"`    // negotiated subprotocol, empty if none
+	Compression bool       `json:"compression"` // permessage-deflate negotiated
+	Connected   time.Time  `json:"connected"`
+	Resumed     bool       `json:"resumed"`
+	Rooms       []string   `json:"rooms"`
+	Queue       int        `json:"queue"` // chat lane
+	QueueCap    int        `json:"queue_cap"`
+	Control     int        `json:"control_queue"` // control lane
+	ControlCap  int        `json:"control_queue_cap"`
+	Closed      bool       `json:"closed"` // the hub closed its send queue
+	LastRead    *time.Time `json:"last_read"`
+	LastWrite   *time.Time `json:"last_write"`
+	Drops       int64      `json:"drops"`
+	BytesSent   int64      `json:"bytes_sent"`
+	Bandwidth   int64      `json:"bytes_per_second"` // over the last bandwidthWindow
+	Throttled   int64      `json:"throttled"`        // low-priority messages skipped over -client-bandwidth
+	Quality     string     `json:"quality"`          // graded as in quality.go
+	RTTMillis   int64      `json:"rtt_ms"`           // smoothed ping round trip, 0 until one is answered
+	Stalls      int64      `json:"stalls"`           // writes that blocked for stallThreshold or more
+	BadFrames   int64      `json:"bad_frames"`       // inbound frames that were not valid JSON
+}
+
+// negotiatedDeflate reports whether the upgrader agrees to permessage-deflate
+// for r, as it does whenever compression is on and the client offers it.
+func negotiatedDeflate(r *http.Request) bool {
+	if !cfg.Compression {
+		return false
+	}
+	for _, h := range r.Header.Values("Sec-WebSocket-Extensions") {
+		if strings.Contains(h, "permessage-deflate") {
+			return true
+		}
+	}
+	return false
+}
+
+// findClient returns the live connection with the given ID.
+func (h *Hub) findClient(id string) (*Client, bool) {
+	for _, r := range h.roomList() {
+		r.mu.RLock()
+		for c := range r.Clients {
+			if c.ID == id {
+				r.mu.RUnlock()
+				return c, true
+			}
+		}
+		r.mu.RUnlock()
+	}
+	return nil, false
+}
+
+func unixTime(nanos int64) *time.Time {
+	if nanos == 0 {
+		return nil
+	}
+	t := time.Unix(0, nanos)
+	return &t
+}
+
+func handleConnection(c *gin.Context) {
+	t := adminTenant(c)
+	client, ok := t.hub.findClient(c.Param("id"))
+	if !ok {
+		c.JSON(404, gin.H{"error": "no such connection"})
+		return
+	}
+	client.sendMu.Lock()
+	closed := client.closed
+	client.sendMu.Unlock()
+	c.JSON(200, connDebug{
+		ID:          client.ID,
+		Username:    client.Username,
+		Tenant:      t.Name,
+		Backend:     cfg.Backend,
+		Protocol:    client.protocol,
+		Compression: client.compression,
+		Connected:   client.connected,
+		Resumed:     client.Resumed,
+		Rooms:       []string{client.Room},
+		Queue:       len(client.Send),
+		QueueCap:    cap(client.Send),
+		Control:     len(client.Control),
+		ControlCap:  cap(client.Control),
+		Closed:      closed,
+		LastRead:    unixTime(client.stats.lastRead.Load()),
+		LastWrite:   unixTime(client.stats.lastWrite.Load()),
+		Drops:       client.stats.drops.Load(),
+		BytesSent:   client.stats.sent.Load(),
+		Bandwidth:   client.bandwidth(time.Now()),
+		Throttled:   client.stats.throttled.Load(),
+		Quality:     client.stats.quality(time.Now()),
+		RTTMillis:   client.stats.rttMillis(),
+		Stalls:      client.stats.stalls.Load(),
+		BadFrames:   client.stats.badFrames.Load(),
+	})
+}
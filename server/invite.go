@@ -0,0 +1,92 @@
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/skip2/go-qrcode"
+)
+
+// Rooms can be shared as links of the form /r/<room>, which open the web
+// UI ready to join that room. /invite replies with the link to the current
+// room, and /r/<room>/qr.png renders the same link as a QR code for
+// sharing with phones, say on a slide at an event. Links point at
+// -public-url when set, otherwise at the host and scheme the inviting client
+// connected with.
+
+const (
+	defaultQRSize = 256
+	maxQRSize     = 1024
+)
+
+// handleRoomLink serves the web UI for a /r/<room> link; script.js reads the
+// room from the path.
+func handleRoomLink(c *gin.Context) {
+	c.HTML(200, "index.html", nil)
+}
+
+// handleRoomQR renders the room's invite link as a PNG QR code, ?size
+// pixels square.
+func handleRoomQR(c *gin.Context) {
+	tenant := c.Query("tenant")
+	if _, ok := lookupTenant(tenant); !ok {
+		c.JSON(404, gin.H{"error": "unknown tenant"})
+		return
+	}
+	size := defaultQRSize
+	if s := c.Query("size"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n < 64 || n > maxQRSize {
+			c.JSON(400, gin.H{"error": "size must be between 64 and " + strconv.Itoa(maxQRSize)})
+			return
+		}
+		size = n
+	}
+	png, err := qrcode.Encode(inviteLink(requestOrigin(c.Request), tenant, c.Param("room")), qrcode.Medium, size)
+	if err != nil {
+		c.JSON(500, gin.H{"error": err.Error()})
+		return
+	}
+	c.Header("Cache-Control", "public, max-age=3600")
+	c.Data(200, "image/png", png)
+}
+
+// requestOrigin returns the scheme and host r was made to, honoring the
+// X-Forwarded-Proto header set by TLS-terminating proxies.
+func requestOrigin(r *http.Request) string {
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	if proto := r.Header.Get("X-Forwarded-Proto"); proto == "http" || proto == "https" {
+		scheme = proto
+	}
+	return scheme + "://" + r.Host
+}
+
+// inviteLink returns the shareable link to room in tenant. origin is used
+// when no -public-url is configured.
+func inviteLink(origin, tenant, room string) string {
+	base := strings.TrimSuffix(cfg.PublicURL, "/")
+	if base == "" {
+		base = origin
+	}
+	link := base + "/r/" + url.PathEscape(room)
+	if tenant != defaultTenant {
+		link += "?tenant=" + url.QueryEscape(tenant)
+	}
+	return link
+}
+
+// inviteQRLink returns the link to the QR code of inviteLink.
+func inviteQRLink(origin, tenant, room string) string {
+	link, query, _ := strings.Cut(inviteLink(origin, tenant, room), "?")
+	link += "/qr.png"
+	if query != "" {
+		link += "?" + query
+	}
+	return link
+}
@@ -0,0 +1,42 @@
+package main
+
+import "bytes"
+
+// Outbound messages travel in two lanes. Chat goes in the normal lane, Send;
+// everything else (system notices, acks, presence, kicks, command replies)
+// goes in the control lane, which writers always empty first. A client
+// backlogged with chat is still told its message was accepted or that it was
+// kicked, and each lane keeps its own order. Both lanes are bounded, and a
+// client that fills either one is dropped. Only Send is closed to hang up;
+// writers deliver what is left in the control lane before closing.
+
+var chatPrefix = []byte(`{"type":"` + MsgChat + `"`)
+
+// isControl reports whether data goes in the control lane. Message always
+// marshals its type first, so a prefix check is enough.
+func isControl(data []byte) bool {
+	return !bytes.HasPrefix(data, chatPrefix)
+}
+
+// lane returns the queue data goes in.
+func (c *Client) lane(data []byte) chan []byte {
+	if isControl(data) {
+		return c.Control
+	}
+	return c.Send
+}
+
+// nextControl returns a queued control message without blocking.
+func (c *Client) nextControl() ([]byte, bool) {
+	select {
+	case data := <-c.Control:
+		return data, true
+	default:
+		return nil, false
+	}
+}
+
+// queued returns how many messages wait in both lanes.
+func (c *Client) queued() int {
+	return len(c.Control) + len(c.Send)
+}
@@ -0,0 +1,249 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// A room may keep hours, or have an end, with two settings:
+//
+//	open_hours  "09:00-17:00", "Mon-Fri 09:00-17:30" or "Sat,Sun 22:00-02:00",
+//	            in the server's local time; a window may run past midnight
+//	expires     an RFC 3339 time, such as the end of a conference
+//
+// Outside its hours a room refuses joins, saying when it opens, and when
+// its hours end, its members are sent away with the same. At its expiry a
+// room is archived: a closing notice is posted to its history, its members
+// are sent away and it is marked archived, after which it refuses joins and
+// cannot be created again. Its history, pins and settings are kept, and an
+// admin brings it back by clearing archived (and expires) through the
+// settings API. Rooms left idle are archived too, in a way the next message
+// undoes; see idle.go.
+
+const (
+	lifecycleTick = 30 * time.Second
+	lifecycleBot  = "lifecycle"
+)
+
+var weekdays = []string{"sun", "mon", "tue", "wed", "thu", "fri", "sat"}
+
+// openHours is a parsed open_hours setting.
+type openHours struct {
+	days     [7]bool // by time.Weekday; a window belongs to the day it opens on
+	from, to int     // minutes after midnight
+}
+
+func parseOpenHours(s string) (openHours, error) {
+	var oh openHours
+	fields := strings.Fields(s)
+	if len(fields) == 0 || len(fields) > 2 {
+		return oh, fmt.Errorf("open_hours must be like 09:00-17:00 or Mon-Fri 09:00-17:00, not %q", s)
+	}
+	if len(fields) == 1 {
+		for i := range oh.days {
+			oh.days[i] = true
+		}
+	} else if err := oh.parseDays(fields[0]); err != nil {
+		return oh, err
+	}
+	from, to, ok := strings.Cut(fields[len(fields)-1], "-")
+	var err error
+	if !ok {
+		return oh, fmt.Errorf("open_hours needs a window such as 09:00-17:00, not %q", s)
+	}
+	if oh.from, err = clockMinutes(from); err != nil {
+		return oh, err
+	}
+	if oh.to, err = clockMinutes(to); err != nil {
+		return oh, err
+	}
+	if oh.from == oh.to {
+		return oh, fmt.Errorf("open_hours %q opens and closes at the same time", s)
+	}
+	return oh, nil
+}
+
+// parseDays reads days such as "Mon-Fri" or "Sat,Sun".
+func (oh *openHours) parseDays(s string) error {
+	day := func(name string) (int, error) {
+		for i, d := range weekdays {
+			if strings.EqualFold(name, d) {
+				return i, nil
+			}
+		}
+		return 0, fmt.Errorf("unknown day %q in open_hours (want Mon, Tue, ...)", name)
+	}
+	for _, part := range strings.Split(s, ",") {
+		first, last, isRange := strings.Cut(part, "-")
+		a, err := day(first)
+		if err != nil {
+			return err
+		}
+		b := a
+		if isRange {
+			if b, err = day(last); err != nil {
+				return err
+			}
+		}
+		for d := a; ; d = (d + 1) % 7 {
+			oh.days[d] = true
+			if d == b {
+				break
+			}
+		}
+	}
+	return nil
+}
+
+// clockMinutes reads a time of day such as 09:30.
+func clockMinutes(s string) (int, error) {
+	t, err := time.Parse("15:04", s)
+	if err != nil {
+		return 0, fmt.Errorf("invalid time of day %q in open_hours (want HH:MM)", s)
+	}
+	return t.Hour()*60 + t.Minute(), nil
+}
+
+// open reports whether t falls within the hours.
+func (oh openHours) open(t time.Time) bool {
+	m := t.Hour()*60 + t.Minute()
+	today, yesterday := t.Weekday(), (t.Weekday()+6)%7
+	if oh.from < oh.to {
+		return oh.days[today] && m >= oh.from && m < oh.to
+	}
+	return oh.days[today] && m >= oh.from || oh.days[yesterday] && m < oh.to
+}
+
+// next returns the next time after t the room opens.
+func (oh openHours) next(t time.Time) time.Time {
+	midnight := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, t.Location())
+	for i := 0; i <= 7; i++ {
+		day := midnight.AddDate(0, 0, i)
+		opens := day.Add(time.Duration(oh.from) * time.Minute)
+		if oh.days[day.Weekday()] && opens.After(t) {
+			return opens
+		}
+	}
+	return time.Time{}
+}
+
+// validLifecycle checks the open_hours and expires settings.
+func (s RoomSettings) validLifecycle() error {
+	if s.OpenHours != "" {
+		if _, err := parseOpenHours(s.OpenHours); err != nil {
+			return err
+		}
+	}
+	if s.Expires != "" {
+		if _, err := time.Parse(time.RFC3339, s.Expires); err != nil {
+			return fmt.Errorf("expires must be an RFC 3339 time such as 2026-06-12T18:00:00Z, not %q", s.Expires)
+		}
+	}
+	return nil
+}
+
+// expired reports whether the room's expiry has passed at now.
+func (s RoomSettings) expired(now time.Time) bool {
+	if s.Expires == "" {
+		return false
+	}
+	at, err := time.Parse(time.RFC3339, s.Expires)
+	return err == nil && !now.Before(at)
+}
+
+// closedReason returns why the room refuses joins at now, and the HTTP
+// status to refuse them with, or "" if it is open.
+func (s RoomSettings) closedReason(room string, now time.Time) (int, string) {
+	if s.Archived || s.expired(now) {
+		return http.StatusGone, "room " + room + " is archived"
+	}
+	if s.OpenHours == "" {
+		return 0, ""
+	}
+	oh, err := parseOpenHours(s.OpenHours)
+	if err != nil || oh.open(now) {
+		return 0, ""
+	}
+	reason := "room " + room + " is closed"
+	if opens := oh.next(now); !opens.IsZero() {
+		reason += "; it opens at " + opens.Format("Mon 15:04")
+	}
+	return http.StatusForbidden, reason
+}
+
+// startLifecycle closes rooms as their hours end and archives them as they
+// expire or go idle.
+func startLifecycle() {
+	go func() {
+		for range time.Tick(lifecycleTick) {
+			now := time.Now()
+			for _, h := range allHubs() {
+				h.enforceLifecycle(now)
+			}
+		}
+	}()
+}
+
+// enforceLifecycle archives the hub's expired rooms and sends the members
+// of closed ones away.
+func (h *Hub) enforceLifecycle(now time.Time) {
+	h.mu.RLock()
+	expired := []string{}
+	for room, s := range h.settings {
+		if !s.Archived && s.expired(now) {
+			expired = append(expired, room)
+		}
+	}
+	h.mu.RUnlock()
+	for _, room := range expired {
+		h.archive(room, "This room's time is up; it has been archived.")
+	}
+	h.enforceMaxIdle(now)
+
+	for _, r := range h.roomList() {
+		if _, reason := h.roomSettings(r.Name).closedReason(r.Name, now); reason != "" {
+			if n := h.evict(r.Name, strings.ToUpper(reason[:1])+reason[1:]+"."); n > 0 {
+				log.Printf("Closed %s for the day: %d connections", tenantQualified(h.tenant, r.Name), n)
+			}
+		}
+	}
+}
+
+// archive marks room archived, posts notice to its history and sends its
+// members away.
+func (h *Hub) archive(room, notice string) {
+	h.updateSettings(room, func(s *RoomSettings) {
+		s.Archived = true
+		s.Persistent = false
+	})
+	h.postIntegration(room, lifecycleBot, notice, "")
+	n := h.closeRoom(room, notice)
+	recordAudit(AuditEntry{Actor: lifecycleBot, Tenant: h.tenant, Action: "room.archive", Subject: room, Detail: fmt.Sprintf("%d connections: %s", n, notice)})
+	log.Printf("Archived %s: %d connections", tenantQualified(h.tenant, room), n)
+}
+
+// evict sends everyone in room away, telling them reason, and returns how
+// many connections it closed. Unlike closeRoom it leaves the room to empty
+// as they unregister, so a persistent room stays listed.
+func (h *Hub) evict(room, reason string) int {
+	h.mu.RLock()
+	r, ok := h.rooms[room]
+	h.mu.RUnlock()
+	if !ok {
+		return 0
+	}
+	notice := mustMarshal(Message{Type: MsgKicked, Room: room, Text: reason, Time: h.clockTime()})
+	n := 0
+	r.mu.RLock()
+	for c := range r.Clients {
+		c.enqueue(notice)
+		if c.closeSend() {
+			n++
+		}
+	}
+	r.mu.RUnlock()
+	return n
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"strconv"
+	"time"
+)
+
+// Zero-downtime restarts: on SIGUSR2 the running server starts a new copy
+// of its binary and hands it the listening socket. Once the new process
+// reports ready, the old one stops accepting, closes its WebSockets so
+// clients reconnect (and resume) against the new process, and exits.
+
+const (
+	envListenerFD = "CHAT_LISTENER_FD" // inherited listening socket
+	envReadyFD    = "CHAT_READY_FD"    // pipe to report readiness to the parent
+
+	// handoverTimeout bounds how long the old process waits for the new one.
+	handoverTimeout = 30 * time.Second
+	// drainTimeout bounds how long clients get to disconnect.
+	drainTimeout = 10 * time.Second
+)
+
+// listen returns the socket inherited from systemd or a parent process, or
+// a fresh listener on addr.
+func listen(addr string) (net.Listener, error) {
+	if ln, ok, err := systemdListener(); ok {
+		return ln, err
+	}
+	if fd := os.Getenv(envListenerFD); fd != "" {
+		n, err := strconv.Atoi(fd)
+		if err != nil {
+			return nil, fmt.Errorf("bad %s: %w", envListenerFD, err)
+		}
+		f := os.NewFile(uintptr(n), "listener")
+		defer f.Close()
+		return net.FileListener(f)
+	}
+	return net.Listen("tcp", addr)
+}
+
+// notifyParent tells the process that started us that we are serving.
+func notifyParent() {
+	fd := os.Getenv(envReadyFD)
+	if fd == "" {
+		return
+	}
+	n, err := strconv.Atoi(fd)
+	if err != nil {
+		return
+	}
+	f := os.NewFile(uintptr(n), "ready")
+	f.Write([]byte{1})
+	f.Close()
+}
+
+// handover starts a new server process sharing ln and waits until it is
+// ready to serve.
+func handover(ln net.Listener) error {
+	tcp, ok := ln.(*net.TCPListener)
+	if !ok {
+		return errors.New("listener cannot be handed over")
+	}
+	lf, err := tcp.File()
+	if err != nil {
+		return err
+	}
+	defer lf.Close()
+
+	readyR, readyW, err := os.Pipe()
+	if err != nil {
+		return err
+	}
+	defer readyR.Close()
+
+	exe, err := os.Executable()
+	if err != nil {
+		readyW.Close()
+		return err
+	}
+	cmd := exec.Command(exe, os.Args[1:]...)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	cmd.ExtraFiles = []*os.File{lf, readyW} // fds 3 and 4
+	cmd.Env = append(os.Environ(),
+		envListenerFD+"=3",
+		envReadyFD+"=4",
+		// Share the resume key so the new process honours our tokens.
+		"CHAT_RESUME_SECRET="+cfg.ResumeSecret,
+	)
+	err = cmd.Start()
+	readyW.Close()
+	if err != nil {
+		return err
+	}
+
+	ready := make(chan error, 1)
+	go func() {
+		buf := make([]byte, 1)
+		_, err := readyR.Read(buf)
+		ready <- err
+	}()
+	select {
+	case err := <-ready:
+		if err != nil {
+			cmd.Process.Kill()
+			return fmt.Errorf("new process exited before becoming ready: %w", err)
+		}
+	case <-time.After(handoverTimeout):
+		cmd.Process.Kill()
+		return errors.New("new process did not become ready in time")
+	}
+	go cmd.Wait()
+	log.Printf("Handed listener over to pid %d", cmd.Process.Pid)
+	return nil
+}
+
+// drain stops accepting connections and disconnects every client with
+// reason, waiting briefly for them to go. After a handover the new process
+// is the service's main one and already told systemd it is ready, so the
+// old one must not report the service as stopping.
+func drain(srv *http.Server, reason string, handedOver bool) {
+	if !handedOver {
+		sdNotify("STOPPING=1")
+	}
+
+	// Report not-ready first and give load balancers time to notice
+	// before we stop listening.
+	draining.Store(true)
+	if cfg.DrainDelay > 0 {
+		log.Printf("Draining: not ready, waiting %s before shutdown", cfg.DrainDelay)
+		time.Sleep(cfg.DrainDelay)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), drainTimeout)
+	defer cancel()
+	srv.Shutdown(ctx)
+
+	for _, h := range allHubs() {
+		h.disconnectAll(reason)
+	}
+	for totalClients() > 0 && ctx.Err() == nil {
+		time.Sleep(100 * time.Millisecond)
+	}
+}
@@ -1,12 +1,16 @@
 package main
 
 import (
+	"bytes"
 	"encoding/json"
 	"fmt"
 	"log"
 	"net/http"
+	"os"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/gin-gonic/gin"
@@ -17,15 +21,47 @@ var upgrader = websocket.Upgrader{
 	CheckOrigin: func(r *http.Request) bool {
 		return true
 	},
+	Subprotocols: subprotocols,
 }
 
 const (
-	MsgChat     = "chat"
-	MsgSystem   = "system"
-	MsgUserList = "user_list"
-	MsgStats    = "stats"
-	MsgCommand  = "command"
-	MsgRoom     = "room"
+	MsgChat        = "chat"
+	MsgSystem      = "system"
+	MsgUserList    = "user_list"
+	MsgStats       = "stats"
+	MsgCommand     = "command"
+	MsgRoom        = "room"
+	MsgHistory     = "history"
+	MsgAck         = "ack"
+	MsgWelcome     = "welcome"
+	MsgRedacted    = "redacted"
+	MsgKicked      = "kicked"
+	MsgMention     = "mention"
+	MsgGroups      = "groups"
+	MsgDirect      = "direct"
+	MsgPrefs       = "prefs"
+	MsgDigest      = "digest"
+	MsgPinned      = "pinned"
+	MsgUnpinned    = "unpinned"
+	MsgPins        = "pins"
+	MsgReceipt     = "receipt"
+	MsgQuality     = "quality"
+	MsgHistoryMode = "history_mode"
+	MsgError       = "error" // a refusal with a code; see ErrorInfo
+	MsgAnnotation  = "annotation"
+
+	// Room events for chat.v2 clients; see protocol.go
+	MsgUserJoined   = "user_joined"
+	MsgUserLeft     = "user_left"
+	MsgTopicChanged = "topic_changed"
+)
+
+const (
+	// historySize is how many chat messages the memory store keeps per room,
+	// and the most that /history or a resume replay returns.
+	historySize = 100
+	// defaultHistory is how many messages /history returns without N.
+	defaultHistory = 20
 )
 
 type StatsMessage struct {
@@ -36,40 +72,170 @@ type StatsMessage struct {
 
 // Message types
 type Message struct {
-	Type     string `json:"type"` // "join", "leave", "chat", "system"
+	Type     string `json:"type"` // "chat", "system", ...; see the Msg constants
 	Room     string `json:"room"`
 	Username string `json:"username"`
 	Text     string `json:"text"`
 	Time     string `json:"time"`
+	ID       string `json:"id,omitempty"`  // server-assigned message ID
+	Ref      string `json:"ref,omitempty"` // client reference echoed back in the ack
+	Seq      int64  `json:"seq,omitempty"` // per-room sequence number of chat messages
+	Redacted bool   `json:"redacted,omitempty"`
+
+	Emoji      map[string]string `json:"emoji,omitempty"`      // custom emoji used in text: name -> image URL
+	Group      string            `json:"group,omitempty"`      // in a mention, the group the recipient was mentioned through
+	Attachment *Attachment       `json:"attachment,omitempty"` // a file posted with the message, such as a voice clip
+	Forwarded  *Forward          `json:"forwarded,omitempty"`  // the message this one was forwarded from
+
+	Integration bool `json:"integration,omitempty"` // posted through a room webhook; username is the webhook's name
+	Unverified  bool `json:"unverified,omitempty"`  // sent under a username that is not registered
+	Unsaved     bool `json:"unsaved,omitempty"`     // kept out of history; see incognito.go
+
+	Topic string `json:"topic,omitempty"` // the room's topic, in topic_changed and chat.v2 welcomes
+	Trace string `json:"trace,omitempty"` // follows a chat message through the logs; see trace.go
+
+	ResumeToken string `json:"resume_token,omitempty"` // sent in the welcome message
+
+	Error *ErrorInfo `json:"error,omitempty"` // in error messages, why the server refused; see quotas.go
+
+	Annotations []Annotation `json:"annotations,omitempty"` // bots' annotations of a stored message; see annotations.go
 }
 
 // Client represents a connected user
 type Client struct {
-	ID       string
-	Username string
-	Conn     *websocket.Conn
-	Room     string
-	Send     chan []byte
+	ID        string
+	Username  string
+	Conn      *websocket.Conn // nil for connections served by the epoll backend
+	Room      string
+	Send      chan []byte // normal lane: chat
+	Control   chan []byte // control lane: everything else, written first
+	hub       *Hub        // the hub of the client's tenant
+	origin    string      // scheme and host the client connected to, for /invite links
+	connected time.Time   // when the connection was accepted
+
+	protocol    string // negotiated subprotocol
+	compression bool   // permessage-deflate negotiated
+	stats       connStats
+
+	Resumed  bool  // reconnected with a valid resume token
+	SinceSeq int64 // last sequence number the client saw before reconnecting
+	verified bool  // logged in to a registered username; see users.go
+	observer bool  // joined with ?mode=observer and may not send; see observers.go
+
+	// wake, if set, is called whenever the send queue changes. Backends
+	// without a writePump per client use it to schedule writes.
+	wake func()
+
+	sendMu    sync.Mutex // orders enqueue against closeSend
+	closed    bool       // Send is closed
+	replaying bool       // a resume replay is being queued; see replay.go
+	held      [][]byte   // chat held back until the replay is queued
+}
+
+// enqueue queues data in its lane without blocking. It reports false if the
+// lane is full or the client's queues are already closed.
+func (c *Client) enqueue(data []byte) bool {
+	c.sendMu.Lock()
+	if c.closed {
+		c.sendMu.Unlock()
+		c.stats.drops.Add(1)
+		return false
+	}
+	lane := c.lane(data)
+	if c.replaying && lane == c.Send {
+		if len(c.held) >= maxReplay {
+			c.sendMu.Unlock()
+			c.stats.drops.Add(1)
+			return false
+		}
+		c.held = append(c.held, data)
+		c.sendMu.Unlock()
+		return true
+	}
+	select {
+	case lane <- data:
+	default:
+		c.sendMu.Unlock()
+		c.stats.drops.Add(1)
+		return false
+	}
+	c.sendMu.Unlock()
+	if c.wake != nil {
+		c.wake()
+	}
+	return true
+}
+
+// closeSend closes the send queue, telling the writer to hang up. Only the
+// first call closes it; it reports whether this was that call. The client
+// stays in its room until its connection ends and it unregisters, so
+// callers holding only a read lock on the room can drop it safely.
+func (c *Client) closeSend() bool {
+	c.sendMu.Lock()
+	if c.closed {
+		c.sendMu.Unlock()
+		return false
+	}
+	c.closed = true
+	close(c.Send)
+	c.sendMu.Unlock()
+	if c.wake != nil {
+		c.wake()
+	}
+	return true
 }
 
 // Room represents a chat room
 type Room struct {
 	Name    string
 	Clients map[*Client]bool
+	rate    rateMeter    // chat messages, for the dashboard
+	sent    atomic.Int64 // bytes sent to connections that have left
 	mu      sync.RWMutex
 }
 
 // Hub manages all rooms and clients
 type Hub struct {
+	tenant     string
+	store      Store   // this tenant's history
+	limit      limiter // per-username message rate, nil if unlimited
+	bans       banList
+	groups     groupList
+	pins       pinBoard
+	webhooks   webhookList
+	members    memberList
+	schedules  scheduleList
+	receipts   receiptBook
+	incognito  incognitoList
+	templates  templateList
+	escalation escalationBook
+	usage      usageBook
+	activity   activityBook
+	clock      Clock       // the time messages are stamped with
+	ids        IDGenerator // numbers chat messages
 	rooms      map[string]*Room
+	seqs       map[string]int64       // last sequence number per room, kept after the room empties
+	writers    map[string]*sync.Mutex // per room, held while a chat message is numbered, stored and sent
+	settings   map[string]RoomSettings
+	digestSeqs map[string]int64 // last seq covered by each room's daily digest
 	register   chan *Client
 	unregister chan *Client
+	live       atomic.Int64 // registered connections not yet unregistered
+	observing  atomic.Int64 // of those, the observers
 	mu         sync.RWMutex
 }
 
-func newHub() *Hub {
+func newHub(tenant string, store Store) *Hub {
 	return &Hub{
+		tenant:     tenant,
+		store:      store,
+		clock:      systemClock{},
+		ids:        messageIDs,
 		rooms:      make(map[string]*Room),
+		seqs:       make(map[string]int64),
+		writers:    make(map[string]*sync.Mutex),
+		settings:   make(map[string]RoomSettings),
+		digestSeqs: make(map[string]int64),
 		register:   make(chan *Client),
 		unregister: make(chan *Client),
 	}
@@ -79,19 +245,42 @@ func (h *Hub) run() {
 	for {
 		select {
 		case client := <-h.register:
-			log.Printf("Registering client: %s in room %s", client.Username, client.Room)
-			h.addClientToRoom(client)
-
+			start := time.Now()
+			h.handleRegister(client)
+			hubMetrics.run.observe(time.Since(start))
 		case client := <-h.unregister:
-			h.removeClientFromRoom(client)
+			start := time.Now()
+			h.handleUnregister(client)
+			hubMetrics.run.observe(time.Since(start))
 		}
 	}
 }
+
+func (h *Hub) handleRegister(client *Client) {
+	log.Printf("Registering client: %s in room %s", client.Username, client.Room)
+	h.live.Add(1)
+	if client.observer {
+		h.observing.Add(1)
+	}
+	h.addClientToRoom(client)
+	if !client.observer {
+		h.botsConnected(client)
+	}
+}
+
+func (h *Hub) handleUnregister(client *Client) {
+	h.live.Add(-1)
+	if client.observer {
+		h.observing.Add(-1)
+	}
+	h.removeClientFromRoom(client)
+}
 func (h *Hub) handleCommand(client *Client, cmd string) {
 
 	var msg Message
-	userCount := make(map[string]int)
+	h.mu.RLock()
 	room, exists := h.rooms[client.Room]
+	h.mu.RUnlock()
 	if !exists {
 		msg = Message{
 			Type: MsgSystem,
@@ -99,29 +288,31 @@ func (h *Hub) handleCommand(client *Client, cmd string) {
 		}
 		// h.sendToClient(client, msg)
 		data, _ := json.Marshal(msg)
-		client.Send <- data
+		client.enqueue(data)
 		return
 	}
-	// Send global statistics
-	for r := range h.rooms {
-		userCount[r] = len(h.rooms[r].Clients)
-	}
-	switch cmd {
+	args := strings.Fields(cmd)
+	switch args[0] {
 	case "/users":
 		var users []string
+		room.mu.RLock()
 		for c := range room.Clients {
-			users = append(users, c.Username)
+			if !c.observer {
+				users = append(users, c.Username)
+			}
 		}
+		room.mu.RUnlock()
 		msg = Message{
 			Type:     MsgUserList,
 			Room:     room.Name,
 			Text:     strings.Join(users, ", "),
 			Username: client.Username,
-			Time:     time.Now().Format("15:04:05"),
+			Time:     h.clockTime(),
 		}
 		h.sendToClient(client, msg)
 
 	case "/stats":
+		userCount := h.userCounts()
 
 		TotalUsers := 0
 		for _, count := range userCount {
@@ -129,7 +320,7 @@ func (h *Hub) handleCommand(client *Client, cmd string) {
 		}
 		stats := StatsMessage{
 			TotalUsers: TotalUsers,
-			TotalRooms: len(h.rooms),
+			TotalRooms: h.roomCount(),
 			// RoomDetails: userCount,
 		}
 		data, _ := json.Marshal(stats)
@@ -138,30 +329,170 @@ func (h *Hub) handleCommand(client *Client, cmd string) {
 			Room:     room.Name,
 			Text:     string(data),
 			Username: client.Username,
-			Time:     time.Now().Format("15:04:05"),
+			Time:     h.clockTime(),
 		}
 		h.sendToClient(client, msg)
 	case "/rooms":
 		// Send list of all rooms
-		data, _ := json.Marshal(userCount)
+		data, _ := json.Marshal(h.userCounts())
 		msg = Message{
 			Type:     MsgRoom,
 			Room:     room.Name,
 			Text:     string(data),
 			Username: client.Username,
-			Time:     time.Now().Format("15:04:05"),
+			Time:     h.clockTime(),
 		}
 		h.sendToClient(client, msg)
+	case "/groups":
+		groups := map[string][]string{}
+		for _, g := range h.groups.list() {
+			groups[g.Name] = g.Members
+		}
+		data, _ := json.Marshal(groups)
+		h.sendToClient(client, Message{
+			Type:     MsgGroups,
+			Room:     room.Name,
+			Text:     string(data),
+			Username: client.Username,
+			Time:     h.clockTime(),
+		})
+	case "/history":
+		n := defaultHistory
+		if len(args) > 1 {
+			v, err := strconv.Atoi(args[1])
+			if err != nil || v <= 0 {
+				h.sendToClient(client, Message{
+					Type: MsgSystem,
+					Text: "Usage: /history [N]",
+				})
+				return
+			}
+			n = min(v, historySize)
+		}
+		recent, err := h.store.Recent(room.Name, n)
+		if err != nil {
+			log.Printf("Loading history of %s: %v", room.Name, err)
+		}
+		withEmoji(h.tenant, recent)
+		h.transformed(room.Name, recent)
+		data, _ := json.Marshal(recent)
+		msg = Message{
+			Type:     MsgHistory,
+			Room:     room.Name,
+			Text:     string(data),
+			Username: client.Username,
+			Time:     h.clockTime(),
+		}
+		h.sendToClient(client, msg)
+	case "/report":
+		if len(args) < 2 {
+			h.sendToClient(client, Message{Type: MsgSystem, Text: "Usage: /report <username> [reason]"})
+			return
+		}
+		detail := "in " + room.Name
+		if len(args) > 2 {
+			detail += ": " + strings.Join(args[2:], " ")
+		}
+		recordAudit(AuditEntry{
+			Actor:   client.Username,
+			Tenant:  h.tenant,
+			Action:  "user.report",
+			Subject: args[1],
+			Detail:  detail,
+		})
+		h.sendToClient(client, Message{
+			Type: MsgSystem,
+			Room: room.Name,
+			Text: "Thanks, the moderators have been told about " + args[1] + ".",
+			Time: h.clockTime(),
+		})
+	case "/pin":
+		h.pinCommand(client, args[1:])
+	case "/unpin":
+		h.unpinCommand(client, args[1:])
+	case "/pins":
+		h.pinsCommand(client)
+	case "/quality":
+		h.qualityCommand(client, room)
+	case "/incognito":
+		h.incognitoCommand(client, args[1:])
+	case "/forward":
+		h.forwardCommand(client, args[1:])
+	case "/digest":
+		h.digestCommand(client, args[1:])
+	case "/prefs":
+		h.prefsCommand(client, args[1:])
+	case "/filter":
+		h.filterCommand(client, args[1:])
+	case "/calendar":
+		h.calendarCommand(client, args[1:])
+	case "/create":
+		h.createCommand(client, args[1:])
+	case "/invite":
+		text := "Invite others to " + room.Name + ": " + inviteLink(client.origin, h.tenant, room.Name)
+		if len(args) > 1 && args[1] == "qr" {
+			text = "QR code inviting others to " + room.Name + ": " + inviteQRLink(client.origin, h.tenant, room.Name)
+		}
+		h.sendToClient(client, Message{
+			Type: MsgSystem,
+			Room: room.Name,
+			Text: text,
+			Time: h.clockTime(),
+		})
 	default:
 		// Unknown command
 		msg = Message{
 			Type: MsgSystem,
-			Text: "Unknown command. Available commands: /users, /stats, /rooms",
+			Text: commandHelp(),
 		}
 		h.sendToClient(client, msg)
 	}
 }
+
+// disconnectAll tells every client reason and closes its connection.
+// Clients reconnect on their own; the SDK resumes its session.
+func (h *Hub) disconnectAll(reason string) {
+	notice := mustMarshal(Message{Type: MsgSystem, Text: reason, Time: h.clockTime()})
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for name, room := range h.rooms {
+		room.mu.Lock()
+		for client := range room.Clients {
+			client.enqueue(notice)
+			client.closeSend()
+			delete(room.Clients, client)
+		}
+		room.mu.Unlock()
+		delete(h.rooms, name)
+	}
+}
+
+// clientCount returns the number of registered connections that have not
+// unregistered yet.
+func (h *Hub) clientCount() int64 {
+	return h.live.Load()
+}
+
+// userCounts returns the number of users in every room.
+func (h *Hub) userCounts() map[string]int {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	counts := make(map[string]int, len(h.rooms))
+	for name, room := range h.rooms {
+		if name == canaryRoom {
+			continue
+		}
+		room.mu.RLock()
+		counts[name] = room.members()
+		room.mu.RUnlock()
+	}
+	return counts
+}
+
 func (h *Hub) addClientToRoom(client *Client) {
+	w := h.writer(client.Room)
+	w.Lock()
 	h.mu.Lock()
 
 	// Get or create room
@@ -175,25 +506,86 @@ func (h *Hub) addClientToRoom(client *Client) {
 		h.rooms[client.Room] = room
 		log.Printf("Created new room: %s", client.Room)
 	}
+	s := h.settings[client.Room]
+	if s.Owner == "" && !client.observer {
+		s.Owner = client.Username // the first to join a room owns it
+		h.settings[client.Room] = s
+	}
 	log.Printf("Adding client %s to room %s", client.Username, client.Room)
 
-	// Add client to room
+	// Add client to room. The welcome is queued and the replay started under
+	// the room lock, and the room's writer, so no live broadcast can slip in
+	// between them.
+	welcomeTopic := ""
+	if client.structured() {
+		welcomeTopic = s.Topic
+	}
 	room.mu.Lock()
 	room.Clients[client] = true
+	client.enqueue(mustMarshal(Message{
+		Type:        MsgWelcome,
+		Room:        client.Room,
+		Username:    client.Username,
+		Time:        h.clockTime(),
+		Seq:         h.lastSeq(client.Room),
+		ResumeToken: issueResumeToken(h.tenant, client.Username, client.Room, h.now()),
+		Topic:       welcomeTopic,
+	}))
+	if s.Topic != "" && !client.structured() {
+		client.enqueue(mustMarshal(Message{Type: MsgSystem, Room: client.Room, Text: "Topic: " + s.Topic, Time: h.clockTime()}))
+	}
+	if s.NoHistory {
+		client.enqueue(mustMarshal(h.historyMode(client.Room, "", true)))
+	}
+	if s.Dormant {
+		client.enqueue(mustMarshal(Message{Type: MsgSystem, Room: client.Room, Text: dormantText, Time: h.clockTime()}))
+	}
+	if client.Resumed {
+		missed, err := h.store.Since(client.Room, client.SinceSeq, maxReplay)
+		if err != nil {
+			log.Printf("Loading history for %s in %s: %v", client.Username, client.Room, err)
+		}
+		withEmoji(h.tenant, missed)
+		transformAll(missed, s.Transforms) // h.mu is held
+		if len(missed) > 0 {
+			client.startReplay(missed)
+		}
+	}
 	room.mu.Unlock()
+	w.Unlock()
 
 	log.Printf("Client %s joined room %s (Total: %d)",
 		client.Username, client.Room, len(room.Clients))
+	joined := AdminEvent{Kind: EventJoin, Tenant: h.tenant, Room: client.Room, Username: client.Username}
+	if client.Resumed {
+		joined.Detail = "resumed"
+	}
+	if client.observer {
+		joined.Detail = strings.TrimPrefix(joined.Detail+", "+modeObserver, ", ")
+	}
+	publishEvent(joined)
+	if client.observer {
+		// Observers come and go unannounced.
+		h.mu.Unlock()
+		return
+	}
+	h.memberJoined(client)
+
+	if client.Resumed {
+		// The session continues; don't announce it again.
+		h.mu.Unlock()
+		return
+	}
 
 	// Send join message to room
 	msg := Message{
-		Type: "system",
-		Room: client.Room,
-		Text: fmt.Sprintf("%s joined the room", client.Username),
-		Time: time.Now().Format("15:04:05"),
+		Type:     MsgUserJoined,
+		Room:     client.Room,
+		Username: client.Username,
+		Time:     h.clockTime(),
 	}
 	h.mu.Unlock()
-	h.broadcastToRoom(client.Room, msg)
+	h.broadcastNotice(client.Room, msg)
 }
 
 func (h *Hub) removeClientFromRoom(client *Client) {
@@ -206,34 +598,197 @@ func (h *Hub) removeClientFromRoom(client *Client) {
 	}
 
 	room.mu.Lock()
-	if _, ok := room.Clients[client]; ok {
+	_, member := room.Clients[client]
+	if member {
 		delete(room.Clients, client)
-		close(client.Send)
+		client.closeSend()
+		room.sent.Add(client.stats.sent.Load())
 	}
+	remaining := len(room.Clients)
 	room.mu.Unlock()
+	if member && !client.observer {
+		h.memberLeft(client)
+	}
 
 	log.Printf("Client %s left room %s (Remaining: %d)",
-		client.Username, client.Room, len(room.Clients))
+		client.Username, client.Room, remaining)
+	left := AdminEvent{Kind: EventLeave, Tenant: h.tenant, Room: client.Room, Username: client.Username}
+	if client.observer {
+		left.Detail = modeObserver
+	}
+	publishEvent(left)
 
 	// Send leave message to room
-	msg := Message{
-		Type: "system",
-		Room: client.Room,
-		Text: fmt.Sprintf("%s left the room", client.Username),
-		Time: time.Now().Format("15:04:05"),
+	if !client.observer {
+		h.broadcastNotice(client.Room, Message{
+			Type:     MsgUserLeft,
+			Room:     client.Room,
+			Username: client.Username,
+			Time:     h.clockTime(),
+		})
 	}
-	h.broadcastToRoom(client.Room, msg)
 
-	// Delete room if empty
-	if len(room.Clients) == 0 {
+	// Delete room if empty, unless it is kept. Someone may have joined
+	// since, so check again with the hub locked.
+	if remaining == 0 {
 		h.mu.Lock()
-		delete(h.rooms, client.Room)
+		room.mu.RLock()
+		empty := h.rooms[client.Room] == room && len(room.Clients) == 0 && !h.settings[client.Room].Persistent
+		room.mu.RUnlock()
+		if empty {
+			delete(h.rooms, client.Room)
+		}
 		h.mu.Unlock()
-		log.Printf("Deleted empty room: %s", client.Room)
+		if empty {
+			h.receipts.forget(client.Room)
+			h.incognito.forget(client.Room)
+			h.activity.forget(client.Room)
+			log.Printf("Deleted empty room: %s", client.Room)
+		}
 	}
 }
 
+// Erased users' history entries are rewritten to these.
+const (
+	tombstoneAuthor = "[deleted]"
+	tombstoneText   = "[message deleted]"
+)
+
+// redactedText replaces the text of a redacted message.
+const redactedText = "[redacted]"
+
+// userRooms returns the rooms username is connected to.
+func (h *Hub) userRooms(username string) []string {
+	out := []string{}
+	for _, room := range h.roomList() {
+		room.mu.RLock()
+		for client := range room.Clients {
+			if client.Username == username {
+				out = append(out, room.Name)
+				break
+			}
+		}
+		room.mu.RUnlock()
+	}
+	return out
+}
+
+func (h *Hub) hasRoom(name string) bool {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	_, ok := h.rooms[name]
+	return ok
+}
+
+func (h *Hub) roomCount() int {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	return len(h.rooms)
+}
+
+func (h *Hub) roomList() []*Room {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	rooms := make([]*Room, 0, len(h.rooms))
+	for _, room := range h.rooms {
+		rooms = append(rooms, room)
+	}
+	return rooms
+}
+
+// lastSeq returns the room's latest sequence number, picking it up from the
+// store the first time so numbering continues across restarts. Callers hold
+// h.mu for writing.
+func (h *Hub) lastSeq(roomName string) int64 {
+	seq, ok := h.seqs[roomName]
+	if !ok {
+		var err error
+		if seq, err = h.store.LastSeq(roomName); err != nil {
+			log.Printf("Loading last seq of %s: %v", roomName, err)
+		}
+		h.seqs[roomName] = seq
+	}
+	return seq
+}
+
+// nextSeq takes the room's next sequence number.
+func (h *Hub) nextSeq(roomName string) int64 {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	seq := h.lastSeq(roomName) + 1
+	h.seqs[roomName] = seq
+	return seq
+}
+
+// recordHistory assigns msg the room's next sequence number and stores it,
+// unless it is unsaved or the room's history is off. Callers hold the
+// room's writer.
+func (h *Hub) recordHistory(roomName string, msg Message) Message {
+	msg.Seq = h.nextSeq(roomName)
+	if h.roomSettings(roomName).NoHistory {
+		msg.Unsaved = true
+	}
+	traceLog(msg, "seq %d", msg.Seq)
+	if msg.Unsaved {
+		h.usage.add(roomName, msg, false, h.now())
+		return msg
+	}
+	stored := msg
+	stored.Trace = ""
+	err := h.store.Append(stored)
+	if err != nil {
+		log.Printf("Storing message %s (trace %s): %v", msg.ID, msg.Trace, err)
+	}
+	h.usage.add(roomName, msg, err == nil, h.now())
+	return msg
+}
+
+// Chat in a room is totally ordered: each room has a single writer, a lock
+// held from the moment a chat message takes its seq until it is stored and
+// queued for every member, and joiners take it while their welcome and
+// replay are queued. Since each connection's queue is delivered in order,
+// every connection sees a room's chat messages in seq order, each seq
+// higher than the last, with none missing from the welcome's seq on.
+// Clients can rely on this to drop duplicates after a resume and to spot
+// gaps, which only a resume further back than the replay can cause (or
+// -echo mode, where each connection sees only its own messages).
+
+// writer returns the lock serializing room's chat. It must not be taken
+// while holding h.mu.
+func (h *Hub) writer(roomName string) *sync.Mutex {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	w, ok := h.writers[roomName]
+	if !ok {
+		w = new(sync.Mutex)
+		h.writers[roomName] = w
+	}
+	return w
+}
+
+// publish numbers msg as room's next chat message, stores it and sends it
+// to the room, as room's writer, and returns it as sent.
+func (h *Hub) publish(roomName string, msg Message) Message {
+	w := h.writer(roomName)
+	w.Lock()
+	defer w.Unlock()
+	if h.roomSettings(roomName).Dormant {
+		h.wake(roomName)
+	}
+	h.activity.touch(roomName, h.now())
+	msg = h.recordHistory(roomName, msg)
+	msg.Emoji = expandEmoji(h.tenant, roomName, msg.Text)
+	h.broadcastToRoom(roomName, msg)
+	return msg
+}
+
 func (h *Hub) broadcastToRoom(roomName string, msg Message) {
+	h.broadcast(roomName, msg, false)
+}
+
+// broadcast sends msg to everyone in the room; a lowPriority one is skipped
+// for clients over -client-bandwidth.
+func (h *Hub) broadcast(roomName string, msg Message, lowPriority bool) {
 	h.mu.RLock()
 	room, exists := h.rooms[roomName]
 	h.mu.RUnlock()
@@ -242,70 +797,191 @@ func (h *Hub) broadcastToRoom(roomName string, msg Message) {
 		return
 	}
 
-	data, _ := json.Marshal(msg)
+	if transforms := h.roomSettings(roomName).Transforms; len(transforms) > 0 {
+		msg = transform(msg, transforms)
+	}
+	data, _ := json.Marshal(outbound(msg))
+	legacy := data
+	if l, ok := legacyEvent(msg); ok {
+		legacy = mustMarshal(l)
+	}
+	if msg.Type == MsgChat {
+		room.rate.add(time.Now())
+	}
 
+	// Only a read lock is held here, so a client that cannot keep up is
+	// not removed: closing its queue hangs it up, and it leaves the room
+	// when it unregisters.
 	room.mu.RLock()
 	defer room.mu.RUnlock()
 
+	now := time.Now()
+	queued := 0
 	for client := range room.Clients {
-		select {
-		case client.Send <- data:
-		default:
-			close(client.Send)
-			delete(room.Clients, client)
+		if lowPriority && client.throttle(now) {
+			continue
+		}
+		frame := data
+		if !client.structured() {
+			frame = legacy
 		}
+		if client.enqueue(frame) {
+			queued++
+		} else if client.closeSend() {
+			publishEvent(AdminEvent{Kind: EventDrop, Tenant: h.tenant, Room: roomName, Username: client.Username, Detail: "send queue full"})
+		}
+	}
+	if msg.Trace != "" {
+		traceLog(msg, "queued for %d of %d connections", queued, len(room.Clients))
 	}
 }
 
-func (h *Hub) sendToClient(client *Client, msg Message) {
+func mustMarshal(msg Message) []byte {
 	data, _ := json.Marshal(msg)
-	log.Printf("Sending message to client %s: %s", client.Username, string(data))
-	select {
-	case client.Send <- data:
-		log.Printf("Message sent to channel %s", client.Username)
-	default:
-		close(client.Send)
+	return data
+}
 
+func (h *Hub) sendToClient(client *Client, msg Message) {
+	data, _ := json.Marshal(outbound(client.render(msg)))
+	if cfg.Verbose {
+		log.Printf("Sending message to client %s: %s", client.Username, string(data))
+	}
+	if !client.enqueue(data) && client.closeSend() {
+		publishEvent(AdminEvent{Kind: EventDrop, Tenant: h.tenant, Room: client.Room, Username: client.Username, Detail: "send queue full"})
 	}
 }
 
 func (c *Client) readPump(hub *Hub) {
 	defer func() {
-		hub.unregister <- c
+		hub.unregisterClient(c)
 		c.Conn.Close()
 	}()
 
 	c.Conn.SetReadDeadline(time.Now().Add(60 * time.Second))
 	c.Conn.SetPongHandler(func(string) error {
 		c.Conn.SetReadDeadline(time.Now().Add(60 * time.Second))
+		c.stats.ponged()
 		return nil
 	})
 
 	for {
-		_, data, err := c.Conn.ReadMessage()
-		log.Println("Received message:", string(data))
+		_, r, err := c.Conn.NextReader()
+		if err != nil {
+			break
+		}
+		c.stats.read()
+		buf := readBufs.Get().(*bytes.Buffer)
+		buf.Reset()
+		_, err = buf.ReadFrom(r)
+		if err == nil {
+			if cfg.Verbose {
+				log.Println("Received message:", buf.String())
+			}
+			c.handleMessage(hub, buf.Bytes())
+		}
+		readBufs.Put(buf)
 		if err != nil {
 			break
 		}
+	}
+}
 
-		var msg Message
-		if err := json.Unmarshal(data, &msg); err != nil {
-			continue
+// readBufs recycles inbound frame buffers; handleMessage copies what it
+// keeps, so a buffer is free again as soon as it returns.
+var readBufs = sync.Pool{New: func() any { return new(bytes.Buffer) }}
+
+// handleMessage processes one inbound frame: a command or a chat message.
+func (c *Client) handleMessage(hub *Hub, data []byte) {
+	var msg Message
+	if err := json.Unmarshal(data, &msg); err != nil {
+		hub.refuseBadJSON(c, err)
+		return
+	}
+	if c.observer {
+		hub.refuseObserver(c, msg.Ref)
+		return
+	}
+	if msg.Type == MsgReceipt {
+		hub.receipt(c, msg)
+		return
+	}
+	if hub.rateLimited(c.Username, hub.now()) {
+		floodAlerts.hit(tenantQualified(hub.tenant, c.Username), time.Now())
+		if hub.rateViolation(c, hub.now()) {
+			return
 		}
-		if strings.HasPrefix(msg.Text, "/") {
+		hub.sendToClient(c, Message{
+			Type: MsgSystem,
+			Room: c.Room,
+			Text: "You are sending messages too fast; slow down.",
+			Time: hub.clockTime(),
+			Ref:  msg.Ref,
+		})
+		return
+	}
+	if strings.HasPrefix(msg.Text, "/") {
+		if cfg.Verbose {
 			log.Println("Received command:", msg.Text)
-			hub.handleCommand(c, msg.Text)
-			continue
 		}
+		hub.handleCommand(c, msg.Text)
+		return
+	}
+	if m, ok := hub.escalation.mutedAt(c.Username, hub.now()); ok {
+		hub.sendToClient(c, Message{
+			Type: MsgSystem,
+			Room: c.Room,
+			Text: "You are muted until " + m.Until.Local().Format("15:04") + ".",
+			Time: hub.clockTime(),
+			Ref:  msg.Ref,
+		})
+		return
+	}
+
+	// Set message metadata
+	msg.Username = c.Username
+	msg.Room = c.Room
+	msg.Type = "chat"
+	msg.Time = hub.clockTime()
+	msg.ID = hub.newMessageID()
+	msg.Trace = traceID(msg.Trace)
+	msg.Emoji = nil
+	msg.Attachment = nil // only the upload endpoint attaches files
+	msg.Forwarded = nil  // and only /forward forwards
+	msg.Integration = false
+	msg.Unverified = cfg.Registration && !c.verified
+	msg.Unsaved = hub.unsaved(c)
+	msg.Text = censor(msg.Text, hub.filterLevel(c.Room))
+	if e := hub.overQuota(c.Room, msg, hub.now()); e != nil {
+		hub.refuseOverQuota(c, msg.Ref, e)
+		return
+	}
+	ref := msg.Ref
+	msg.Ref = ""
+	traceLog(msg, "received from %s (connection %s)", c.Username, c.ID)
 
-		// Set message metadata
-		msg.Username = c.Username
-		msg.Room = c.Room
-		msg.Type = "chat"
-		msg.Time = time.Now().Format("15:04:05")
+	// Broadcast to room. Emoji are looked up on delivery, not stored. In
+	// echo mode the message is numbered as usual but only its sender sees
+	// it.
+	if cfg.Echo {
+		msg.Seq = hub.nextSeq(c.Room)
+		msg.Emoji = expandEmoji(hub.tenant, c.Room, msg.Text)
+		hub.sendToClient(c, msg)
+	} else {
+		msg = hub.publish(c.Room, msg)
+		hub.notifyMentions(msg)
+		hub.trackReceipts(msg)
+	}
 
-		// Broadcast to room
-		hub.broadcastToRoom(c.Room, msg)
+	// Confirm delivery to the sender if it asked for an ack
+	if ref != "" {
+		hub.sendToClient(c, Message{
+			Type:  MsgAck,
+			Room:  c.Room,
+			Time:  msg.Time,
+			ID:    msg.ID,
+			Ref:   ref,
+			Trace: msg.Trace,
+		})
 	}
 }
 
@@ -316,70 +992,311 @@ func (c *Client) writePump() {
 		c.Conn.Close()
 	}()
 
+	// Ping straight away so the link is graded within a round trip.
+	if !c.ping() {
+		return
+	}
 	for {
+		// Control messages go out ahead of any queued chat
+		if message, ok := c.nextControl(); ok {
+			if !c.write(message) {
+				return
+			}
+			continue
+		}
+
 		select {
+		case message := <-c.Control:
+			if !c.write(message) {
+				return
+			}
+
 		case message, ok := <-c.Send:
-			c.Conn.SetWriteDeadline(time.Now().Add(30 * time.Second))
 			if !ok {
-				log.Println("Client send channel closed")
-				c.Conn.WriteMessage(websocket.CloseMessage, []byte{})
+				c.drainAndClose()
 				return
 			}
-			if err := c.Conn.WriteMessage(websocket.TextMessage, message); err != nil {
-				log.Println("Write error:", err)
+			batch, open := c.collectBatch(message)
+			if !c.write(batch...) {
+				return
+			}
+			if !open {
+				c.drainAndClose()
 				return
 			}
 
 		case <-ticker.C:
-			c.Conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
-			if err := c.Conn.WriteMessage(websocket.PingMessage, nil); err != nil {
+			if !c.ping() {
 				return
 			}
 		}
 	}
 }
 
-var hub = newHub()
+// ping sends a keepalive ping, timing its round trip for quality.go, and
+// reports whether it went out.
+func (c *Client) ping() bool {
+	c.Conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
+	c.stats.pinged()
+	return c.Conn.WriteMessage(websocket.PingMessage, nil) == nil
+}
+
+// write sends one message, or a batch of them as a JSON array, and reports
+// whether it went out.
+func (c *Client) write(batch ...[]byte) bool {
+	c.Conn.SetWriteDeadline(time.Now().Add(30 * time.Second))
+	size := frameSize(batch)
+	start := batch[0]
+	if len(batch) > 1 {
+		start = []byte{'['}
+	}
+	c.Conn.EnableWriteCompression(shouldCompress(start, size))
+	began := time.Now()
+	var err error
+	if fragmented(size) {
+		err = c.writeFragmented(batch)
+	} else {
+		err = c.Conn.WriteMessage(websocket.TextMessage, joinBatch(batch))
+	}
+	if err != nil {
+		log.Println("Write error:", err)
+		return false
+	}
+	c.stats.wroteIn(time.Since(began))
+	c.stats.wrote(size)
+	return true
+}
+
+// drainAndClose delivers what is left in the control lane, such as a kick
+// notice, then sends a normal closure frame, as the epoll backend does. The
+// hub closed the send queue.
+func (c *Client) drainAndClose() {
+	log.Println("Client send channel closed")
+	for {
+		message, ok := c.nextControl()
+		if !ok || !c.write(message) {
+			break
+		}
+	}
+	c.Conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
+	c.Conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""))
+}
 
 func handleWebSocket(c *gin.Context) {
 
 	username := c.Query("username")
 	room := c.Query("room")
-	log.Printf("Connection request: username=%s, room=%s", username, room)
+	log.Printf("Connection request: username=%s, room=%s", username, tenantQualified(c.Query("tenant"), room))
 
 	if username == "" || room == "" {
 		c.JSON(400, gin.H{"error": "username and room required"})
 		return
 	}
+	tenant, ok := lookupTenant(c.Query("tenant"))
+	if !ok {
+		c.JSON(404, gin.H{"error": "unknown tenant"})
+		return
+	}
+	if reason := readiness(); reason != "" {
+		c.Header("Retry-After", "5")
+		c.JSON(503, gin.H{"error": "server " + reason + ", try again later"})
+		return
+	}
 	room = strings.TrimSpace(room)
+	observer, err := parseMode(c.Query("mode"))
+	if err != nil {
+		c.JSON(400, gin.H{"error": err.Error()})
+		return
+	}
+	if status, reason := tenant.refuseJoin(username, room, observer, time.Now()); reason != "" {
+		c.JSON(status, gin.H{"error": reason})
+		return
+	}
+	hub := tenant.hub
 
-	conn, err := upgrader.Upgrade(c.Writer, c.Request, nil)
+	// A valid resume token continues the previous session
+	var resumed bool
+	var sinceSeq int64
+	if token := c.Query("resume"); token != "" {
+		if err := verifyResumeToken(token, tenant.Name, username, room, time.Now()); err != nil {
+			log.Printf("Resume rejected for %s in %s: %v", username, room, err)
+		} else {
+			resumed = true
+			sinceSeq, _ = strconv.ParseInt(c.Query("since_seq"), 10, 64)
+		}
+	}
+
+	// Registered names need a login
+	verified, err := identify(tenant.Name, username, c.Query("auth"), resumed, time.Now())
 	if err != nil {
-		log.Printf("Upgrade failed: %v", err)
+		c.JSON(401, gin.H{"error": err.Error()})
 		return
 	}
 
+	// New sessions pay a proof of work when enabled; resumed ones already did
+	if !resumed && !paidPow(c) {
+		return
+	}
+
+	joinAlerts.hit(c.ClientIP(), time.Now())
+
 	client := &Client{
-		ID:       fmt.Sprintf("%s-%d", username, time.Now().Unix()),
-		Username: username,
-		Room:     room,
-		Conn:     conn,
-		Send:     make(chan []byte, 256),
+		ID:        newConnID(username),
+		Username:  username,
+		Room:      room,
+		Send:      make(chan []byte, cfg.SendQueue),
+		Control:   make(chan []byte, cfg.ControlQueue),
+		hub:       hub,
+		origin:    requestOrigin(c.Request),
+		connected: time.Now(),
+		Resumed:   resumed,
+		SinceSeq:  sinceSeq,
+		verified:  verified,
+		observer:  observer,
 	}
+
+	if cfg.Backend == backendEpoll {
+		pc, err := upgradeEpoll(c, client)
+		if err != nil {
+			log.Printf("Upgrade failed: %v", err)
+			return
+		}
+		log.Printf("New client created: %s in room %s", client.Username, client.Room)
+		hub.registerClient(client)
+		poller.watch(pc)
+		return
+	}
+
+	conn, err := upgrader.Upgrade(c.Writer, c.Request, nil)
+	if err != nil {
+		log.Printf("Upgrade failed: %v", err)
+		return
+	}
+	if cfg.Compression {
+		if err := conn.SetCompressionLevel(cfg.CompressionLevel); err != nil {
+			log.Printf("Invalid compression level %d: %v", cfg.CompressionLevel, err)
+		}
+	}
+	client.Conn = conn
+	client.protocol = conn.Subprotocol()
+	client.compression = negotiatedDeflate(c.Request)
 	log.Printf("New client created: %s in room %s", client.Username, client.Room)
 
-	hub.register <- client
+	hub.registerClient(client)
 
 	go client.writePump()
 	go client.readPump(hub)
 
 }
 
-func main() {
-	go hub.run()
+// refuseJoin returns the HTTP status and reason to refuse username a
+// session in room with, as an observer if observer is set, or "" if they
+// may have one.
+func (t *Tenant) refuseJoin(username, room string, observer bool, now time.Time) (int, string) {
+	if reason := t.admit(room, observer); reason != "" {
+		return 429, reason
+	}
+	if observer {
+		if status, reason := t.hub.admitObserver(room); reason != "" {
+			return status, reason
+		}
+	}
+	if status, reason := t.hub.roomSettings(room).closedReason(room, now); reason != "" {
+		return status, reason
+	}
+	if ban, ok := t.hub.bans.banned(username, now); ok {
+		reason := "banned"
+		if !ban.Until.IsZero() {
+			reason += " until " + ban.Until.UTC().Format(time.RFC3339)
+		}
+		return 403, reason
+	}
+	return 0, ""
+}
+
+// paidPow reports whether the request carries a valid proof of work, if
+// one is required, and otherwise replies with a challenge.
+func paidPow(c *gin.Context) bool {
+	if cfg.PowDifficulty <= 0 {
+		return true
+	}
+	err := verifyPow(c.Query("pow"), c.Query("pow_solution"), time.Now())
+	if err == nil {
+		return true
+	}
+	if err != errPowRequired {
+		powAlerts.hit(c.ClientIP(), time.Now())
+	}
+	c.JSON(428, gin.H{
+		"error":      err.Error(),
+		"challenge":  issueChallenge(time.Now()),
+		"difficulty": cfg.PowDifficulty,
+	})
+	return false
+}
 
+func main() {
+	if len(os.Args) > 1 && os.Args[1] == "migrate" {
+		os.Exit(runMigrate(os.Args[2:]))
+	}
+	if len(os.Args) > 1 && os.Args[1] == "simulate" {
+		os.Exit(runSimulate(os.Args[2:]))
+	}
+	cfg = loadConfig()
+	setupCompression()
+	base, err := setupStore()
+	if err != nil {
+		log.Fatalf("Opening store: %v", err)
+	}
+	if err := setupTenants(base); err != nil {
+		log.Fatalf("Tenants: %v", err)
+	}
+	for _, h := range allHubs() {
+		if err := h.countStorage(); err != nil {
+			log.Fatalf("Counting storage: %v", err)
+		}
+	}
+	if err := setupRooms(); err != nil {
+		log.Fatalf("Rooms: %v", err)
+	}
+	if err := setupTemplates(); err != nil {
+		log.Fatalf("Room templates: %v", err)
+	}
+	if err := setupAttachments(); err != nil {
+		log.Fatalf("Attachments: %v", err)
+	}
+	if err := setupPrefs(); err != nil {
+		log.Fatalf("Preferences: %v", err)
+	}
+	if err := setupRegistrations(); err != nil {
+		log.Fatalf("Registrations: %v", err)
+	}
+	if err := setupBots(); err != nil {
+		log.Fatalf("Bots: %v", err)
+	}
+	if err := startBackups(); err != nil {
+		log.Fatalf("Backups: %v", err)
+	}
+	startAlerts()
+	startMemberHooks()
+	startSchedules()
+	startDigests()
+	startFeeds()
+	startCalendars()
+	startLifecycle()
+	if cfg.Backend == backendEpoll {
+		if err := startPoller(); err != nil {
+			log.Fatalf("epoll backend: %v", err)
+		}
+	}
 	router := gin.Default()
 	router.GET("/ws", handleWebSocket)
+	router.GET("/ws/mux", handleMux)
+	router.GET("/api/schema", handleSchema)
+	router.GET("/api/challenge", handleChallenge)
+	registerAdminRoutes(router)
+	router.GET("/healthz", handleHealthz)
+	router.GET("/readyz", handleReadyz)
 
 	// Serve static files (HTML, JS, CSS)
 	router.Static("/static", "./static")
@@ -389,9 +1306,42 @@ func main() {
 	router.GET("/", func(c *gin.Context) {
 		c.HTML(200, "index.html", nil)
 	})
+	router.GET("/r/:room", handleRoomLink)
+	router.GET("/r/:room/qr.png", handleRoomQR)
+	router.GET("/api/rooms", handleRoomDirectory)
+	router.GET("/api/rooms/:room/emoji", handleRoomEmoji)
+	router.GET("/attachments/:name", handleAttachment)
+	router.POST("/api/rooms/:room/attachments", handleUploadAudio)
+	router.POST("/api/rooms/:room/messages", handlePostMessage)
+	router.POST("/api/rooms/:room/messages/:id/annotations", handleAnnotate)
+	router.POST("/api/rooms/:room/github", handleGitHubHook)
+	router.POST("/api/rooms/:room/gitlab", handleGitLabHook)
+	router.POST("/api/rooms/:room/alertmanager", handleAlertmanagerHook)
+	router.POST("/api/users/:username/register", handleRegister)
+	router.POST("/api/users/:username/login", handleLogin)
+	router.PUT("/api/users/:username/password", handleChangePassword)
+	router.GET("/api/users/:username/prefs", handleGetPrefs)
+	router.PUT("/api/users/:username/prefs", handleUpdatePrefs)
+
+	ln, err := listen(cfg.Addr)
+	if err != nil {
+		log.Fatalf("listen: %v", err)
+	}
+	srv := &http.Server{Handler: router}
+	go func() {
+		if err := srv.Serve(ln); err != nil && err != http.ErrServerClosed {
+			log.Fatalf("serve: %v", err)
+		}
+	}()
+	startCanary(ln.Addr())
+	notifyParent()
+	sdNotify("MAINPID="+strconv.Itoa(os.Getpid()), "READY=1")
 
-	fmt.Println("🚀 Chat Rooms Server started on :8080")
+	fmt.Printf("🚀 Chat Rooms Server started on %s (pid %d)\n", ln.Addr(), os.Getpid())
+	if cfg.Echo {
+		fmt.Println("🔁 Echo mode: chat messages go back to their sender only and are not stored")
+	}
 	fmt.Println("📱 Connect using: go run client/room_client.go <username> <room>")
 
-	router.Run(":8080")
+	waitForSignals(srv, ln)
 }
@@ -0,0 +1,235 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"slices"
+	"sync"
+	"time"
+)
+
+// External systems can follow room membership, to provision what members
+// of a room should have: a mailing list subscription, access to a
+// repository. A user becomes a member of a room with their first
+// connection to it and stops being one leaveGrace after their last, so
+// reconnects and extra tabs do not count. Every change is published on the
+// admin event stream as member.join or member.leave, and rooms in the
+// -rooms file can also call out:
+//
+//	{"name": "eng", "hooks": [{"url": "https://provisioner.internal/chat", "events": ["join", "leave"], "secret": "..."}]}
+//
+// Each hook is POSTed
+//
+//	{"event": "join", "tenant": "", "room": "eng", "username": "alice", "verified": true, "time": "2024-05-01T09:30:00Z"}
+//
+// with X-Chat-Event set to the event and, if the hook has a secret,
+// X-Chat-Signature-256 set to "sha256=" and the hex HMAC-SHA256 of the
+// body. verified says the user logged in to a registered username (see
+// users.go); provisioning for an unverified name trusts whoever typed it.
+// Calls are made in order, one at a time, and retried up to
+// memberHookAttempts times; calls that still fail are logged and dropped.
+
+const (
+	leaveGrace         = 30 * time.Second
+	memberHookAttempts = 3
+)
+
+// MemberHook is called when users join or leave a room.
+type MemberHook struct {
+	URL    string   `json:"url"`
+	Events []string `json:"events,omitempty"` // "join" and "leave"; both by default
+	Secret string   `json:"secret,omitempty"` // signs the body, if set
+}
+
+func (m *MemberHook) validate() error {
+	if u, err := url.Parse(m.URL); err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+		return fmt.Errorf("hook url %q must be http or https", m.URL)
+	}
+	if len(m.Events) == 0 {
+		m.Events = []string{"join", "leave"}
+	}
+	for _, e := range m.Events {
+		if e != "join" && e != "leave" {
+			return fmt.Errorf("hook event %q must be join or leave", e)
+		}
+	}
+	return nil
+}
+
+// memberEvent is the body of a hook call.
+type memberEvent struct {
+	Event    string    `json:"event"`
+	Tenant   string    `json:"tenant"`
+	Room     string    `json:"room"`
+	Username string    `json:"username"`
+	Verified bool      `json:"verified"`
+	Time     time.Time `json:"time"`
+}
+
+// presence is one user's connections to one room.
+type presence struct {
+	conns    int
+	verified bool
+	leaving  *time.Timer // set while the last connection's grace runs
+}
+
+// memberList tracks who is a member of each room and the rooms' hooks.
+type memberList struct {
+	mu      sync.Mutex
+	hooks   map[string][]MemberHook         // room -> hooks
+	present map[string]map[string]*presence // room -> username
+}
+
+// addHook has room call hook on membership changes.
+func (l *memberList) addHook(room string, hook MemberHook) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.hooks == nil {
+		l.hooks = make(map[string][]MemberHook)
+	}
+	l.hooks[room] = append(l.hooks[room], hook)
+}
+
+// memberJoined counts a new connection of client's, announcing the user as
+// a member unless they already were one or are rejoining within the grace.
+func (h *Hub) memberJoined(client *Client) {
+	l := &h.members
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.present == nil {
+		l.present = make(map[string]map[string]*presence)
+	}
+	if l.present[client.Room] == nil {
+		l.present[client.Room] = make(map[string]*presence)
+	}
+	p := l.present[client.Room][client.Username]
+	if p == nil {
+		p = &presence{}
+		l.present[client.Room][client.Username] = p
+	}
+	p.conns++
+	p.verified = p.verified || client.verified
+	if p.leaving != nil {
+		p.leaving.Stop()
+		p.leaving = nil
+		return
+	}
+	if p.conns == 1 {
+		h.memberChanged("join", client.Room, client.Username, p.verified)
+	}
+}
+
+// memberLeft counts a closed connection of client's; once the user has
+// none left for leaveGrace, they are announced as gone.
+func (h *Hub) memberLeft(client *Client) {
+	l := &h.members
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	p := l.present[client.Room][client.Username]
+	if p == nil {
+		return
+	}
+	if p.conns--; p.conns > 0 {
+		return
+	}
+	var t *time.Timer
+	t = time.AfterFunc(leaveGrace, func() {
+		l.mu.Lock()
+		defer l.mu.Unlock()
+		if l.present[client.Room][client.Username] != p || p.leaving != t {
+			return // rejoined meanwhile
+		}
+		delete(l.present[client.Room], client.Username)
+		if len(l.present[client.Room]) == 0 {
+			delete(l.present, client.Room)
+		}
+		h.memberChanged("leave", client.Room, client.Username, p.verified)
+	})
+	p.leaving = t
+}
+
+// memberChanged publishes a membership change and queues the room's hooks
+// for it. Callers hold h.members.mu.
+func (h *Hub) memberChanged(event, room, username string, verified bool) {
+	e := memberEvent{Event: event, Tenant: h.tenant, Room: room, Username: username, Verified: verified, Time: h.now().UTC()}
+	detail := ""
+	if verified {
+		detail = "verified"
+	}
+	kind := EventMemberJoin
+	if event == "leave" {
+		kind = EventMemberLeave
+	}
+	publishEvent(AdminEvent{Time: e.Time, Kind: kind, Tenant: h.tenant, Room: room, Username: username, Detail: detail})
+	for _, hook := range h.members.hooks[room] {
+		if !slices.Contains(hook.Events, event) {
+			continue
+		}
+		select {
+		case memberHookQueue <- memberCall{hook, e}:
+		default:
+			log.Printf("Member hook backlog full, dropped %s of %s in %s", event, username, room)
+		}
+	}
+}
+
+type memberCall struct {
+	hook  MemberHook
+	event memberEvent
+}
+
+// memberHookQueue feeds the hook caller; calls are dropped rather than
+// blocking joins when the hooks fall behind.
+var memberHookQueue = make(chan memberCall, 256)
+
+// startMemberHooks starts calling room membership hooks.
+func startMemberHooks() {
+	go func() {
+		client := &http.Client{Timeout: 10 * time.Second}
+		for call := range memberHookQueue {
+			body, _ := json.Marshal(call.event)
+			var err error
+			for attempt := 1; attempt <= memberHookAttempts; attempt++ {
+				if err = callMemberHook(client, call.hook, call.event.Event, body); err == nil {
+					break
+				}
+				if attempt < memberHookAttempts {
+					time.Sleep(time.Duration(attempt) * time.Second)
+				}
+			}
+			if err != nil {
+				log.Printf("Member hook %s for %s of %s in %s: %v", call.hook.URL, call.event.Event, call.event.Username, call.event.Room, err)
+			}
+		}
+	}()
+}
+
+func callMemberHook(client *http.Client, hook MemberHook, event string, body []byte) error {
+	req, err := http.NewRequest("POST", hook.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Chat-Event", event)
+	if hook.Secret != "" {
+		mac := hmac.New(sha256.New, []byte(hook.Secret))
+		mac.Write(body)
+		req.Header.Set("X-Chat-Signature-256", "sha256="+hex.EncodeToString(mac.Sum(nil)))
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("returned %s", resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"database/sql"
+	"embed"
+	"flag"
+	"fmt"
+	"io/fs"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Schema changes ship as numbered SQL files under migrations/<dialect>/,
+// named NNNN_description.sql and embedded in the binary. Each runs once, in
+// its own transaction, and is recorded in schema_migrations. Never edit a
+// released migration; add a new one.
+
+//go:embed migrations
+var migrationFiles embed.FS
+
+type migration struct {
+	version int
+	name    string
+	sql     string
+}
+
+func migrations(dialect string) ([]migration, error) {
+	dir := "migrations/" + dialect
+	entries, err := fs.ReadDir(migrationFiles, dir)
+	if err != nil {
+		return nil, err
+	}
+	var out []migration
+	for _, e := range entries {
+		num, _, ok := strings.Cut(e.Name(), "_")
+		version, err := strconv.Atoi(num)
+		if !ok || err != nil || !strings.HasSuffix(e.Name(), ".sql") {
+			return nil, fmt.Errorf("bad migration file name %s", e.Name())
+		}
+		data, err := fs.ReadFile(migrationFiles, dir+"/"+e.Name())
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, migration{version: version, name: e.Name(), sql: string(data)})
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].version < out[j].version })
+	return out, nil
+}
+
+const migrationsTable = `CREATE TABLE IF NOT EXISTS schema_migrations (
+	version    INTEGER PRIMARY KEY,
+	applied_at TEXT NOT NULL
+)`
+
+func appliedMigrations(db *sql.DB) (map[int]bool, error) {
+	if _, err := db.Exec(migrationsTable); err != nil {
+		return nil, err
+	}
+	rows, err := db.Query("SELECT version FROM schema_migrations")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	applied := make(map[int]bool)
+	for rows.Next() {
+		var v int
+		if err := rows.Scan(&v); err != nil {
+			return nil, err
+		}
+		applied[v] = true
+	}
+	return applied, rows.Err()
+}
+
+func pendingMigrations(db *sql.DB, dialect string) ([]migration, error) {
+	all, err := migrations(dialect)
+	if err != nil {
+		return nil, err
+	}
+	applied, err := appliedMigrations(db)
+	if err != nil {
+		return nil, err
+	}
+	var pending []migration
+	for _, m := range all {
+		if !applied[m.version] {
+			pending = append(pending, m)
+		}
+	}
+	return pending, nil
+}
+
+// migrate applies every pending migration and returns the first failure.
+func migrate(db *sql.DB, dialect string) error {
+	pending, err := pendingMigrations(db, dialect)
+	if err != nil {
+		return err
+	}
+	for _, m := range pending {
+		tx, err := db.Begin()
+		if err != nil {
+			return err
+		}
+		if _, err := tx.Exec(m.sql); err != nil {
+			tx.Rollback()
+			return fmt.Errorf("migration %s: %w", m.name, err)
+		}
+		record := "INSERT INTO schema_migrations (version, applied_at) VALUES (?, ?)"
+		if dialect == "postgres" {
+			record = "INSERT INTO schema_migrations (version, applied_at) VALUES ($1, $2)"
+		}
+		if _, err := tx.Exec(record, m.version, time.Now().UTC().Format(time.RFC3339)); err != nil {
+			tx.Rollback()
+			return err
+		}
+		if err := tx.Commit(); err != nil {
+			return fmt.Errorf("migration %s: %w", m.name, err)
+		}
+	}
+	return nil
+}
+
+// runMigrate implements `server migrate`: apply pending migrations, or list
+// them with -status, and exit.
+func runMigrate(args []string) int {
+	fs := flag.NewFlagSet("migrate", flag.ContinueOnError)
+	spec := fs.String("store", "", "database to migrate: sqlite:<path> or postgres:<dsn>")
+	status := fs.Bool("status", false, "list pending migrations without applying them")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	dialect, dsn, _ := strings.Cut(*spec, ":")
+	if dsn == "" || (dialect != "sqlite" && dialect != "postgres") {
+		fmt.Fprintln(os.Stderr, "migrate: -store sqlite:<path> or postgres:<dsn> is required")
+		return 2
+	}
+
+	db, err := openDB(dialect, dsn)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "migrate:", err)
+		return 1
+	}
+	defer db.Close()
+
+	pending, err := pendingMigrations(db, dialect)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "migrate:", err)
+		return 1
+	}
+	if len(pending) == 0 {
+		fmt.Println("Schema is up to date")
+		return 0
+	}
+	for _, m := range pending {
+		fmt.Println("Pending:", m.name)
+	}
+	if *status {
+		return 0
+	}
+	if err := migrate(db, dialect); err != nil {
+		fmt.Fprintln(os.Stderr, "migrate:", err)
+		return 1
+	}
+	fmt.Printf("Applied %d migrations\n", len(pending))
+	return 0
+}
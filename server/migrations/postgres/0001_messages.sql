@@ -0,0 +1,12 @@
+-- Chat history.
+CREATE TABLE IF NOT EXISTS messages (
+	id       TEXT PRIMARY KEY,
+	room     TEXT NOT NULL,
+	seq      BIGINT NOT NULL,
+	username TEXT NOT NULL,
+	text     TEXT NOT NULL,
+	time     TEXT NOT NULL,
+	redacted BOOLEAN NOT NULL DEFAULT FALSE
+);
+CREATE INDEX IF NOT EXISTS messages_room_seq ON messages (room, seq);
+CREATE INDEX IF NOT EXISTS messages_username ON messages (username);
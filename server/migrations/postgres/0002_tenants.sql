@@ -0,0 +1,6 @@
+-- Scope history to tenants; existing rows belong to the default tenant.
+ALTER TABLE messages ADD COLUMN tenant TEXT NOT NULL DEFAULT '';
+DROP INDEX IF EXISTS messages_room_seq;
+DROP INDEX IF EXISTS messages_username;
+CREATE INDEX messages_tenant_room_seq ON messages (tenant, room, seq);
+CREATE INDEX messages_tenant_username ON messages (tenant, username);
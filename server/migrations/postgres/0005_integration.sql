@@ -0,0 +1,2 @@
+-- Whether the message was posted by an integration through a room webhook.
+ALTER TABLE messages ADD COLUMN integration BOOLEAN NOT NULL DEFAULT FALSE;
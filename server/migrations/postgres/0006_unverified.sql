@@ -0,0 +1,2 @@
+-- Whether the message was sent under a username that was not registered.
+ALTER TABLE messages ADD COLUMN unverified BOOLEAN NOT NULL DEFAULT FALSE;
@@ -0,0 +1,12 @@
+-- Chat history. IF NOT EXISTS adopts databases created before migrations.
+CREATE TABLE IF NOT EXISTS messages (
+	id       TEXT PRIMARY KEY,
+	room     TEXT NOT NULL,
+	seq      INTEGER NOT NULL,
+	username TEXT NOT NULL,
+	text     TEXT NOT NULL,
+	time     TEXT NOT NULL,
+	redacted INTEGER NOT NULL DEFAULT 0
+);
+CREATE INDEX IF NOT EXISTS messages_room_seq ON messages (room, seq);
+CREATE INDEX IF NOT EXISTS messages_username ON messages (username);
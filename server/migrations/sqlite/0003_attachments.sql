@@ -0,0 +1,2 @@
+-- Files posted with messages, such as voice clips, as JSON; '' for none.
+ALTER TABLE messages ADD COLUMN attachment TEXT NOT NULL DEFAULT '';
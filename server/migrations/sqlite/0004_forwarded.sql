@@ -0,0 +1,3 @@
+-- Where forwarded messages came from, as JSON; '' for messages that were
+-- not forwarded.
+ALTER TABLE messages ADD COLUMN forwarded TEXT NOT NULL DEFAULT '';
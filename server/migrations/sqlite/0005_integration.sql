@@ -0,0 +1,2 @@
+-- 1 for messages posted by an integration through a room webhook.
+ALTER TABLE messages ADD COLUMN integration INTEGER NOT NULL DEFAULT 0;
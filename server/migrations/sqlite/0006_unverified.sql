@@ -0,0 +1,2 @@
+-- 1 for messages sent under a username that was not registered.
+ALTER TABLE messages ADD COLUMN unverified INTEGER NOT NULL DEFAULT 0;
@@ -0,0 +1,3 @@
+-- Bots' annotations of messages, as a JSON array; '' for messages with
+-- none.
+ALTER TABLE messages ADD COLUMN annotations TEXT NOT NULL DEFAULT '';
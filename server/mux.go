@@ -0,0 +1,388 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gorilla/websocket"
+)
+
+// /ws/mux carries many room sessions over one WebSocket, for bots in
+// hundreds of rooms that would otherwise hold a socket for each. It takes
+// the same username, tenant, auth and proof of work parameters as /ws, but
+// no room. Every frame is an envelope naming a channel, chosen by the
+// client, that stands for one session:
+//
+//	{"ch": "1", "op": "join", "room": "ops", "resume": "...", "since_seq": 41}
+//	{"ch": "2", "op": "join", "room": "support", "mode": "observer"}
+//	{"ch": "1", "data": {"text": "deploy done", "ref": "a1"}}
+//	{"ch": "1", "op": "leave"}
+//
+// and the server answers with the session's messages, one per frame,
+// exactly as /ws sends them, or with why it could not join or that it
+// ended:
+//
+//	{"ch": "1", "data": {"type": "welcome", ...}}
+//	{"ch": "1", "op": "refused", "status": 403, "error": "banned"}
+//	{"ch": "1", "op": "closed"}
+//
+// Each session is the same to the hub as one over /ws: it is admitted,
+// rate-limited, kicked and resumed alike, and counts towards connection
+// quotas. The connection is pinged as /ws connections are; when it drops,
+// all its sessions end.
+
+const (
+	muxJoin    = "join"
+	muxLeave   = "leave"
+	muxRefused = "refused"
+	muxClosed  = "closed"
+	muxError   = "error" // a frame the server could not read; see badjson.go
+
+	// maxMuxChannels bounds the sessions one connection may hold.
+	maxMuxChannels = 1000
+)
+
+type muxFrame struct {
+	Ch       string          `json:"ch"`
+	Op       string          `json:"op,omitempty"`
+	Room     string          `json:"room,omitempty"`
+	Resume   string          `json:"resume,omitempty"`
+	SinceSeq int64           `json:"since_seq,omitempty"`
+	Mode     string          `json:"mode,omitempty"` // in a join, observer to watch the room; see observers.go
+	Status   int             `json:"status,omitempty"`
+	Error    string          `json:"error,omitempty"`
+	Data     json.RawMessage `json:"data,omitempty"`
+}
+
+// muxConn is one /ws/mux connection and the sessions on it.
+type muxConn struct {
+	conn     *websocket.Conn
+	tenant   *Tenant
+	username string
+	verified bool
+	origin   string
+	protocol string
+
+	wmu   sync.Mutex // serializes frames
+	mu    sync.Mutex
+	chans map[string]*Client
+	wake  chan struct{} // a session has something to send
+	done  chan struct{} // closed when the connection is read no more
+
+	bad int64 // frames that were not valid mux frames
+}
+
+func handleMux(c *gin.Context) {
+	username := c.Query("username")
+	if username == "" {
+		c.JSON(400, gin.H{"error": "username required"})
+		return
+	}
+	tenant, ok := lookupTenant(c.Query("tenant"))
+	if !ok {
+		c.JSON(404, gin.H{"error": "unknown tenant"})
+		return
+	}
+	if reason := readiness(); reason != "" {
+		c.Header("Retry-After", "5")
+		c.JSON(503, gin.H{"error": "server " + reason + ", try again later"})
+		return
+	}
+	verified, err := identify(tenant.Name, username, c.Query("auth"), false, time.Now())
+	if err != nil {
+		c.JSON(401, gin.H{"error": err.Error()})
+		return
+	}
+	if !paidPow(c) {
+		return
+	}
+	conn, err := upgrader.Upgrade(c.Writer, c.Request, nil)
+	if err != nil {
+		log.Printf("Upgrade failed: %v", err)
+		return
+	}
+	m := &muxConn{
+		conn:     conn,
+		tenant:   tenant,
+		username: username,
+		verified: verified,
+		origin:   requestOrigin(c.Request),
+		protocol: conn.Subprotocol(),
+		chans:    make(map[string]*Client),
+		wake:     make(chan struct{}, 1),
+		done:     make(chan struct{}),
+	}
+	log.Printf("Multiplexed connection for %s", tenantQualified(tenant.Name, username))
+	go m.writeLoop()
+	m.readLoop(c.ClientIP())
+}
+
+// readLoop handles the client's frames until the connection fails, then
+// ends every session on it.
+func (m *muxConn) readLoop(ip string) {
+	defer func() {
+		close(m.done)
+		m.conn.Close()
+		m.mu.Lock()
+		chans := m.chans
+		m.chans = map[string]*Client{}
+		m.mu.Unlock()
+		for _, client := range chans {
+			client.closeSend()
+			client.hub.unregisterClient(client)
+		}
+	}()
+
+	m.conn.SetReadDeadline(time.Now().Add(60 * time.Second))
+	m.conn.SetPongHandler(func(string) error {
+		m.conn.SetReadDeadline(time.Now().Add(60 * time.Second))
+		return nil
+	})
+	for {
+		_, data, err := m.conn.ReadMessage()
+		if err != nil {
+			return
+		}
+		var f muxFrame
+		if err := json.Unmarshal(data, &f); err != nil {
+			if m.badFrame(err) {
+				return
+			}
+			continue
+		}
+		if f.Ch == "" {
+			continue
+		}
+		switch f.Op {
+		case muxJoin:
+			m.join(f, ip)
+		case muxLeave:
+			if client := m.channel(f.Ch); client != nil {
+				client.closeSend()
+			}
+		case "":
+			if client := m.channel(f.Ch); client != nil {
+				client.stats.read()
+				client.handleMessage(client.hub, f.Data)
+			}
+		}
+	}
+}
+
+// badFrame applies the -bad-json policy to a frame that did not parse for
+// err and reports whether the connection is to be closed for it.
+func (m *muxConn) badFrame(err error) bool {
+	m.bad++
+	closing := badFrame(m.bad)
+	if cfg.BadJSON != badJSONIgnore {
+		m.send(muxFrame{Op: muxError, Status: 400, Error: badJSONText(err, closing)})
+	}
+	if closing {
+		log.Printf("Closing multiplexed connection for %s: %d frames that were not valid JSON", tenantQualified(m.tenant.Name, m.username), m.bad)
+		m.conn.WriteControl(websocket.CloseMessage,
+			websocket.FormatCloseMessage(websocket.ClosePolicyViolation, "too many invalid frames"),
+			time.Now().Add(time.Second))
+	}
+	return closing
+}
+
+func (m *muxConn) channel(ch string) *Client {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.chans[ch]
+}
+
+// join starts a session in f.Room on channel f.Ch, as /ws would.
+func (m *muxConn) join(f muxFrame, ip string) {
+	refuse := func(status int, reason string) {
+		m.send(muxFrame{Ch: f.Ch, Op: muxRefused, Status: status, Error: reason})
+	}
+	room := strings.TrimSpace(f.Room)
+	if room == "" {
+		refuse(400, "room required")
+		return
+	}
+	observer, err := parseMode(f.Mode)
+	if err != nil {
+		refuse(400, err.Error())
+		return
+	}
+	now := time.Now()
+	if status, reason := m.tenant.refuseJoin(m.username, room, observer, now); reason != "" {
+		refuse(status, reason)
+		return
+	}
+	resumed := false
+	if f.Resume != "" {
+		if err := verifyResumeToken(f.Resume, m.tenant.Name, m.username, room, now); err != nil {
+			log.Printf("Resume rejected for %s in %s: %v", m.username, room, err)
+		} else {
+			resumed = true
+		}
+	}
+	joinAlerts.hit(ip, now)
+
+	client := &Client{
+		ID:        newConnID(m.username),
+		Username:  m.username,
+		Room:      room,
+		Send:      make(chan []byte, cfg.SendQueue),
+		Control:   make(chan []byte, cfg.ControlQueue),
+		hub:       m.tenant.hub,
+		origin:    m.origin,
+		connected: now,
+		protocol:  m.protocol,
+		Resumed:   resumed,
+		verified:  m.verified,
+		observer:  observer,
+		wake:      m.signal,
+	}
+	if resumed {
+		client.SinceSeq = f.SinceSeq
+	}
+	m.mu.Lock()
+	_, taken := m.chans[f.Ch]
+	full := len(m.chans) >= maxMuxChannels
+	if !taken && !full {
+		m.chans[f.Ch] = client
+	}
+	m.mu.Unlock()
+	switch {
+	case taken:
+		refuse(409, "channel "+f.Ch+" is in use")
+		return
+	case full:
+		refuse(429, "at most "+strconv.Itoa(maxMuxChannels)+" sessions per connection")
+		return
+	}
+	client.hub.registerClient(client)
+}
+
+// signal wakes the writer.
+func (m *muxConn) signal() {
+	select {
+	case m.wake <- struct{}{}:
+	default:
+	}
+}
+
+// writeLoop sends the sessions' queued messages, control lanes first, and
+// pings the connection.
+func (m *muxConn) writeLoop() {
+	ticker := time.NewTicker(54 * time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-m.done:
+			return
+		case <-ticker.C:
+			m.wmu.Lock()
+			m.conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
+			err := m.conn.WriteMessage(websocket.PingMessage, nil)
+			m.wmu.Unlock()
+			if err != nil {
+				m.conn.Close()
+				return
+			}
+		case <-m.wake:
+			if !m.flush() {
+				m.conn.Close()
+				return
+			}
+		}
+	}
+}
+
+// flush writes everything the sessions have queued, and ends those whose
+// queue the hub closed. It reports whether the writes went out.
+func (m *muxConn) flush() bool {
+	m.mu.Lock()
+	chans := make(map[string]*Client, len(m.chans))
+	for ch, client := range m.chans {
+		chans[ch] = client
+	}
+	m.mu.Unlock()
+
+	for ch, client := range chans {
+		if !m.drain(ch, client) {
+			return false
+		}
+	}
+	return true
+}
+
+// drain writes what client has queued on channel ch, control lane first.
+func (m *muxConn) drain(ch string, client *Client) bool {
+	for {
+		if data, ok := client.nextControl(); ok {
+			if !m.deliver(ch, client, data) {
+				return false
+			}
+			continue
+		}
+		select {
+		case data, ok := <-client.Send:
+			if !ok {
+				for {
+					data, ok := client.nextControl()
+					if !ok {
+						break
+					}
+					if !m.deliver(ch, client, data) {
+						return false
+					}
+				}
+				m.end(ch, client)
+				return true
+			}
+			if !m.deliver(ch, client, data) {
+				return false
+			}
+		default:
+			return true
+		}
+	}
+}
+
+// deliver writes one of client's messages on channel ch.
+func (m *muxConn) deliver(ch string, client *Client, data []byte) bool {
+	began := time.Now()
+	if !m.send(muxFrame{Ch: ch, Data: data}) {
+		return false
+	}
+	client.stats.wroteIn(time.Since(began))
+	client.stats.wrote(len(data))
+	return true
+}
+
+// end removes the session on ch, which the hub or the client closed, and
+// unregisters it.
+func (m *muxConn) end(ch string, client *Client) {
+	m.mu.Lock()
+	mine := m.chans[ch] == client
+	if mine {
+		delete(m.chans, ch)
+	}
+	m.mu.Unlock()
+	if mine {
+		m.send(muxFrame{Ch: ch, Op: muxClosed})
+		client.hub.unregisterClient(client)
+	}
+}
+
+func (m *muxConn) send(f muxFrame) bool {
+	data, _ := json.Marshal(f)
+	m.wmu.Lock()
+	defer m.wmu.Unlock()
+	m.conn.SetWriteDeadline(time.Now().Add(30 * time.Second))
+	if err := m.conn.WriteMessage(websocket.TextMessage, data); err != nil {
+		log.Println("Write error:", err)
+		return false
+	}
+	return true
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+)
+
+// Dashboards and moderation tools can watch a room without taking part in
+// it by joining with ?mode=observer (or "mode": "observer" in a /ws/mux
+// join). An observer is sent the room's traffic, history replays included,
+// as a member is, but:
+//
+//   - whatever it sends, chat, commands and receipts alike, is refused with
+//     an "error" message with code read_only;
+//   - it is left out of /users, member counts, the room directory and
+//     membership hooks, its comings and goings are not announced, it is not
+//     greeted by bots, and it never becomes a room's owner;
+//   - it counts towards -max-observers per room rather than the tenant's
+//     connection quota. With -max-observers 0 observers are refused.
+//
+// The admin API lists observers among a room's connections, flagged.
+
+const (
+	modeObserver = "observer"
+	errReadOnly  = "read_only"
+)
+
+// parseMode reads a join's mode: empty for a member, or observer.
+func parseMode(mode string) (observer bool, err error) {
+	switch mode {
+	case "":
+		return false, nil
+	case modeObserver:
+		return true, nil
+	}
+	return false, fmt.Errorf("unknown mode %q (want observer, or none)", mode)
+}
+
+// members counts the room's connections that are not observers. It must
+// be called with r.mu held.
+func (r *Room) members() int {
+	n := 0
+	for c := range r.Clients {
+		if !c.observer {
+			n++
+		}
+	}
+	return n
+}
+
+// observers counts the observers watching room.
+func (h *Hub) observers(room string) int {
+	h.mu.RLock()
+	r, ok := h.rooms[room]
+	h.mu.RUnlock()
+	if !ok {
+		return 0
+	}
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return len(r.Clients) - r.members()
+}
+
+// admitObserver checks -max-observers for a new observer of room and
+// returns the status and reason to refuse it with, or "".
+func (h *Hub) admitObserver(room string) (int, string) {
+	if cfg.MaxObservers <= 0 {
+		return http.StatusForbidden, "observers are not allowed"
+	}
+	if h.observers(room) >= cfg.MaxObservers {
+		return http.StatusTooManyRequests, fmt.Sprintf("room %s already has the most observers allowed (%d)", room, cfg.MaxObservers)
+	}
+	return 0, ""
+}
+
+// refuseObserver tells an observer it cannot send what it sent, with ref.
+func (h *Hub) refuseObserver(client *Client, ref string) {
+	h.sendToClient(client, Message{
+		Type:  MsgError,
+		Room:  client.Room,
+		Text:  "You are observing this room and cannot send to it.",
+		Time:  h.clockTime(),
+		Ref:   ref,
+		Error: &ErrorInfo{Code: errReadOnly},
+	})
+}
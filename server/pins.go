@@ -0,0 +1,196 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Members pin chat messages to keep them in view: /pin <id> [duration]
+// pins one, for the duration if given or else the room's pin_ttl, and
+// /unpin <id> takes it down again, which the pinner and the room's owner and
+// moderators may do. Everyone in the room is sent a pinned or unpinned
+// message, unpinned also when a pin expires. A room holds at most its
+// max_pins pins, -max-pins unless its settings say otherwise. /pins lists
+// them. Like room settings, pins are kept in memory.
+
+type Pin struct {
+	ID       string     `json:"id"` // the pinned message
+	Seq      int64      `json:"seq"`
+	Author   string     `json:"author"`
+	Text     string     `json:"text"`
+	PinnedBy string     `json:"pinned_by"`
+	PinnedAt time.Time  `json:"pinned_at"`
+	Expires  *time.Time `json:"expires,omitempty"`
+}
+
+var (
+	errAlreadyPinned = errors.New("already pinned")
+	errPinLimit      = errors.New("pin limit reached")
+)
+
+type pinBoard struct {
+	mu     sync.Mutex
+	rooms  map[string][]Pin
+	timers map[string]*time.Timer // expiry of pins by message ID
+}
+
+// list returns room's pins, oldest first.
+func (b *pinBoard) list(room string) []Pin {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return append([]Pin{}, b.rooms[room]...)
+}
+
+// add pins p in room unless it is pinned already or the room has limit
+// pins, and starts its expiry timer with expire.
+func (b *pinBoard) add(room string, p Pin, limit int, expire func()) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for _, q := range b.rooms[room] {
+		if q.ID == p.ID {
+			return errAlreadyPinned
+		}
+	}
+	if len(b.rooms[room]) >= limit {
+		return errPinLimit
+	}
+	if b.rooms == nil {
+		b.rooms = make(map[string][]Pin)
+		b.timers = make(map[string]*time.Timer)
+	}
+	b.rooms[room] = append(b.rooms[room], p)
+	if p.Expires != nil {
+		b.timers[p.ID] = time.AfterFunc(time.Until(*p.Expires), expire)
+	}
+	return nil
+}
+
+// remove unpins message id in room and returns its pin, if it was pinned.
+func (b *pinBoard) remove(room, id string) (Pin, bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for i, p := range b.rooms[room] {
+		if p.ID != id {
+			continue
+		}
+		b.rooms[room] = append(b.rooms[room][:i:i], b.rooms[room][i+1:]...)
+		if len(b.rooms[room]) == 0 {
+			delete(b.rooms, room)
+		}
+		if t, ok := b.timers[id]; ok {
+			t.Stop()
+			delete(b.timers, id)
+		}
+		return p, true
+	}
+	return Pin{}, false
+}
+
+// pinLimits returns the most pins room may hold and how long they last when
+// no duration is given, 0 for ever.
+func (h *Hub) pinLimits(room string) (int, time.Duration) {
+	s := h.roomSettings(room)
+	limit := cfg.MaxPins
+	if s.MaxPins > 0 {
+		limit = s.MaxPins
+	}
+	ttl, _ := time.ParseDuration(s.PinTTL)
+	return limit, ttl
+}
+
+// pinCommand handles /pin <id> [duration] from client.
+func (h *Hub) pinCommand(client *Client, args []string) {
+	reply := func(text string) {
+		h.sendToClient(client, Message{Type: MsgSystem, Room: client.Room, Text: text, Time: h.clockTime()})
+	}
+	if len(args) == 0 || len(args) > 2 {
+		reply("Usage: /pin <message id> [duration, e.g. 24h]")
+		return
+	}
+	limit, ttl := h.pinLimits(client.Room)
+	if len(args) == 2 {
+		d, err := time.ParseDuration(args[1])
+		if err != nil || d <= 0 {
+			reply("Usage: /pin <message id> [duration, e.g. 24h]")
+			return
+		}
+		ttl = d
+	}
+	msg, err := h.store.Get(args[0])
+	if errors.Is(err, errNotFound) || (err == nil && msg.Room != client.Room) {
+		reply("There is no message " + args[0] + " in this room.")
+		return
+	}
+	if err != nil {
+		log.Printf("Loading message %s: %v", args[0], err)
+		reply("Pinning is not available right now.")
+		return
+	}
+	if msg.Redacted {
+		reply("Redacted messages cannot be pinned.")
+		return
+	}
+	now := h.now()
+	p := Pin{ID: msg.ID, Seq: msg.Seq, Author: msg.Username, Text: msg.Text, PinnedBy: client.Username, PinnedAt: now}
+	if ttl > 0 {
+		expires := now.Add(ttl)
+		p.Expires = &expires
+	}
+	room := client.Room
+	err = h.pins.add(room, p, limit, func() { h.unpin(room, p.ID, "", "expired") })
+	switch {
+	case errors.Is(err, errAlreadyPinned):
+		reply("That message is already pinned.")
+		return
+	case errors.Is(err, errPinLimit):
+		reply("This room already has " + strconv.Itoa(limit) + " pins, its limit; unpin one first.")
+		return
+	}
+	data, _ := json.Marshal(p)
+	h.broadcastToRoom(room, Message{Type: MsgPinned, Room: room, Username: client.Username, ID: p.ID, Seq: p.Seq, Text: string(data), Time: h.clockTime()})
+}
+
+// unpinCommand handles /unpin <id> from client, who must have pinned the
+// message or own or moderate the room.
+func (h *Hub) unpinCommand(client *Client, args []string) {
+	reply := func(text string) {
+		h.sendToClient(client, Message{Type: MsgSystem, Room: client.Room, Text: text, Time: h.clockTime()})
+	}
+	if len(args) != 1 {
+		reply("Usage: /unpin <message id>")
+		return
+	}
+	var pinner string
+	for _, p := range h.pins.list(client.Room) {
+		if p.ID == args[0] {
+			pinner = p.PinnedBy
+		}
+	}
+	switch {
+	case pinner == "":
+		reply("That message is not pinned.")
+	case pinner != client.Username && !h.roomSettings(client.Room).manages(client.Username):
+		reply("Only " + pinner + ", who pinned it, or the room's owner and moderators can unpin that message.")
+	default:
+		h.unpin(client.Room, args[0], client.Username, "unpinned")
+	}
+}
+
+// unpin takes down the pin of message id in room and tells the room why.
+func (h *Hub) unpin(room, id, by, reason string) {
+	p, ok := h.pins.remove(room, id)
+	if !ok {
+		return
+	}
+	h.broadcastToRoom(room, Message{Type: MsgUnpinned, Room: room, Username: by, ID: p.ID, Seq: p.Seq, Text: reason, Time: h.clockTime()})
+}
+
+// pinsCommand handles /pins, replying with the room's pins as JSON.
+func (h *Hub) pinsCommand(client *Client) {
+	data, _ := json.Marshal(h.pins.list(client.Room))
+	h.sendToClient(client, Message{Type: MsgPins, Room: client.Room, Username: client.Username, Text: string(data), Time: h.clockTime()})
+}
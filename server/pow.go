@@ -0,0 +1,99 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"math/bits"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// With -pow-difficulty set, a join without a resume token must carry a
+// solved proof-of-work challenge: ?pow=<challenge>&pow_solution=<s> where
+// SHA-256("<challenge>:<s>") starts with that many zero bits. A join without
+// one is answered 428 with a fresh challenge in the body, which is how the
+// Go client discovers it; browsers fetch one from /api/challenge first.
+//
+// Challenges are "<nonce>.<issued-unix>.<signature>", signed with the resume
+// secret under a "pow:" prefix so they can never pass as resume tokens. Each
+// is accepted once.
+
+const powTTL = 2 * time.Minute
+
+var errPowRequired = errors.New("proof of work required")
+
+func issueChallenge(now time.Time) string {
+	nonce := make([]byte, 12)
+	rand.Read(nonce)
+	payload := hex.EncodeToString(nonce) + "." + strconv.FormatInt(now.Unix(), 10)
+	return payload + "." + signResume("pow:"+payload)
+}
+
+// spentChallenges remembers accepted challenges until they expire.
+var spentChallenges = struct {
+	sync.Mutex
+	m map[string]time.Time
+}{m: make(map[string]time.Time)}
+
+func verifyPow(challenge, solution string, now time.Time) error {
+	if challenge == "" {
+		return errPowRequired
+	}
+	i := strings.LastIndexByte(challenge, '.')
+	if i < 0 {
+		return errPowRequired
+	}
+	payload, sig := challenge[:i], challenge[i+1:]
+	if !hmac.Equal([]byte(sig), []byte(signResume("pow:"+payload))) {
+		return errors.New("invalid challenge")
+	}
+	_, ts, _ := strings.Cut(payload, ".")
+	issued, err := strconv.ParseInt(ts, 10, 64)
+	if err != nil || now.Sub(time.Unix(issued, 0)) > powTTL {
+		return errors.New("challenge expired")
+	}
+	sum := sha256.Sum256([]byte(challenge + ":" + solution))
+	if leadingZeroBits(sum[:]) < cfg.PowDifficulty {
+		return errors.New("wrong proof of work")
+	}
+
+	spentChallenges.Lock()
+	defer spentChallenges.Unlock()
+	if _, ok := spentChallenges.m[challenge]; ok {
+		return errors.New("challenge already used")
+	}
+	for ch, at := range spentChallenges.m {
+		if now.Sub(at) > powTTL {
+			delete(spentChallenges.m, ch)
+		}
+	}
+	spentChallenges.m[challenge] = now
+	return nil
+}
+
+func leadingZeroBits(b []byte) int {
+	n := 0
+	for _, x := range b {
+		if x != 0 {
+			return n + bits.LeadingZeros8(x)
+		}
+		n += 8
+	}
+	return n
+}
+
+// handleChallenge hands out a challenge, or difficulty 0 when none is needed.
+func handleChallenge(c *gin.Context) {
+	if cfg.PowDifficulty <= 0 {
+		c.JSON(200, gin.H{"difficulty": 0})
+		return
+	}
+	c.JSON(200, gin.H{"challenge": issueChallenge(time.Now()), "difficulty": cfg.PowDifficulty})
+}
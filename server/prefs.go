@@ -0,0 +1,233 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Users keep notification preferences, which every notification subsystem
+// checks before sending: mentions in muted rooms are not notified, and with
+// mentions_only neither are @group mentions, only mentions by name.
+//
+// Users edit their own preferences with /prefs or through
+//
+//	GET|PUT /api/users/:username/prefs?tenant=&room=
+//	Authorization: Bearer <resume token for room>
+//
+// and moderators through /api/admin/users/:username/prefs. Preferences are
+// saved to -prefs-file, or kept in memory without it. They are part of a
+// user's export and go when the user is erased.
+//
+// Earlier versions also kept an email address and an email_digests switch
+// that nothing used; loading -prefs-file drops them from it.
+
+type Prefs struct {
+	MentionsOnly bool     `json:"mentions_only"` // notify only on mentions by name, not through @groups
+	MutedRooms   []string `json:"muted_rooms"`   // rooms that send no notifications
+}
+
+// mutes reports whether room's notifications are muted.
+func (p Prefs) mutes(room string) bool {
+	return slices.Contains(p.MutedRooms, room)
+}
+
+// prefsUpdate changes the preferences it sets and leaves the rest alone.
+type prefsUpdate struct {
+	MentionsOnly *bool  `json:"mentions_only"`
+	Mute         string `json:"mute"`   // room to add to muted_rooms
+	Unmute       string `json:"unmute"` // room to remove from muted_rooms
+}
+
+func (u prefsUpdate) apply(p *Prefs) {
+	if u.MentionsOnly != nil {
+		p.MentionsOnly = *u.MentionsOnly
+	}
+	if u.Mute != "" && !p.mutes(u.Mute) {
+		p.MutedRooms = append(p.MutedRooms, u.Mute)
+		slices.Sort(p.MutedRooms)
+	}
+	if u.Unmute != "" {
+		p.MutedRooms = slices.DeleteFunc(p.MutedRooms, func(r string) bool { return r == u.Unmute })
+	}
+}
+
+// prefs maps tenant and username to preferences.
+var prefs = struct {
+	mu    sync.RWMutex
+	table map[string]map[string]Prefs
+}{table: map[string]map[string]Prefs{}}
+
+func setupPrefs() error {
+	if cfg.PrefsFile == "" {
+		return nil
+	}
+	data, err := os.ReadFile(cfg.PrefsFile)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	prefs.mu.Lock()
+	defer prefs.mu.Unlock()
+	if err := json.Unmarshal(data, &prefs.table); err != nil {
+		return err
+	}
+	savePrefs()
+	return nil
+}
+
+// savePrefs writes the preferences to -prefs-file, if there is one. The
+// caller holds prefs.mu.
+func savePrefs() {
+	if cfg.PrefsFile == "" {
+		return
+	}
+	data, _ := json.MarshalIndent(prefs.table, "", "  ")
+	if err := writeFileAtomic(filepath.Dir(cfg.PrefsFile), cfg.PrefsFile, data); err != nil {
+		log.Printf("Saving %s: %v", cfg.PrefsFile, err)
+	}
+}
+
+// userPrefs returns username's preferences.
+func userPrefs(tenant, username string) Prefs {
+	prefs.mu.RLock()
+	defer prefs.mu.RUnlock()
+	p := prefs.table[tenant][username]
+	if p.MutedRooms == nil {
+		p.MutedRooms = []string{}
+	}
+	return p
+}
+
+// updatePrefs applies u to username's preferences and returns the result.
+func updatePrefs(tenant, username string, u prefsUpdate) Prefs {
+	prefs.mu.Lock()
+	defer prefs.mu.Unlock()
+	p := prefs.table[tenant][username]
+	p.MutedRooms = slices.Clone(p.MutedRooms)
+	u.apply(&p)
+	if prefs.table[tenant] == nil {
+		prefs.table[tenant] = map[string]Prefs{}
+	}
+	prefs.table[tenant][username] = p
+	savePrefs()
+	if p.MutedRooms == nil {
+		p.MutedRooms = []string{}
+	}
+	return p
+}
+
+// deletePrefs forgets username's preferences.
+func deletePrefs(tenant, username string) {
+	prefs.mu.Lock()
+	defer prefs.mu.Unlock()
+	if _, ok := prefs.table[tenant][username]; !ok {
+		return
+	}
+	delete(prefs.table[tenant], username)
+	savePrefs()
+}
+
+// prefsCommand handles /prefs from client: alone it shows the user's
+// preferences, otherwise it changes one.
+func (h *Hub) prefsCommand(client *Client, args []string) {
+	var u prefsUpdate
+	onOff := len(args) == 2 && (args[1] == "on" || args[1] == "off")
+	on := onOff && args[1] == "on"
+	switch {
+	case len(args) == 0:
+	case onOff && args[0] == "mentions-only":
+		u.MentionsOnly = &on
+	case len(args) <= 2 && args[0] == "mute":
+		u.Mute = client.Room
+		if len(args) == 2 {
+			u.Mute = args[1]
+		}
+	case len(args) <= 2 && args[0] == "unmute":
+		u.Unmute = client.Room
+		if len(args) == 2 {
+			u.Unmute = args[1]
+		}
+	default:
+		h.sendToClient(client, Message{
+			Type: MsgSystem,
+			Room: client.Room,
+			Text: "Usage: /prefs [mentions-only on|off | mute [room] | unmute [room]]",
+			Time: h.clockTime(),
+		})
+		return
+	}
+	p := userPrefs(h.tenant, client.Username)
+	if len(args) > 0 {
+		p = updatePrefs(h.tenant, client.Username, u)
+	}
+	data, _ := json.Marshal(p)
+	h.sendToClient(client, Message{
+		Type:     MsgPrefs,
+		Room:     client.Room,
+		Text:     string(data),
+		Username: client.Username,
+		Time:     h.clockTime(),
+	})
+}
+
+// userPrefsRequest checks that a user's own prefs request carries a resume
+// token for them and returns their tenant.
+func userPrefsRequest(c *gin.Context) (string, bool) {
+	tenant := c.Query("tenant")
+	if _, ok := lookupTenant(tenant); !ok {
+		c.JSON(404, gin.H{"error": "unknown tenant"})
+		return "", false
+	}
+	token, _ := strings.CutPrefix(c.GetHeader("Authorization"), "Bearer ")
+	if err := verifyResumeToken(token, tenant, c.Param("username"), c.Query("room"), time.Now()); err != nil {
+		c.JSON(401, gin.H{"error": err.Error()})
+		return "", false
+	}
+	return tenant, true
+}
+
+func handleGetPrefs(c *gin.Context) {
+	if tenant, ok := userPrefsRequest(c); ok {
+		c.JSON(200, userPrefs(tenant, c.Param("username")))
+	}
+}
+
+func handleUpdatePrefs(c *gin.Context) {
+	tenant, ok := userPrefsRequest(c)
+	if !ok {
+		return
+	}
+	var u prefsUpdate
+	if err := c.ShouldBindJSON(&u); err != nil {
+		c.JSON(400, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(200, updatePrefs(tenant, c.Param("username"), u))
+}
+
+func handleAdminGetPrefs(c *gin.Context) {
+	c.JSON(200, userPrefs(adminTenant(c).Name, c.Param("username")))
+}
+
+func handleAdminUpdatePrefs(c *gin.Context) {
+	var u prefsUpdate
+	if err := c.ShouldBindJSON(&u); err != nil {
+		c.JSON(400, gin.H{"error": err.Error()})
+		return
+	}
+	t, username := adminTenant(c), c.Param("username")
+	p := updatePrefs(t.Name, username, u)
+	recordAudit(AuditEntry{Actor: c.ClientIP(), Tenant: t.Name, Action: "user.prefs", Subject: username})
+	c.JSON(200, p)
+}
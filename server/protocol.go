@@ -0,0 +1,77 @@
+package main
+
+import "fmt"
+
+// Clients pick a protocol version with the WebSocket subprotocol:
+//
+//	chat.v2  room events are typed messages with structured fields
+//	chat.v1  room events are system messages in free text
+//
+// A client that asks for neither, as browsers written before the versions
+// were, is served chat.v1. The two differ only in room events: a chat.v2
+// client is sent
+//
+//	{"type": "user_joined", "room": "eng", "username": "alice", ...}
+//	{"type": "user_left", "room": "eng", "username": "alice", ...}
+//	{"type": "topic_changed", "room": "eng", "topic": "Release on Friday", ...}
+//
+// and finds the current topic in its welcome, where a chat.v1 client is sent
+// "alice joined the room", "alice left the room" and "Topic: Release on
+// Friday" as system messages, as before. Likewise a chat.v2 client is told
+// of a refusal, such as a quota exceeded, with an "error" message carrying a
+// code, and a chat.v1 client with a system message giving only its text.
+
+const (
+	protoV1 = "chat.v1"
+	protoV2 = "chat.v2"
+)
+
+// subprotocols are the versions offered, preferred first.
+var subprotocols = []string{protoV2, protoV1}
+
+func knownProtocol(p string) bool {
+	return p == protoV1 || p == protoV2
+}
+
+// structured reports whether c is sent room events as typed messages.
+func (c *Client) structured() bool {
+	return c.protocol == protoV2
+}
+
+// legacyEvent returns the system message a chat.v1 client is sent instead
+// of the room event msg, and false if msg is not one.
+func legacyEvent(msg Message) (Message, bool) {
+	var text string
+	switch msg.Type {
+	case MsgError:
+		return Message{Type: MsgSystem, Room: msg.Room, Text: msg.Text, Time: msg.Time, Ref: msg.Ref}, true
+	case MsgUserJoined:
+		text = fmt.Sprintf("%s joined the room", msg.Username)
+	case MsgUserLeft:
+		text = fmt.Sprintf("%s left the room", msg.Username)
+	case MsgTopicChanged:
+		text = "Topic: " + msg.Topic
+		if msg.Topic == "" {
+			text = "The topic was cleared"
+		}
+	default:
+		return msg, false
+	}
+	return Message{Type: MsgSystem, Room: msg.Room, Text: text, Time: msg.Time}, true
+}
+
+// render returns msg as c's protocol version has it.
+func (c *Client) render(msg Message) Message {
+	if c.structured() {
+		return msg
+	}
+	legacy, _ := legacyEvent(msg)
+	return legacy
+}
+
+// topicChanged tells room its topic changed.
+func (h *Hub) topicChanged(room string, before, after RoomSettings) {
+	if before.Topic != after.Topic {
+		h.broadcastToRoom(room, Message{Type: MsgTopicChanged, Room: room, Topic: after.Topic, Time: h.clockTime()})
+	}
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"encoding/json"
+	"sort"
+	"time"
+)
+
+// Each connection's link is graded from what the server sees of it: the
+// round trip of its keepalive pings, smoothed, and how often writing to it
+// stalled, blocking for stallThreshold or more because the client was not
+// taking data off the socket. The grade is shown on the dashboard and the
+// connection introspection endpoint, and anyone can list their room's with
+// /quality, which helps with "I missed messages" reports:
+//
+//	good     round trip under fairRTT, no stalls or drops
+//	fair     a slower round trip, or the odd stall or dropped message
+//	poor     a round trip over poorRTT, an unanswered ping, or stalls on a
+//	         tenth of writes
+//	unknown  no ping answered or frame written yet
+//
+// Connections are pinged as they start, so they are graded within a round
+// trip, and then every keepalive interval.
+
+const (
+	stallThreshold = 500 * time.Millisecond
+	fairRTT        = 250 * time.Millisecond
+	poorRTT        = time.Second
+	pongOverdue    = 10 * time.Second // a ping unanswered this long makes the link poor
+)
+
+const (
+	qualityGood    = "good"
+	qualityFair    = "fair"
+	qualityPoor    = "poor"
+	qualityUnknown = "unknown"
+)
+
+// pinged records a keepalive ping sent.
+func (s *connStats) pinged() {
+	s.pingSent.CompareAndSwap(0, time.Now().UnixNano())
+}
+
+// ponged records the answer to the outstanding ping, smoothing its round
+// trip into rtt as TCP does.
+func (s *connStats) ponged() {
+	sent := s.pingSent.Swap(0)
+	if sent == 0 {
+		return
+	}
+	sample := time.Now().UnixNano() - sent
+	if old := s.rtt.Load(); old != 0 {
+		sample = (7*old + sample) / 8
+	}
+	s.rtt.Store(sample)
+}
+
+// wroteIn records a write that took d.
+func (s *connStats) wroteIn(d time.Duration) {
+	s.writes.Add(1)
+	if d >= stallThreshold {
+		s.stalls.Add(1)
+	}
+}
+
+// rttMillis returns the smoothed round trip in milliseconds, rounded up so
+// a measured one is never 0.
+func (s *connStats) rttMillis() int64 {
+	return (s.rtt.Load() + int64(time.Millisecond) - 1) / int64(time.Millisecond)
+}
+
+// quality grades the link.
+func (s *connStats) quality(now time.Time) string {
+	rtt := time.Duration(s.rtt.Load())
+	writes, stalls := s.writes.Load(), s.stalls.Load()
+	sent := s.pingSent.Load()
+	switch {
+	case sent != 0 && now.Sub(time.Unix(0, sent)) > pongOverdue,
+		rtt >= poorRTT,
+		stalls > 0 && stalls*10 >= writes:
+		return qualityPoor
+	case rtt == 0 && writes == 0:
+		return qualityUnknown
+	case rtt >= fairRTT, stalls > 0, s.drops.Load() > 0:
+		return qualityFair
+	}
+	return qualityGood
+}
+
+// QualityReport is one connection's line in the reply to /quality.
+type QualityReport struct {
+	Username  string `json:"username"`
+	Quality   string `json:"quality"`
+	RTTMillis int64  `json:"rtt_ms,omitempty"` // smoothed ping round trip
+	Stalls    int64  `json:"stalls"`           // writes that blocked for stallThreshold or more
+	Drops     int64  `json:"drops"`            // messages dropped because its send queue was full
+}
+
+func (c *Client) qualityReport(now time.Time) QualityReport {
+	return QualityReport{
+		Username:  c.Username,
+		Quality:   c.stats.quality(now),
+		RTTMillis: c.stats.rttMillis(),
+		Stalls:    c.stats.stalls.Load(),
+		Drops:     c.stats.drops.Load(),
+	}
+}
+
+// qualityCommand replies to /quality with the room's connections, worst
+// first.
+func (h *Hub) qualityCommand(client *Client, room *Room) {
+	now := time.Now()
+	reports := []QualityReport{}
+	room.mu.RLock()
+	for c := range room.Clients {
+		if !c.observer {
+			reports = append(reports, c.qualityReport(now))
+		}
+	}
+	room.mu.RUnlock()
+	rank := map[string]int{qualityPoor: 0, qualityFair: 1, qualityUnknown: 2, qualityGood: 3}
+	sort.Slice(reports, func(i, j int) bool {
+		a, b := reports[i], reports[j]
+		if rank[a.Quality] != rank[b.Quality] {
+			return rank[a.Quality] < rank[b.Quality]
+		}
+		return a.Username < b.Username
+	})
+	data, _ := json.Marshal(reports)
+	h.sendToClient(client, Message{
+		Type:     MsgQuality,
+		Room:     room.Name,
+		Username: client.Username,
+		Text:     string(data),
+		Time:     h.clockTime(),
+	})
+}
@@ -0,0 +1,350 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Quotas cap what a tenant, and each room in it, may use:
+//
+//	messages_per_day  chat messages a day, by the server's local time
+//	storage_bytes     stored history: message text plus attachment sizes
+//	max_attachments   files, such as voice clips, in stored history
+//
+// Tenant quotas are set in the -tenants file, so the default tenant has
+// none, and room quotas through the settings API; zero means unlimited.
+// A user's message that would take its room or its tenant over a quota is
+// refused, and the sender is sent an "error" message with code
+// quota_exceeded naming the quota, its scope, limit and usage, and for the
+// daily quota when it starts over. Messages posted by webhooks, bots and
+// the server itself are never refused, but count all the same.
+//
+// Storage is counted from the store at startup and then as messages are
+// stored, and is counted again after redactions, erasures and restores.
+// The memory store keeps only each room's newest messages, so with it a
+// message stops counting once the store drops it. The day's message counts
+// start over with the server. Usage is reported by GET /api/admin/usage
+// and /api/admin/rooms/:room/usage.
+
+const (
+	quotaMessages    = "messages_per_day"
+	quotaStorage     = "storage_bytes"
+	quotaAttachments = "max_attachments"
+)
+
+// Quotas are the limits of a tenant or a room.
+type Quotas struct {
+	MessagesPerDay int   `json:"messages_per_day,omitempty"`
+	StorageBytes   int64 `json:"storage_bytes,omitempty"`
+	MaxAttachments int   `json:"max_attachments,omitempty"`
+}
+
+// Usage is what a tenant or a room has used.
+type Usage struct {
+	Day          string `json:"day"`      // the day Messages counts, as 2006-01-02
+	Messages     int    `json:"messages"` // chat messages that day
+	StorageBytes int64  `json:"storage_bytes"`
+	Attachments  int    `json:"attachments"`
+}
+
+// UsageReport is a tenant's or a room's usage next to its quotas.
+type UsageReport struct {
+	Usage
+	Quotas Quotas `json:"quotas"`
+}
+
+// ErrorInfo says why the server refused what a client sent, in "error"
+// messages.
+type ErrorInfo struct {
+	Code   string `json:"code"`             // quota_exceeded, read_only or bad_json
+	Quota  string `json:"quota,omitempty"`  // messages_per_day, storage_bytes or max_attachments
+	Scope  string `json:"scope,omitempty"`  // room or tenant
+	Limit  int64  `json:"limit,omitempty"`  // the quota, or the bad frames that close the connection
+	Used   int64  `json:"used,omitempty"`   // how much of it is used, or the bad frames sent
+	Resets string `json:"resets,omitempty"` // RFC 3339 time messages_per_day starts over
+}
+
+const errQuotaExceeded = "quota_exceeded"
+
+type usageBook struct {
+	mu     sync.Mutex
+	tenant Usage
+	rooms  map[string]*Usage
+
+	// keep is how many messages the store keeps per room, 0 for all; with
+	// it, stored holds what each room's stored messages count, oldest
+	// first, so those the store drops can be taken off again.
+	keep   int
+	stored map[string][]footprint
+}
+
+// footprint is what a stored message counts towards storage quotas.
+type footprint struct {
+	bytes      int64
+	attachment bool
+}
+
+func footprintOf(msg Message) footprint {
+	return footprint{bytes: storedSize(msg), attachment: msg.Attachment != nil}
+}
+
+// count adds f to u, or takes it off with sign -1.
+func (u *Usage) count(f footprint, sign int) {
+	u.StorageBytes += int64(sign) * f.bytes
+	if f.attachment {
+		u.Attachments += sign
+	}
+}
+
+// room returns room's usage, starting a new day's count if now is past the
+// one it has. It must be called with b.mu held.
+func (b *usageBook) room(room string, now time.Time) *Usage {
+	if b.rooms == nil {
+		b.rooms = make(map[string]*Usage)
+	}
+	u, ok := b.rooms[room]
+	if !ok {
+		u = &Usage{}
+		b.rooms[room] = u
+	}
+	u.rollover(now)
+	b.tenant.rollover(now)
+	return u
+}
+
+func (u *Usage) rollover(now time.Time) {
+	if day := now.Format(time.DateOnly); u.Day != day {
+		u.Day = day
+		u.Messages = 0
+	}
+}
+
+// add counts a chat message in room, and its size and attachment if it was
+// stored.
+func (b *usageBook) add(room string, msg Message, stored bool, now time.Time) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	u := b.room(room, now)
+	f := footprintOf(msg)
+	for _, u := range []*Usage{u, &b.tenant} {
+		u.Messages++
+		if stored {
+			u.count(f, 1)
+		}
+	}
+	if !stored || b.keep == 0 {
+		return
+	}
+	if b.stored == nil {
+		b.stored = make(map[string][]footprint)
+	}
+	kept := append(b.stored[room], f)
+	if len(kept) > b.keep {
+		u.count(kept[0], -1)
+		b.tenant.count(kept[0], -1)
+		kept = kept[1:]
+	}
+	b.stored[room] = kept
+}
+
+// get returns room's usage and the tenant's at now.
+func (b *usageBook) get(room string, now time.Time) (Usage, Usage) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.tenant.rollover(now)
+	u, ok := b.rooms[room]
+	if !ok {
+		u = &Usage{}
+	}
+	u.rollover(now)
+	return *u, b.tenant
+}
+
+// all returns the tenant's usage and every room's at now.
+func (b *usageBook) all(now time.Time) (Usage, map[string]Usage) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	rooms := make(map[string]Usage, len(b.rooms))
+	for name := range b.rooms {
+		rooms[name] = *b.room(name, now)
+	}
+	b.tenant.rollover(now)
+	return b.tenant, rooms
+}
+
+// storedSize is what msg counts towards storage_bytes.
+func storedSize(msg Message) int64 {
+	n := int64(len(msg.Text))
+	if msg.Attachment != nil {
+		n += int64(msg.Attachment.Size)
+	}
+	return n
+}
+
+// countStorage counts the storage and attachments of the hub's stored
+// history afresh, keeping the day's message counts.
+func (h *Hub) countStorage() error {
+	type tally struct {
+		bytes       int64
+		attachments int
+	}
+	rooms := map[string]*tally{}
+	var total tally
+	stored := map[string][]footprint{}
+	err := h.store.Each(func(msg Message) error {
+		t, ok := rooms[msg.Room]
+		if !ok {
+			t = &tally{}
+			rooms[msg.Room] = t
+		}
+		for _, t := range []*tally{t, &total} {
+			t.bytes += storedSize(msg)
+			if msg.Attachment != nil {
+				t.attachments++
+			}
+		}
+		if h.usage.keep > 0 {
+			stored[msg.Room] = append(stored[msg.Room], footprintOf(msg))
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	b := &h.usage
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	now := h.now()
+	for name, u := range b.rooms {
+		if _, ok := rooms[name]; !ok {
+			u.StorageBytes, u.Attachments = 0, 0
+		}
+	}
+	for name, t := range rooms {
+		u := b.room(name, now)
+		u.StorageBytes, u.Attachments = t.bytes, t.attachments
+	}
+	b.tenant.StorageBytes, b.tenant.Attachments = total.bytes, total.attachments
+	if b.keep > 0 {
+		b.stored = stored
+	}
+	return nil
+}
+
+// recountStorage counts storage again after history changed other than by
+// new messages, logging if it cannot.
+func (h *Hub) recountStorage() {
+	if err := h.countStorage(); err != nil {
+		log.Printf("Counting storage of tenant %q: %v", h.tenant, err)
+	}
+}
+
+// tenantQuotas returns the quotas of the hub's tenant.
+func (h *Hub) tenantQuotas() Quotas {
+	if t, ok := lookupTenant(h.tenant); ok {
+		return t.Config.Quotas
+	}
+	return Quotas{}
+}
+
+// overQuota checks msg, about to be sent to room by a user, against the
+// room's quotas and the tenant's, and returns the first it would exceed, or
+// nil.
+func (h *Hub) overQuota(room string, msg Message, now time.Time) *ErrorInfo {
+	s := h.roomSettings(room)
+	ru, tu := h.usage.get(room, now)
+	var size, files int64
+	if !s.NoHistory && !msg.Unsaved {
+		size = storedSize(msg)
+		if msg.Attachment != nil {
+			files = 1
+		}
+	}
+	tq := h.tenantQuotas()
+	resets := time.Date(now.Year(), now.Month(), now.Day()+1, 0, 0, 0, 0, now.Location()).Format(time.RFC3339)
+	checks := []struct {
+		quota, scope      string
+		limit, used, more int64
+	}{
+		{quotaMessages, "room", int64(s.MessagesPerDay), int64(ru.Messages), 1},
+		{quotaMessages, "tenant", int64(tq.MessagesPerDay), int64(tu.Messages), 1},
+		{quotaStorage, "room", s.StorageBytes, ru.StorageBytes, size},
+		{quotaStorage, "tenant", tq.StorageBytes, tu.StorageBytes, size},
+		{quotaAttachments, "room", int64(s.MaxAttachments), int64(ru.Attachments), files},
+		{quotaAttachments, "tenant", int64(tq.MaxAttachments), int64(tu.Attachments), files},
+	}
+	for _, c := range checks {
+		if c.limit <= 0 || c.more == 0 || c.used+c.more <= c.limit {
+			continue
+		}
+		e := &ErrorInfo{Code: errQuotaExceeded, Quota: c.quota, Scope: c.scope, Limit: c.limit, Used: c.used}
+		if c.quota == quotaMessages {
+			e.Resets = resets
+		}
+		return e
+	}
+	return nil
+}
+
+// quotaText explains e to the user it refused.
+func quotaText(room string, e *ErrorInfo) string {
+	whose := "This server"
+	if e.Scope == "room" {
+		whose = "Room " + room
+	}
+	switch e.Quota {
+	case quotaMessages:
+		return fmt.Sprintf("%s has reached its limit of %d messages a day; try again after midnight.", whose, e.Limit)
+	case quotaStorage:
+		return fmt.Sprintf("%s has used %d of its %d bytes of storage; this message does not fit.", whose, e.Used, e.Limit)
+	default:
+		return fmt.Sprintf("%s has reached its limit of %d attachments.", whose, e.Limit)
+	}
+}
+
+// refuseOverQuota tells client its message, with ref, was refused for e.
+func (h *Hub) refuseOverQuota(client *Client, ref string, e *ErrorInfo) {
+	h.sendToClient(client, Message{
+		Type:  MsgError,
+		Room:  client.Room,
+		Text:  quotaText(client.Room, e),
+		Time:  h.clockTime(),
+		Ref:   ref,
+		Error: e,
+	})
+}
+
+// validQuotas checks that no quota is negative.
+func (q Quotas) validQuotas() error {
+	if q.MessagesPerDay < 0 || q.StorageBytes < 0 || q.MaxAttachments < 0 {
+		return errors.New("messages_per_day, storage_bytes and max_attachments must be positive, or 0 for no limit")
+	}
+	return nil
+}
+
+// handleUsage reports the tenant's usage and every room's, with their
+// quotas.
+func handleUsage(c *gin.Context) {
+	h := adminTenant(c).hub
+	tenant, rooms := h.usage.all(h.now())
+	out := make(map[string]UsageReport, len(rooms))
+	for name, u := range rooms {
+		out[name] = UsageReport{Usage: u, Quotas: h.roomSettings(name).Quotas}
+	}
+	c.JSON(200, gin.H{
+		"tenant": UsageReport{Usage: tenant, Quotas: h.tenantQuotas()},
+		"rooms":  out,
+	})
+}
+
+func handleRoomUsage(c *gin.Context) {
+	h, room := adminTenant(c).hub, c.Param("room")
+	u, _ := h.usage.get(room, h.now())
+	c.JSON(200, UsageReport{Usage: u, Quotas: h.roomSettings(room).Quotas})
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// With -rate-limit set (it is off by default), or a tenant's rate_limit,
+// messages are rate-limited per identity — the username — rather than per
+// connection, so a user can't multiply their allowance by opening more
+// sockets or joining more rooms. All of a user's sessions in one tenant on
+// this process draw from one token bucket; each tenant has its own limiter.
+//
+// localLimiter is the only limiter: its buckets live in this process, so
+// behind a load balancer a user gets the allowance once per server process.
+// The limiter interface is the seam for sharing limits across processes,
+// with buckets kept in a store they all reach; nothing implements it that
+// way yet.
+
+type limiter interface {
+	// allow reports whether identity may send one more message now.
+	allow(identity string, now time.Time) bool
+}
+
+// bucketIdle is how long an untouched bucket is kept; by then it has
+// refilled, so forgetting it changes nothing.
+const bucketIdle = 10 * time.Minute
+
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+type localLimiter struct {
+	rate  float64 // tokens added per second
+	burst float64 // bucket capacity
+	mu    sync.Mutex
+	users map[string]*bucket
+	swept time.Time
+}
+
+func newLocalLimiter(rate float64, burst int) *localLimiter {
+	return &localLimiter{rate: rate, burst: float64(burst), users: make(map[string]*bucket)}
+}
+
+func (l *localLimiter) allow(identity string, now time.Time) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if now.Sub(l.swept) > bucketIdle {
+		for name, b := range l.users {
+			if now.Sub(b.last) > bucketIdle {
+				delete(l.users, name)
+			}
+		}
+		l.swept = now
+	}
+
+	b, ok := l.users[identity]
+	if !ok {
+		b = &bucket{tokens: l.burst, last: now}
+		l.users[identity] = b
+	}
+	b.tokens += now.Sub(b.last).Seconds() * l.rate
+	if b.tokens > l.burst {
+		b.tokens = l.burst
+	}
+	b.last = now
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"sync"
+)
+
+// In rooms of at most -receipt-room-size members, such as two people
+// talking privately, senders learn who received and who read their
+// messages. Clients report how far they have got in the room they are
+// connected to:
+//
+//	{"type": "receipt", "text": "delivered", "seq": 41}
+//	{"type": "receipt", "text": "read", "seq": 41}
+//
+// meaning every chat message up to seq 41 reached them, or was read, which
+// implies delivered. The authors of the messages it covers are then sent a
+// receipt on their connections to the room, naming the reader and the
+// latest of their own messages covered:
+//
+//	{"type": "receipt", "room": "dm-ann-bob", "username": "bob", "text": "read", "seq": 40, "id": "..."}
+//
+// Only the last maxReceiptTracked messages of a room are tracked, and
+// receipts that do not move a reader forward are ignored, so they cost at
+// most one reply per author per message. A room's owner can turn receipts
+// off for privacy with the no_receipts setting; rooms larger than the limit
+// never send them. Receipts are not rate limited, since they are only
+// relayed as far as the chat they acknowledge.
+
+const (
+	receiptDelivered  = "delivered"
+	receiptRead       = "read"
+	maxReceiptTracked = 200
+)
+
+// sentMessage is a chat message whose receipts are tracked.
+type sentMessage struct {
+	seq    int64
+	id     string
+	author string
+}
+
+// roomReceipts is how far each member of a room has got.
+type roomReceipts struct {
+	sent      []sentMessage    // recent chat, oldest first
+	delivered map[string]int64 // username -> seq
+	read      map[string]int64
+}
+
+type receiptBook struct {
+	mu    sync.Mutex
+	rooms map[string]*roomReceipts
+}
+
+// sent tracks msg for receipts.
+func (b *receiptBook) sent(msg Message) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.rooms == nil {
+		b.rooms = make(map[string]*roomReceipts)
+	}
+	r := b.rooms[msg.Room]
+	if r == nil {
+		r = &roomReceipts{delivered: map[string]int64{}, read: map[string]int64{}}
+		b.rooms[msg.Room] = r
+	}
+	r.sent = append(r.sent, sentMessage{msg.Seq, msg.ID, msg.Username})
+	if len(r.sent) > maxReceiptTracked {
+		r.sent = r.sent[len(r.sent)-maxReceiptTracked:]
+	}
+}
+
+// advance moves reader forward to seq in room and returns, for each author
+// of the messages it newly covers, the latest of them.
+func (b *receiptBook) advance(room, reader, kind string, seq int64) map[string]sentMessage {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	r := b.rooms[room]
+	if r == nil {
+		return nil
+	}
+	marks := r.delivered
+	if kind == receiptRead {
+		marks = r.read
+		r.delivered[reader] = max(r.delivered[reader], seq)
+	}
+	from := marks[reader]
+	if seq <= from {
+		return nil
+	}
+	marks[reader] = seq
+	latest := map[string]sentMessage{}
+	for _, m := range r.sent {
+		if m.seq > from && m.seq <= seq && m.author != reader {
+			latest[m.author] = m
+		}
+	}
+	return latest
+}
+
+// forget drops room's receipts, once it is gone.
+func (b *receiptBook) forget(room string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	delete(b.rooms, room)
+}
+
+// receiptsEnabled reports whether room sends receipts: it allows them and
+// has at most -receipt-room-size members.
+func (h *Hub) receiptsEnabled(room string) bool {
+	if cfg.ReceiptRoomSize <= 0 || h.roomSettings(room).NoReceipts {
+		return false
+	}
+	h.mu.RLock()
+	r, ok := h.rooms[room]
+	h.mu.RUnlock()
+	if !ok {
+		return false
+	}
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	members := map[string]bool{}
+	for c := range r.Clients {
+		if !c.observer {
+			members[c.Username] = true
+		}
+	}
+	return len(members) <= cfg.ReceiptRoomSize
+}
+
+// trackReceipts tracks a chat message sent in room, if the room sends
+// receipts.
+func (h *Hub) trackReceipts(msg Message) {
+	if msg.Seq > 0 && h.receiptsEnabled(msg.Room) {
+		h.receipts.sent(msg)
+	}
+}
+
+// receipt relays a receipt from client to the authors of the messages it
+// covers.
+func (h *Hub) receipt(client *Client, msg Message) {
+	if (msg.Text != receiptDelivered && msg.Text != receiptRead) || msg.Seq <= 0 || !h.receiptsEnabled(client.Room) {
+		return
+	}
+	latest := h.receipts.advance(client.Room, client.Username, msg.Text, msg.Seq)
+	if len(latest) == 0 {
+		return
+	}
+	h.mu.RLock()
+	room, ok := h.rooms[client.Room]
+	h.mu.RUnlock()
+	if !ok {
+		return
+	}
+	room.mu.RLock()
+	defer room.mu.RUnlock()
+	for c := range room.Clients {
+		m, ok := latest[c.Username]
+		if !ok {
+			continue
+		}
+		h.sendToClient(c, Message{
+			Type:     MsgReceipt,
+			Room:     client.Room,
+			Username: client.Username,
+			Text:     msg.Text,
+			Time:     h.clockTime(),
+			ID:       m.id,
+			Seq:      m.seq,
+		})
+	}
+}
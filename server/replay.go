@@ -0,0 +1,90 @@
+package main
+
+import "time"
+
+// A resumed connection is sent the chat it missed, up to maxReplay
+// messages, which can be more than its send queue holds. Rather than queue
+// it all at once and drop the client when the queue overflows, the replay
+// is fed to the queue in batches of replayBatch, pausing whenever the queue
+// is three quarters full until the client's writer catches up. Live chat
+// arriving meanwhile is held back and queued after the replay, so the
+// connection still sees the room's chat in seq order. A client that takes
+// nothing for replayStall, or falls maxReplay messages behind the room
+// while its replay is queued, is dropped as any slow client is.
+
+const (
+	maxReplay   = 1000
+	replayBatch = 32
+	replayPause = 20 * time.Millisecond // wait for a full queue to drain
+	replayYield = time.Millisecond      // between batches
+	replayStall = 30 * time.Second
+)
+
+// startReplay queues msgs for c in paced batches, holding back live chat
+// until they are all queued. Callers hold the room's writer, so no chat is
+// broadcast between loading msgs and holding back the rest.
+func (c *Client) startReplay(msgs []Message) {
+	frames := make([][]byte, len(msgs))
+	for i, m := range msgs {
+		frames[i] = mustMarshal(m)
+	}
+	c.sendMu.Lock()
+	c.replaying = true
+	c.sendMu.Unlock()
+	go c.replay(frames)
+}
+
+func (c *Client) replay(frames [][]byte) {
+	progress := time.Now()
+	for {
+		rest, queued, done, open := c.feed(frames)
+		if !open || done {
+			return
+		}
+		frames = rest
+		switch {
+		case queued:
+			progress = time.Now()
+			time.Sleep(replayYield)
+		case time.Since(progress) > replayStall:
+			if c.closeSend() {
+				publishEvent(AdminEvent{Kind: EventDrop, Tenant: c.hub.tenant, Room: c.Room, Username: c.Username, Detail: "replay stalled"})
+			}
+			return
+		default:
+			time.Sleep(replayPause)
+		}
+	}
+}
+
+// feed queues frames, then the held-back chat, up to a batch and up to the
+// queue's high-water mark. It returns the frames left, whether it queued
+// anything, whether the replay is over and whether the client is still
+// open.
+func (c *Client) feed(frames [][]byte) (rest [][]byte, queued, done, open bool) {
+	c.sendMu.Lock()
+	if c.closed {
+		c.replaying, c.held = false, nil
+		c.sendMu.Unlock()
+		return nil, false, false, false
+	}
+	space := min(max(cap(c.Send)*3/4, 1)-len(c.Send), replayBatch)
+	for space > 0 && len(frames) > 0 {
+		c.Send <- frames[0]
+		frames, space, queued = frames[1:], space-1, true
+	}
+	if len(frames) == 0 {
+		for space > 0 && len(c.held) > 0 {
+			c.Send <- c.held[0]
+			c.held, space, queued = c.held[1:], space-1, true
+		}
+		if len(c.held) == 0 {
+			c.replaying, c.held, done = false, nil, true
+		}
+	}
+	c.sendMu.Unlock()
+	if queued && c.wake != nil {
+		c.wake()
+	}
+	return frames, queued, done, true
+}
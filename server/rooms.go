@@ -0,0 +1,141 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Rooms declared in the -rooms file are set up at startup with their
+// settings in place, rather than being created by their first joiner with
+// the defaults:
+//
+//	[{"name": "general", "topic": "Say hello", "persistent": true,
+//	  "owner": "alice", "moderators": ["bob"], "filter": "mild", "max_pins": 20,
+//	  "webhooks": {"ci": "<key>"}, "feeds": [{"url": "https://example.com/feed.xml"}],
+//	  "hooks": [{"url": "https://provisioner.internal/chat"}]}]
+//
+// An entry takes any of the RoomSettings fields, the room's webhooks by name
+// and key, the feeds it follows, the membership hooks it calls (see
+// members.go) and, for multi-tenant servers, the tenant the room belongs
+// to. Persistent rooms are created straight away and stay listed while
+// empty; the others get their settings now and are created when someone
+// joins. Moderators can change any of it
+// later through the admin API.
+
+// RoomConfig is one room in the -rooms file.
+type RoomConfig struct {
+	Name     string            `json:"name"`
+	Tenant   string            `json:"tenant,omitempty"`
+	Webhooks map[string]string `json:"webhooks,omitempty"` // name -> key
+	Feeds    []FeedConfig      `json:"feeds,omitempty"`
+	Hooks    []MemberHook      `json:"hooks,omitempty"` // called as members join and leave
+	RoomSettings
+}
+
+// setupRooms applies the -rooms file, if there is one.
+func setupRooms() error {
+	if cfg.RoomsFile == "" {
+		return nil
+	}
+	data, err := os.ReadFile(cfg.RoomsFile)
+	if err != nil {
+		return err
+	}
+	var rooms []RoomConfig
+	if err := json.Unmarshal(data, &rooms); err != nil {
+		return fmt.Errorf("%s: %w", cfg.RoomsFile, err)
+	}
+	seen := map[string]bool{}
+	for _, rc := range rooms {
+		if rc.Name == "" || rc.Name != strings.TrimSpace(rc.Name) {
+			return fmt.Errorf("%s: invalid room name %q", cfg.RoomsFile, rc.Name)
+		}
+		t, ok := lookupTenant(rc.Tenant)
+		if !ok {
+			return fmt.Errorf("%s: room %s: unknown tenant %q", cfg.RoomsFile, rc.Name, rc.Tenant)
+		}
+		key := tenantQualified(rc.Tenant, rc.Name)
+		if seen[key] {
+			return fmt.Errorf("%s: room %s is declared twice", cfg.RoomsFile, rc.Name)
+		}
+		seen[key] = true
+		if err := rc.validate(); err != nil {
+			return fmt.Errorf("%s: room %s: %w", cfg.RoomsFile, rc.Name, err)
+		}
+		for name, key := range rc.Webhooks {
+			if !groupName.MatchString(name) || key == "" {
+				return fmt.Errorf("%s: room %s: invalid webhook %q", cfg.RoomsFile, rc.Name, name)
+			}
+			t.hub.webhooks.set(rc.Name, name, key)
+		}
+		for i := range rc.Feeds {
+			if err := rc.Feeds[i].validate(); err != nil {
+				return fmt.Errorf("%s: room %s: %w", cfg.RoomsFile, rc.Name, err)
+			}
+			t.hub.followFeed(rc.Name, rc.Feeds[i])
+		}
+		for i := range rc.Hooks {
+			if err := rc.Hooks[i].validate(); err != nil {
+				return fmt.Errorf("%s: room %s: %w", cfg.RoomsFile, rc.Name, err)
+			}
+			t.hub.members.addHook(rc.Name, rc.Hooks[i])
+		}
+		t.hub.preload(rc.Name, rc.RoomSettings)
+	}
+	log.Printf("Set up %d rooms from %s", len(rooms), cfg.RoomsFile)
+	return nil
+}
+
+// preload gives room its settings and, if it is persistent, creates it.
+func (h *Hub) preload(name string, s RoomSettings) {
+	h.updateSettings(name, func(old *RoomSettings) { *old = s })
+	if !s.Persistent || s.Archived || s.Dormant {
+		return
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if _, ok := h.rooms[name]; !ok {
+		h.rooms[name] = &Room{Name: name, Clients: make(map[*Client]bool)}
+	}
+}
+
+// RoomEntry is a room in the public directory.
+type RoomEntry struct {
+	Name    string `json:"name"`
+	Members int    `json:"members"`
+	Topic   string `json:"topic,omitempty"`
+}
+
+// directory lists the hub's rooms, by name.
+func (h *Hub) directory() []RoomEntry {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	entries := make([]RoomEntry, 0, len(h.rooms))
+	for name, room := range h.rooms {
+		if name == canaryRoom {
+			continue
+		}
+		room.mu.RLock()
+		entries = append(entries, RoomEntry{Name: name, Members: room.members(), Topic: h.settings[name].Topic})
+		room.mu.RUnlock()
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Name < entries[j].Name })
+	return entries
+}
+
+// handleRoomDirectory lists the tenant's rooms with their member counts and
+// topics, for clients to offer before joining.
+func handleRoomDirectory(c *gin.Context) {
+	t, ok := lookupTenant(c.Query("tenant"))
+	if !ok {
+		c.JSON(404, gin.H{"error": "unknown tenant"})
+		return
+	}
+	c.JSON(200, t.hub.directory())
+}
@@ -0,0 +1,333 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Scheduled posts are messages the server posts on a recurring schedule,
+// such as a standup reminder every weekday morning or the rules once a
+// week. They are managed through the admin API:
+//
+//	GET    /api/admin/schedules
+//	POST   /api/admin/schedules      {"room": "eng", "cron": "0 9 * * 1-5", "text": "Standup in 15 minutes"}
+//	PUT    /api/admin/schedules/:id  (the same body)
+//	DELETE /api/admin/schedules/:id
+//
+// A post without a room goes to every live room of the tenant. The
+// schedule is a cron expression of minute, hour, day of month, month and
+// day of week, each *, a number, a range a-b or a list of them, optionally
+// stepped with /n, in the server's local time; @hourly, @daily and @weekly
+// are also understood. As in cron, a day matches if either of the day
+// fields does when both are restricted. Posts are integration messages
+// from their name, "scheduler" by default. Like webhooks, scheduled posts
+// are kept in memory.
+
+const (
+	scheduleBot  = "scheduler"
+	scheduleTick = 30 * time.Second
+)
+
+// ScheduledPost is a message posted on a schedule.
+type ScheduledPost struct {
+	ID   string    `json:"id"`
+	Room string    `json:"room,omitempty"` // every live room if empty
+	Cron string    `json:"cron"`
+	Text string    `json:"text"`
+	Name string    `json:"name,omitempty"` // who it is posted as
+	Next time.Time `json:"next"`           // the next time it is posted
+}
+
+// cronSpec is a parsed cron expression: the minutes, hours, days, months
+// and weekdays it matches, as bit sets.
+type cronSpec struct {
+	minute, hour, dom, month, dow uint64
+	anyDay                        bool // neither day field is restricted
+	domOnly, dowOnly              bool // only one of them is
+}
+
+var cronMacros = map[string]string{
+	"@hourly": "0 * * * *",
+	"@daily":  "0 0 * * *",
+	"@weekly": "0 0 * * 0",
+}
+
+var cronFields = []struct {
+	name     string
+	min, max int
+}{
+	{"minute", 0, 59}, {"hour", 0, 23}, {"day of month", 1, 31}, {"month", 1, 12}, {"day of week", 0, 7},
+}
+
+func parseCron(expr string) (cronSpec, error) {
+	if m, ok := cronMacros[expr]; ok {
+		expr = m
+	}
+	fields := strings.Fields(expr)
+	if len(fields) != len(cronFields) {
+		return cronSpec{}, errors.New("cron must have 5 fields: minute hour day month weekday")
+	}
+	var sets [5]uint64
+	for i, f := range fields {
+		set, err := parseCronField(f, cronFields[i].min, cronFields[i].max)
+		if err != nil {
+			return cronSpec{}, fmt.Errorf("cron %s: %w", cronFields[i].name, err)
+		}
+		sets[i] = set
+	}
+	s := cronSpec{minute: sets[0], hour: sets[1], dom: sets[2], month: sets[3], dow: sets[4]}
+	if s.dow&(1<<7) != 0 {
+		s.dow |= 1 // 7 is Sunday too
+	}
+	domAny, dowAny := fields[2] == "*", fields[4] == "*"
+	s.anyDay = domAny && dowAny
+	s.domOnly = !domAny && dowAny
+	s.dowOnly = domAny && !dowAny
+	return s, nil
+}
+
+// parseCronField returns the values field matches, as bits.
+func parseCronField(field string, min, max int) (uint64, error) {
+	var set uint64
+	for _, part := range strings.Split(field, ",") {
+		rng, stepText, stepped := strings.Cut(part, "/")
+		step := 1
+		if stepped {
+			n, err := strconv.Atoi(stepText)
+			if err != nil || n < 1 {
+				return 0, fmt.Errorf("invalid step %q", stepText)
+			}
+			step = n
+		}
+		lo, hi := min, max
+		if rng != "*" {
+			a, b, isRange := strings.Cut(rng, "-")
+			var err error
+			if lo, err = strconv.Atoi(a); err != nil {
+				return 0, fmt.Errorf("invalid value %q", part)
+			}
+			hi = lo
+			if isRange {
+				if hi, err = strconv.Atoi(b); err != nil {
+					return 0, fmt.Errorf("invalid value %q", part)
+				}
+			} else if stepped {
+				hi = max // 5/15 means from 5 on
+			}
+		}
+		if lo < min || hi > max || lo > hi {
+			return 0, fmt.Errorf("%q is out of range %d-%d", part, min, max)
+		}
+		for v := lo; v <= hi; v += step {
+			set |= 1 << v
+		}
+	}
+	return set, nil
+}
+
+func (s cronSpec) dayMatches(t time.Time) bool {
+	dom, dow := s.dom&(1<<t.Day()) != 0, s.dow&(1<<int(t.Weekday())) != 0
+	switch {
+	case s.anyDay:
+		return true
+	case s.domOnly:
+		return dom
+	case s.dowOnly:
+		return dow
+	}
+	return dom || dow
+}
+
+// next returns the first time the spec matches after t, or the zero time if
+// it never does, as for February 30th.
+func (s cronSpec) next(t time.Time) time.Time {
+	t = t.Truncate(time.Minute).Add(time.Minute)
+	for limit := t.AddDate(5, 0, 0); t.Before(limit); {
+		switch {
+		case s.month&(1<<int(t.Month())) == 0:
+			t = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, t.Location())
+		case !s.dayMatches(t):
+			t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, t.Location())
+		case s.hour&(1<<t.Hour()) == 0:
+			t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour()+1, 0, 0, 0, t.Location())
+		case s.minute&(1<<t.Minute()) == 0:
+			t = t.Add(time.Minute)
+		default:
+			return t
+		}
+	}
+	return time.Time{}
+}
+
+// schedule is a scheduled post with its parsed cron expression.
+type schedule struct {
+	ScheduledPost
+	spec cronSpec
+}
+
+type scheduleList struct {
+	mu     sync.Mutex
+	posts  map[string]*schedule
+	lastID int
+}
+
+// set adds post, or replaces the one with its ID, and returns it with its
+// ID and next time filled in.
+func (l *scheduleList) set(post ScheduledPost, spec cronSpec, now time.Time) ScheduledPost {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.posts == nil {
+		l.posts = make(map[string]*schedule)
+	}
+	if post.ID == "" {
+		l.lastID++
+		post.ID = strconv.Itoa(l.lastID)
+	}
+	post.Next = spec.next(now)
+	l.posts[post.ID] = &schedule{post, spec}
+	return post
+}
+
+// has reports whether there is a scheduled post with id.
+func (l *scheduleList) has(id string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	_, ok := l.posts[id]
+	return ok
+}
+
+// remove deletes the scheduled post with id and reports whether it existed.
+func (l *scheduleList) remove(id string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	_, ok := l.posts[id]
+	delete(l.posts, id)
+	return ok
+}
+
+// list returns the scheduled posts in ID order.
+func (l *scheduleList) list() []ScheduledPost {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	posts := []ScheduledPost{}
+	for _, s := range l.posts {
+		posts = append(posts, s.ScheduledPost)
+	}
+	sort.Slice(posts, func(i, j int) bool {
+		a, _ := strconv.Atoi(posts[i].ID)
+		b, _ := strconv.Atoi(posts[j].ID)
+		return a < b
+	})
+	return posts
+}
+
+// due returns the posts due by now and moves them on to their next time.
+func (l *scheduleList) due(now time.Time) []ScheduledPost {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	var due []ScheduledPost
+	for _, s := range l.posts {
+		if s.Next.IsZero() || s.Next.After(now) {
+			continue
+		}
+		due = append(due, s.ScheduledPost)
+		s.Next = s.spec.next(now)
+	}
+	return due
+}
+
+// startSchedules posts the scheduled posts as they fall due.
+func startSchedules() {
+	go func() {
+		for range time.Tick(scheduleTick) {
+			now := time.Now()
+			for _, h := range allHubs() {
+				for _, post := range h.schedules.due(now) {
+					h.postScheduled(post)
+				}
+			}
+		}
+	}()
+}
+
+// postScheduled posts post to its room, or to every live room.
+func (h *Hub) postScheduled(post ScheduledPost) {
+	name := post.Name
+	if name == "" {
+		name = scheduleBot
+	}
+	rooms := []string{post.Room}
+	if post.Room == "" {
+		rooms = h.roomNames()
+	}
+	for _, room := range rooms {
+		h.postIntegration(room, name, post.Text, "")
+	}
+}
+
+// roomNames returns the names of the live rooms.
+func (h *Hub) roomNames() []string {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	names := make([]string, 0, len(h.rooms))
+	for name := range h.rooms {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func handleListSchedules(c *gin.Context) {
+	c.JSON(200, adminTenant(c).hub.schedules.list())
+}
+
+// handleSetSchedule creates a scheduled post, or with an :id replaces one.
+func handleSetSchedule(c *gin.Context) {
+	t := adminTenant(c)
+	var post ScheduledPost
+	if err := c.ShouldBindJSON(&post); err != nil || strings.TrimSpace(post.Text) == "" {
+		c.JSON(400, gin.H{"error": `body must be {"cron": ..., "text": ..., "room": ..., "name": ...}`})
+		return
+	}
+	spec, err := parseCron(post.Cron)
+	if err == nil && spec.next(time.Now()).IsZero() {
+		err = errors.New("cron never matches")
+	}
+	if err != nil {
+		c.JSON(400, gin.H{"error": err.Error()})
+		return
+	}
+	if post.Name != "" && !groupName.MatchString(post.Name) {
+		c.JSON(400, gin.H{"error": "names are 1 to 32 of a-z, 0-9, _ and -"})
+		return
+	}
+	post.ID = c.Param("id")
+	action, status := "schedule.update", 200
+	if post.ID == "" {
+		action, status = "schedule.create", 201
+	} else if !t.hub.schedules.has(post.ID) {
+		c.JSON(404, gin.H{"error": "no such scheduled post"})
+		return
+	}
+	post = t.hub.schedules.set(post, spec, time.Now())
+	recordAudit(AuditEntry{Actor: c.ClientIP(), Tenant: t.Name, Action: action, Subject: post.ID, Detail: post.Cron})
+	c.JSON(status, post)
+}
+
+func handleDeleteSchedule(c *gin.Context) {
+	t := adminTenant(c)
+	id := c.Param("id")
+	if !t.hub.schedules.remove(id) {
+		c.JSON(404, gin.H{"error": "no such scheduled post"})
+		return
+	}
+	recordAudit(AuditEntry{Actor: c.ClientIP(), Tenant: t.Name, Action: "schedule.delete", Subject: id})
+	c.JSON(200, gin.H{"id": id})
+}
@@ -0,0 +1,324 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"sync"
+
+	"github.com/gin-gonic/gin"
+)
+
+// The protocol description served at /api/schema is an AsyncAPI 2.6
+// document whose payload schemas are generated from the Go types below, so
+// it cannot drift from what the server actually sends.
+
+// commandInfo describes one slash command understood by handleCommand.
+type commandInfo struct {
+	Usage       string `json:"usage"`
+	Description string `json:"description"`
+	Reply       string `json:"reply"` // message type of the response
+}
+
+var commands = []commandInfo{
+	{"/users", "List the users in the current room", MsgUserList},
+	{"/stats", "Show global user and room totals", MsgStats},
+	{"/rooms", "List all rooms with their user counts", MsgRoom},
+	{"/history [N]", "Return the last N chat messages of the room (default 20)", MsgHistory},
+	{"/report <username> [reason]", "Flag a user to the moderators", MsgSystem},
+	{"/groups", "List the @groups that mentions can notify, with their members", MsgGroups},
+	{"/pin <id> [duration]", "Pin a message of the room, until the duration (e.g. 24h) or the room's default passes", MsgPinned},
+	{"/unpin <id>", "Take down a pin you made, or as the room's owner or a moderator any pin", MsgUnpinned},
+	{"/pins", "List the room's pinned messages", MsgPins},
+	{"/incognito [on|off]", "Show whether your messages are saved to the room's history, or where the room allows it stop or resume saving them", MsgHistoryMode},
+	{"/quality", "Show how good each connection to the room is, worst first, from its ping round trip and stalled writes", MsgQuality},
+	{"/forward <id> <room>", "Repost a message from one of your rooms into another you are in, crediting its author", MsgChat},
+	{"/digest [daily on|off]", "Summarize the room's activity since its last daily digest, or as the room's owner or a moderator turn daily digests on or off", MsgDigest},
+	{"/prefs [mentions-only on|off | mute [room] | unmute [room]]", "Show your notification preferences, or change one", MsgPrefs},
+	{"/filter [off|mild|strict|default]", "Show the room's language filter, or as the room's owner or a moderator change it", MsgSystem},
+	{"/calendar [<ics url> [minutes] | off]", "Show the room's calendar and its next event, or as the room's owner or a moderator subscribe the room to reminders of an ICS calendar's events", MsgSystem},
+	{"/create <room> [--template name]", "Create a room you own, set up from a room template if given: its settings, pinned welcome message and integrations", MsgSystem},
+	{"/invite [qr]", "Return a shareable link that opens the web UI in the current room, or with qr a link to it as a QR code image", MsgSystem},
+}
+
+// commandHelp is the usage line sent for unknown commands.
+func commandHelp() string {
+	usages := make([]string, len(commands))
+	for i, cmd := range commands {
+		usages[i] = cmd.Usage
+	}
+	return "Unknown command. Available commands: " + strings.Join(usages, ", ")
+}
+
+// messageInfo documents one value of Message.Type.
+type messageInfo struct {
+	Type        string
+	Description string
+	FromClient  bool   // clients may send this type
+	TextSchema  any    // schema of the JSON carried in Text, if any
+	TextFormat  string // human description of Text when it is not free text
+}
+
+func messageTypes() []messageInfo {
+	return []messageInfo{
+		{Type: MsgChat, Description: "A chat message. Clients send only text (and optionally ref); the server fills in the rest before broadcasting.", FromClient: true},
+		{Type: MsgSystem, Description: "A notice from the server, such as errors and command replies; chat.v1 clients are also sent joins, leaves and topic changes as system messages."},
+		{Type: MsgUserJoined, Description: "To chat.v2 clients: username joined the room."},
+		{Type: MsgUserLeft, Description: "To chat.v2 clients: username left the room."},
+		{Type: MsgTopicChanged, Description: "To chat.v2 clients: the room's topic is now topic, or was cleared if it is empty."},
+		{Type: MsgUserList, Description: "Reply to /users.", TextFormat: "comma-separated usernames"},
+		{Type: MsgStats, Description: "Reply to /stats.", TextSchema: schemaFor(reflect.TypeOf(StatsMessage{}))},
+		{Type: MsgRoom, Description: "Reply to /rooms.", TextSchema: map[string]any{
+			"type":                 "object",
+			"additionalProperties": map[string]any{"type": "integer"},
+			"description":          "room name -> user count",
+		}},
+		{Type: MsgHistory, Description: "Reply to /history.", TextSchema: map[string]any{
+			"type":  "array",
+			"items": map[string]any{"$ref": "#/components/schemas/Message"},
+		}},
+		{Type: MsgAck, Description: "Confirms a chat message that carried a ref; id and seq identify the stored message."},
+		{Type: MsgWelcome, Description: "First message on every connection; carries the resume token, the room's current seq and, to chat.v2 clients, its topic."},
+		{Type: MsgRedacted, Description: "A moderator redacted the message with this id and seq; text is the marker that now replaces it."},
+		{Type: MsgKicked, Description: "A moderator disconnected this client or closed its room; text gives the reason. Clients should not reconnect."},
+		{Type: MsgMention, Description: "A chat message in room mentioned this user, directly or through the @group in group; text, id and seq are the message's. Sent on every connection of the user."},
+		{Type: MsgGroups, Description: "Reply to /groups.", TextSchema: map[string]any{
+			"type":                 "object",
+			"additionalProperties": map[string]any{"type": "array", "items": map[string]any{"type": "string"}},
+			"description":          "group name -> member usernames",
+		}},
+		{Type: MsgPinned, Description: "Someone (username) pinned the message with this id and seq.", TextSchema: schemaFor(reflect.TypeOf(Pin{}))},
+		{Type: MsgUnpinned, Description: "The pin of the message with this id and seq was taken down, by username; text is unpinned, or expired when its time ran out."},
+		{Type: MsgPins, Description: "Reply to /pins.", TextSchema: map[string]any{
+			"type":  "array",
+			"items": schemaFor(reflect.TypeOf(Pin{})),
+		}},
+		{Type: MsgDigest, Description: "Reply to /digest, and the daily digest posted to rooms that want one.", TextSchema: schemaFor(reflect.TypeOf(Digest{}))},
+		{Type: MsgPrefs, Description: "Reply to /prefs.", TextSchema: schemaFor(reflect.TypeOf(Prefs{}))},
+		{Type: MsgDirect, Description: "A private message from a built-in bot, such as the welcome bot, to this connection only; username is the bot's name. Not stored."},
+		{Type: MsgQuality, Description: "Reply to /quality.", TextSchema: map[string]any{
+			"type":  "array",
+			"items": schemaFor(reflect.TypeOf(QualityReport{})),
+		}},
+		{Type: MsgHistoryMode, Description: "Whether the room stores its chat in history: sent after the welcome when it does not, and to the room when that changes. With username set, it is about that member's own messages, which they kept out of history with /incognito.", TextFormat: "on or off"},
+		{Type: MsgError, Description: "The server refused what the client sent, with error saying why; ref is the refused message's. Sent to chat.v2 clients; chat.v1 clients are sent text as a system message."},
+		{Type: MsgAnnotation, Description: "A bot (username) annotated the stored message with this id and seq through POST /api/rooms/{room}/messages/{id}/annotations; annotations holds the new annotation, which replaces any earlier one of the same bot and kind. Stored messages carry their annotations in history."},
+		{Type: MsgReceipt, Description: "In rooms small enough for receipts, clients send text delivered or read with the seq of the last chat message they received or read. The server relays it to the authors of the messages covered, with username the reader and id and seq the latest of the author's own messages covered.", FromClient: true, TextFormat: "delivered or read"},
+	}
+}
+
+// fieldDocs are descriptions for generated schema properties, keyed by
+// "Type.jsonName".
+var fieldDocs = map[string]string{
+	"Message.type":         "Message type, see the messages section",
+	"Message.room":         "Room the message belongs to",
+	"Message.username":     "Author, or the requesting user for command replies",
+	"Message.text":         "Message text; for some types a JSON document",
+	"Message.time":         "Server time as HH:MM:SS",
+	"Message.id":           "Server-assigned message ID",
+	"Message.ref":          "Client-chosen reference echoed back in the ack, or in the system message rejecting it",
+	"Message.seq":          "Per-room sequence number of chat messages; see x-ordering",
+	"Message.redacted":     "Set on chat messages whose text a moderator replaced",
+	"Message.emoji":        "Custom emoji used in text as :name:, mapped to their image URLs",
+	"Message.group":        "In a mention, the group through which the recipient was mentioned",
+	"Message.attachment":   "A file posted with the message through POST /api/rooms/{room}/attachments, such as a voice clip",
+	"Message.forwarded":    "On a message reposted with /forward, the message it was forwarded from",
+	"Message.integration":  "Set on chat messages posted through a room webhook with POST /api/rooms/{room}/messages; username is the webhook's name",
+	"Message.unverified":   "Set on chat messages sent under a username that is not registered, on servers that allow registration",
+	"Message.unsaved":      "Set on chat messages that were not stored, because the room's history is off or the sender is incognito; /history and resumes will not return them",
+	"Message.topic":        "The room's topic, in topic_changed and in chat.v2 welcomes",
+	"Message.trace":        "Trace ID following a chat message through the server's logs and integrations; clients may choose their own when sending, and are sent it by servers run with -trace-clients",
+	"Message.resume_token": "Token to pass as ?resume= when reconnecting, and as the bearer token for uploads",
+	"Message.error":        "In error messages, why the server refused",
+	"Message.annotations":  "Bots' annotations of a stored chat message, and in annotation messages the new one",
+
+	"Annotation.bot":  "The webhook that added it",
+	"Annotation.kind": "What it is, such as sentiment, language or moderation; a bot has one of each kind per message",
+	"Annotation.data": "The annotation, as the bot posted it: any JSON of up to 4096 bytes",
+	"Annotation.time": "When it was added",
+
+	"ErrorInfo.code":   "Why: quota_exceeded, read_only for observers, or bad_json for a frame that was not valid JSON",
+	"ErrorInfo.quota":  "For quota_exceeded, the quota: messages_per_day, storage_bytes or max_attachments",
+	"ErrorInfo.scope":  "For quota_exceeded, whose quota: room or tenant",
+	"ErrorInfo.limit":  "For quota_exceeded, the quota; for bad_json on servers that disconnect for it, how many bad frames close the connection",
+	"ErrorInfo.used":   "For quota_exceeded, how much of the quota is used; for bad_json, how many bad frames the connection has sent",
+	"ErrorInfo.resets": "For messages_per_day, when the count starts over",
+
+	"Prefs.mentions_only": "Notify only on mentions by name, not through @groups",
+	"Prefs.muted_rooms":   "Rooms whose mentions are not notified",
+
+	"Digest.from_seq":  "Seq of the first message covered",
+	"Digest.to_seq":    "Seq of the last message covered",
+	"Digest.messages":  "Number of messages covered",
+	"Digest.top_users": "Users who sent the most messages",
+	"Digest.top_links": "Links shared most often",
+
+	"QualityReport.quality": "good, fair, poor, or unknown until the connection has been measured",
+	"QualityReport.rtt_ms":  "Smoothed round trip of the connection's pings, in milliseconds",
+	"QualityReport.stalls":  "Writes to the connection that blocked for half a second or more",
+	"QualityReport.drops":   "Messages dropped because the connection's send queue was full",
+
+	"Pin.id":        "ID of the pinned message",
+	"Pin.author":    "Author of the pinned message",
+	"Pin.pinned_by": "User who pinned it",
+	"Pin.expires":   "When the pin is taken down, if ever",
+
+	"Forward.id":     "ID of the source message",
+	"Forward.room":   "Room of the source message",
+	"Forward.seq":    "Seq of the source message in its room",
+	"Forward.author": "Author of the source message",
+	"Forward.time":   "When the source message was sent",
+
+	"Attachment.type":         "Kind of attachment: audio",
+	"Attachment.url":          "Path the file is served from",
+	"Attachment.content_type": "MIME type of the file",
+	"Attachment.size":         "Size of the file in bytes",
+	"Attachment.duration":     "Length of an audio clip in seconds",
+}
+
+// schemaFor builds a JSON Schema for t from its json struct tags.
+func schemaFor(t reflect.Type) map[string]any {
+	switch t.Kind() {
+	case reflect.Pointer:
+		return schemaFor(t.Elem())
+	case reflect.String:
+		return map[string]any{"type": "string"}
+	case reflect.Bool:
+		return map[string]any{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return map[string]any{"type": "integer"}
+	case reflect.Float32, reflect.Float64:
+		return map[string]any{"type": "number"}
+	case reflect.Slice, reflect.Array:
+		return map[string]any{"type": "array", "items": schemaFor(t.Elem())}
+	case reflect.Map:
+		return map[string]any{"type": "object", "additionalProperties": schemaFor(t.Elem())}
+	case reflect.Struct:
+		props := map[string]any{}
+		var required []string
+		for i := 0; i < t.NumField(); i++ {
+			f := t.Field(i)
+			if !f.IsExported() {
+				continue
+			}
+			name, opts, _ := strings.Cut(f.Tag.Get("json"), ",")
+			if name == "-" {
+				continue
+			}
+			if name == "" {
+				name = f.Name
+			}
+			prop := schemaFor(f.Type)
+			if doc, ok := fieldDocs[t.Name()+"."+name]; ok {
+				prop["description"] = doc
+			}
+			props[name] = prop
+			if !strings.Contains(opts, "omitempty") {
+				required = append(required, name)
+			}
+		}
+		s := map[string]any{"type": "object", "properties": props}
+		if len(required) > 0 {
+			s["required"] = required
+		}
+		return s
+	}
+	return map[string]any{}
+}
+
+// protocolSchema assembles the AsyncAPI document.
+func protocolSchema() map[string]any {
+	messages := map[string]any{}
+	var publish, subscribe []any
+	for _, mt := range messageTypes() {
+		payload := map[string]any{
+			"allOf": []any{
+				map[string]any{"$ref": "#/components/schemas/Message"},
+				map[string]any{"properties": map[string]any{
+					"type": map[string]any{"const": mt.Type},
+				}},
+			},
+		}
+		msg := map[string]any{
+			"name":    mt.Type,
+			"summary": mt.Description,
+			"payload": payload,
+		}
+		if mt.TextSchema != nil {
+			msg["x-text-schema"] = mt.TextSchema
+		}
+		if mt.TextFormat != "" {
+			msg["x-text-format"] = mt.TextFormat
+		}
+		messages[mt.Type] = msg
+
+		ref := map[string]any{"$ref": "#/components/messages/" + mt.Type}
+		subscribe = append(subscribe, ref)
+		if mt.FromClient {
+			publish = append(publish, ref)
+		}
+	}
+
+	return map[string]any{
+		"asyncapi": "2.6.0",
+		"info": map[string]any{
+			"title":       "Chat Rooms WebSocket protocol",
+			"version":     "1",
+			"description": "Every frame is one JSON-encoded Message, or, when the server batches under load, a JSON array of Messages. Text starting with / is a command; see x-commands.",
+		},
+		"channels": map[string]any{
+			"/ws": map[string]any{
+				"description": "One connection per user and room. Request subprotocol chat.v2 to be sent joins, leaves and topic changes as typed messages; without it, or with chat.v1, they are system messages in free text.",
+				"bindings": map[string]any{
+					"ws": map[string]any{
+						"method": "GET",
+						"query": map[string]any{
+							"type": "object",
+							"properties": map[string]any{
+								"username":     map[string]any{"type": "string"},
+								"room":         map[string]any{"type": "string"},
+								"tenant":       map[string]any{"type": "string", "description": "tenant namespace on multi-tenant servers; omitted for the default tenant"},
+								"resume":       map[string]any{"type": "string", "description": "resume token from a previous welcome"},
+								"since_seq":    map[string]any{"type": "integer", "description": "last seq seen; used with resume"},
+								"auth":         map[string]any{"type": "string", "description": "login token from POST /api/users/{username}/login; required for registered usernames without resume"},
+								"pow":          map[string]any{"type": "string", "description": "challenge from /api/challenge or a 428 reply; required without resume when the server sets a difficulty"},
+								"pow_solution": map[string]any{"type": "string", "description": "value s such that SHA-256(pow + \":\" + s) has the required leading zero bits"},
+								"mode":         map[string]any{"type": "string", "enum": []string{"observer"}, "description": "observer to watch the room read-only, unlisted and unannounced; anything sent is refused with an error of code read_only"},
+							},
+							"required": []string{"username", "room"},
+						},
+					},
+				},
+				"publish":   map[string]any{"message": map[string]any{"oneOf": publish}},
+				"subscribe": map[string]any{"message": map[string]any{"oneOf": subscribe}},
+			},
+		},
+		"components": map[string]any{
+			"schemas": map[string]any{
+				"Message":      schemaFor(reflect.TypeOf(Message{})),
+				"StatsMessage": schemaFor(reflect.TypeOf(StatsMessage{})),
+			},
+			"messages": messages,
+		},
+		"x-commands": commands,
+		"x-ordering": ordering,
+	}
+}
+
+// ordering states the guarantee enforced by Hub.publish.
+const ordering = "Chat in a room is totally ordered by seq, which the server assigns in the order messages are stored and sent. " +
+	"Each connection receives its room's chat messages in seq order with none missing, starting after the welcome's seq, or after since_seq on a resumed connection; " +
+	"after a resume, messages at or below the highest seq already seen are duplicates to drop. " +
+	"A jump in seq means messages were missed, as when a resume reaches further back than the server replays, " +
+	"or on a server in -echo test mode, where each connection sees only its own messages. " +
+	"Other message types are outside this order and may be delivered ahead of chat."
+
+var (
+	schemaOnce sync.Once
+	schemaDoc  map[string]any
+)
+
+func handleSchema(c *gin.Context) {
+	schemaOnce.Do(func() { schemaDoc = protocolSchema() })
+	c.JSON(200, schemaDoc)
+}
@@ -0,0 +1,20 @@
+//go:build !unix
+
+package main
+
+import (
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+)
+
+// waitForSignals blocks until interrupted. Listener handover needs Unix.
+func waitForSignals(srv *http.Server, ln net.Listener) {
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, os.Interrupt)
+	sig := <-sigs
+	log.Printf("Received %s, shutting down", sig)
+	drain(srv, "Server shutting down", false)
+}
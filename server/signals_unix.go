@@ -0,0 +1,34 @@
+//go:build unix
+
+package main
+
+import (
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// waitForSignals blocks until the server should exit. SIGUSR2 hands the
+// listener to a fresh process first; SIGINT and SIGTERM just shut down.
+func waitForSignals(srv *http.Server, ln net.Listener) {
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGUSR2, syscall.SIGINT, syscall.SIGTERM)
+
+	for sig := range sigs {
+		if sig == syscall.SIGUSR2 {
+			log.Println("Upgrade requested, starting new process")
+			if err := handover(ln); err != nil {
+				log.Printf("Upgrade failed, still serving: %v", err)
+				continue
+			}
+			drain(srv, "Server restarting, reconnecting...", true)
+			return
+		}
+		log.Printf("Received %s, shutting down", sig)
+		drain(srv, "Server shutting down", false)
+		return
+	}
+}
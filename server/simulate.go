@@ -0,0 +1,511 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"math/rand"
+	"os"
+	"runtime/debug"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// `server simulate` drives a hub with a seeded random schedule of joins,
+// leaves, messages, commands and moderation, with no network in between.
+// Clients are bare send queues, and their writers are simulated too: on
+// each tick of a virtual clock a fast reader drains its queue, a slow one
+// takes a message, and a stalled one takes nothing until its connection
+// times out. When a writer finds its queue closed the client unregisters a
+// random number of ticks later, as readPump would once the connection
+// fails, which leaves room for the window between a drop and its
+// unregister.
+//
+// Everything runs on one goroutine, and the hub reads a fake clock that
+// moves simTick each tick and numbers messages m-1, m-2 and so on, so a
+// seed always produces the same schedule, timestamps and IDs and a failure
+// reproduces exactly: rerun with the printed seed.
+// After every step the hub is checked against what the simulation expects:
+// no panic, the connection count matches, no unregistered client is still in
+// a room, and each client sees its room's chat in sequence order with no
+// gaps, starting after the seq of its welcome.
+//
+// With -concurrent the schedule gives way to real goroutines: clients join,
+// chat, run commands and leave while others are kicked or dropped, all at
+// once, through the hub's register and unregister channels. That run is not
+// reproducible; it is meant for the race detector, under which
+// broadcast_race_test.go runs it briefly next to a test of broadcasts to
+// clients that are disconnecting.
+
+type simWriter int
+
+const (
+	simFast simWriter = iota
+	simSlow
+	simStalled
+)
+
+// simClient is one simulated connection.
+type simClient struct {
+	*Client
+	writer  simWriter
+	gone    bool  // unregistered
+	leaveAt int   // tick its reader notices the closed queue, 0 if not yet
+	lastSeq int64 // last chat seq received, or the welcome's
+	closed  bool  // its send queue was closed by the hub
+}
+
+type simulation struct {
+	rng     *rand.Rand
+	hub     *Hub
+	clients []*simClient
+	tick    int
+	clock   *fakeClock
+	rooms   int
+	trace   []string
+	stats   map[string]int
+}
+
+func runSimulate(args []string) int {
+	fs := flag.NewFlagSet("simulate", flag.ContinueOnError)
+	seed := fs.Int64("seed", 1, "first seed")
+	seeds := fs.Int("seeds", 100, "number of seeds to run, from -seed up")
+	steps := fs.Int("steps", 2000, "steps per seed")
+	rooms := fs.Int("rooms", 4, "rooms clients pick from")
+	queue := fs.Int("send-queue", 8, "send queue length; small queues exercise slow-client drops")
+	verbose := fs.Bool("v", false, "keep the hub's logging")
+	concurrent := fs.Bool("concurrent", false, "run clients on goroutines instead of a seeded schedule")
+	workers := fs.Int("workers", 64, "with -concurrent, clients running at once")
+	duration := fs.Duration("duration", 5*time.Second, "with -concurrent, how long to run")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if !*verbose {
+		log.SetOutput(io.Discard)
+	}
+	cfg = Config{SendQueue: *queue, ControlQueue: *queue, ResumeSecret: "simulation", ResumeTTL: 1 << 62}
+	if *concurrent {
+		return runConcurrent(*workers, *rooms, *duration)
+	}
+
+	totals := map[string]int{}
+	for s := *seed; s < *seed+int64(*seeds); s++ {
+		sim := newSimulation(s, *rooms)
+		if err := sim.run(*steps); err != nil {
+			fmt.Fprintf(os.Stderr, "simulate: seed %d failed at tick %d: %v\n", s, sim.tick, err)
+			fmt.Fprintln(os.Stderr, "Last steps:")
+			for _, line := range sim.trace {
+				fmt.Fprintln(os.Stderr, "  "+line)
+			}
+			fmt.Fprintf(os.Stderr, "Reproduce with: server simulate -seed %d -seeds 1 -steps %d -rooms %d -send-queue %d\n",
+				s, *steps, *rooms, *queue)
+			return 1
+		}
+		for k, v := range sim.stats {
+			totals[k] += v
+		}
+	}
+	fmt.Printf("%d seeds passed, %d steps each: %d joins, %d leaves, %d messages, %d commands, %d drops, %d kicks\n",
+		*seeds, *steps, totals["join"], totals["leave"], totals["say"], totals["command"], totals["drop"], totals["kick"])
+	return 0
+}
+
+// simTick is how far the fake clock moves each tick, from simStart.
+const simTick = 100 * time.Millisecond
+
+var simStart = time.Date(2024, 1, 1, 9, 0, 0, 0, time.UTC)
+
+func newSimulation(seed int64, rooms int) *simulation {
+	hub := newHub(defaultTenant, newMemoryStore())
+	clock := newFakeClock(simStart)
+	hub.clock, hub.ids = clock, &sequentialIDs{}
+	return &simulation{
+		rng:   rand.New(rand.NewSource(seed)),
+		hub:   hub,
+		clock: clock,
+		rooms: rooms,
+		stats: map[string]int{},
+	}
+}
+
+const simTraceLen = 20
+
+func (s *simulation) logf(format string, args ...any) {
+	s.trace = append(s.trace, fmt.Sprintf("t=%d ", s.tick)+fmt.Sprintf(format, args...))
+	if len(s.trace) > simTraceLen {
+		s.trace = s.trace[1:]
+	}
+}
+
+// run performs steps random actions, then lets every client leave and
+// checks the hub is empty.
+func (s *simulation) run(steps int) (err error) {
+	defer func() {
+		if p := recover(); p != nil {
+			err = fmt.Errorf("panic: %v\n%s", p, debug.Stack())
+		}
+	}()
+	for i := 0; i < steps; i++ {
+		s.step()
+		if err := s.check(); err != nil {
+			return err
+		}
+	}
+
+	s.logf("everyone leaves")
+	for _, c := range s.live() {
+		s.leave(c)
+	}
+	for s.pending() {
+		s.advance()
+	}
+	if err := s.check(); err != nil {
+		return err
+	}
+	if n := s.hub.roomCount(); n != 0 {
+		return fmt.Errorf("%d rooms left after every client left", n)
+	}
+	return nil
+}
+
+// step takes one random action.
+func (s *simulation) step() {
+	live := s.live()
+	switch r := s.rng.Intn(100); {
+	case r < 15 || len(live) == 0:
+		s.join()
+	case r < 22:
+		s.leave(live[s.rng.Intn(len(live))])
+	case r < 62:
+		s.say(live[s.rng.Intn(len(live))])
+	case r < 70:
+		s.command(live[s.rng.Intn(len(live))])
+	case r < 72:
+		c := live[s.rng.Intn(len(live))]
+		s.logf("kick %s", c.Username)
+		s.stats["kick"]++
+		s.hub.kick(c.Username, "", "simulated kick")
+	case r < 73:
+		room := s.room()
+		s.logf("close room %s", room)
+		s.hub.closeRoom(room, "simulated close")
+	default:
+		s.advance()
+	}
+}
+
+func (s *simulation) room() string {
+	return fmt.Sprintf("room%d", s.rng.Intn(s.rooms))
+}
+
+func (s *simulation) join() {
+	id := len(s.clients)
+	c := &simClient{
+		Client: &Client{
+			ID:       fmt.Sprintf("sim-%d", id),
+			Username: fmt.Sprintf("user%d", s.rng.Intn(20)),
+			Room:     s.room(),
+			Send:     make(chan []byte, cfg.SendQueue),
+			Control:  make(chan []byte, cfg.ControlQueue),
+		},
+		writer: simWriter(s.rng.Intn(3)),
+	}
+	c.hub = s.hub
+	s.clients = append(s.clients, c)
+	s.logf("join %s as %s in %s (writer %d)", c.ID, c.Username, c.Room, c.writer)
+	s.stats["join"]++
+	s.hub.handleRegister(c.Client)
+}
+
+// leave unregisters c, as readPump does when its connection ends.
+func (s *simulation) leave(c *simClient) {
+	s.logf("leave %s", c.ID)
+	s.stats["leave"]++
+	c.gone = true
+	s.hub.handleUnregister(c.Client)
+}
+
+func (s *simulation) say(c *simClient) {
+	s.logf("%s says something in %s", c.ID, c.Room)
+	s.stats["say"]++
+	data, _ := json.Marshal(Message{Text: fmt.Sprintf("message %d", s.rng.Int())})
+	c.handleMessage(s.hub, data)
+}
+
+func (s *simulation) command(c *simClient) {
+	cmd := []string{"/users", "/stats", "/rooms", "/history 5"}[s.rng.Intn(4)]
+	s.logf("%s sends %s", c.ID, cmd)
+	s.stats["command"]++
+	data, _ := json.Marshal(Message{Text: cmd})
+	c.handleMessage(s.hub, data)
+}
+
+// advance moves the virtual clock one tick: writers drain their queues and
+// clients whose queues were closed unregister when their time comes.
+func (s *simulation) advance() {
+	s.tick++
+	s.clock.Advance(simTick)
+	s.logf("tick")
+	for _, c := range s.clients {
+		if c.gone {
+			continue
+		}
+		if c.leaveAt > 0 && s.tick >= c.leaveAt {
+			s.leave(c)
+			continue
+		}
+		if c.closed {
+			continue
+		}
+		if c.writer == simStalled {
+			// A stalled connection's writes eventually time out, which
+			// ends it whether or not the hub gave up on it first.
+			if c.leaveAt == 0 && s.rng.Intn(8) == 0 {
+				c.leaveAt = s.tick + 1
+			}
+			continue
+		}
+		budget := 1
+		if c.writer == simFast {
+			budget = cfg.SendQueue + cfg.ControlQueue + 1
+		}
+		for i := 0; i < budget && s.receive(c); i++ {
+		}
+	}
+}
+
+// receive takes one message off c's queues, control lane first, and reports
+// whether it got one.
+func (s *simulation) receive(c *simClient) bool {
+	if data, ok := c.nextControl(); ok {
+		var msg Message
+		if json.Unmarshal(data, &msg) == nil && msg.Type == MsgWelcome {
+			c.lastSeq = msg.Seq
+		}
+		return true
+	}
+	select {
+	case data, ok := <-c.Send:
+		if !ok {
+			s.closedBy(c)
+			return false
+		}
+		var msg Message
+		if json.Unmarshal(data, &msg) == nil && msg.Type == MsgChat {
+			if msg.Seq != c.lastSeq+1 {
+				panic(fmt.Sprintf("%s got seq %d after %d in %s", c.ID, msg.Seq, c.lastSeq, msg.Room))
+			}
+			c.lastSeq = msg.Seq
+		}
+		return true
+	default:
+		return false
+	}
+}
+
+// closedBy records that the hub closed c's queue; its reader unregisters a
+// few ticks later.
+func (s *simulation) closedBy(c *simClient) {
+	c.closed = true
+	c.leaveAt = s.tick + 1 + s.rng.Intn(3)
+	s.logf("%s queue closed by the hub", c.ID)
+	s.stats["drop"]++
+}
+
+func (s *simulation) live() []*simClient {
+	var out []*simClient
+	for _, c := range s.clients {
+		if !c.gone {
+			out = append(out, c)
+		}
+	}
+	return out
+}
+
+// pending reports whether any client still has to unregister.
+func (s *simulation) pending() bool {
+	for _, c := range s.clients {
+		if !c.gone {
+			return true
+		}
+	}
+	return false
+}
+
+// check compares the hub with the simulation's view of it.
+func (s *simulation) check() error {
+	registered := 0
+	for _, c := range s.clients {
+		if !c.gone {
+			registered++
+		}
+	}
+	if n := s.hub.clientCount(); n != int64(registered) {
+		return fmt.Errorf("hub counts %d connections, %d are registered", n, registered)
+	}
+
+	var errs []string
+	for _, room := range s.hub.roomList() {
+		room.mu.RLock()
+		for client := range room.Clients {
+			for _, c := range s.clients {
+				if c.Client == client && c.gone {
+					errs = append(errs, fmt.Sprintf("%s unregistered but still in %s", c.ID, room.Name))
+				}
+			}
+		}
+		room.mu.RUnlock()
+	}
+	if len(errs) > 0 {
+		return errors.New(strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+// runConcurrent has workers goroutines join, chat and leave until duration
+// is up, each as a fresh connection every time round, while one more kicks
+// users and closes rooms. Then it checks the hub is empty.
+func runConcurrent(workers, rooms int, duration time.Duration) int {
+	hub := newHub(defaultTenant, newMemoryStore())
+	go hub.run()
+
+	var (
+		wg      sync.WaitGroup
+		stop    atomic.Bool
+		ops     atomic.Int64
+		drops   atomic.Int64
+		failure atomic.Value
+	)
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			defer func() {
+				if p := recover(); p != nil {
+					failure.Store(fmt.Sprintf("worker %d: panic: %v\n%s", w, p, debug.Stack()))
+					stop.Store(true)
+				}
+			}()
+			rng := rand.New(rand.NewSource(int64(w)))
+			for n := 0; !stop.Load(); n++ {
+				if concurrentSession(hub, rng, fmt.Sprintf("w%d-%d", w, n), rooms, &stop) {
+					drops.Add(1)
+				}
+				ops.Add(1)
+			}
+		}(w)
+	}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		rng := rand.New(rand.NewSource(-1))
+		for !stop.Load() {
+			if rng.Intn(4) == 0 {
+				hub.closeRoom(fmt.Sprintf("room%d", rng.Intn(rooms)), "simulated close")
+			} else {
+				hub.kick(fmt.Sprintf("user%d", rng.Intn(20)), "", "simulated kick")
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}()
+
+	time.Sleep(duration)
+	stop.Store(true)
+	wg.Wait()
+
+	if f := failure.Load(); f != nil {
+		fmt.Fprintln(os.Stderr, "simulate:", f)
+		return 1
+	}
+	settle(hub, 5*time.Second)
+	if n := hub.clientCount(); n != 0 {
+		fmt.Fprintf(os.Stderr, "simulate: %d connections left after every client left\n", n)
+		return 1
+	}
+	if n := hub.roomCount(); n != 0 {
+		fmt.Fprintf(os.Stderr, "simulate: %d rooms left after every client left\n", n)
+		return 1
+	}
+	fmt.Printf("%d sessions on %d workers in %v, %d dropped or kicked\n", ops.Load(), workers, duration, drops.Load())
+	return 0
+}
+
+// settle waits up to d for hub to have no connections or rooms left.
+// unregisterClient returns once the hub has taken a client, before it has
+// handled it, so the counts lag the last unregisters a little.
+func settle(hub *Hub, d time.Duration) {
+	for deadline := time.Now().Add(d); hub.clientCount() != 0 || hub.roomCount() != 0; {
+		if time.Now().After(deadline) {
+			return
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// concurrentSession is one connection: it registers, has a reader drain its
+// queue, or stall, sends a few messages and commands, and unregisters once it
+// is done or the hub hung it up. It reports whether the hub hung it up.
+func concurrentSession(hub *Hub, rng *rand.Rand, id string, rooms int, stop *atomic.Bool) bool {
+	c := &Client{
+		ID:       id,
+		Username: fmt.Sprintf("user%d", rng.Intn(20)),
+		Room:     fmt.Sprintf("room%d", rng.Intn(rooms)),
+		Send:     make(chan []byte, cfg.SendQueue),
+		Control:  make(chan []byte, cfg.ControlQueue),
+		hub:      hub,
+	}
+	hungUp := make(chan struct{})
+	stalled := rng.Intn(4) == 0
+	go func() {
+		// The reader, as writePump: it sees the queue close when the hub
+		// hangs up, and a stalled one only notices at the end.
+		if stalled {
+			<-hungUp
+		}
+		for {
+			select {
+			case <-c.Control:
+				continue
+			case _, ok := <-c.Send:
+				if ok {
+					continue
+				}
+			}
+			break
+		}
+		if !stalled {
+			close(hungUp)
+		}
+	}()
+
+	hub.registerClient(c)
+	dropped := false
+	for i := rng.Intn(20); i > 0 && !stop.Load(); i-- {
+		if !stalled {
+			select {
+			case <-hungUp:
+				dropped = true
+			default:
+			}
+			if dropped {
+				break
+			}
+		}
+		text := fmt.Sprintf("message %d", i)
+		if rng.Intn(5) == 0 {
+			text = []string{"/users", "/stats", "/rooms", "/history 5"}[rng.Intn(4)]
+		}
+		data, _ := json.Marshal(Message{Text: text})
+		c.handleMessage(hub, data)
+	}
+	hub.unregisterClient(c)
+	if stalled {
+		close(hungUp)
+	}
+	return dropped
+}
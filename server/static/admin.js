@@ -0,0 +1,222 @@
+// admin.js drives the /admin dashboard through the admin API.
+
+const refreshInterval = 2000;
+const maxEvents = 200;
+
+let token = sessionStorage.getItem('admin.token') || '';
+let tenant = sessionStorage.getItem('admin.tenant') || '';
+let refreshTimer = null;
+let events = null;
+
+const loginScreen = document.getElementById('loginScreen');
+const dashboard = document.getElementById('dashboard');
+const tokenInput = document.getElementById('tokenInput');
+const tenantInput = document.getElementById('tenantInput');
+const loginError = document.getElementById('loginError');
+const adminError = document.getElementById('adminError');
+const roomsDiv = document.getElementById('rooms');
+const eventsDiv = document.getElementById('events');
+const announceText = document.getElementById('announceText');
+const announceRoom = document.getElementById('announceRoom');
+
+document.getElementById('signInBtn').addEventListener('click', signIn);
+tokenInput.addEventListener('keypress', (e) => {
+    if (e.key === 'Enter') signIn();
+});
+document.getElementById('announceBtn').addEventListener('click', announce);
+announceText.addEventListener('keypress', (e) => {
+    if (e.key === 'Enter') announce();
+});
+
+if (token) start();
+
+// api calls the admin API and returns the decoded reply, throwing the
+// server's error message on failure.
+async function api(method, path, body) {
+    const query = tenant ? `?tenant=${encodeURIComponent(tenant)}` : '';
+    const res = await fetch(`/api/admin${path}${query}`, {
+        method,
+        headers: { 'Authorization': `Bearer ${token}`, 'Content-Type': 'application/json' },
+        body: body ? JSON.stringify(body) : undefined
+    });
+    const data = await res.json().catch(() => ({}));
+    if (!res.ok) {
+        const err = new Error(data.error || res.statusText);
+        err.status = res.status;
+        throw err;
+    }
+    return data;
+}
+
+function signIn() {
+    token = tokenInput.value.trim();
+    tenant = tenantInput.value.trim();
+    if (!token) return;
+    start();
+}
+
+function start() {
+    refresh().then(() => {
+        sessionStorage.setItem('admin.token', token);
+        sessionStorage.setItem('admin.tenant', tenant);
+        loginError.textContent = '';
+        loginScreen.classList.add('hidden');
+        dashboard.classList.remove('hidden');
+        refreshTimer = setInterval(refresh, refreshInterval);
+        openEvents();
+    }).catch((err) => {
+        loginError.textContent = err.message;
+        token = '';
+    });
+}
+
+function signOut() {
+    clearInterval(refreshTimer);
+    sessionStorage.removeItem('admin.token');
+    token = '';
+    if (events) {
+        events.onclose = null;
+        events.close();
+        events = null;
+    }
+    eventsDiv.innerHTML = '';
+    dashboard.classList.add('hidden');
+    loginScreen.classList.remove('hidden');
+}
+
+async function refresh() {
+    let rooms;
+    try {
+        rooms = await api('GET', '/rooms');
+    } catch (err) {
+        if (err.status === 401 || err.status === 403) {
+            if (refreshTimer) signOut();
+            throw err;
+        }
+        adminError.textContent = err.message;
+        return;
+    }
+    adminError.textContent = '';
+    render(rooms);
+}
+
+function render(rooms) {
+    const members = rooms.reduce((n, r) => n + r.members, 0);
+    document.getElementById('summary').textContent =
+        `${rooms.length} room${rooms.length !== 1 ? 's' : ''}, ${members} connection${members !== 1 ? 's' : ''}`;
+    document.getElementById('updated').textContent = new Date().toLocaleTimeString('en-US', { hour12: false });
+
+    const selected = announceRoom.value;
+    announceRoom.innerHTML = '<option value="">All rooms</option>' +
+        rooms.map((r) => `<option>${escapeHtml(r.name)}</option>`).join('');
+    announceRoom.value = rooms.some((r) => r.name === selected) ? selected : '';
+
+    if (rooms.length === 0) {
+        roomsDiv.innerHTML = '<div class="admin-empty">No live rooms</div>';
+        return;
+    }
+    roomsDiv.innerHTML = rooms.map((r) => `
+        <div class="admin-room">
+            <div class="admin-room-header">
+                <h2># ${escapeHtml(r.name)}</h2>
+                <span>${r.members} member${r.members !== 1 ? 's' : ''} · ${r.messages_per_minute} msg/min · seq ${r.last_seq} · ${formatBytes(r.bytes_sent)} sent</span>
+                <button class="btn-action btn-leave" data-room="${escapeHtml(r.name)}" onclick="closeRoom(this.dataset.room)">Close room</button>
+            </div>
+            <table class="admin-table">
+                <tr><th>User</th><th>Connected</th><th>Link</th><th>Send queue</th><th>Sent</th><th></th></tr>
+                ${r.connections.map((c) => `
+                    <tr>
+                        <td>${escapeHtml(c.username)}${c.resumed ? ' <span class="admin-tag">resumed</span>' : ''}</td>
+                        <td>${new Date(c.connected).toLocaleTimeString('en-US', { hour12: false })}</td>
+                        <td><span class="quality quality-${c.quality}">${c.quality}</span>${c.rtt_ms ? ` · ${c.rtt_ms} ms` : ''}</td>
+                        <td>
+                            <div class="queue-bar"><div style="width: ${Math.round(100 * c.queue / c.queue_cap)}%"></div></div>
+                            ${c.queue} / ${c.queue_cap}
+                        </td>
+                        <td>
+                            ${formatBytes(c.bytes_sent)} · ${formatBytes(c.bytes_per_second)}/s
+                            ${c.throttled ? ` <span class="admin-tag">${c.throttled} throttled</span>` : ''}
+                        </td>
+                        <td><button class="btn-action btn-stats" data-user="${escapeHtml(c.username)}" data-room="${escapeHtml(r.name)}"
+                            onclick="kick(this.dataset.user, this.dataset.room)">Kick</button></td>
+                    </tr>
+                `).join('')}
+            </table>
+        </div>
+    `).join('');
+}
+
+// openEvents follows the /ws/admin event stream, reconnecting while signed
+// in. Membership changes refresh the room list straight away.
+function openEvents() {
+    let url = `${location.protocol === 'https:' ? 'wss' : 'ws'}://${location.host}/ws/admin?token=${encodeURIComponent(token)}`;
+    if (tenant) url += `&tenant=${encodeURIComponent(tenant)}`;
+    events = new WebSocket(url);
+    events.onmessage = (e) => {
+        const ev = JSON.parse(e.data);
+        showEvent(ev);
+        if (['join', 'leave', 'drop', 'user.kick', 'room.close'].includes(ev.kind)) refresh();
+    };
+    events.onclose = () => {
+        if (token) setTimeout(openEvents, refreshInterval);
+    };
+}
+
+function showEvent(ev) {
+    const line = document.createElement('div');
+    const moderation = ev.kind !== 'join' && ev.kind !== 'leave';
+    line.className = `admin-event${moderation ? ' moderation' : ''}`;
+    const where = [ev.tenant && `${ev.tenant}/`, ev.room && `#${ev.room}`].filter(Boolean).join('');
+    line.textContent = [
+        new Date(ev.time).toLocaleTimeString('en-US', { hour12: false }),
+        ev.kind,
+        where,
+        ev.username,
+        ev.actor && `by ${ev.actor}`,
+        ev.detail
+    ].filter(Boolean).join('  ');
+    eventsDiv.prepend(line);
+    while (eventsDiv.childElementCount > maxEvents) eventsDiv.lastChild.remove();
+}
+
+async function act(confirmText, method, path, body) {
+    if (confirmText && !confirm(confirmText)) return;
+    try {
+        await api(method, path, body);
+        await refresh();
+    } catch (err) {
+        adminError.textContent = err.message;
+    }
+}
+
+function kick(user, room) {
+    const reason = prompt(`Kick ${user} from #${room}? Reason shown to them:`, 'You were removed by an admin.');
+    if (reason === null) return;
+    act('', 'POST', `/users/${encodeURIComponent(user)}/kick`, { room, reason });
+}
+
+function closeRoom(room) {
+    act(`Close #${room} and disconnect everyone in it?`, 'POST', `/rooms/${encodeURIComponent(room)}/close`);
+}
+
+function announce() {
+    const text = announceText.value.trim();
+    if (!text) return;
+    const room = announceRoom.value;
+    act('', 'POST', '/announce', { text, room }).then(() => {
+        announceText.value = '';
+    });
+}
+
+// formatBytes renders a byte count as B, KB or MB.
+function formatBytes(n) {
+    if (n < 1024) return `${n} B`;
+    if (n < 1024 * 1024) return `${(n / 1024).toFixed(1)} KB`;
+    return `${(n / 1024 / 1024).toFixed(1)} MB`;
+}
+
+function escapeHtml(text) {
+    const div = document.createElement('div');
+    div.textContent = text;
+    return div.innerHTML;
+}
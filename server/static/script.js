@@ -4,21 +4,31 @@ let ws = null;
 let username = '';
 let room = '';
 let currentStats = null;
+let resumeToken = ''; // from the welcome message; authorizes uploads
+let recorder = null;  // MediaRecorder while a voice clip is being recorded
+const mentionedIds = new Set(); // mentions that arrived before their message
+const receipts = new Map(); // reader -> {id, state} of the latest own message they got to
+let unreadSeq = 0; // latest chat from others not yet seen with the tab visible
 
 const loginScreen = document.getElementById('loginScreen');
 const chatScreen = document.getElementById('chatScreen');
 const usernameInput = document.getElementById('usernameInput');
 const roomInput = document.getElementById('roomInput');
+const passwordInput = document.getElementById('passwordInput');
+const registerInput = document.getElementById('registerInput');
 const joinBtn = document.getElementById('joinBtn');
 const messageInput = document.getElementById('messageInput');
 const sendBtn = document.getElementById('sendBtn');
+const recordBtn = document.getElementById('recordBtn');
 const messagesContainer = document.getElementById('messagesContainer');
 const roomNameSpan = document.getElementById('roomName');
+const historyBadge = document.getElementById('historyBadge');
 const currentUserSpan = document.getElementById('currentUser');
 
 // Event Listeners
 joinBtn.addEventListener('click', connectWebSocket);
 sendBtn.addEventListener('click', sendMessage);
+recordBtn.addEventListener('click', toggleRecording);
 messageInput.addEventListener('keypress', (e) => {
     if (e.key === 'Enter') sendMessage();
 });
@@ -28,8 +38,24 @@ usernameInput.addEventListener('keypress', (e) => {
 roomInput.addEventListener('keypress', (e) => {
     if (e.key === 'Enter') connectWebSocket();
 });
+passwordInput.addEventListener('keypress', (e) => {
+    if (e.key === 'Enter') connectWebSocket();
+});
+
+// Shared /r/<room> links open the UI ready to join that room, straight away
+// if a username was remembered from an earlier visit.
+const linkMatch = location.pathname.match(/^\/r\/([^/]+)\/?$/);
+if (linkMatch) {
+    roomInput.value = decodeURIComponent(linkMatch[1]);
+    usernameInput.value = localStorage.getItem('chat.username') || '';
+    if (usernameInput.value) {
+        connectWebSocket();
+    } else {
+        usernameInput.focus();
+    }
+}
 
-function connectWebSocket() {
+async function connectWebSocket() {
     username = usernameInput.value.trim();
     room = roomInput.value.trim();
 
@@ -41,8 +67,25 @@ function connectWebSocket() {
     joinBtn.innerHTML = '<span class="spinner"></span>Connecting...';
     joinBtn.disabled = true;
 
-const wsUrl = `${location.protocol === "https:" ? "wss" : "ws"}://${location.host}/ws?username=${encodeURIComponent(username)}&room=${encodeURIComponent(room)}`;
-    ws = new WebSocket(wsUrl);
+let wsUrl = `${location.protocol === "https:" ? "wss" : "ws"}://${location.host}/ws?username=${encodeURIComponent(username)}&room=${encodeURIComponent(room)}`;
+    // Multi-tenant servers are reached with ?tenant=<name> on the page URL
+    const tenant = new URLSearchParams(location.search).get('tenant');
+    if (tenant) wsUrl += `&tenant=${encodeURIComponent(tenant)}`;
+    try {
+        wsUrl += await login(tenant);
+    } catch (err) {
+        alert(err.message);
+        joinBtn.innerHTML = 'Join Room';
+        joinBtn.disabled = false;
+        return;
+    }
+    try {
+        wsUrl += await proofOfWork();
+    } catch (err) {
+        console.error('Proof of work failed:', err);
+    }
+    // chat.v2 sends joins, leaves and topic changes as typed events
+    ws = new WebSocket(wsUrl, ['chat.v2']);
 
     ws.onopen = () => {
         console.log('Connected to chatroom');
@@ -51,17 +94,30 @@ const wsUrl = `${location.protocol === "https:" ? "wss" : "ws"}://${location.hos
         roomNameSpan.textContent = room;
         currentUserSpan.textContent = username;
         addSystemMessage(`Connected to room '${room}'`);
+        localStorage.setItem('chat.username', username);
+        // Keep the address bar a shareable link to the room
+        history.replaceState(null, '', `/r/${encodeURIComponent(room)}${location.search}`);
     };
 
     ws.onmessage = (event) => {
         try {
-            const msg = JSON.parse(event.data);
+            const data = JSON.parse(event.data);
+            // Under load the server batches several messages into one array frame
+            const batch = Array.isArray(data) ? data : [data];
 
-            if (msg.type === 'stats') {
-                currentStats = JSON.parse(msg.text);
-            }
+            for (const msg of batch) {
+                if (msg.type === 'stats') {
+                    currentStats = JSON.parse(msg.text);
+                }
+                if (msg.type === 'welcome') {
+                    resumeToken = msg.resume_token;
+                }
+                if (msg.type === 'chat' && msg.seq && msg.username !== username && !msg.integration) {
+                    acknowledge(msg.seq);
+                }
 
-            displayMessage(msg);
+                displayMessage(msg);
+            }
         } catch (err) {
             console.error('Error parsing message:', err);
         }
@@ -74,6 +130,9 @@ const wsUrl = `${location.protocol === "https:" ? "wss" : "ws"}://${location.hos
     };
 
     ws.onclose = () => {
+        if (chatScreen.classList.contains('hidden') && !passwordInput.value) {
+            alert('Could not join. If this username is registered, enter its password.');
+        }
         console.log('Disconnected from chatroom');
         addSystemMessage('Disconnected from server');
         joinBtn.innerHTML = 'Join Room';
@@ -81,6 +140,52 @@ const wsUrl = `${location.protocol === "https:" ? "wss" : "ws"}://${location.hos
     };
 }
 
+// login exchanges the password, if one was entered, for a login token, first
+// registering the username if asked to, and returns the query parameter
+// carrying the token.
+async function login(tenant) {
+    const password = passwordInput.value;
+    if (!password) return '';
+    const action = registerInput.checked ? 'register' : 'login';
+    const query = tenant ? `?tenant=${encodeURIComponent(tenant)}` : '';
+    const res = await fetch(`/api/users/${encodeURIComponent(username)}/${action}${query}`, {
+        method: 'POST',
+        headers: { 'Content-Type': 'application/json' },
+        body: JSON.stringify({ password }),
+    });
+    const reply = await res.json().catch(() => ({}));
+    if (!res.ok) throw new Error(`Could not ${action}: ${reply.error || res.statusText}`);
+    registerInput.checked = false;
+    return `&auth=${encodeURIComponent(reply.token)}`;
+}
+
+// proofOfWork solves the server's join challenge, if it sets one, and
+// returns the query parameters carrying the solution.
+async function proofOfWork() {
+    const res = await fetch('/api/challenge');
+    const { challenge, difficulty } = await res.json();
+    if (!difficulty) return '';
+
+    joinBtn.innerHTML = '<span class="spinner"></span>Verifying...';
+    const encoder = new TextEncoder();
+    for (let n = 0; ; n++) {
+        const solution = n.toString(36);
+        const digest = new Uint8Array(await crypto.subtle.digest('SHA-256', encoder.encode(`${challenge}:${solution}`)));
+        if (zeroBits(digest) >= difficulty) {
+            return `&pow=${encodeURIComponent(challenge)}&pow_solution=${solution}`;
+        }
+    }
+}
+
+function zeroBits(bytes) {
+    let n = 0;
+    for (const b of bytes) {
+        if (b !== 0) return n + Math.clz32(b) - 24;
+        n += 8;
+    }
+    return n;
+}
+
 function sendMessage() {
     const text = messageInput.value.trim();
     if (!text || !ws) return;
@@ -90,6 +195,22 @@ function sendMessage() {
     messageInput.value = '';
 }
 
+// acknowledge tells the server chat up to seq arrived and, if the tab is
+// visible, that it was read; the author sees it in small rooms.
+function acknowledge(seq) {
+    ws.send(JSON.stringify({ type: 'receipt', text: 'delivered', seq: seq }));
+    unreadSeq = seq;
+    markRead();
+}
+
+function markRead() {
+    if (!ws || !unreadSeq || document.visibilityState !== 'visible') return;
+    ws.send(JSON.stringify({ type: 'receipt', text: 'read', seq: unreadSeq }));
+    unreadSeq = 0;
+}
+
+document.addEventListener('visibilitychange', markRead);
+
 function sendCommand(cmd) {
     if (!ws) return;
     const msg = { text: cmd };
@@ -105,6 +226,23 @@ function disconnect() {
     loginScreen.classList.remove('hidden');
     messagesContainer.innerHTML = '';
     currentStats = null;
+    receipts.clear();
+    unreadSeq = 0;
+    historyBadge.classList.add('hidden');
+    historyBadge.textContent = 'history off';
+}
+
+// showInvite shows the room's invite link with its QR code, for others to
+// scan from the screen.
+function showInvite() {
+    const tenant = new URLSearchParams(location.search).get('tenant');
+    const query = tenant ? `?tenant=${encodeURIComponent(tenant)}` : '';
+    const path = `/r/${encodeURIComponent(room)}`;
+    displayMessage({
+        type: 'invite',
+        text: location.origin + path + query,
+        qr: `${path}/qr.png${query}`
+    });
 }
 
 function addSystemMessage(text) {
@@ -116,6 +254,21 @@ function addSystemMessage(text) {
     });
 }
 
+// roomEventText is the notice shown for a room event, or for the topic in a
+// welcome; empty for a welcome to a room without one.
+function roomEventText(msg) {
+    switch (msg.type) {
+        case 'user_joined':
+            return `${msg.username} joined the room`;
+        case 'user_left':
+            return `${msg.username} left the room`;
+        case 'topic_changed':
+            return msg.topic ? `Topic: ${msg.topic}` : 'The topic was cleared';
+        default:
+            return msg.topic ? `Topic: ${msg.topic}` : '';
+    }
+}
+
 function displayMessage(msg) {
     const messageDiv = document.createElement('div');
     messageDiv.className = 'message';
@@ -123,17 +276,121 @@ function displayMessage(msg) {
     switch (msg.type) {
         case 'chat':
             const isOwn = msg.username === username;
+            if (msg.id) messageDiv.dataset.id = msg.id;
             messageDiv.innerHTML = `
                 <div class="message-chat ${isOwn ? 'own' : ''}">
-                    <div class="message-bubble ${isOwn ? 'own' : 'other'}">
-                        <div class="message-meta">${msg.username} · ${msg.time}</div>
-                        <div class="message-text">${escapeHtml(msg.text)}</div>
+                    <div class="message-bubble ${isOwn ? 'own' : 'other'}${mentionedIds.delete(msg.id) ? ' mentioned' : ''}${msg.integration ? ' integration' : ''}">
+                        <div class="message-meta">${msg.username}${msg.integration ? ' <span class="integration-badge" title="Posted by an integration">bot</span>' : ''}${msg.unverified ? ' <span class="unverified-badge" title="This username is not registered">unverified</span>' : ''}${msg.unsaved ? ' <span class="unsaved-badge" title="Not saved to the room\'s history">unsaved</span>' : ''} · ${msg.time}${msg.id ? ' <button class="pin-btn" title="Pin this message">📌</button>' : ''}</div>
+                        ${msg.forwarded ? forwardedFrom(msg.forwarded) : ''}
+                        <div class="message-text${msg.redacted ? ' redacted' : ''}">${msg.attachment ? audioClip(msg.attachment) : withEmoji(escapeHtml(msg.text), msg.emoji)}</div>
                     </div>
                 </div>
             `;
+            const pinBtn = messageDiv.querySelector('.pin-btn');
+            if (pinBtn) pinBtn.addEventListener('click', () => sendCommand('/pin ' + msg.id));
+            break;
+
+        case 'pinned':
+        case 'unpinned': {
+            const bubble = messagesContainer.querySelector(`[data-id="${CSS.escape(msg.id)}"] .message-bubble`);
+            if (bubble) bubble.classList.toggle('pinned', msg.type === 'pinned');
+            let text = `${escapeHtml(msg.username)} unpinned a message`;
+            if (msg.type === 'pinned') {
+                const pin = JSON.parse(msg.text);
+                text = `📌 ${escapeHtml(msg.username)} pinned ${escapeHtml(pin.author)}: ${escapeHtml(pin.text)}`;
+            } else if (msg.text === 'expired') {
+                text = 'A pin expired';
+            }
+            messageDiv.innerHTML = `
+                <div class="message-system">
+                    <span class="system-badge">${msg.time} · ${text}</span>
+                </div>
+            `;
             break;
+        }
+
+        case 'pins': {
+            let pins = [];
+            try {
+                pins = JSON.parse(msg.text) || [];
+            } catch (e) {
+                console.error("Invalid pins JSON:", msg.text);
+            }
+            const rows = pins.map((p) =>
+                `<div class="stat-row"><span>${escapeHtml(p.author)}:</span><span>${escapeHtml(p.text)}</span></div>`).join('');
+            messageDiv.innerHTML = `
+                <div class="message-info info-rooms">
+                    <div class="info-title">📌 Pinned messages</div>
+                    <div class="info-content">${rows || '<div>Nothing pinned</div>'}</div>
+                </div>
+            `;
+            break;
+        }
+
+        case 'quality': {
+            let reports = [];
+            try {
+                reports = JSON.parse(msg.text) || [];
+            } catch (e) {
+                console.error("Invalid quality JSON:", msg.text);
+            }
+            const rows = reports.map((r) =>
+                `<div class="stat-row"><span>${escapeHtml(r.username)}:</span><span><span class="quality quality-${r.quality}">${r.quality}</span>${r.rtt_ms ? ` · ${r.rtt_ms} ms` : ''}${r.stalls ? ` · ${r.stalls} stalls` : ''}${r.drops ? ` · ${r.drops} dropped` : ''}</span></div>`).join('');
+            messageDiv.innerHTML = `
+                <div class="message-info info-rooms">
+                    <div class="info-title">📶 Connection quality</div>
+                    <div class="info-content">${rows}</div>
+                </div>
+            `;
+            break;
+        }
+
+        case 'redacted': {
+            // Replace the original in place rather than adding a new line
+            const original = messagesContainer.querySelector(`[data-id="${CSS.escape(msg.id)}"] .message-text`);
+            if (original) {
+                original.textContent = msg.text;
+                original.classList.add('redacted');
+            }
+            return;
+        }
+
+        case 'receipt': {
+            // Move the reader's mark to the message it names, updating
+            // both labels, rather than adding a line
+            const prev = receipts.get(msg.username);
+            if (prev && prev.id === msg.id && prev.state === 'read') return;
+            receipts.set(msg.username, { id: msg.id, state: msg.text });
+            if (prev) showReceipts(prev.id);
+            showReceipts(msg.id);
+            return;
+        }
+
+        case 'history_mode': {
+            // The room's own mode shows in the header; members going
+            // incognito show as a notice
+            const off = msg.text === 'off';
+            let text;
+            if (!msg.username) {
+                historyBadge.classList.toggle('hidden', !off);
+                text = off ? 'History is off: messages in this room are not saved' : 'History is on: messages are saved again';
+            } else if (msg.username === username) {
+                historyBadge.textContent = off ? 'incognito' : 'history off';
+                historyBadge.classList.toggle('hidden', !off);
+                text = off ? 'You are incognito: your messages are not saved' : 'Your messages are saved again';
+            } else {
+                text = off ? `${escapeHtml(msg.username)} went incognito: their messages are not saved` : `${escapeHtml(msg.username)}'s messages are saved again`;
+            }
+            messageDiv.innerHTML = `
+                <div class="message-system">
+                    <span class="system-badge">${msg.time} · ${text}</span>
+                </div>
+            `;
+            break;
+        }
 
         case 'system':
+        case 'error':
             messageDiv.innerHTML = `
                 <div class="message-system">
                     <span class="system-badge">${msg.time ? msg.time + ' · ' : ''}${escapeHtml(msg.text)}</span>
@@ -141,6 +398,40 @@ function displayMessage(msg) {
             `;
             break;
 
+        case 'welcome':
+        case 'user_joined':
+        case 'user_left':
+        case 'topic_changed': {
+            const text = roomEventText(msg);
+            if (!text) return;
+            messageDiv.innerHTML = `
+                <div class="message-system">
+                    <span class="system-badge">${msg.time ? msg.time + ' · ' : ''}${escapeHtml(text)}</span>
+                </div>
+            `;
+            break;
+        }
+
+        case 'kicked':
+            messageDiv.innerHTML = `
+                <div class="message-system">
+                    <span class="system-badge">${msg.time ? msg.time + ' · ' : ''}Disconnected by a moderator: ${escapeHtml(msg.text)}</span>
+                </div>
+            `;
+            break;
+
+        case 'invite':
+            messageDiv.innerHTML = `
+                <div class="message-info info-invite">
+                    <div class="info-title">📱 Invite others to ${escapeHtml(room)}</div>
+                    <div class="info-content">
+                        <img class="invite-qr" src="${escapeHtml(msg.qr)}" alt="QR code of the invite link">
+                        <div>${escapeHtml(msg.text)}</div>
+                    </div>
+                </div>
+            `;
+            break;
+
         case 'user_list':
             messageDiv.innerHTML = `
                 <div class="message-info info-users">
@@ -176,6 +467,137 @@ function displayMessage(msg) {
             break;
         }
 
+        case 'groups': {
+            let groupsHtml = '';
+            try {
+                const groups = JSON.parse(msg.text); // { group: [members] }
+                for (const [name, members] of Object.entries(groups)) {
+                    groupsHtml += `
+                        <div class="stat-row">
+                            <span>@${escapeHtml(name)}:</span>
+                            <span class="stat-label">${escapeHtml(members.join(', '))}</span>
+                        </div>
+                    `;
+                }
+            } catch (e) {
+                groupsHtml = `<div class="error">❌ Failed to parse group data</div>`;
+            }
+            if (!groupsHtml) {
+                groupsHtml = '<div>No groups defined</div>';
+            }
+
+            messageDiv.innerHTML = `
+                <div class="message-info info-rooms">
+                    <div class="info-title">@ Groups</div>
+                    <div class="info-content">${groupsHtml}</div>
+                </div>
+            `;
+            break;
+        }
+
+        case 'mention': {
+            // A mention in this room marks the message's line instead. It
+            // can overtake the message, which then marks itself.
+            if (msg.room === room) {
+                const line = messagesContainer.querySelector(`[data-id="${CSS.escape(msg.id)}"] .message-bubble`);
+                if (line) line.classList.add('mentioned');
+                else mentionedIds.add(msg.id);
+                return;
+            }
+            const who = msg.group ? `@${escapeHtml(msg.group)}` : 'you';
+            messageDiv.innerHTML = `
+                <div class="message-system">
+                    <span class="system-badge mention-badge">${msg.time} · ${escapeHtml(msg.username)} mentioned ${who} in #${escapeHtml(msg.room)}: ${escapeHtml(msg.text)}</span>
+                </div>
+            `;
+            break;
+        }
+
+        case 'digest': {
+            let d = null;
+            try {
+                d = JSON.parse(msg.text);
+            } catch (e) {
+                console.error("Invalid digest JSON:", msg.text);
+            }
+            if (!d) break;
+            const users = d.top_users.map((u) =>
+                `<div class="stat-row"><span>${escapeHtml(u.name)}</span><span>${u.count}</span></div>`).join('');
+            const links = d.top_links.map((l) => {
+                const href = escapeHtml(l.name).replace(/"/g, '&quot;');
+                return `<div class="stat-row"><a href="${href}" target="_blank" rel="noopener">${escapeHtml(l.name)}</a><span>${l.count}</span></div>`;
+            }).join('');
+            messageDiv.innerHTML = `
+                <div class="message-info info-stats">
+                    <div class="info-title">📰 Digest of #${escapeHtml(d.room)}: ${d.messages} messages</div>
+                    <div class="info-content">${users}${links}</div>
+                </div>
+            `;
+            break;
+        }
+
+        case 'prefs': {
+            let p = {};
+            try {
+                p = JSON.parse(msg.text);
+            } catch (e) {
+                console.error("Invalid prefs JSON:", msg.text);
+            }
+            const muted = (p.muted_rooms || []).map((r) => '#' + escapeHtml(r)).join(', ') || 'none';
+            messageDiv.innerHTML = `
+                <div class="message-info info-rooms">
+                    <div class="info-title">🔔 Notification preferences</div>
+                    <div class="info-content">
+                        <div class="stat-row"><span>Mentions by name only:</span><span>${p.mentions_only ? 'on' : 'off'}</span></div>
+                        <div class="stat-row"><span>Muted rooms:</span><span>${muted}</span></div>
+                        <div class="stat-row"><span>Email digests:</span><span>${p.email_digests ? 'on, to ' + escapeHtml(p.email) : 'off'}</span></div>
+                    </div>
+                </div>
+            `;
+            break;
+        }
+
+        case 'direct':
+            messageDiv.innerHTML = `
+                <div class="message-chat">
+                    <div class="message-bubble other direct">
+                        <div class="message-meta">${escapeHtml(msg.username)} · ${msg.time} · only you can see this</div>
+                        <div class="message-text">${escapeHtml(msg.text)}</div>
+                    </div>
+                </div>
+            `;
+            break;
+
+        case 'history': {
+            let entries = [];
+            try {
+                entries = JSON.parse(msg.text) || [];
+            } catch (e) {
+                console.error("Invalid history JSON:", msg.text);
+            }
+
+            let historyHtml = '';
+            for (const entry of entries) {
+                historyHtml += `
+                    <div class="stat-row">
+                        <span>${escapeHtml(entry.time)} ${escapeHtml(entry.username)}:</span>
+                        <span>${entry.attachment ? audioClip(entry.attachment) : escapeHtml(entry.text)}</span>
+                    </div>
+                `;
+            }
+            if (!historyHtml) {
+                historyHtml = '<div>No messages yet</div>';
+            }
+
+            messageDiv.innerHTML = `
+                <div class="message-info info-rooms">
+                    <div class="info-title">🕘 Recent messages</div>
+                    <div class="info-content">${historyHtml}</div>
+                </div>
+            `;
+            break;
+        }
+
         // ✅ /stats shows only totals now
         case 'stats': {
             let stats = null;
@@ -213,6 +635,102 @@ function displayMessage(msg) {
     messagesContainer.scrollTop = messagesContainer.scrollHeight;
 }
 
+// withEmoji replaces the :name: shortcodes of the room's custom emoji in
+// already escaped html with their images.
+// showReceipts labels the own message with id with who has received and
+// read up to it.
+function showReceipts(id) {
+    const bubble = messagesContainer.querySelector(`[data-id="${CSS.escape(id)}"] .message-bubble`);
+    if (!bubble) return;
+    const seen = [], delivered = [];
+    for (const [reader, r] of receipts) {
+        if (r.id === id) (r.state === 'read' ? seen : delivered).push(escapeHtml(reader));
+    }
+    let label = bubble.querySelector('.message-receipt');
+    if (!seen.length && !delivered.length) {
+        if (label) label.remove();
+        return;
+    }
+    if (!label) {
+        label = document.createElement('div');
+        label.className = 'message-receipt';
+        bubble.appendChild(label);
+    }
+    const parts = [];
+    if (seen.length) parts.push('Seen by ' + seen.join(', '));
+    if (delivered.length) parts.push('Delivered to ' + delivered.join(', '));
+    label.innerHTML = parts.join(' · ');
+}
+
+function withEmoji(html, emoji) {
+    if (!emoji) return html;
+    return html.replace(/:([a-z0-9_+-]{1,32}):/g, (code, name) =>
+        emoji[name] ? `<img class="emoji" src="${escapeHtml(emoji[name]).replace(/"/g, '&quot;')}" alt="${code}" title="${code}">` : code);
+}
+
+// forwardedFrom credits the author of a forwarded message and links to the
+// room it came from.
+function forwardedFrom(f) {
+    const url = escapeHtml('/r/' + encodeURIComponent(f.room) + location.search).replace(/"/g, '&quot;');
+    return `<div class="forwarded">↪ Forwarded from ${escapeHtml(f.author)} in <a href="${url}" title="Message ${escapeHtml(f.id)}">#${escapeHtml(f.room)}</a> · ${escapeHtml(f.time)}</div>`;
+}
+
+// audioClip renders a voice clip attachment as a player with a link to the
+// file.
+function audioClip(a) {
+    const url = escapeHtml(a.url).replace(/"/g, '&quot;');
+    const secs = Math.round(a.duration || 0);
+    const length = `${Math.floor(secs / 60)}:${String(secs % 60).padStart(2, '0')}`;
+    return `<audio class="voice-clip" controls preload="none" src="${url}"></audio>` +
+        `<a class="voice-clip-link" href="${url}" target="_blank">🎤 voice clip ${length}</a>`;
+}
+
+// toggleRecording starts recording a voice clip from the microphone, or
+// stops and uploads the one being recorded.
+async function toggleRecording() {
+    if (recorder) {
+        recorder.stop();
+        return;
+    }
+    let stream;
+    try {
+        stream = await navigator.mediaDevices.getUserMedia({ audio: true });
+    } catch (err) {
+        addSystemMessage('Microphone unavailable: ' + err.message);
+        return;
+    }
+    const chunks = [];
+    const started = Date.now();
+    recorder = new MediaRecorder(stream);
+    recorder.ondataavailable = (e) => chunks.push(e.data);
+    recorder.onstop = () => {
+        stream.getTracks().forEach((t) => t.stop());
+        recordBtn.classList.remove('recording');
+        const type = recorder.mimeType;
+        recorder = null;
+        uploadAudio(new Blob(chunks, { type }), (Date.now() - started) / 1000);
+    };
+    recorder.start();
+    recordBtn.classList.add('recording');
+}
+
+// uploadAudio posts a recorded clip to the room; it arrives back as a chat
+// message like any other.
+async function uploadAudio(blob, duration) {
+    const params = new URLSearchParams({ username, duration: duration.toFixed(1) });
+    const tenant = new URLSearchParams(location.search).get('tenant');
+    if (tenant) params.set('tenant', tenant);
+    const resp = await fetch(`/api/rooms/${encodeURIComponent(room)}/attachments?${params}`, {
+        method: 'POST',
+        headers: { 'Authorization': 'Bearer ' + resumeToken },
+        body: blob,
+    });
+    if (!resp.ok) {
+        const body = await resp.json().catch(() => ({}));
+        addSystemMessage('Voice clip not sent: ' + (body.error || resp.statusText));
+    }
+}
+
 function escapeHtml(text) {
     const div = document.createElement('div');
     div.textContent = text;
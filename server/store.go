@@ -0,0 +1,263 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Store keeps chat history. The hub assigns sequence numbers and calls the
+// store for everything it used to keep in Room.History: /history, resume
+// replay, exports, erasure and redaction. Only chat messages are stored.
+// Each tenant's hub gets its own view from ForTenant and sees nothing else.
+type Store interface {
+	// ForTenant returns the part of the store holding tenant's history.
+	ForTenant(tenant string) Store
+	// Append stores msg, which already carries its ID and Seq.
+	Append(msg Message) error
+	// Recent returns up to n of room's newest messages, oldest first.
+	Recent(room string, n int) ([]Message, error)
+	// Since returns up to n of room's messages after seq, oldest first,
+	// keeping the newest if there are more.
+	Since(room string, seq int64, n int) ([]Message, error)
+	// LastSeq returns the highest stored seq in room, or 0.
+	LastSeq(room string) (int64, error)
+	// ByUser returns every stored message username wrote.
+	ByUser(username string) ([]Message, error)
+	// Get returns the message with id, or errNotFound.
+	Get(id string) (Message, error)
+	// Redact replaces the text of message id, drops its attachment and
+	// annotations and marks it redacted.
+	Redact(id, text string) (Message, error)
+	// Annotate sets annotation a on message id, replacing the bot's
+	// earlier annotation of the same kind, or returns
+	// errTooManyAnnotations.
+	Annotate(id string, a Annotation) (Message, error)
+	// Anonymize rewrites username's messages, and forwarded copies of them,
+	// to author and, if text is not empty, replaces their text and drops
+	// their attachments and annotations. It returns how many it changed.
+	Anonymize(username, author, text string) (int, error)
+	// Each calls fn with every stored message, by room and seq.
+	Each(fn func(Message) error) error
+	// Replace discards all stored messages and stores msgs instead.
+	Replace(msgs []Message) error
+	Close() error
+}
+
+var errNotFound = errors.New("not found")
+
+// openStore opens the store named by spec: "memory", "sqlite:<path>" or
+// "postgres:<dsn>".
+func openStore(spec string) (Store, error) {
+	kind, arg, _ := strings.Cut(spec, ":")
+	switch kind {
+	case "memory":
+		return newMemoryStore(), nil
+	case "sqlite", "postgres":
+		if arg == "" {
+			return nil, fmt.Errorf("%s store needs a location: %s:<path or dsn>", kind, kind)
+		}
+		return openSQLStore(kind, arg, cfg.AutoMigrate)
+	}
+	return nil, fmt.Errorf("unknown store %q (want memory, sqlite:<path> or postgres:<dsn>)", spec)
+}
+
+// setupStore opens the configured store, encrypting it when a history key
+// is set and caching recent messages in front of a database. Tenants take
+// their views of it with ForTenant.
+func setupStore() (Store, error) {
+	s, err := openStore(cfg.Store)
+	if err != nil {
+		return nil, err
+	}
+	key, err := historyKey()
+	if err != nil {
+		s.Close()
+		return nil, err
+	}
+	if key != nil {
+		if historySealer, err = newSealer(key); err != nil {
+			s.Close()
+			return nil, err
+		}
+		s = newEncryptedStore(s, historySealer)
+	}
+	if cfg.RoomCache > 0 && cfg.Store != "memory" {
+		s = newCachedStore(s, cfg.RoomCache)
+	}
+	return s, nil
+}
+
+// memoryStore keeps the newest historySize messages of each room in memory.
+type memoryStore struct {
+	mu    sync.RWMutex
+	rooms map[string][]Message
+}
+
+func newMemoryStore() *memoryStore {
+	return &memoryStore{rooms: make(map[string][]Message)}
+}
+
+func (s *memoryStore) ForTenant(string) Store { return newMemoryStore() }
+
+func (s *memoryStore) Append(msg Message) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	h := append(s.rooms[msg.Room], msg)
+	if len(h) > historySize {
+		h = h[len(h)-historySize:]
+	}
+	s.rooms[msg.Room] = h
+	return nil
+}
+
+func (s *memoryStore) Recent(room string, n int) ([]Message, error) {
+	return s.Since(room, 0, n)
+}
+
+func (s *memoryStore) Since(room string, seq int64, n int) ([]Message, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	h := s.rooms[room]
+	i := len(h)
+	for i > 0 && h[i-1].Seq > seq && len(h)-i < n {
+		i--
+	}
+	out := make([]Message, len(h)-i)
+	copy(out, h[i:])
+	return out, nil
+}
+
+func (s *memoryStore) LastSeq(room string) (int64, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if h := s.rooms[room]; len(h) > 0 {
+		return h[len(h)-1].Seq, nil
+	}
+	return 0, nil
+}
+
+func (s *memoryStore) ByUser(username string) ([]Message, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	out := []Message{}
+	for _, h := range s.rooms {
+		for _, msg := range h {
+			if msg.Username == username {
+				out = append(out, msg)
+			}
+		}
+	}
+	return out, nil
+}
+
+func (s *memoryStore) Get(id string) (Message, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	for _, h := range s.rooms {
+		for _, msg := range h {
+			if msg.ID == id {
+				return msg, nil
+			}
+		}
+	}
+	return Message{}, errNotFound
+}
+
+func (s *memoryStore) Redact(id, text string) (Message, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, h := range s.rooms {
+		for i := range h {
+			if h[i].ID == id {
+				h[i].Text = text
+				h[i].Redacted = true
+				h[i].Attachment = nil
+				h[i].Annotations = nil
+				return h[i], nil
+			}
+		}
+	}
+	return Message{}, errNotFound
+}
+
+func (s *memoryStore) Annotate(id string, a Annotation) (Message, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, h := range s.rooms {
+		for i := range h {
+			if h[i].ID == id {
+				if !annotate(&h[i], a) {
+					return Message{}, errTooManyAnnotations
+				}
+				return h[i], nil
+			}
+		}
+	}
+	return Message{}, errNotFound
+}
+
+func (s *memoryStore) Anonymize(username, author, text string) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	n := 0
+	for _, h := range s.rooms {
+		for i := range h {
+			msg := &h[i]
+			own := msg.Username == username
+			forwarded := msg.Forwarded != nil && msg.Forwarded.Author == username
+			if !own && !forwarded {
+				continue
+			}
+			if own {
+				msg.Username = author
+			}
+			if forwarded {
+				f := *msg.Forwarded
+				f.Author = author
+				msg.Forwarded = &f
+			}
+			if text != "" {
+				msg.Text = text
+				msg.Attachment = nil
+				msg.Annotations = nil
+			}
+			n++
+		}
+	}
+	return n, nil
+}
+
+func (s *memoryStore) Each(fn func(Message) error) error {
+	s.mu.RLock()
+	rooms := make([]string, 0, len(s.rooms))
+	for room := range s.rooms {
+		rooms = append(rooms, room)
+	}
+	s.mu.RUnlock()
+	sort.Strings(rooms)
+
+	for _, room := range rooms {
+		msgs, _ := s.Since(room, 0, historySize)
+		for _, msg := range msgs {
+			if err := fn(msg); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (s *memoryStore) Replace(msgs []Message) error {
+	s.mu.Lock()
+	s.rooms = make(map[string][]Message)
+	s.mu.Unlock()
+	for _, msg := range msgs {
+		s.Append(msg)
+	}
+	return nil
+}
+
+func (s *memoryStore) Close() error { return nil }
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"cmp"
+	"slices"
+	"sync"
+)
+
+// cachedStore keeps the newest -room-cache messages of each room in memory
+// in front of a database store, so /history, resume replays and digests of
+// recent activity are served without a query. A room is loaded into the
+// cache the first time it is read and kept up to date by Append from then
+// on; a read reaching further back than the cache holds falls through to
+// the store. Redactions and annotations are applied to the cache, while
+// erasures and restores, which may touch any message, empty it.
+type cachedStore struct {
+	Store
+	size  int
+	mu    sync.Mutex
+	rooms map[string]*roomCache
+}
+
+// roomCache holds a room's newest messages, in seq order. Every stored
+// message from the first one on is in it.
+type roomCache struct {
+	msgs     []Message
+	complete bool // the room has no older messages
+}
+
+func newCachedStore(inner Store, size int) *cachedStore {
+	return &cachedStore{Store: inner, size: size, rooms: make(map[string]*roomCache)}
+}
+
+func (s *cachedStore) ForTenant(tenant string) Store {
+	return newCachedStore(s.Store.ForTenant(tenant), s.size)
+}
+
+func (s *cachedStore) Append(msg Message) error {
+	if err := s.Store.Append(msg); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if rc, ok := s.rooms[msg.Room]; ok {
+		rc.add(msg, s.size)
+	}
+	return nil
+}
+
+// add puts msg in the cache in seq order, unless it is there already, as it
+// is if the room was loaded after msg was stored, and drops the oldest
+// messages beyond size.
+func (rc *roomCache) add(msg Message, size int) {
+	i := len(rc.msgs)
+	for i > 0 && rc.msgs[i-1].Seq >= msg.Seq {
+		if rc.msgs[i-1].Seq == msg.Seq {
+			return
+		}
+		i--
+	}
+	rc.msgs = slices.Insert(rc.msgs, i, msg)
+	if len(rc.msgs) > size {
+		rc.msgs = slices.Delete(rc.msgs, 0, len(rc.msgs)-size)
+		rc.complete = false
+	}
+}
+
+func (s *cachedStore) Recent(room string, n int) ([]Message, error) {
+	return s.Since(room, 0, n)
+}
+
+func (s *cachedStore) Since(room string, seq int64, n int) ([]Message, error) {
+	s.mu.Lock()
+	rc, ok := s.rooms[room]
+	if !ok {
+		msgs, err := s.Store.Recent(room, s.size)
+		if err != nil {
+			s.mu.Unlock()
+			return nil, err
+		}
+		rc = &roomCache{msgs: msgs, complete: len(msgs) < s.size}
+		s.rooms[room] = rc
+	}
+	i, _ := slices.BinarySearchFunc(rc.msgs, seq+1, func(m Message, seq int64) int {
+		return cmp.Compare(m.Seq, seq)
+	})
+	after := rc.msgs[i:]
+	if len(after) < n && i == 0 && !rc.complete {
+		// Messages older than the cache holds are wanted.
+		s.mu.Unlock()
+		return s.Store.Since(room, seq, n)
+	}
+	out := slices.Clone(after[max(len(after)-n, 0):])
+	s.mu.Unlock()
+	return out, nil
+}
+
+func (s *cachedStore) Redact(id, text string) (Message, error) {
+	return s.update(s.Store.Redact(id, text))
+}
+
+func (s *cachedStore) Annotate(id string, a Annotation) (Message, error) {
+	return s.update(s.Store.Annotate(id, a))
+}
+
+// update puts msg, changed in the store, in the cache in place of the old
+// copy.
+func (s *cachedStore) update(msg Message, err error) (Message, error) {
+	if err != nil {
+		return msg, err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if rc, ok := s.rooms[msg.Room]; ok {
+		for i := range rc.msgs {
+			if rc.msgs[i].ID == msg.ID {
+				rc.msgs[i] = msg
+			}
+		}
+	}
+	return msg, nil
+}
+
+func (s *cachedStore) Anonymize(username, author, text string) (int, error) {
+	defer s.clear()
+	return s.Store.Anonymize(username, author, text)
+}
+
+func (s *cachedStore) Replace(msgs []Message) error {
+	defer s.clear()
+	return s.Store.Replace(msgs)
+}
+
+// clear empties the cache; rooms are loaded again as they are read.
+func (s *cachedStore) clear() {
+	s.mu.Lock()
+	clear(s.rooms)
+	s.mu.Unlock()
+}
+
+// forget drops room's cached history, for a room the hub let go of.
+func (s *cachedStore) forget(room string) {
+	s.mu.Lock()
+	delete(s.rooms, room)
+	s.mu.Unlock()
+}
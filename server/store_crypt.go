@@ -0,0 +1,182 @@
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// encryptedStore seals message text with AES-256-GCM before it reaches the
+// underlying store and opens it on the way out, so the hub never sees
+// ciphertext. Text written before encryption was turned on has no prefix
+// and is returned as is.
+type encryptedStore struct {
+	Store
+	*sealer
+}
+
+func newEncryptedStore(inner Store, s *sealer) *encryptedStore {
+	return &encryptedStore{Store: inner, sealer: s}
+}
+
+// sealer encrypts text with the history key. Backups use it too.
+type sealer struct {
+	aead cipher.AEAD
+}
+
+const sealedPrefix = "enc1:"
+
+// historySealer is set when a history key is configured.
+var historySealer *sealer
+
+func newSealer(key []byte) (*sealer, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	return &sealer{aead: aead}, nil
+}
+
+// historyKey loads the 32-byte history key, hex or base64 encoded, from
+// -history-key or -history-key-file. It returns nil if neither is set.
+func historyKey() ([]byte, error) {
+	text := cfg.HistoryKey
+	if cfg.HistoryKeyFile != "" {
+		data, err := os.ReadFile(cfg.HistoryKeyFile)
+		if err != nil {
+			return nil, err
+		}
+		text = string(data)
+	}
+	text = strings.TrimSpace(text)
+	if text == "" {
+		return nil, nil
+	}
+	key, err := hex.DecodeString(text)
+	if err != nil {
+		key, err = base64.StdEncoding.DecodeString(text)
+	}
+	if err != nil || len(key) != 32 {
+		return nil, errors.New("history key must be 32 bytes, hex or base64 encoded")
+	}
+	return key, nil
+}
+
+func (s *sealer) seal(text string) string {
+	nonce := make([]byte, s.aead.NonceSize())
+	rand.Read(nonce)
+	return sealedPrefix + base64.RawStdEncoding.EncodeToString(s.aead.Seal(nonce, nonce, []byte(text), nil))
+}
+
+func (s *sealer) open(text string) (string, error) {
+	enc, ok := strings.CutPrefix(text, sealedPrefix)
+	if !ok {
+		return text, nil
+	}
+	data, err := base64.RawStdEncoding.DecodeString(enc)
+	if err != nil || len(data) < s.aead.NonceSize() {
+		return "", errors.New("malformed sealed text")
+	}
+	nonce, ct := data[:s.aead.NonceSize()], data[s.aead.NonceSize():]
+	plain, err := s.aead.Open(nil, nonce, ct, nil)
+	if err != nil {
+		return "", fmt.Errorf("cannot decrypt history (wrong key?): %w", err)
+	}
+	return string(plain), nil
+}
+
+func (s *encryptedStore) openAll(msgs []Message, err error) ([]Message, error) {
+	if err != nil {
+		return nil, err
+	}
+	for i := range msgs {
+		if msgs[i].Text, err = s.open(msgs[i].Text); err != nil {
+			return nil, err
+		}
+	}
+	return msgs, nil
+}
+
+func (s *encryptedStore) ForTenant(tenant string) Store {
+	return newEncryptedStore(s.Store.ForTenant(tenant), s.sealer)
+}
+
+func (s *encryptedStore) Each(fn func(Message) error) error {
+	return s.Store.Each(func(msg Message) error {
+		var err error
+		if msg.Text, err = s.open(msg.Text); err != nil {
+			return err
+		}
+		return fn(msg)
+	})
+}
+
+func (s *encryptedStore) Replace(msgs []Message) error {
+	sealed := make([]Message, len(msgs))
+	for i, msg := range msgs {
+		msg.Text = s.seal(msg.Text)
+		sealed[i] = msg
+	}
+	return s.Store.Replace(sealed)
+}
+
+func (s *encryptedStore) Append(msg Message) error {
+	msg.Text = s.seal(msg.Text)
+	return s.Store.Append(msg)
+}
+
+func (s *encryptedStore) Recent(room string, n int) ([]Message, error) {
+	return s.openAll(s.Store.Recent(room, n))
+}
+
+func (s *encryptedStore) Since(room string, seq int64, n int) ([]Message, error) {
+	return s.openAll(s.Store.Since(room, seq, n))
+}
+
+func (s *encryptedStore) ByUser(username string) ([]Message, error) {
+	return s.openAll(s.Store.ByUser(username))
+}
+
+func (s *encryptedStore) Get(id string) (Message, error) {
+	msg, err := s.Store.Get(id)
+	if err != nil {
+		return msg, err
+	}
+	msg.Text, err = s.open(msg.Text)
+	return msg, err
+}
+
+func (s *encryptedStore) Redact(id, text string) (Message, error) {
+	msg, err := s.Store.Redact(id, s.seal(text))
+	if err != nil {
+		return msg, err
+	}
+	msg.Text, err = s.open(msg.Text)
+	return msg, err
+}
+
+func (s *encryptedStore) Annotate(id string, a Annotation) (Message, error) {
+	msg, err := s.Store.Annotate(id, a)
+	if err != nil {
+		return msg, err
+	}
+	msg.Text, err = s.open(msg.Text)
+	return msg, err
+}
+
+func (s *encryptedStore) Anonymize(username, author, text string) (int, error) {
+	if text != "" {
+		text = s.seal(text)
+	}
+	return s.Store.Anonymize(username, author, text)
+}
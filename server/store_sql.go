@@ -0,0 +1,325 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+
+	_ "github.com/lib/pq"
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// sqlStore keeps all chat history in SQLite or PostgreSQL, so it survives
+// restarts. Queries are written with ? placeholders and rebound for
+// PostgreSQL; the schema comes from the migrations. Every query is confined
+// to the store's tenant.
+type sqlStore struct {
+	db      *sql.DB
+	dialect string // "sqlite" or "postgres"
+	tenant  string
+}
+
+// openSQLStore connects to the database and brings its schema up to date,
+// or with autoMigrate false refuses to start on an outdated schema.
+func openSQLStore(dialect, dsn string, autoMigrate bool) (*sqlStore, error) {
+	db, err := openDB(dialect, dsn)
+	if err != nil {
+		return nil, err
+	}
+	if autoMigrate {
+		err = migrate(db, dialect)
+	} else {
+		var pending []migration
+		if pending, err = pendingMigrations(db, dialect); err == nil && len(pending) > 0 {
+			err = fmt.Errorf("%d pending migrations; run `server migrate` or start with -auto-migrate", len(pending))
+		}
+	}
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("%s store: %w", dialect, err)
+	}
+	return &sqlStore{db: db, dialect: dialect}, nil
+}
+
+func openDB(dialect, dsn string) (*sql.DB, error) {
+	switch dialect {
+	case "sqlite":
+		return sql.Open("sqlite3", "file:"+dsn+"?_journal_mode=WAL&_busy_timeout=5000")
+	case "postgres":
+		return sql.Open("postgres", dsn)
+	}
+	return nil, fmt.Errorf("unknown database %q", dialect)
+}
+
+// q rewrites ? placeholders as $1, $2... for PostgreSQL.
+func (s *sqlStore) q(query string) string {
+	if s.dialect != "postgres" {
+		return query
+	}
+	var b strings.Builder
+	n := 0
+	for _, r := range query {
+		if r == '?' {
+			n++
+			b.WriteString("$" + strconv.Itoa(n))
+			continue
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
+
+const messageColumns = "id, room, seq, username, text, time, redacted, attachment, forwarded, integration, unverified, annotations"
+
+// scanMessage reads one row of messageColumns. The attachment, the
+// forwarded source and the annotations are kept as JSON, or "" if there
+// are none.
+func scanMessage(rows *sql.Rows) (Message, error) {
+	msg := Message{Type: MsgChat}
+	var attachment, forwarded, annotations string
+	if err := rows.Scan(&msg.ID, &msg.Room, &msg.Seq, &msg.Username, &msg.Text, &msg.Time, &msg.Redacted, &attachment, &forwarded, &msg.Integration, &msg.Unverified, &annotations); err != nil {
+		return msg, err
+	}
+	if annotations != "" {
+		if err := json.Unmarshal([]byte(annotations), &msg.Annotations); err != nil {
+			return msg, fmt.Errorf("message %s: annotations: %w", msg.ID, err)
+		}
+	}
+	if attachment != "" {
+		msg.Attachment = new(Attachment)
+		if err := json.Unmarshal([]byte(attachment), msg.Attachment); err != nil {
+			return msg, fmt.Errorf("message %s: attachment: %w", msg.ID, err)
+		}
+	}
+	if forwarded != "" {
+		msg.Forwarded = new(Forward)
+		if err := json.Unmarshal([]byte(forwarded), msg.Forwarded); err != nil {
+			return msg, fmt.Errorf("message %s: forwarded: %w", msg.ID, err)
+		}
+	}
+	return msg, nil
+}
+
+// attachmentColumn returns msg's attachment as stored in the attachment
+// column.
+func attachmentColumn(msg Message) string {
+	if msg.Attachment == nil {
+		return ""
+	}
+	data, _ := json.Marshal(msg.Attachment)
+	return string(data)
+}
+
+// forwardedColumn returns where msg was forwarded from as stored in the
+// forwarded column.
+func forwardedColumn(msg Message) string {
+	if msg.Forwarded == nil {
+		return ""
+	}
+	data, _ := json.Marshal(msg.Forwarded)
+	return string(data)
+}
+
+// annotationsColumn returns msg's annotations as stored in the annotations
+// column.
+func annotationsColumn(msg Message) string {
+	if len(msg.Annotations) == 0 {
+		return ""
+	}
+	data, _ := json.Marshal(msg.Annotations)
+	return string(data)
+}
+
+func scanMessages(rows *sql.Rows) ([]Message, error) {
+	defer rows.Close()
+	out := []Message{}
+	for rows.Next() {
+		msg, err := scanMessage(rows)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, msg)
+	}
+	return out, rows.Err()
+}
+
+func (s *sqlStore) ForTenant(tenant string) Store {
+	return &sqlStore{db: s.db, dialect: s.dialect, tenant: tenant}
+}
+
+func (s *sqlStore) Append(msg Message) error {
+	_, err := s.db.Exec(s.q("INSERT INTO messages (tenant, "+messageColumns+") VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)"),
+		s.tenant, msg.ID, msg.Room, msg.Seq, msg.Username, msg.Text, msg.Time, msg.Redacted, attachmentColumn(msg), forwardedColumn(msg), msg.Integration, msg.Unverified, annotationsColumn(msg))
+	return err
+}
+
+func (s *sqlStore) Recent(room string, n int) ([]Message, error) {
+	return s.Since(room, 0, n)
+}
+
+func (s *sqlStore) Since(room string, seq int64, n int) ([]Message, error) {
+	rows, err := s.db.Query(s.q("SELECT * FROM (SELECT "+messageColumns+" FROM messages WHERE tenant = ? AND room = ? AND seq > ? ORDER BY seq DESC LIMIT ?) AS recent ORDER BY seq"),
+		s.tenant, room, seq, n)
+	if err != nil {
+		return nil, err
+	}
+	return scanMessages(rows)
+}
+
+func (s *sqlStore) LastSeq(room string) (int64, error) {
+	var seq int64
+	err := s.db.QueryRow(s.q("SELECT COALESCE(MAX(seq), 0) FROM messages WHERE tenant = ? AND room = ?"), s.tenant, room).Scan(&seq)
+	return seq, err
+}
+
+func (s *sqlStore) ByUser(username string) ([]Message, error) {
+	rows, err := s.db.Query(s.q("SELECT "+messageColumns+" FROM messages WHERE tenant = ? AND username = ? ORDER BY room, seq"), s.tenant, username)
+	if err != nil {
+		return nil, err
+	}
+	return scanMessages(rows)
+}
+
+func (s *sqlStore) Get(id string) (Message, error) {
+	rows, err := s.db.Query(s.q("SELECT "+messageColumns+" FROM messages WHERE tenant = ? AND id = ?"), s.tenant, id)
+	if err != nil {
+		return Message{}, err
+	}
+	msgs, err := scanMessages(rows)
+	if err != nil {
+		return Message{}, err
+	}
+	if len(msgs) == 0 {
+		return Message{}, errNotFound
+	}
+	return msgs[0], nil
+}
+
+func (s *sqlStore) Redact(id, text string) (Message, error) {
+	res, err := s.db.Exec(s.q("UPDATE messages SET text = ?, redacted = ?, attachment = '', annotations = '' WHERE tenant = ? AND id = ?"), text, true, s.tenant, id)
+	if err != nil {
+		return Message{}, err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return Message{}, errNotFound
+	}
+	return s.Get(id)
+}
+
+func (s *sqlStore) Annotate(id string, a Annotation) (Message, error) {
+	msg, err := s.Get(id)
+	if err != nil {
+		return msg, err
+	}
+	if !annotate(&msg, a) {
+		return Message{}, errTooManyAnnotations
+	}
+	_, err = s.db.Exec(s.q("UPDATE messages SET annotations = ? WHERE tenant = ? AND id = ?"), annotationsColumn(msg), s.tenant, id)
+	return msg, err
+}
+
+func (s *sqlStore) Anonymize(username, author, text string) (int, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	// Forwarded copies of username's messages name them as the author, so
+	// they are rewritten too. The source is JSON, so it is matched here
+	// rather than in SQL.
+	rows, err := tx.Query(s.q("SELECT id, username, forwarded FROM messages WHERE tenant = ? AND forwarded <> ''"), s.tenant)
+	if err != nil {
+		return 0, err
+	}
+	forwards := map[string]Forward{}
+	n := 0
+	for rows.Next() {
+		var id, forwarder, forwarded string
+		var f Forward
+		if err := rows.Scan(&id, &forwarder, &forwarded); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		if json.Unmarshal([]byte(forwarded), &f) == nil && f.Author == username {
+			forwards[id] = f
+			if forwarder != username {
+				n++ // the update below counts the rest
+			}
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+
+	var res sql.Result
+	if text == "" {
+		res, err = tx.Exec(s.q("UPDATE messages SET username = ? WHERE tenant = ? AND username = ?"), author, s.tenant, username)
+	} else {
+		res, err = tx.Exec(s.q("UPDATE messages SET username = ?, text = ?, attachment = '', annotations = '' WHERE tenant = ? AND username = ?"), author, text, s.tenant, username)
+	}
+	if err != nil {
+		return 0, err
+	}
+	own, _ := res.RowsAffected()
+	n += int(own)
+
+	for id, f := range forwards {
+		f.Author = author
+		data, _ := json.Marshal(f)
+		if text == "" {
+			_, err = tx.Exec(s.q("UPDATE messages SET forwarded = ? WHERE tenant = ? AND id = ?"), string(data), s.tenant, id)
+		} else {
+			_, err = tx.Exec(s.q("UPDATE messages SET forwarded = ?, text = ?, attachment = '', annotations = '' WHERE tenant = ? AND id = ?"), string(data), text, s.tenant, id)
+		}
+		if err != nil {
+			return 0, err
+		}
+	}
+	return n, tx.Commit()
+}
+
+func (s *sqlStore) Each(fn func(Message) error) error {
+	rows, err := s.db.Query(s.q("SELECT "+messageColumns+" FROM messages WHERE tenant = ? ORDER BY room, seq"), s.tenant)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		msg, err := scanMessage(rows)
+		if err != nil {
+			return err
+		}
+		if err := fn(msg); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+func (s *sqlStore) Replace(msgs []Message) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if _, err := tx.Exec(s.q("DELETE FROM messages WHERE tenant = ?"), s.tenant); err != nil {
+		return err
+	}
+	insert, err := tx.Prepare(s.q("INSERT INTO messages (tenant, " + messageColumns + ") VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)"))
+	if err != nil {
+		return err
+	}
+	defer insert.Close()
+	for _, msg := range msgs {
+		if _, err := insert.Exec(s.tenant, msg.ID, msg.Room, msg.Seq, msg.Username, msg.Text, msg.Time, msg.Redacted, attachmentColumn(msg), forwardedColumn(msg), msg.Integration, msg.Unverified, annotationsColumn(msg)); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+func (s *sqlStore) Close() error { return s.db.Close() }
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"net"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// systemd integration: socket activation hands us the listening socket as
+// fd 3 (LISTEN_FDS/LISTEN_PID), and sd_notify messages on NOTIFY_SOCKET
+// report readiness and shutdown for Type=notify units. After a SIGUSR2
+// handover the new process announces itself with MAINPID, which needs
+// NotifyAccess=all in the unit.
+
+// sdListenFDsStart is the first file descriptor passed by systemd.
+const sdListenFDsStart = 3
+
+// systemdListener returns the socket systemd passed us, if any.
+func systemdListener() (net.Listener, bool, error) {
+	pid, err := strconv.Atoi(os.Getenv("LISTEN_PID"))
+	if err != nil || pid != os.Getpid() {
+		return nil, false, nil
+	}
+	n, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil || n < 1 {
+		return nil, false, nil
+	}
+	// Don't let child processes mistake the variables for their own.
+	os.Unsetenv("LISTEN_PID")
+	os.Unsetenv("LISTEN_FDS")
+	os.Unsetenv("LISTEN_FDNAMES")
+
+	f := os.NewFile(sdListenFDsStart, "systemd-listener")
+	defer f.Close()
+	ln, err := net.FileListener(f)
+	return ln, true, err
+}
+
+// sdNotify sends state to systemd's notification socket. It is a no-op
+// when not running under a Type=notify unit.
+func sdNotify(state ...string) {
+	addr := os.Getenv("NOTIFY_SOCKET")
+	if addr == "" {
+		return
+	}
+	if strings.HasPrefix(addr, "@") {
+		addr = "\x00" + addr[1:] // abstract namespace
+	}
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: addr, Net: "unixgram"})
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+	conn.Write([]byte(strings.Join(state, "\n")))
+}
@@ -0,0 +1,245 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Room templates let anyone create a room ready for its purpose:
+//
+//	/create <room> --template support
+//
+// makes the creator the owner of a new room with the template's settings
+// (topic, filter, moderators and so on), posts its welcome message and pins
+// it, and sets up the integrations it names: room webhooks, whose keys are
+// sent to the creator alone, and feeds. /create <room> without a template
+// just claims the room. A room that exists, has settings or has history
+// cannot be created again.
+//
+// Templates come from the -room-templates file, a JSON array of them, each
+// for the default tenant unless it names another, and from the admin API:
+//
+//	GET    /api/admin/templates
+//	PUT    /api/admin/templates/:name  {"topic": "Ask us anything", "welcome": "...", "webhooks": ["helpdesk"]}
+//	DELETE /api/admin/templates/:name
+//
+// Like the rest of the admin API's changes they are kept in memory.
+
+const templateBot = "templates"
+
+// RoomTemplate is what a room created from a template starts with. The
+// creator is its owner, whatever the template's settings say.
+type RoomTemplate struct {
+	Name     string       `json:"name"`
+	Tenant   string       `json:"tenant,omitempty"`   // in the -room-templates file, the tenant it is for
+	Welcome  string       `json:"welcome,omitempty"`  // posted and pinned as the room is created
+	Webhooks []string     `json:"webhooks,omitempty"` // names of room webhooks to create
+	Feeds    []FeedConfig `json:"feeds,omitempty"`    // feeds for the room to follow
+	RoomSettings
+}
+
+func (t *RoomTemplate) validate() error {
+	if !groupName.MatchString(t.Name) {
+		return fmt.Errorf("template names are 1 to 32 of a-z, 0-9, _ and -, not %q", t.Name)
+	}
+	for _, name := range t.Webhooks {
+		if !groupName.MatchString(name) {
+			return fmt.Errorf("invalid webhook name %q", name)
+		}
+	}
+	for i := range t.Feeds {
+		if err := t.Feeds[i].validate(); err != nil {
+			return err
+		}
+	}
+	return t.RoomSettings.validate()
+}
+
+type templateList struct {
+	mu        sync.Mutex
+	templates map[string]RoomTemplate
+}
+
+func (l *templateList) set(t RoomTemplate) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.templates == nil {
+		l.templates = make(map[string]RoomTemplate)
+	}
+	l.templates[t.Name] = t
+}
+
+func (l *templateList) get(name string) (RoomTemplate, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	t, ok := l.templates[name]
+	return t, ok
+}
+
+// remove deletes the template name and reports whether it existed.
+func (l *templateList) remove(name string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	_, ok := l.templates[name]
+	delete(l.templates, name)
+	return ok
+}
+
+// list returns the templates by name.
+func (l *templateList) list() []RoomTemplate {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	out := make([]RoomTemplate, 0, len(l.templates))
+	for _, t := range l.templates {
+		out = append(out, t)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Name < out[j].Name })
+	return out
+}
+
+// setupTemplates loads the -room-templates file, if there is one.
+func setupTemplates() error {
+	if cfg.TemplatesFile == "" {
+		return nil
+	}
+	data, err := os.ReadFile(cfg.TemplatesFile)
+	if err != nil {
+		return err
+	}
+	var templates []RoomTemplate
+	if err := json.Unmarshal(data, &templates); err != nil {
+		return fmt.Errorf("%s: %w", cfg.TemplatesFile, err)
+	}
+	for _, t := range templates {
+		if err := t.validate(); err != nil {
+			return fmt.Errorf("%s: %w", cfg.TemplatesFile, err)
+		}
+		tenant, ok := lookupTenant(t.Tenant)
+		if !ok {
+			return fmt.Errorf("%s: template %s: unknown tenant %q", cfg.TemplatesFile, t.Name, t.Tenant)
+		}
+		t.Tenant = ""
+		tenant.hub.templates.set(t)
+	}
+	log.Printf("Loaded %d room templates from %s", len(templates), cfg.TemplatesFile)
+	return nil
+}
+
+// claimRoom gives room name settings s, unless it is a live room or has
+// settings or history already, and reports whether it did.
+func (h *Hub) claimRoom(name string, s RoomSettings) bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	_, live := h.rooms[name]
+	_, configured := h.settings[name]
+	if live || configured || h.lastSeq(name) > 0 {
+		return false
+	}
+	h.settings[name] = s
+	return true
+}
+
+// createCommand handles /create <room> [--template name] from client.
+func (h *Hub) createCommand(client *Client, args []string) {
+	reply := func(text string) {
+		h.sendToClient(client, Message{Type: MsgSystem, Room: client.Room, Text: text, Time: h.clockTime()})
+	}
+	var template string
+	switch {
+	case len(args) == 1:
+	case len(args) == 3 && args[1] == "--template":
+		template = args[2]
+	case len(args) == 2 && strings.HasPrefix(args[1], "--template="):
+		template = strings.TrimPrefix(args[1], "--template=")
+	default:
+		reply("Usage: /create <room> [--template name]")
+		return
+	}
+	name := args[0]
+	if len(name) > 64 {
+		reply("Room names are at most 64 characters.")
+		return
+	}
+	t := RoomTemplate{Name: template}
+	if template != "" {
+		var ok bool
+		if t, ok = h.templates.get(template); !ok {
+			reply("There is no room template " + template + ".")
+			return
+		}
+	}
+	s := t.RoomSettings
+	s.Owner = client.Username
+	if !h.claimRoom(name, s) {
+		reply("The room " + name + " already exists.")
+		return
+	}
+	if s.Persistent {
+		h.preload(name, s)
+	}
+	var keys []string
+	for _, hook := range t.Webhooks {
+		key := newWebhookKey()
+		h.webhooks.set(name, hook, key)
+		keys = append(keys, hook+": "+key)
+	}
+	for _, feed := range t.Feeds {
+		h.startFeed(name, feed)
+	}
+	if t.Welcome != "" {
+		msg := h.postIntegration(name, templateBot, t.Welcome, "")
+		limit, _ := h.pinLimits(name)
+		p := Pin{ID: msg.ID, Seq: msg.Seq, Author: msg.Username, Text: msg.Text, PinnedBy: templateBot, PinnedAt: h.now()}
+		h.pins.add(name, p, limit, nil)
+	}
+	recordAudit(AuditEntry{Actor: client.Username, Tenant: h.tenant, Action: "room.create", Subject: name, Detail: template})
+
+	text := "Created " + name + "; you own it."
+	if template != "" {
+		text = "Created " + name + " from the " + template + " template; you own it."
+	}
+	if len(keys) > 0 {
+		text += " Its webhooks post with POST /api/rooms/" + name + "/messages and these keys, shown only now:\n" + strings.Join(keys, "\n")
+	}
+	reply(text)
+}
+
+func handleListTemplates(c *gin.Context) {
+	c.JSON(200, adminTenant(c).hub.templates.list())
+}
+
+// handleSetTemplate creates or replaces the template :name.
+func handleSetTemplate(c *gin.Context) {
+	t := adminTenant(c)
+	var tmpl RoomTemplate
+	if err := c.ShouldBindJSON(&tmpl); err != nil {
+		c.JSON(400, gin.H{"error": `body must be {"welcome": text, "webhooks": [name], "feeds": [feed], ...room settings}`})
+		return
+	}
+	tmpl.Name, tmpl.Tenant = c.Param("name"), ""
+	if err := tmpl.validate(); err != nil {
+		c.JSON(400, gin.H{"error": err.Error()})
+		return
+	}
+	t.hub.templates.set(tmpl)
+	recordAudit(AuditEntry{Actor: c.ClientIP(), Tenant: t.Name, Action: "template.set", Subject: tmpl.Name})
+	c.JSON(200, tmpl)
+}
+
+func handleDeleteTemplate(c *gin.Context) {
+	t := adminTenant(c)
+	name := c.Param("name")
+	if !t.hub.templates.remove(name) {
+		c.JSON(404, gin.H{"error": "no such template"})
+		return
+	}
+	recordAudit(AuditEntry{Actor: c.ClientIP(), Tenant: t.Name, Action: "template.delete", Subject: name})
+	c.JSON(200, gin.H{"name": name})
+}
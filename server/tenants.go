@@ -0,0 +1,166 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"time"
+)
+
+// Tenants are isolated namespaces: each has its own hub (rooms, users,
+// sequence numbers), its own view of the history store, and its own limits,
+// so two organizations can share a deployment without seeing each other.
+// Clients pick one with ?tenant=<name>; without it they land in the default
+// tenant, which is how a single-tenant deployment runs. Further tenants come
+// from the -tenants file:
+//
+//	{"acme": {"key": "…", "max_connections": 500, "max_rooms": 50, "rate_limit": 5,
+//	          "messages_per_day": 100000, "storage_bytes": 1073741824}}
+//
+// A tenant's key works as a bearer token for the admin API, scoped to that
+// tenant.
+
+// TenantConfig is one tenant's entry in the -tenants file. Zero limits fall
+// back to the server-wide flags; zero quotas mean unlimited.
+type TenantConfig struct {
+	Key            string  `json:"key"`
+	MaxConnections int     `json:"max_connections"`
+	MaxRooms       int     `json:"max_rooms"`
+	RateLimit      float64 `json:"rate_limit"`
+	RateBurst      int     `json:"rate_burst"`
+	Quotas                 // see quotas.go
+}
+
+type Tenant struct {
+	Name   string
+	Config TenantConfig
+	hub    *Hub
+}
+
+// defaultTenant is the tenant of clients that don't name one.
+const defaultTenant = ""
+
+// tenants is filled at startup and read-only afterwards.
+var tenants = map[string]*Tenant{}
+
+// hub is the default tenant's hub.
+var hub *Hub
+
+// setupTenants creates the default tenant and those in the -tenants file,
+// each with a hub over its slice of base.
+func setupTenants(base Store) error {
+	configs := map[string]TenantConfig{defaultTenant: {}}
+	if cfg.TenantsFile != "" {
+		data, err := os.ReadFile(cfg.TenantsFile)
+		if err != nil {
+			return err
+		}
+		var fromFile map[string]TenantConfig
+		if err := json.Unmarshal(data, &fromFile); err != nil {
+			return fmt.Errorf("%s: %w", cfg.TenantsFile, err)
+		}
+		for name, tc := range fromFile {
+			if name == defaultTenant {
+				return fmt.Errorf("%s: tenant names must not be empty", cfg.TenantsFile)
+			}
+			if err := tc.validQuotas(); err != nil {
+				return fmt.Errorf("%s: tenant %s: %w", cfg.TenantsFile, name, err)
+			}
+			configs[name] = tc
+		}
+	}
+
+	for name, tc := range configs {
+		if tc.RateLimit == 0 {
+			tc.RateLimit = cfg.RateLimit
+		}
+		if tc.RateBurst == 0 {
+			tc.RateBurst = cfg.RateBurst
+		}
+		t := &Tenant{Name: name, Config: tc, hub: newHub(name, base.ForTenant(name))}
+		if cfg.Store == "memory" {
+			t.hub.usage.keep = historySize
+		}
+		if tc.RateLimit > 0 {
+			t.hub.limit = newLocalLimiter(tc.RateLimit, tc.RateBurst)
+		}
+		tenants[name] = t
+		go t.hub.run()
+	}
+	hub = tenants[defaultTenant].hub
+	return nil
+}
+
+func lookupTenant(name string) (*Tenant, bool) {
+	t, ok := tenants[name]
+	return t, ok
+}
+
+// tenantByKey finds the tenant whose API key is key.
+func tenantByKey(key string) (*Tenant, bool) {
+	if key == "" {
+		return nil, false
+	}
+	for _, t := range tenants {
+		if t.Config.Key != "" && constantTimeEqual(t.Config.Key, key) {
+			return t, true
+		}
+	}
+	return nil, false
+}
+
+// tenantNames returns all tenant names, the default tenant first.
+func tenantNames() []string {
+	names := make([]string, 0, len(tenants))
+	for name := range tenants {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// allHubs returns every tenant's hub.
+func allHubs() []*Hub {
+	hubs := make([]*Hub, 0, len(tenants))
+	for _, name := range tenantNames() {
+		hubs = append(hubs, tenants[name].hub)
+	}
+	return hubs
+}
+
+// totalClients counts connections across all tenants.
+func totalClients() int64 {
+	var n int64
+	for _, h := range allHubs() {
+		n += h.clientCount()
+	}
+	return n
+}
+
+// admit checks the tenant's quotas for a new connection to room and
+// returns why it is refused, or "". Observers are not held to the
+// connection quota, nor count towards it.
+func (t *Tenant) admit(room string, observer bool) string {
+	if max := t.Config.MaxConnections; max > 0 && !observer && t.hub.clientCount()-t.hub.observing.Load() >= int64(max) {
+		return "tenant connection quota reached"
+	}
+	if max := t.Config.MaxRooms; max > 0 && !t.hub.hasRoom(room) && t.hub.roomCount() >= max {
+		return "tenant room quota reached"
+	}
+	return ""
+}
+
+// tenantQualified names subject within its tenant for logs and alerts.
+func tenantQualified(tenant, subject string) string {
+	if tenant == defaultTenant {
+		return subject
+	}
+	return tenant + "/" + subject
+}
+
+// rateLimited reports whether username in this hub's tenant is over its
+// message rate.
+func (h *Hub) rateLimited(username string, now time.Time) bool {
+	return h.limit != nil && !h.limit.allow(username, now)
+}
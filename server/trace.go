@@ -0,0 +1,77 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"log"
+	"regexp"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Every chat message gets a trace ID as it enters the server, to follow it
+// through the logs and the systems it passes through. A client may choose
+// its own by sending a trace field with the message; HTTP integrations
+// (room webhooks, GitHub, GitLab and Alertmanager hooks) take it from a W3C
+// traceparent header, X-Request-ID or X-Correlation-ID, and get it back in
+// X-Trace-ID. Anything else, or an ID that is not 1 to 64 letters, digits,
+// dots, dashes and underscores, gets a new one. Messages posted by the
+// server itself, such as scheduled posts and feed items, get one too, as
+// does a forward, which logs the message it came from.
+//
+// With -trace-log, each step of a message's path is logged with its trace
+// ID: where it came from, its seq, how many connections it was queued for,
+// and who it notified. With -trace-clients, clients are sent it too.
+// Trace IDs are not stored, so history and resume replays do not carry
+// them.
+
+var traceIDPattern = regexp.MustCompile(`^[A-Za-z0-9._-]{1,64}$`)
+
+// newTraceID returns a random trace ID, in the form of a W3C trace-id.
+func newTraceID() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// traceID returns id if it is usable as a trace ID, or a new one.
+func traceID(id string) string {
+	if traceIDPattern.MatchString(id) {
+		return id
+	}
+	return newTraceID()
+}
+
+// requestTrace returns the trace ID of an HTTP request from its headers,
+// or a new one, and echoes it back in X-Trace-ID.
+func requestTrace(c *gin.Context) string {
+	id := ""
+	if parts := strings.Split(c.GetHeader("traceparent"), "-"); len(parts) == 4 {
+		id = parts[1]
+	} else if v := c.GetHeader("X-Request-ID"); v != "" {
+		id = v
+	} else {
+		id = c.GetHeader("X-Correlation-ID")
+	}
+	id = traceID(id)
+	c.Header("X-Trace-ID", id)
+	return id
+}
+
+// traceLog logs a step of msg's path, with -trace-log.
+func traceLog(msg Message, format string, args ...any) {
+	if !cfg.TraceLog {
+		return
+	}
+	log.Printf("trace=%s id=%s room=%s: "+format, append([]any{msg.Trace, msg.ID, msg.Room}, args...)...)
+}
+
+// outbound returns msg as sent to clients: without its trace ID, unless
+// -trace-clients is on.
+func outbound(msg Message) Message {
+	if !cfg.TraceClients {
+		msg.Trace = ""
+	}
+	return msg
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// A room's transforms change its chat on the way out to members, for rooms
+// that relay chat from elsewhere or are read by a wider audience than they
+// are written by. The transforms setting lists them, applied in order:
+//
+//	strip_attachments  drop files such as voice clips, leaving the text
+//	strip_forwarded    drop where a forwarded message came from
+//	prefix:<text>      put text before each message, e.g. "prefix:[irc] "
+//	suffix:<text>      put text after each message
+//
+// Messages are stored as sent, and transformed each time they are sent:
+// live, in /history replies and in resume replays, so changing the setting
+// applies to the room's past chat too.
+
+const (
+	transformStripAttachments = "strip_attachments"
+	transformStripForwarded   = "strip_forwarded"
+	transformPrefix           = "prefix:"
+	transformSuffix           = "suffix:"
+	maxTransforms             = 8
+)
+
+// validTransforms checks a transforms setting.
+func validTransforms(transforms []string) error {
+	if len(transforms) > maxTransforms {
+		return fmt.Errorf("a room may have at most %d transforms", maxTransforms)
+	}
+	for _, t := range transforms {
+		switch {
+		case t == transformStripAttachments, t == transformStripForwarded:
+		case strings.HasPrefix(t, transformPrefix) && len(t) > len(transformPrefix),
+			strings.HasPrefix(t, transformSuffix) && len(t) > len(transformSuffix):
+		default:
+			return fmt.Errorf("unknown transform %q (want strip_attachments, strip_forwarded, prefix:<text> or suffix:<text>)", t)
+		}
+	}
+	return nil
+}
+
+// transform returns chat message msg as transforms have it sent.
+func transform(msg Message, transforms []string) Message {
+	if msg.Type != MsgChat {
+		return msg
+	}
+	for _, t := range transforms {
+		switch {
+		case t == transformStripAttachments:
+			msg.Attachment = nil
+		case t == transformStripForwarded:
+			msg.Forwarded = nil
+		case strings.HasPrefix(t, transformPrefix):
+			msg.Text = t[len(transformPrefix):] + msg.Text
+		case strings.HasPrefix(t, transformSuffix):
+			msg.Text += t[len(transformSuffix):]
+		}
+	}
+	return msg
+}
+
+// transformed applies room's transforms to msgs loaded from its history.
+func (h *Hub) transformed(room string, msgs []Message) {
+	transformAll(msgs, h.roomSettings(room).Transforms)
+}
+
+// transformAll applies transforms to each of msgs.
+func transformAll(msgs []Message, transforms []string) {
+	if len(transforms) == 0 {
+		return
+	}
+	for i := range msgs {
+		msgs[i] = transform(msgs[i], transforms)
+	}
+}
@@ -0,0 +1,313 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// With -registration, users may register their names so nobody else can
+// connect as them:
+//
+//	POST /api/users/:username/register?tenant=   {"password": "..."}
+//	POST /api/users/:username/login?tenant=      {"password": "..."}
+//	PUT  /api/users/:username/password?tenant=   {"password": "...", "new_password": "..."}
+//
+// each answer {"token": "..."}, a login token to connect with as
+// /ws?username=...&auth=<token>. A registered name is refused without a
+// login token or a resume token issued since its password was last set;
+// changing the password revokes both. Chat from names that are not
+// registered is marked "unverified". Admins can reserve a name for a bot
+// with POST /api/admin/users/:username/registration, which returns a
+// generated password once, and release one with DELETE. Registrations are
+// saved to -users-file, or kept in memory without it.
+
+const (
+	loginTTL          = 30 * 24 * time.Hour
+	minPasswordLength = 8
+)
+
+var (
+	errRegistered     = errors.New("this username is registered; log in to use it")
+	errNoRegistration = errors.New("registration is not enabled on this server")
+)
+
+// Registration is a registered username.
+type Registration struct {
+	Hash    []byte    `json:"hash"`    // bcrypt hash of the password
+	Changed time.Time `json:"changed"` // when the password was last set; older tokens are void
+}
+
+// registrations maps tenant and username to registrations.
+var registrations = struct {
+	mu    sync.RWMutex
+	table map[string]map[string]Registration
+}{table: map[string]map[string]Registration{}}
+
+func setupRegistrations() error {
+	if cfg.UsersFile == "" {
+		return nil
+	}
+	data, err := os.ReadFile(cfg.UsersFile)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	registrations.mu.Lock()
+	defer registrations.mu.Unlock()
+	return json.Unmarshal(data, &registrations.table)
+}
+
+// registration returns username's registration, if it is registered.
+func registration(tenant, username string) (Registration, bool) {
+	if !cfg.Registration {
+		return Registration{}, false
+	}
+	registrations.mu.RLock()
+	defer registrations.mu.RUnlock()
+	r, ok := registrations.table[tenant][username]
+	return r, ok
+}
+
+// setPassword registers username with password, or changes its password.
+// It fails if username is already registered and replace is false.
+func setPassword(tenant, username, password string, replace bool, now time.Time) error {
+	if len(password) < minPasswordLength {
+		return errors.New("passwords must be at least " + strconv.Itoa(minPasswordLength) + " characters")
+	}
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return err
+	}
+	registrations.mu.Lock()
+	defer registrations.mu.Unlock()
+	if _, ok := registrations.table[tenant][username]; ok && !replace {
+		return errors.New("username is already registered")
+	}
+	if registrations.table[tenant] == nil {
+		registrations.table[tenant] = map[string]Registration{}
+	}
+	// Tokens carry whole seconds; anything issued before now is void.
+	registrations.table[tenant][username] = Registration{Hash: hash, Changed: now.Truncate(time.Second)}
+	saveRegistrations()
+	return nil
+}
+
+// unregister releases username. It reports whether it was registered.
+func unregister(tenant, username string) bool {
+	registrations.mu.Lock()
+	defer registrations.mu.Unlock()
+	if _, ok := registrations.table[tenant][username]; !ok {
+		return false
+	}
+	delete(registrations.table[tenant], username)
+	saveRegistrations()
+	return true
+}
+
+// saveRegistrations writes -users-file. Callers hold registrations.mu.
+func saveRegistrations() {
+	if cfg.UsersFile == "" {
+		return
+	}
+	data, _ := json.MarshalIndent(registrations.table, "", "  ")
+	if err := writeFileAtomic(filepath.Dir(cfg.UsersFile), cfg.UsersFile, data); err != nil {
+		log.Printf("Saving %s: %v", cfg.UsersFile, err)
+	}
+}
+
+// checkPassword reports whether password is username's.
+func checkPassword(tenant, username, password string) bool {
+	r, ok := registration(tenant, username)
+	return ok && bcrypt.CompareHashAndPassword(r.Hash, []byte(password)) == nil
+}
+
+// Login tokens are "login\x00tenant\x00username\x00issued-unix" signed like
+// resume tokens.
+
+func issueLoginToken(tenant, username string, now time.Time) string {
+	payload := "login\x00" + tenant + "\x00" + username + "\x00" + strconv.FormatInt(now.Unix(), 10)
+	return base64.RawURLEncoding.EncodeToString([]byte(payload)) + "." + signResume(payload)
+}
+
+// verifyLoginToken checks that token logs username in.
+func verifyLoginToken(token, tenant, username string, now time.Time) error {
+	bad := errors.New("invalid login token")
+	enc, sig, ok := strings.Cut(token, ".")
+	if !ok {
+		return bad
+	}
+	raw, err := base64.RawURLEncoding.DecodeString(enc)
+	if err != nil || !hmac.Equal([]byte(sig), []byte(signResume(string(raw)))) {
+		return bad
+	}
+	parts := strings.Split(string(raw), "\x00")
+	if len(parts) != 4 || parts[0] != "login" || parts[1] != tenant || parts[2] != username {
+		return bad
+	}
+	issued, err := strconv.ParseInt(parts[3], 10, 64)
+	if err != nil || now.Sub(time.Unix(issued, 0)) > loginTTL {
+		return errors.New("login token expired")
+	}
+	return checkIssued(tenant, username, issued)
+}
+
+// checkIssued fails if username is registered and its password was set
+// after a token was issued at issued.
+func checkIssued(tenant, username string, issued int64) error {
+	if r, ok := registration(tenant, username); ok && issued < r.Changed.Unix() {
+		return errors.New("token predates the username's registration or password change")
+	}
+	return nil
+}
+
+// identify checks a connection's claim to username. It returns whether the
+// name is verified, or an error if the name is registered and the
+// connection did not log in, with auth or a resume token.
+func identify(tenant, username, auth string, resumed bool, now time.Time) (bool, error) {
+	if !cfg.Registration {
+		return false, nil
+	}
+	if _, ok := registration(tenant, username); !ok {
+		return false, nil
+	}
+	if resumed {
+		return true, nil // verifyResumeToken checked it against the registration
+	}
+	if auth == "" {
+		return false, errRegistered
+	}
+	if err := verifyLoginToken(auth, tenant, username, now); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// unverified reports whether chat from username is marked unverified.
+func unverified(tenant, username string) bool {
+	_, ok := registration(tenant, username)
+	return cfg.Registration && !ok
+}
+
+// credentials is the JSON body of the register, login and password
+// endpoints.
+type credentials struct {
+	Password    string `json:"password"`
+	NewPassword string `json:"new_password"` // for a password change
+}
+
+// readCredentials reads the request's tenant and credentials.
+func readCredentials(c *gin.Context) (string, credentials, bool) {
+	var body credentials
+	if !cfg.Registration {
+		c.JSON(404, gin.H{"error": errNoRegistration.Error()})
+		return "", body, false
+	}
+	tenant := c.Query("tenant")
+	if _, ok := lookupTenant(tenant); !ok {
+		c.JSON(404, gin.H{"error": "unknown tenant"})
+		return "", body, false
+	}
+	if err := c.ShouldBindJSON(&body); err != nil || body.Password == "" {
+		c.JSON(400, gin.H{"error": `body must be {"password": ...}`})
+		return "", body, false
+	}
+	return tenant, body, true
+}
+
+func handleRegister(c *gin.Context) {
+	tenant, body, ok := readCredentials(c)
+	if !ok {
+		return
+	}
+	username, now := c.Param("username"), time.Now()
+	if username != strings.TrimSpace(username) {
+		c.JSON(400, gin.H{"error": "invalid username"})
+		return
+	}
+	if err := setPassword(tenant, username, body.Password, false, now); err != nil {
+		c.JSON(409, gin.H{"error": err.Error()})
+		return
+	}
+	log.Printf("Registered %s", tenantQualified(tenant, username))
+	// Whoever was using the name so far has to log in now.
+	t, _ := lookupTenant(tenant)
+	t.hub.kick(username, "", "This username was just registered; log in to use it.")
+	c.JSON(201, gin.H{"token": issueLoginToken(tenant, username, now)})
+}
+
+func handleLogin(c *gin.Context) {
+	tenant, body, ok := readCredentials(c)
+	if !ok {
+		return
+	}
+	username := c.Param("username")
+	if !checkPassword(tenant, username, body.Password) {
+		c.JSON(401, gin.H{"error": "wrong username or password"})
+		return
+	}
+	c.JSON(200, gin.H{"token": issueLoginToken(tenant, username, time.Now())})
+}
+
+func handleChangePassword(c *gin.Context) {
+	tenant, body, ok := readCredentials(c)
+	if !ok {
+		return
+	}
+	username, now := c.Param("username"), time.Now()
+	if !checkPassword(tenant, username, body.Password) {
+		c.JSON(401, gin.H{"error": "wrong username or password"})
+		return
+	}
+	if err := setPassword(tenant, username, body.NewPassword, true, now); err != nil {
+		c.JSON(400, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(200, gin.H{"token": issueLoginToken(tenant, username, now)})
+}
+
+// handleReserveUser registers a name with a generated password, for bots
+// and names the operator wants kept.
+func handleReserveUser(c *gin.Context) {
+	if !cfg.Registration {
+		c.JSON(404, gin.H{"error": errNoRegistration.Error()})
+		return
+	}
+	t := adminTenant(c)
+	username := c.Param("username")
+	b := make([]byte, 16)
+	rand.Read(b)
+	password := hex.EncodeToString(b)
+	if err := setPassword(t.Name, username, password, false, time.Now()); err != nil {
+		c.JSON(409, gin.H{"error": err.Error()})
+		return
+	}
+	recordAudit(AuditEntry{Actor: c.ClientIP(), Tenant: t.Name, Action: "user.reserve", Subject: username})
+	c.JSON(201, gin.H{"username": username, "password": password})
+}
+
+func handleReleaseUser(c *gin.Context) {
+	t := adminTenant(c)
+	username := c.Param("username")
+	if !unregister(t.Name, username) {
+		c.JSON(404, gin.H{"error": "username is not registered"})
+		return
+	}
+	recordAudit(AuditEntry{Actor: c.ClientIP(), Tenant: t.Name, Action: "user.release", Subject: username})
+	c.JSON(200, gin.H{"username": username})
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Room webhooks let external systems, such as CI or monitoring, post into a
+// room without keeping a WebSocket open:
+//
+//	POST /api/rooms/:room/messages?tenant=
+//	Authorization: Bearer <webhook key>
+//	{"text": "Build 512 passed"}
+//
+// Each webhook belongs to one room and has a name, which its messages are
+// posted under with the integration flag set, so clients can tell them from
+// users' messages. Moderators create webhooks, which returns their key, and
+// delete them through /api/admin/rooms/:room/webhooks; webhooks can also be
+// declared in the -rooms file. Like groups, webhooks made through the admin
+// API are kept in memory. A webhook's key also lets it annotate the room's
+// messages; see annotations.go.
+
+// Webhook is a named key that posts into a room.
+type Webhook struct {
+	Name string `json:"name"`
+	Room string `json:"room"`
+	Key  string `json:"key,omitempty"` // only shown when the webhook is created
+}
+
+type webhookList struct {
+	mu    sync.Mutex
+	rooms map[string]map[string]string // room -> name -> key
+}
+
+// set gives room a webhook called name with key, replacing any old key.
+func (l *webhookList) set(room, name, key string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.rooms == nil {
+		l.rooms = make(map[string]map[string]string)
+	}
+	if l.rooms[room] == nil {
+		l.rooms[room] = make(map[string]string)
+	}
+	l.rooms[room][name] = key
+}
+
+// remove deletes room's webhook called name and reports whether it existed.
+func (l *webhookList) remove(room, name string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	_, ok := l.rooms[room][name]
+	delete(l.rooms[room], name)
+	return ok
+}
+
+// list returns the names of room's webhooks, sorted.
+func (l *webhookList) list(room string) []string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	names := []string{}
+	for name := range l.rooms[room] {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// lookup returns the name of room's webhook with key.
+func (l *webhookList) lookup(room, key string) (string, bool) {
+	return l.match(room, func(k string) bool { return key != "" && constantTimeEqual(k, key) })
+}
+
+// match returns the name of room's webhook whose key satisfies ok, for
+// senders that prove they know the key rather than sending it.
+func (l *webhookList) match(room string, ok func(key string) bool) (string, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for name, k := range l.rooms[room] {
+		if ok(k) {
+			return name, true
+		}
+	}
+	return "", false
+}
+
+func newWebhookKey() string {
+	b := make([]byte, 24)
+	rand.Read(b)
+	return "whk_" + hex.EncodeToString(b)
+}
+
+// handlePostMessage posts the chat message in the request body to the room
+// of the webhook whose key authorizes it.
+func handlePostMessage(c *gin.Context) {
+	tenant, roomName := c.Query("tenant"), c.Param("room")
+	t, ok := lookupTenant(tenant)
+	if !ok {
+		c.JSON(404, gin.H{"error": "unknown tenant"})
+		return
+	}
+	key, _ := strings.CutPrefix(c.GetHeader("Authorization"), "Bearer ")
+	name, ok := t.hub.webhooks.lookup(roomName, key)
+	if !ok {
+		c.JSON(401, gin.H{"error": "invalid webhook key for this room"})
+		return
+	}
+	var body struct {
+		Text string `json:"text"`
+	}
+	if err := c.ShouldBindJSON(&body); err != nil || strings.TrimSpace(body.Text) == "" {
+		c.JSON(400, gin.H{"error": "body must be {\"text\": message}"})
+		return
+	}
+	now := time.Now()
+	if t.hub.rateLimited("#"+roomName+"/"+name, now) {
+		c.JSON(429, gin.H{"error": "You are sending messages too fast; slow down."})
+		return
+	}
+
+	c.JSON(201, t.hub.postIntegration(roomName, name, body.Text, requestTrace(c)))
+}
+
+// postIntegration posts text to room as a chat message from the webhook
+// called name and returns it.
+func (h *Hub) postIntegration(room, name, text, trace string) Message {
+	msg := Message{
+		Trace:       traceID(trace),
+		Type:        MsgChat,
+		Room:        room,
+		Username:    name,
+		Text:        censor(text, h.filterLevel(room)),
+		Time:        h.clockTime(),
+		ID:          h.newMessageID(),
+		Integration: true,
+	}
+	traceLog(msg, "posted by integration %s", name)
+	msg = h.publish(room, msg)
+	h.notifyMentions(msg)
+	return msg
+}
+
+func handleListWebhooks(c *gin.Context) {
+	room := c.Param("room")
+	hooks := []Webhook{}
+	for _, name := range adminTenant(c).hub.webhooks.list(room) {
+		hooks = append(hooks, Webhook{Name: name, Room: room})
+	}
+	c.JSON(200, hooks)
+}
+
+// handleCreateWebhook creates a webhook with a new key, or gives an existing
+// one a new key, and returns it.
+func handleCreateWebhook(c *gin.Context) {
+	room, name := c.Param("room"), c.Param("name")
+	if !groupName.MatchString(name) {
+		c.JSON(400, gin.H{"error": "webhook names are 1 to 32 of a-z, 0-9, _ and -"})
+		return
+	}
+	t := adminTenant(c)
+	key := newWebhookKey()
+	t.hub.webhooks.set(room, name, key)
+	recordAudit(AuditEntry{Actor: c.ClientIP(), Tenant: t.Name, Action: "room.webhook.create", Subject: room, Detail: name})
+	c.JSON(201, Webhook{Name: name, Room: room, Key: key})
+}
+
+func handleDeleteWebhook(c *gin.Context) {
+	room, name := c.Param("room"), c.Param("name")
+	t := adminTenant(c)
+	if !t.hub.webhooks.remove(room, name) {
+		c.JSON(404, gin.H{"error": "no such webhook"})
+		return
+	}
+	recordAudit(AuditEntry{Actor: c.ClientIP(), Tenant: t.Name, Action: "room.webhook.delete", Subject: room, Detail: name})
+	c.JSON(200, Webhook{Name: name, Room: room})
+}
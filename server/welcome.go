@@ -0,0 +1,110 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"text/template"
+)
+
+// The welcome bot (-welcome-bot) greets each user the first time they ever
+// connect with a direct message explaining how to chat and listing the
+// commands. The message comes from a text/template, -welcome-template or
+// the built-in one, executed with welcomeData. Users who have been greeted
+// are remembered in -welcome-seen, or in memory without it, in which case a
+// restart greets everyone once more.
+
+const welcomeBotName = "welcomebot"
+
+const defaultWelcome = `Welcome, {{.Username}}! You are in #{{.Room}}. Type a message and press Enter to chat with everyone here.
+Commands:
+{{range .Commands}}  {{.Usage}}: {{.Description}}
+{{end}}`
+
+// welcomeData is what the welcome template is executed with.
+type welcomeData struct {
+	Username string
+	Room     string
+	Tenant   string
+	Commands []commandInfo
+}
+
+type welcomeBot struct {
+	tmpl *template.Template
+
+	mu   sync.Mutex
+	seen map[string]bool // tenant-qualified usernames already greeted
+}
+
+func newWelcomeBot() (*welcomeBot, error) {
+	text := defaultWelcome
+	if cfg.WelcomeTemplate != "" {
+		data, err := os.ReadFile(cfg.WelcomeTemplate)
+		if err != nil {
+			return nil, err
+		}
+		text = string(data)
+	}
+	tmpl, err := template.New("welcome").Parse(text)
+	if err != nil {
+		return nil, err
+	}
+	b := &welcomeBot{tmpl: tmpl, seen: map[string]bool{}}
+	if cfg.WelcomeSeen != "" {
+		data, err := os.ReadFile(cfg.WelcomeSeen)
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return nil, err
+		}
+		var names []string
+		if len(data) > 0 {
+			if err := json.Unmarshal(data, &names); err != nil {
+				return nil, err
+			}
+		}
+		for _, name := range names {
+			b.seen[name] = true
+		}
+	}
+	return b, nil
+}
+
+func (b *welcomeBot) Name() string { return welcomeBotName }
+
+func (b *welcomeBot) Connected(h *Hub, client *Client) {
+	if client.Resumed || !b.firstTime(tenantQualified(h.tenant, client.Username)) {
+		return
+	}
+	var text strings.Builder
+	err := b.tmpl.Execute(&text, welcomeData{
+		Username: client.Username,
+		Room:     client.Room,
+		Tenant:   h.tenant,
+		Commands: commands,
+	})
+	if err != nil {
+		log.Printf("Welcome template: %v", err)
+		return
+	}
+	h.direct(b, client, strings.TrimSpace(text.String()))
+}
+
+// firstTime records name as greeted and reports whether it was new.
+func (b *welcomeBot) firstTime(name string) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.seen[name] {
+		return false
+	}
+	b.seen[name] = true
+	if cfg.WelcomeSeen != "" {
+		data, _ := json.Marshal(sortedKeys(b.seen))
+		if err := writeFileAtomic(filepath.Dir(cfg.WelcomeSeen), cfg.WelcomeSeen, data); err != nil {
+			log.Printf("Saving %s: %v", cfg.WelcomeSeen, err)
+		}
+	}
+	return true
+}
@@ -0,0 +1,462 @@
+// Command soak runs a chaos test against a chat server: hundreds of clients
+// join, chat, read slowly or not at all, drop and reconnect at random for as
+// long as it is left running, while the server's goroutines and heap are
+// watched through /api/admin/runtime.
+//
+//	soak [-server URL] [-token TOKEN] [-clients 200] [-duration 1h] [-seed N]
+//
+// The run fails (exit 1) if the server stops answering /healthz, which is
+// what a panic looks like from outside, if its heap grows past -max-heap,
+// or if its goroutines have not come back to within -leak-slack of where
+// they started once every client has gone. The token is the server's
+// -admin-token; without it only liveness is checked. Run the server with
+// proof of work and -rate-limit off, as they are by default, or a generous
+// -rate-limit, or most traffic is refused.
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+type config struct {
+	server      string
+	token       string
+	clients     int
+	rooms       int
+	duration    time.Duration
+	maxSession  time.Duration
+	msgInterval time.Duration
+	slowFrac    float64
+	stallFrac   float64
+	maxHeap     uint64
+	leakSlack   int
+	report      time.Duration
+	seed        int64
+}
+
+// runtimeStats mirrors the server's /api/admin/runtime.
+type runtimeStats struct {
+	Goroutines  int    `json:"goroutines"`
+	HeapAlloc   uint64 `json:"heap_alloc"`
+	Connections int64  `json:"connections"`
+	Rooms       int    `json:"rooms"`
+	Hub         struct {
+		RegisterWait struct {
+			P99Millis float64 `json:"p99_ms"`
+		} `json:"register_wait"`
+		Run struct {
+			P99Millis float64 `json:"p99_ms"`
+		} `json:"run"`
+	} `json:"hub"`
+}
+
+// message is the part of the protocol the clients look at.
+type message struct {
+	Type        string `json:"type"`
+	Seq         int64  `json:"seq"`
+	ResumeToken string `json:"resume_token"`
+}
+
+// counters are totals over the run, reported as it goes.
+var counters struct {
+	sessions, resumes, sent, received, drops, dialErrors atomic.Int64
+}
+
+func main() {
+	var c config
+	var maxHeapMB int
+	flag.StringVar(&c.server, "server", "http://localhost:8080", "server base URL")
+	flag.StringVar(&c.token, "token", os.Getenv("CHAT_ADMIN_TOKEN"), "server admin token for /api/admin/runtime (env CHAT_ADMIN_TOKEN)")
+	flag.IntVar(&c.clients, "clients", 200, "concurrent simulated clients")
+	flag.IntVar(&c.rooms, "rooms", 20, "rooms in the steady pool; clients also churn through short-lived ones")
+	flag.DurationVar(&c.duration, "duration", time.Hour, "how long to run")
+	flag.DurationVar(&c.maxSession, "max-session", 30*time.Second, "longest a client stays connected before leaving or dropping")
+	flag.DurationVar(&c.msgInterval, "msg-interval", 2*time.Second, "average time between a client's messages")
+	flag.Float64Var(&c.slowFrac, "slow", 0.1, "fraction of sessions that read slowly")
+	flag.Float64Var(&c.stallFrac, "stall", 0.02, "fraction of sessions that stop reading, to be dropped by the server")
+	flag.IntVar(&maxHeapMB, "max-heap", 512, "fail if the server's heap exceeds this many MiB")
+	flag.IntVar(&c.leakSlack, "leak-slack", 20, "goroutines above the starting count tolerated after the run")
+	flag.DurationVar(&c.report, "report", 10*time.Second, "time between progress lines")
+	flag.Int64Var(&c.seed, "seed", time.Now().UnixNano(), "random seed, to repeat a run's choices")
+	flag.Parse()
+	c.server = strings.TrimSuffix(c.server, "/")
+	c.maxHeap = uint64(maxHeapMB) << 20
+
+	log.SetFlags(log.Ltime)
+	log.Printf("soak: %d clients for %s against %s (seed %d)", c.clients, c.duration, c.server, c.seed)
+	if err := run(c); err != nil {
+		log.Printf("FAIL: %v", err)
+		os.Exit(1)
+	}
+	log.Printf("PASS")
+}
+
+func run(c config) error {
+	mon := &monitor{cfg: c, client: &http.Client{Timeout: 10 * time.Second}}
+	if err := mon.healthy(); err != nil {
+		return err
+	}
+	base, err := mon.settle()
+	if err != nil {
+		return err
+	}
+	if base != nil {
+		log.Printf("baseline: %d goroutines, heap %s", base.Goroutines, mib(base.HeapAlloc))
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), c.duration)
+	defer cancel()
+	interrupt := make(chan os.Signal, 1)
+	signal.Notify(interrupt, os.Interrupt)
+	go func() {
+		<-interrupt
+		log.Printf("interrupted, winding down")
+		cancel()
+	}()
+
+	var wg sync.WaitGroup
+	for i := 0; i < c.clients; i++ {
+		wg.Add(1)
+		sim := &simClient{cfg: c, id: i, rng: rand.New(rand.NewSource(c.seed + int64(i)))}
+		go func() {
+			defer wg.Done()
+			sim.run(ctx)
+		}()
+	}
+
+	failed := make(chan error, 1)
+	go func() {
+		if err := mon.watch(ctx); err != nil {
+			failed <- err
+			cancel()
+		}
+	}()
+	wg.Wait()
+	cancel()
+	select {
+	case err := <-failed:
+		return err
+	default:
+	}
+	mon.progress()
+
+	// Every client is gone; the server should be back where it started.
+	if err := mon.healthy(); err != nil {
+		return err
+	}
+	if base == nil {
+		return nil
+	}
+	end, err := mon.settle()
+	if err != nil {
+		return err
+	}
+	log.Printf("after run: %d goroutines, heap %s, %d connections", end.Goroutines, mib(end.HeapAlloc), end.Connections)
+	if end.Connections != 0 {
+		return fmt.Errorf("server still counts %d connections after every client left", end.Connections)
+	}
+	if end.Goroutines > base.Goroutines+c.leakSlack {
+		return fmt.Errorf("goroutine leak: %d after the run, %d before", end.Goroutines, base.Goroutines)
+	}
+	return nil
+}
+
+// monitor watches the server while the clients run.
+type monitor struct {
+	cfg    config
+	client *http.Client
+}
+
+func (m *monitor) healthy() error {
+	resp, err := m.client.Get(m.cfg.server + "/healthz")
+	if err != nil {
+		return fmt.Errorf("server is down (crashed?): %w", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != 200 {
+		return fmt.Errorf("server unhealthy: %s", resp.Status)
+	}
+	return nil
+}
+
+// stats returns the server's runtime stats, or nil without a token.
+func (m *monitor) stats() (*runtimeStats, error) {
+	if m.cfg.token == "" {
+		return nil, nil
+	}
+	req, _ := http.NewRequest("GET", m.cfg.server+"/api/admin/runtime", nil)
+	req.Header.Set("Authorization", "Bearer "+m.cfg.token)
+	resp, err := m.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		return nil, fmt.Errorf("/api/admin/runtime: %s", resp.Status)
+	}
+	var s runtimeStats
+	return &s, json.NewDecoder(resp.Body).Decode(&s)
+}
+
+// settle waits for the server's connections to drain and its goroutine
+// count to stop falling, and returns the stats it settled at.
+func (m *monitor) settle() (*runtimeStats, error) {
+	s, err := m.stats()
+	if s == nil || err != nil {
+		return s, err
+	}
+	deadline := time.Now().Add(30 * time.Second)
+	for time.Now().Before(deadline) {
+		time.Sleep(time.Second)
+		next, err := m.stats()
+		if err != nil {
+			return nil, err
+		}
+		if next.Connections == 0 && next.Goroutines >= s.Goroutines {
+			return next, nil
+		}
+		s = next
+	}
+	return s, nil
+}
+
+func (m *monitor) watch(ctx context.Context) error {
+	ticker := time.NewTicker(m.cfg.report)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+		if err := m.healthy(); err != nil {
+			return err
+		}
+		s, err := m.progress()
+		if err != nil {
+			return err
+		}
+		if s != nil && s.HeapAlloc > m.cfg.maxHeap {
+			return fmt.Errorf("server heap %s exceeds -max-heap %s", mib(s.HeapAlloc), mib(m.cfg.maxHeap))
+		}
+	}
+}
+
+// progress logs the counters and the server's stats.
+func (m *monitor) progress() (*runtimeStats, error) {
+	line := fmt.Sprintf("sessions %d (resumed %d) sent %d received %d drops %d dial errors %d",
+		counters.sessions.Load(), counters.resumes.Load(), counters.sent.Load(),
+		counters.received.Load(), counters.drops.Load(), counters.dialErrors.Load())
+	s, err := m.stats()
+	if err != nil {
+		return nil, err
+	}
+	if s != nil {
+		line += fmt.Sprintf(" | server: %d conns, %d rooms, %d goroutines, heap %s, hub p99 wait %gms run %gms",
+			s.Connections, s.Rooms, s.Goroutines, mib(s.HeapAlloc), s.Hub.RegisterWait.P99Millis, s.Hub.Run.P99Millis)
+	}
+	log.Print(line)
+	return s, nil
+}
+
+func mib(n uint64) string {
+	return fmt.Sprintf("%.1f MiB", float64(n)/(1<<20))
+}
+
+// reading is how a session reads its messages.
+type reading int
+
+const (
+	readNormal reading = iota
+	readSlow           // pauses after every message
+	readStalled        // never reads, so its server send queue fills up
+)
+
+// ending is how a session ends.
+type ending int
+
+const (
+	endClose  ending = iota // a clean close handshake
+	endAbrupt               // the TCP connection just goes away
+	endResume               // goes away, then reconnects with its resume token
+)
+
+// simClient is one simulated user, joining session after session until the
+// run ends.
+type simClient struct {
+	cfg config
+	id  int
+	rng *rand.Rand
+}
+
+// session is one connection's worth of state carried over a resume.
+type session struct {
+	room    string
+	token   string
+	lastSeq int64
+}
+
+func (sc *simClient) run(ctx context.Context) {
+	// Stagger the start so the server sees a ramp, not a wall.
+	if !sleep(ctx, time.Duration(sc.rng.Int63n(int64(5*time.Second)))) {
+		return
+	}
+	var resume *session
+	for ctx.Err() == nil {
+		s := resume
+		if s == nil {
+			s = &session{room: sc.pickRoom()}
+		}
+		resume = nil
+		end, err := sc.session(ctx, s, s.token != "")
+		if err != nil {
+			counters.dialErrors.Add(1)
+			sleep(ctx, time.Second)
+			continue
+		}
+		if end == endResume {
+			resume = s
+		}
+	}
+}
+
+// pickRoom mostly picks from the steady pool, sometimes a fresh room so
+// rooms are created and deleted all the time.
+func (sc *simClient) pickRoom() string {
+	if sc.rng.Intn(10) == 0 {
+		return fmt.Sprintf("churn-%d-%d", sc.id, sc.rng.Intn(1000))
+	}
+	return fmt.Sprintf("soak-%d", sc.rng.Intn(sc.cfg.rooms))
+}
+
+// session connects once and runs until its random lifetime is up, the
+// server drops it, or ctx ends. It returns how it ended.
+func (sc *simClient) session(ctx context.Context, s *session, resuming bool) (ending, error) {
+	q := url.Values{"username": {fmt.Sprintf("soak%d", sc.id)}, "room": {s.room}}
+	if resuming {
+		q.Set("resume", s.token)
+		q.Set("since_seq", fmt.Sprint(s.lastSeq))
+	}
+	u := strings.Replace(sc.cfg.server, "http", "ws", 1) + "/ws?" + q.Encode()
+	dialCtx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	conn, _, err := websocket.DefaultDialer.DialContext(dialCtx, u, nil)
+	cancel()
+	if err != nil {
+		return endClose, err
+	}
+	counters.sessions.Add(1)
+	if resuming {
+		counters.resumes.Add(1)
+	}
+
+	mode := readNormal
+	switch r := sc.rng.Float64(); {
+	case r < sc.cfg.stallFrac:
+		mode = readStalled
+	case r < sc.cfg.stallFrac+sc.cfg.slowFrac:
+		mode = readSlow
+	}
+	end := ending(sc.rng.Intn(3))
+	lifetime := time.Duration(sc.rng.Int63n(int64(sc.cfg.maxSession))) + time.Second
+
+	// dropped closes when the reader stops: the connection failed, or quit
+	// closed for a stalled reader.
+	dropped := make(chan struct{})
+	quit := make(chan struct{})
+	go func() {
+		defer close(dropped)
+		if mode == readStalled {
+			<-quit
+			return
+		}
+		for {
+			_, data, err := conn.ReadMessage()
+			if err != nil {
+				return
+			}
+			counters.received.Add(1)
+			var msg message
+			if json.Unmarshal(data, &msg) == nil {
+				switch msg.Type {
+				case "welcome":
+					s.token = msg.ResumeToken
+				case "chat":
+					s.lastSeq = max(s.lastSeq, msg.Seq)
+				}
+			}
+			if mode == readSlow {
+				time.Sleep(time.Duration(sc.rng.Intn(500)) * time.Millisecond)
+			}
+		}
+	}()
+
+	timeout := time.After(lifetime)
+	for {
+		wait := time.Duration(sc.rng.ExpFloat64() * float64(sc.cfg.msgInterval))
+		select {
+		case <-ctx.Done():
+			end = endClose
+		case <-timeout:
+		case <-dropped:
+			counters.drops.Add(1)
+			conn.Close()
+			return endClose, nil
+		case <-time.After(wait):
+			text := fmt.Sprintf("message %d from soak%d", sc.rng.Int(), sc.id)
+			if sc.rng.Intn(20) == 0 {
+				text = "/users"
+			}
+			conn.SetWriteDeadline(time.Now().Add(5 * time.Second))
+			if err := conn.WriteJSON(map[string]string{"text": text}); err != nil {
+				counters.drops.Add(1)
+				conn.Close()
+				return endClose, nil
+			}
+			counters.sent.Add(1)
+			continue
+		}
+		break
+	}
+
+	if end == endClose {
+		conn.WriteControl(websocket.CloseMessage,
+			websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""),
+			time.Now().Add(time.Second))
+		select {
+		case <-dropped:
+		case <-time.After(2 * time.Second):
+		}
+	}
+	close(quit)
+	conn.Close()
+	<-dropped
+	if end == endResume && s.token == "" {
+		end = endAbrupt
+	}
+	return end, nil
+}
+
+// sleep waits for d or ctx, reporting whether d elapsed.
+func sleep(ctx context.Context, d time.Duration) bool {
+	select {
+	case <-time.After(d):
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}